@@ -0,0 +1,354 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/pivotal-golang/lager"
+)
+
+// Implemented by service brokers that let operators inspect and repair the instances they manage
+type InstanceAdministrator interface {
+	// Lists the instances matching the filter, without their bindings
+	ListInstances(filter InstanceFilter) ([]InstanceDetails, error)
+
+	// Fetches an instance with its bindings and process state
+	GetInstance(instanceId string) (InstanceDetails, error)
+
+	// Stops and starts the process serving an instance
+	RestartInstance(ctx context.Context, instanceId string) error
+
+	// Removes everything the broker holds for an instance, whether or not the platform still knows about it
+	ForceDeleteInstance(ctx context.Context, instanceId string) error
+}
+
+// Process states
+const (
+	ProcessRunning = "running"
+	ProcessStopped = "stopped"
+)
+
+type (
+	// Zero values match everything
+	InstanceFilter struct {
+		OrganizationGuid string
+		SpaceGuid        string
+		PlanId           string
+		Status           string
+	}
+
+	ProcessDetails struct {
+		State string `json:"state"`
+		Pid   int    `json:"pid,omitempty"`
+	}
+
+	BindingDetails struct {
+		Id        string               `json:"id"`
+		CreatedBy *OriginatingIdentity `json:"created_by,omitempty"`
+		CreatedAt time.Time            `json:"created_at"`
+	}
+
+	InstanceDetails struct {
+		Id               string               `json:"id"`
+		ServiceId        string               `json:"service_id"`
+		PlanId           string               `json:"plan_id"`
+		OrganizationGuid string               `json:"organization_guid"`
+		SpaceGuid        string               `json:"space_guid"`
+		Address          string               `json:"address"`
+		CreatedBy        *OriginatingIdentity `json:"created_by,omitempty"`
+		CreatedAt        time.Time            `json:"created_at"`
+		Pipeline         string               `json:"pipeline,omitempty"`
+		Filters          string               `json:"filters,omitempty"`
+		Process          ProcessDetails       `json:"process"`
+		Bindings         []BindingDetails     `json:"bindings,omitempty"`
+	}
+
+	InstancesResponse struct {
+		Instances []InstanceDetails `json:"instances"`
+	}
+)
+
+func (filter InstanceFilter) Matches(instance InstanceDetails) bool {
+	if filter.OrganizationGuid != "" && instance.OrganizationGuid != filter.OrganizationGuid {
+		return false
+	}
+	if filter.SpaceGuid != "" && instance.SpaceGuid != filter.SpaceGuid {
+		return false
+	}
+	if filter.PlanId != "" && instance.PlanId != filter.PlanId {
+		return false
+	}
+	if filter.Status != "" && instance.Process.State != filter.Status {
+		return false
+	}
+	return true
+}
+
+func adminRoutes(serviceBroker ServiceBroker) func(martini.Router) {
+	// Responds with 404 and returns nil when the broker does not support instance administration
+	administrator := func(r render.Render) InstanceAdministrator {
+		administrator, ok := serviceBroker.(InstanceAdministrator)
+		if !ok {
+			r.JSON(404, ErrorResponse{
+				Description: "instance administration is not supported by this broker",
+			})
+			return nil
+		}
+		return administrator
+	}
+
+	return func(router martini.Router) {
+		// Probe every service instance
+		router.Get("/instances/health", func(r render.Render, logger lager.Logger) {
+			checker, ok := serviceBroker.(HealthChecker)
+			if !ok {
+				r.JSON(404, ErrorResponse{
+					Description: "instance health is not supported by this broker",
+				})
+				return
+			}
+
+			instances, err := checker.CheckInstancesHealth()
+			if err != nil {
+				status, response := handleServiceError(err, logger.Session("instances-health"))
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, InstancesHealthResponse{
+				Instances: instances,
+			})
+		})
+
+		// List instances, e.g. /admin/instances?org=...&space=...&plan=...&status=running
+		router.Get("/instances", func(r render.Render, req *http.Request, logger lager.Logger) {
+			administrator := administrator(r)
+			if administrator == nil {
+				return
+			}
+
+			values := req.URL.Query()
+			instances, err := administrator.ListInstances(InstanceFilter{
+				OrganizationGuid: values.Get("org"),
+				SpaceGuid:        values.Get("space"),
+				PlanId:           values.Get("plan"),
+				Status:           values.Get("status"),
+			})
+			if err != nil {
+				status, response := handleServiceError(err, logger.Session("list-instances"))
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, InstancesResponse{
+				Instances: instances,
+			})
+		})
+
+		// Show an instance with its bindings and process state
+		router.Get("/instances/:instance_id", func(params martini.Params, r render.Render, logger lager.Logger) {
+			administrator := administrator(r)
+			if administrator == nil {
+				return
+			}
+
+			instance, err := administrator.GetInstance(params["instance_id"])
+			if err != nil {
+				status, response := handleServiceError(err, logger.Session("get-instance"))
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, instance)
+		})
+
+		// Restart the process serving an instance
+		router.Post("/instances/:instance_id/restart", func(params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			administrator := administrator(r)
+			if administrator == nil {
+				return
+			}
+
+			ctxLogger := logger.Session("restart-instance", lager.Data{
+				"instance-id": params["instance_id"],
+			})
+			started := time.Now()
+			err := administrator.RestartInstance(WithLogger(ctx, ctxLogger), params["instance_id"])
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "admin-restart",
+				InstanceId: params["instance_id"],
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, EmptyResponse{})
+		})
+
+		// Remove an instance even if the Cloud Controller no longer knows about it
+		router.Delete("/instances/:instance_id", func(params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			administrator := administrator(r)
+			if administrator == nil {
+				return
+			}
+
+			ctxLogger := logger.Session("force-delete-instance", lager.Data{
+				"instance-id": params["instance_id"],
+			})
+			started := time.Now()
+			err := administrator.ForceDeleteInstance(WithLogger(ctx, ctxLogger), params["instance_id"])
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "admin-force-delete",
+				InstanceId: params["instance_id"],
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, EmptyResponse{})
+		})
+
+		// Download every instance as a tar.gz archive
+		router.Get("/backup", func(w http.ResponseWriter, r render.Render, ctx context.Context, logger lager.Logger) {
+			archiver, ok := serviceBroker.(StateArchiver)
+			if !ok {
+				r.JSON(404, ErrorResponse{
+					Description: "backups are not supported by this broker",
+				})
+				return
+			}
+
+			// buffered so that a failure can still be reported with a status code
+			ctxLogger := logger.Session("backup")
+			started := time.Now()
+			var archive bytes.Buffer
+			err := archiver.Backup(&archive)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation: "admin-backup",
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"logsearch-backup-%s.tar.gz\"", started.UTC().Format("20060102T150405Z")))
+			w.WriteHeader(200)
+			w.Write(archive.Bytes())
+		})
+
+		// Recreate the instances in an archive downloaded from /admin/backup and start their agents
+		router.Post("/restore", func(req *http.Request, r render.Render, ctx context.Context, logger lager.Logger) {
+			archiver, ok := serviceBroker.(StateArchiver)
+			if !ok {
+				r.JSON(404, ErrorResponse{
+					Description: "backups are not supported by this broker",
+				})
+				return
+			}
+
+			ctxLogger := logger.Session("restore")
+			started := time.Now()
+			report, err := archiver.Restore(WithLogger(ctx, ctxLogger), req.Body)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "admin-restore",
+				Parameters: map[string]interface{}{"instances": report.Instances},
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, report)
+		})
+
+		// Report how much of each quota is used
+		router.Get("/quotas", func(r render.Render, logger lager.Logger) {
+			reporter, ok := serviceBroker.(QuotaReporter)
+			if !ok {
+				r.JSON(404, ErrorResponse{
+					Description: "quotas are not supported by this broker",
+				})
+				return
+			}
+
+			usage, err := reporter.QuotaUsage()
+			if err != nil {
+				status, response := handleServiceError(err, logger.Session("quotas"))
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, QuotasResponse{
+				Quotas: usage,
+			})
+		})
+
+		// List the pipelines instances can be provisioned with
+		router.Get("/pipelines", func(r render.Render, logger lager.Logger) {
+			lister, ok := serviceBroker.(PipelineLister)
+			if !ok {
+				r.JSON(404, ErrorResponse{
+					Description: "pipelines are not supported by this broker",
+				})
+				return
+			}
+
+			pipelines, err := lister.ListPipelines()
+			if err != nil {
+				status, response := handleServiceError(err, logger.Session("pipelines"))
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, PipelinesResponse{
+				Pipelines: pipelines,
+			})
+		})
+
+		// Query the audit log, e.g. /admin/audit?instance_id=...&from=2014-09-01T00:00:00Z&to=2014-09-02T00:00:00Z
+		router.Get("/audit", func(r render.Render, req *http.Request, logger lager.Logger) {
+			auditor, ok := serviceBroker.(Auditor)
+			if !ok {
+				r.JSON(404, ErrorResponse{
+					Description: "auditing is not supported by this broker",
+				})
+				return
+			}
+
+			query, err := parseAuditQuery(req)
+			if err != nil {
+				r.JSON(400, ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			}
+
+			entries, err := auditor.AuditLog().Query(query)
+			if err != nil {
+				status, response := handleServiceError(err, logger.Session("audit"))
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, AuditResponse{
+				Entries: entries,
+			})
+		})
+	}
+}
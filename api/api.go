@@ -1,13 +1,16 @@
 package api
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/malston/cf-logsearch-service-broker/api/handlers"
+	"github.com/malston/cf-logsearch-service-broker/metrics"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
 	"github.com/pivotal-golang/lager"
@@ -15,6 +18,8 @@ import (
 
 // Implements the Cloud Foundry Service Broker API
 // http://docs.cloudfoundry.org/services/api.html#api-overview
+//
+// The context passed to each operation carries the request id and a logger session tagged with it.
 type ServiceBroker interface {
 	// Fetches the service catalog for the developer to select from the marketplace
 	// http://docs.cloudfoundry.org/services/api.html#catalog-mgmt
@@ -22,21 +27,49 @@ type ServiceBroker interface {
 
 	// Creates a new service resource for the developer
 	// http://docs.cloudfoundry.org/services/api.html#provisioning
-	Provision(instanceId string, params map[string]string) (string, error)
+	Provision(ctx context.Context, instanceId string, params map[string]string) (string, error)
 
 	// Creates a binding to a provisioned service instance for an application to use for connecting to the instance
 	// http://docs.cloudfoundry.org/services/api.html#binding
-	Bind(instanceId string, bindingId string) (interface{}, error)
+	Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error)
 
 	// Removes a service instance binding so applications can no longer bind to that instance
 	// http://docs.cloudfoundry.org/services/api.html#unbinding
-	Unbind(instanceId string, bindingId string) error
+	Unbind(ctx context.Context, instanceId string, bindingId string) error
 
 	// Deletes a provisioned service instance completely so users can no longer use it
 	// http://docs.cloudfoundry.org/services/api.html#deprovisioning
-	Deprovision(instanceId string) error
+	Deprovision(ctx context.Context, instanceId string) error
 }
 
+// Implemented by service brokers that can change the parameters of a provisioned instance
+type InstanceUpdater interface {
+	// Applies new provision parameters to an instance
+	// http://docs.cloudfoundry.org/services/api.html#updating_service_instance
+	Update(ctx context.Context, instanceId string, params map[string]string) error
+}
+
+// Implemented by service brokers whose bindings take parameters
+type ParameterizedBinder interface {
+	// Binds like Bind, given the service, plan and app of the binding along with its parameters
+	BindWithParameters(ctx context.Context, instanceId string, bindingId string, params map[string]string) (interface{}, error)
+}
+
+// Implemented by service brokers that can report on their own health and on the health of the instances they manage
+type HealthChecker interface {
+	// Checks the resources the broker depends on, such as its data directory and configuration
+	CheckHealth() []HealthCheck
+
+	// Probes every provisioned service instance to see if it is accepting connections
+	CheckInstancesHealth() ([]InstanceHealth, error)
+}
+
+// Health check statuses
+const (
+	HealthStatusOk     = "ok"
+	HealthStatusFailed = "failed"
+)
+
 // Broker API Errors
 var (
 	// 409 HTTP status code should be returned if the requested service instance already exists.
@@ -47,18 +80,20 @@ var (
 	ServiceInstanceDoesNotExistsError = errors.New("service instance does not exists")
 	// 409 HTTP status code should be returned if the requested binding already exists
 	ServiceInstanceBindingAlreadyExistsError = errors.New("binding already exists")
+	// 410 HTTP status code should be returned if the binding being removed does not exist
+	ServiceInstanceBindingDoesNotExistsError = errors.New("binding does not exist")
 )
 
 type (
 	Service struct {
-		Id              string          `json:"id"`
-		Name            string          `json:"name"`
-		Description     string          `json:"description"`
-		Bindable        bool            `json:"bindable"`
-		Plans           []Plan          `json:"plans"`
-		Metadata        ServiceMetadata `json:"metadata,omitempty"`
-		Tags            []string        `json:"tags,omitempty"`
-		DashboardClient DashboardClient `json:"dashboard_client"`
+		Id              string           `json:"id"`
+		Name            string           `json:"name"`
+		Description     string           `json:"description"`
+		Bindable        bool             `json:"bindable"`
+		Plans           []Plan           `json:"plans"`
+		Metadata        ServiceMetadata  `json:"metadata,omitempty"`
+		Tags            []string         `json:"tags,omitempty"`
+		DashboardClient *DashboardClient `json:"dashboard_client,omitempty"`
 	}
 	Plan struct {
 		Id          string       `json:"id"`
@@ -101,6 +136,24 @@ type (
 		PlanId           string `json:"plan_id"`
 		OrganizationGuid string `json:"organization_guid"`
 		SpaceGuid        string `json:"space_guid"`
+		// Service specific settings, e.g. {"pipeline": "json-lines"}
+		Parameters map[string]interface{} `json:"parameters,omitempty"`
+		// Sent by platforms that know more about where the instance is created, such as the names of its org and space
+		Context map[string]interface{} `json:"context,omitempty"`
+	}
+
+	UpdateRequest struct {
+		ServiceId  string                 `json:"service_id"`
+		PlanId     string                 `json:"plan_id,omitempty"`
+		Parameters map[string]interface{} `json:"parameters,omitempty"`
+	}
+
+	BindRequest struct {
+		ServiceId string `json:"service_id"`
+		PlanId    string `json:"plan_id"`
+		AppGuid   string `json:"app_guid,omitempty"`
+		// Service specific settings, e.g. {"access": "read-only"}
+		Parameters map[string]interface{} `json:"parameters,omitempty"`
 	}
 
 	EmptyResponse struct{}
@@ -120,6 +173,34 @@ type (
 	BindingResponse struct {
 		Credentials interface{} `json:"credentials"`
 	}
+
+	HealthCheck struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	HealthResponse struct {
+		Status string        `json:"status"`
+		Checks []HealthCheck `json:"checks"`
+	}
+
+	PortHealth struct {
+		Protocol      string  `json:"protocol"`
+		Status        string  `json:"status"`
+		LatencyMillis float64 `json:"latency_ms"`
+	}
+
+	InstanceHealth struct {
+		InstanceId string       `json:"instance_id"`
+		Address    string       `json:"address"`
+		Status     string       `json:"status"`
+		Ports      []PortHealth `json:"ports"`
+	}
+
+	InstancesHealthResponse struct {
+		Instances []InstanceHealth `json:"instances"`
+	}
 )
 
 // Creates v2 service broker api for a given broker
@@ -128,90 +209,324 @@ func New(serviceBroker ServiceBroker, logger lager.Logger) *martini.ClassicMarti
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
 	m.Map(logger)
 	m.Handlers(
-		handlers.HandleAuthCheck(),
+		handleRequestContext(logger),
+		handlers.HandleMetrics(),
 		render.Renderer(),
 	)
 
-	// Fetch catalog
-	m.Get("/v2/catalog", func(r render.Render) {
-		catalog := CatalogResponse{
-			Services: serviceBroker.GetCatalog(),
+	// Report broker health, unauthenticated so load balancers can use it
+	m.Get("/healthz", func(r render.Render) {
+		checks := []HealthCheck{
+			HealthCheck{Name: "process", Status: HealthStatusOk},
+		}
+		if checker, ok := serviceBroker.(HealthChecker); ok {
+			checks = append(checks, checker.CheckHealth()...)
 		}
-		r.JSON(200, catalog)
-	})
-
-	// Provision instance
-	m.Put("/v2/service_instances/:instance_id", binding.Json(ProvisionRequest{}), func(provisionRequest ProvisionRequest, params martini.Params, r render.Render, req *http.Request) {
-		logger.Debug("Entering service provisioning")
-
-		instanceId := params["instance_id"]
-
-		url, err := serviceBroker.Provision(instanceId, map[string]string{
-			"organization_guid": provisionRequest.OrganizationGuid,
-			"plan_id":           provisionRequest.PlanId,
-			"service_id":        provisionRequest.ServiceId,
-			"space_guid":        provisionRequest.SpaceGuid,
-		})
 
-		ctxLogger := logger.Session("provision", lager.Data{
-			"instance-id":      instanceId,
-			"instance-details": provisionRequest,
-		})
+		response := HealthResponse{
+			Status: HealthStatusOk,
+			Checks: checks,
+		}
+		for _, check := range checks {
+			if check.Status != HealthStatusOk {
+				response.Status = HealthStatusFailed
+			}
+		}
 
-		if err != nil {
-			status, response := handleServiceError(err, ctxLogger)
-			r.JSON(status, response)
+		if response.Status != HealthStatusOk {
+			r.JSON(503, response)
 			return
 		}
+		r.JSON(200, response)
+	})
 
-		ctxLogger.Debug("dashboard-url", lager.Data{"url": url})
+	// Expose metrics in the Prometheus text format, to scrapers with the operator credentials
+	m.Get("/metrics", handlers.HandleAdminAuthCheck(), func(res http.ResponseWriter) {
+		res.Header().Set("Content-Type", metrics.ContentType)
+		res.WriteHeader(200)
+		metrics.DefaultRegistry.Write(res)
+	})
 
-		r.JSON(201, ProvisionResponse{
-			DashboardUrl: url,
+	// Operator API, with its own credentials
+	m.Group("/admin", adminRoutes(serviceBroker), handlers.HandleAdminAuthCheck(), handleIds())
+
+	// Service Broker API, for the Cloud Controller
+	m.Group("/v2", func(router martini.Router) {
+		// Fetch catalog
+		router.Get("/catalog", func(r render.Render) {
+			catalog := CatalogResponse{
+				Services: serviceBroker.GetCatalog(),
+			}
+			r.JSON(200, catalog)
 		})
-	})
 
-	// Create binding
-	m.Put("/v2/service_instances/:instance_id/service_bindings/:binding_id", func(params martini.Params, r render.Render) {
-		logger.Debug("Entering service binding")
+		// Provision instance
+		router.Put("/service_instances/:instance_id", binding.Json(ProvisionRequest{}), func(provisionRequest ProvisionRequest, params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			instanceId := params["instance_id"]
+
+			// the parameters may hold credentials, so only the audit log records them, redacted
+			ctxLogger := logger.Session("provision", lager.Data{
+				"instance-id":       instanceId,
+				"service-id":        provisionRequest.ServiceId,
+				"plan-id":           provisionRequest.PlanId,
+				"organization-guid": provisionRequest.OrganizationGuid,
+				"space-guid":        provisionRequest.SpaceGuid,
+			})
+
+			provisionParams := map[string]string{
+				"organization_guid": provisionRequest.OrganizationGuid,
+				"plan_id":           provisionRequest.PlanId,
+				"service_id":        provisionRequest.ServiceId,
+				"space_guid":        provisionRequest.SpaceGuid,
+			}
+			for _, name := range contextParameters {
+				if value, ok := provisionRequest.Context[name].(string); ok && value != "" {
+					provisionParams[name] = value
+				}
+			}
+
+			started := time.Now()
+			var url string
+			err := mergeParameters(provisionParams, provisionRequest.Parameters)
+			if err == nil {
+				url, err = serviceBroker.Provision(WithLogger(ctx, ctxLogger), instanceId, provisionParams)
+			}
+			recordOperation("provision", err)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "provision",
+				InstanceId: instanceId,
+				Parameters: stringParameters(provisionParams),
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			ctxLogger.Debug("dashboard-url", lager.Data{"url": url})
+
+			r.JSON(201, ProvisionResponse{
+				DashboardUrl: url,
+			})
+		})
 
-		instanceID := params["instance_id"]
-		bindingID := params["binding_id"]
+		// Update instance
+		router.Patch("/service_instances/:instance_id", binding.Json(UpdateRequest{}), func(updateRequest UpdateRequest, params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			instanceId := params["instance_id"]
+
+			ctxLogger := logger.Session("update", lager.Data{
+				"instance-id": instanceId,
+				"service-id":  updateRequest.ServiceId,
+				"plan-id":     updateRequest.PlanId,
+			})
+
+			updater, ok := serviceBroker.(InstanceUpdater)
+			if !ok {
+				r.JSON(422, ErrorResponse{
+					Description: "instances of this service cannot be updated",
+				})
+				return
+			}
+
+			updateParams := map[string]string{
+				"service_id": updateRequest.ServiceId,
+			}
+			if updateRequest.PlanId != "" {
+				updateParams["plan_id"] = updateRequest.PlanId
+			}
+
+			started := time.Now()
+			err := mergeParameters(updateParams, updateRequest.Parameters)
+			if err == nil {
+				err = updater.Update(WithLogger(ctx, ctxLogger), instanceId, updateParams)
+			}
+			recordOperation("update", err)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "update",
+				InstanceId: instanceId,
+				Parameters: stringParameters(updateParams),
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, EmptyResponse{})
+		})
 
-		ctxLogger := logger.Session("bind", lager.Data{
-			"instance-id": instanceID,
-			"binding-id":  bindingID,
+		// Create binding
+		router.Put("/service_instances/:instance_id/service_bindings/:binding_id", binding.Json(BindRequest{}), func(bindRequest BindRequest, params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			instanceID := params["instance_id"]
+			bindingID := params["binding_id"]
+
+			ctxLogger := logger.Session("bind", lager.Data{
+				"instance-id": instanceID,
+				"binding-id":  bindingID,
+			})
+
+			bindParams := map[string]string{
+				"service_id": bindRequest.ServiceId,
+				"plan_id":    bindRequest.PlanId,
+			}
+			if bindRequest.AppGuid != "" {
+				bindParams["app_guid"] = bindRequest.AppGuid
+			}
+
+			started := time.Now()
+			var credentials interface{}
+			err := mergeParameters(bindParams, bindRequest.Parameters)
+			if err == nil {
+				if binder, ok := serviceBroker.(ParameterizedBinder); ok {
+					credentials, err = binder.BindWithParameters(WithLogger(ctx, ctxLogger), instanceID, bindingID, bindParams)
+				} else {
+					credentials, err = serviceBroker.Bind(WithLogger(ctx, ctxLogger), instanceID, bindingID)
+				}
+			}
+			recordOperation("bind", err)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "bind",
+				InstanceId: instanceID,
+				BindingId:  bindingID,
+				Parameters: stringParameters(bindParams),
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			bindingResponse := BindingResponse{
+				Credentials: credentials,
+			}
+			r.JSON(201, bindingResponse)
 		})
-		credentials, err := serviceBroker.Bind(instanceID, bindingID)
 
-		ctxLogger.Debug("broker", lager.Data{"credentials": fmt.Sprintf("Credentials: %v", credentials)})
+		// Remove binding
+		router.Delete("/service_instances/:instance_id/service_bindings/:binding_id", func(params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			instanceID := params["instance_id"]
+			bindingID := params["binding_id"]
+
+			ctxLogger := logger.Session("unbind", lager.Data{
+				"instance-id": instanceID,
+				"binding-id":  bindingID,
+			})
+			started := time.Now()
+			err := serviceBroker.Unbind(WithLogger(ctx, ctxLogger), instanceID, bindingID)
+			recordOperation("unbind", err)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "unbind",
+				InstanceId: instanceID,
+				BindingId:  bindingID,
+			}, started, err)
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, EmptyResponse{})
+		})
 
-		if err != nil {
-			status, response := handleServiceError(err, ctxLogger)
-			r.JSON(status, response)
-			return
-		}
+		// Remove instance
+		router.Delete("/service_instances/:instance_id", func(params martini.Params, r render.Render, ctx context.Context, logger lager.Logger) {
+			instanceID := params["instance_id"]
+
+			ctxLogger := logger.Session("deprovision", lager.Data{
+				"instance-id": instanceID,
+			})
+			started := time.Now()
+			err := serviceBroker.Deprovision(WithLogger(ctx, ctxLogger), instanceID)
+			recordOperation("deprovision", err)
+			RecordAudit(serviceBroker, ctx, ctxLogger, AuditEntry{
+				Operation:  "deprovision",
+				InstanceId: instanceID,
+			}, started, err)
+
+			if err == ServiceInstanceDoesNotExistsError {
+				r.JSON(410, EmptyResponse{})
+				return
+			}
+
+			if err != nil {
+				status, response := handleServiceError(err, ctxLogger)
+				r.JSON(status, response)
+				return
+			}
+
+			r.JSON(200, EmptyResponse{})
+		})
+	}, handlers.HandleAuthCheck(), handlers.HandleAPIVersionCheck(), handleOriginatingIdentity(), handleIds())
 
-		bindingResponse := BindingResponse{
-			Credentials: credentials,
-		}
-		r.JSON(201, bindingResponse)
-	})
+	return m
+}
 
-	// Remove binding
-	m.Delete("/v2/service_instances/:instance_id/service_bindings/:binding_id", func(params martini.Params, r render.Render) {
-	})
+// Parameters taken from the fields and context of provision and update requests
+var reservedParameters = map[string]bool{
+	"organization_guid": true,
+	"plan_id":           true,
+	"service_id":        true,
+	"space_guid":        true,
+	"organization_name": true,
+	"space_name":        true,
+	"app_guid":          true,
+}
 
-	// Remove instance
-	m.Delete("/v2/service_instances/:instance_id", func(params martini.Params, r render.Render) {
-	})
+// The context of a provision request passed on to brokers, with the parameters
+var contextParameters = []string{"organization_name", "space_name"}
 
-	return m
+// Adds the parameters of a provision, update or binding, which may not replace the fields of the request. Numbers
+// and booleans are passed on as the strings they are written as, e.g. {"retention_days": 7} as "7".
+func mergeParameters(params map[string]string, parameters map[string]interface{}) error {
+	for name, value := range parameters {
+		if reservedParameters[name] {
+			return &InvalidParameterError{Name: name, Reason: "is set by the platform"}
+		}
+		switch value := value.(type) {
+		case string:
+			params[name] = value
+		case float64:
+			// not fmt.Sprint, which writes large numbers with an exponent
+			params[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			params[name] = strconv.FormatBool(value)
+		default:
+			return &InvalidParameterError{Name: name, Reason: "must be a string, number or boolean"}
+		}
+	}
+	return nil
 }
 
 func handleServiceError(err error, logger lager.Logger) (int, interface{}) {
 	logger.Error("service-broker-error", err, lager.Data{"error": err.Error()})
 
+	switch err.(type) {
+	case *QuotaExceededError:
+		logger.Error("quota-exceeded", err)
+		return 403, ErrorResponse{
+			Description: err.Error(),
+		}
+	case *InvalidArchiveError:
+		logger.Error("invalid-archive", err)
+		return 400, ErrorResponse{
+			Description: err.Error(),
+		}
+	case *RestoreConflictError:
+		logger.Error("restore-conflict", err)
+		return 409, ErrorResponse{
+			Description: err.Error(),
+		}
+	case *InvalidParameterError:
+		logger.Error("invalid-parameter", err)
+		return 400, ErrorResponse{
+			Description: err.Error(),
+		}
+	}
+
 	switch err {
 	case ServiceInstanceAlreadyExistsError:
 		logger.Error("service-instance-already-exists", err)
@@ -231,6 +546,9 @@ func handleServiceError(err error, logger lager.Logger) (int, interface{}) {
 		return 409, ErrorResponse{
 			Description: err.Error(),
 		}
+	case ServiceInstanceBindingDoesNotExistsError:
+		logger.Error("binding-missing", err)
+		return 410, EmptyResponse{}
 	default:
 		logger.Error("unknown-error", err)
 		return 500, ErrorResponse{
@@ -6,6 +6,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/pivotal-golang/lager/lagertest"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -19,15 +20,35 @@ func TestApi(t *testing.T) {
 }
 
 func Request(method string, route string, username string, password string, broker api.ServiceBroker) *httptest.ResponseRecorder {
-	return makeRequest(method, route, username, password, broker)
+	return makeRequest(method, route, username, password, nil, broker)
 }
 
 func AuthorizedRequest(method string, route string, broker api.ServiceBroker) *httptest.ResponseRecorder {
-	return makeRequest(method, route, "username", "password", broker)
+	return makeRequest(method, route, "username", "password", nil, broker)
+}
+
+func AuthorizedRequestWithHeaders(method string, route string, headers map[string]string, broker api.ServiceBroker) *httptest.ResponseRecorder {
+	return makeRequest(method, route, "username", "password", headers, broker)
+}
+
+func AuthorizedRequestWithBody(method string, route string, body io.Reader, broker api.ServiceBroker) *httptest.ResponseRecorder {
+	return makeRequestWithBody(method, route, "username", "password", nil, body, broker)
+}
+
+func AdminRequest(method string, route string, broker api.ServiceBroker) *httptest.ResponseRecorder {
+	return makeRequest(method, route, "admin", "admin-password", nil, broker)
+}
+
+func AdminRequestWithBody(method string, route string, body io.Reader, broker api.ServiceBroker) *httptest.ResponseRecorder {
+	return makeRequestWithBody(method, route, "admin", "admin-password", nil, body, broker)
+}
+
+func RequestWithHeaders(method string, route string, headers map[string]string, broker api.ServiceBroker) *httptest.ResponseRecorder {
+	return makeRequest(method, route, "", "", headers, broker)
 }
 
 func UnauthorizedRequest(method string, route string, broker api.ServiceBroker) *httptest.ResponseRecorder {
-	return makeRequest(method, route, "", "", broker)
+	return makeRequest(method, route, "", "", nil, broker)
 }
 
 func Fixture(name string) string {
@@ -40,12 +61,19 @@ func Fixture(name string) string {
 	return string(contents)
 }
 
-func makeRequest(method string, route string, username string, password string, broker api.ServiceBroker) *httptest.ResponseRecorder {
+func makeRequest(method string, route string, username string, password string, headers map[string]string, broker api.ServiceBroker) *httptest.ResponseRecorder {
+	return makeRequestWithBody(method, route, username, password, headers, nil, broker)
+}
+
+func makeRequestWithBody(method string, route string, username string, password string, headers map[string]string, body io.Reader, broker api.ServiceBroker) *httptest.ResponseRecorder {
 	m := api.New(broker, lagertest.NewTestLogger("service-broker-test"))
-	request, _ := http.NewRequest(method, route, nil)
+	request, _ := http.NewRequest(method, route, body)
 	if username != "" {
 		request.SetBasicAuth(username, password)
 	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
 	response := httptest.NewRecorder()
 	m.ServeHTTP(response, request)
 	return response
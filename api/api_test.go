@@ -1,16 +1,27 @@
 package api_test
 
 import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"time"
 
 	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/pivotal-golang/lager/lagertest"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 type FakeServiceBroker struct {
 	ServiceBroker
+	ProvisionRequestId string
+	ProvisionIdentity  *OriginatingIdentity
 }
 
 func (fsb *FakeServiceBroker) GetCatalog() []Service {
@@ -20,7 +31,7 @@ func (fsb *FakeServiceBroker) GetCatalog() []Service {
 			Name:        "logsearch-service",
 			Description: "Logsearch Service for Cloud Foundry v2",
 			Bindable:    true,
-			DashboardClient: DashboardClient{
+			DashboardClient: &DashboardClient{
 				Id:          "logsearch-service-client",
 				Secret:      "s3cr3t",
 				RedirectUri: "https://dashboard.com",
@@ -57,10 +68,176 @@ func (fsb *FakeServiceBroker) GetCatalog() []Service {
 	}
 }
 
-func (fsb *FakeServiceBroker) Provision(instanceId string, _ map[string]string) (string, error) {
+func (fsb *FakeServiceBroker) Provision(ctx context.Context, instanceId string, _ map[string]string) (string, error) {
+	fsb.ProvisionRequestId = RequestIdFromContext(ctx)
+	fsb.ProvisionIdentity = OriginatingIdentityFromContext(ctx)
 	return "http://locahost/dashboard/instances/" + instanceId, nil
 }
 
+type FakeHealthyServiceBroker struct {
+	FakeServiceBroker
+	Checks    []HealthCheck
+	Instances []InstanceHealth
+}
+
+func (fsb *FakeHealthyServiceBroker) CheckHealth() []HealthCheck {
+	return fsb.Checks
+}
+
+func (fsb *FakeHealthyServiceBroker) CheckInstancesHealth() ([]InstanceHealth, error) {
+	return fsb.Instances, nil
+}
+
+type FakeAuditLog struct {
+	Entries []AuditEntry
+	Queries []AuditQuery
+}
+
+func (fal *FakeAuditLog) Record(entry AuditEntry) error {
+	fal.Entries = append(fal.Entries, entry)
+	return nil
+}
+
+func (fal *FakeAuditLog) Query(query AuditQuery) ([]AuditEntry, error) {
+	fal.Queries = append(fal.Queries, query)
+	return fal.Entries, nil
+}
+
+type FakeAuditedServiceBroker struct {
+	FakeServiceBroker
+	Log *FakeAuditLog
+}
+
+func (fsb *FakeAuditedServiceBroker) AuditLog() AuditLog {
+	return fsb.Log
+}
+
+type FakeAdministeredServiceBroker struct {
+	FakeAuditedServiceBroker
+	Instances      []InstanceDetails
+	Filters        []InstanceFilter
+	Restarted      []string
+	ForceDeleted   []string
+	ForceDeleteErr error
+}
+
+func (fsb *FakeAdministeredServiceBroker) ListInstances(filter InstanceFilter) ([]InstanceDetails, error) {
+	fsb.Filters = append(fsb.Filters, filter)
+	instances := []InstanceDetails{}
+	for _, instance := range fsb.Instances {
+		if filter.Matches(instance) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+func (fsb *FakeAdministeredServiceBroker) GetInstance(instanceId string) (InstanceDetails, error) {
+	for _, instance := range fsb.Instances {
+		if instance.Id == instanceId {
+			return instance, nil
+		}
+	}
+	return InstanceDetails{}, ServiceInstanceDoesNotExistsError
+}
+
+func (fsb *FakeAdministeredServiceBroker) RestartInstance(ctx context.Context, instanceId string) error {
+	fsb.Restarted = append(fsb.Restarted, instanceId)
+	return nil
+}
+
+func (fsb *FakeAdministeredServiceBroker) ForceDeleteInstance(ctx context.Context, instanceId string) error {
+	fsb.ForceDeleted = append(fsb.ForceDeleted, instanceId)
+	return fsb.ForceDeleteErr
+}
+
+type FakeQuotaServiceBroker struct {
+	FakeServiceBroker
+	Usage []QuotaUsage
+}
+
+func (fsb *FakeQuotaServiceBroker) Provision(ctx context.Context, instanceId string, _ map[string]string) (string, error) {
+	return "", &QuotaExceededError{Quota: QuotaOrg, Scope: "org-1", Limit: 2}
+}
+
+func (fsb *FakeQuotaServiceBroker) QuotaUsage() ([]QuotaUsage, error) {
+	return fsb.Usage, nil
+}
+
+type FakePipelineServiceBroker struct {
+	FakeAuditedServiceBroker
+	Params    map[string]string
+	Pipelines []PipelineDetails
+}
+
+func (fsb *FakePipelineServiceBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	fsb.Params = params
+	if params["pipeline"] == "unknown" {
+		return "", &InvalidParameterError{Name: "pipeline", Reason: "unknown pipeline 'unknown'"}
+	}
+	return "", nil
+}
+
+func (fsb *FakePipelineServiceBroker) ListPipelines() ([]PipelineDetails, error) {
+	return fsb.Pipelines, nil
+}
+
+type FakeUpdatingServiceBroker struct {
+	FakeAuditedServiceBroker
+	InstanceId string
+	Params     map[string]string
+	UpdateErr  error
+}
+
+func (fsb *FakeUpdatingServiceBroker) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	fsb.InstanceId = instanceId
+	fsb.Params = params
+	return fsb.UpdateErr
+}
+
+type FakeBindingServiceBroker struct {
+	FakeAuditedServiceBroker
+	BindingId string
+	Params    map[string]string
+	BindErr   error
+}
+
+func (fsb *FakeBindingServiceBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	fsb.BindingId = bindingId
+	return map[string]string{"username": "user-1"}, fsb.BindErr
+}
+
+type FakeParameterizedBindingServiceBroker struct {
+	FakeBindingServiceBroker
+}
+
+func (fsb *FakeParameterizedBindingServiceBroker) BindWithParameters(ctx context.Context, instanceId string, bindingId string, params map[string]string) (interface{}, error) {
+	fsb.Params = params
+	return fsb.Bind(ctx, instanceId, bindingId)
+}
+
+type FakeArchivingServiceBroker struct {
+	FakeAuditedServiceBroker
+	Archive    string
+	Restored   []string
+	Report     RestoreReport
+	RestoreErr error
+}
+
+func (fsb *FakeArchivingServiceBroker) Backup(w io.Writer) error {
+	_, err := io.WriteString(w, fsb.Archive)
+	return err
+}
+
+func (fsb *FakeArchivingServiceBroker) Restore(ctx context.Context, r io.Reader) (RestoreReport, error) {
+	archive, err := ioutil.ReadAll(r)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	fsb.Restored = append(fsb.Restored, string(archive))
+	return fsb.Report, fsb.RestoreErr
+}
+
 var _ = Describe("service broker api", func() {
 	var (
 		fakeServiceBroker *FakeServiceBroker
@@ -92,4 +269,662 @@ var _ = Describe("service broker api", func() {
 			})
 		})
 	})
+	Describe("health", func() {
+		var healthyServiceBroker *FakeHealthyServiceBroker
+
+		BeforeEach(func() {
+			healthyServiceBroker = new(FakeHealthyServiceBroker)
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		Context("when the broker is healthy", func() {
+			BeforeEach(func() {
+				healthyServiceBroker.Checks = []HealthCheck{
+					HealthCheck{Name: "config", Status: HealthStatusOk},
+				}
+			})
+			It("returns a 200 status code without credentials", func() {
+				response := UnauthorizedRequest("GET", "/healthz", healthyServiceBroker)
+				Expect(response.Code).To(Equal(200))
+				Expect(response.Body).To(MatchJSON(`{"status":"ok","checks":[{"name":"process","status":"ok"},{"name":"config","status":"ok"}]}`))
+			})
+		})
+		Context("when one of the broker checks fails", func() {
+			BeforeEach(func() {
+				healthyServiceBroker.Checks = []HealthCheck{
+					HealthCheck{Name: "data-directory", Status: HealthStatusFailed, Error: "read-only file system"},
+				}
+			})
+			It("returns a 503 status code", func() {
+				response := UnauthorizedRequest("GET", "/healthz", healthyServiceBroker)
+				Expect(response.Code).To(Equal(503))
+			})
+		})
+		Context("when instance health is fetched", func() {
+			BeforeEach(func() {
+				healthyServiceBroker.Instances = []InstanceHealth{
+					InstanceHealth{
+						InstanceId: "instance-1",
+						Address:    "127.0.0.1:5000",
+						Status:     HealthStatusOk,
+						Ports: []PortHealth{
+							PortHealth{Protocol: "tcp", Status: HealthStatusOk, LatencyMillis: 1.5},
+						},
+					},
+				}
+			})
+			It("reports every instance with valid credentials", func() {
+				response := AdminRequest("GET", "/admin/instances/health", healthyServiceBroker)
+				Expect(response.Code).To(Equal(200))
+				Expect(response.Body).To(MatchJSON(`{"instances":[{"instance_id":"instance-1","address":"127.0.0.1:5000","status":"ok","ports":[{"protocol":"tcp","status":"ok","latency_ms":1.5}]}]}`))
+			})
+			It("returns a 401 status code without credentials", func() {
+				response := UnauthorizedRequest("GET", "/admin/instances/health", healthyServiceBroker)
+				Expect(response.Code).To(Equal(http.StatusUnauthorized))
+			})
+		})
+	})
+	Describe("metrics", func() {
+		BeforeEach(func() {
+			fakeServiceBroker = new(FakeServiceBroker)
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		It("exposes request counts by route pattern in the Prometheus text format", func() {
+			AuthorizedRequest("GET", "/v2/catalog", fakeServiceBroker)
+			response := AdminRequest("GET", "/metrics", fakeServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4"))
+			Expect(response.Body.String()).To(ContainSubstring(`logsearch_broker_http_requests_total{method="GET",route="/v2/catalog",status="200"}`))
+		})
+		It("exposes broker operation outcomes", func() {
+			AuthorizedRequest("PUT", "/v2/service_instances/instance-1", fakeServiceBroker)
+			response := AdminRequest("GET", "/metrics", fakeServiceBroker)
+			Expect(response.Body.String()).To(ContainSubstring(`logsearch_broker_operations_total{operation="provision",outcome="success"}`))
+		})
+		It("returns a 401 status code without the operator credentials", func() {
+			Expect(UnauthorizedRequest("GET", "/metrics", fakeServiceBroker).Code).To(Equal(http.StatusUnauthorized))
+			Expect(AuthorizedRequest("GET", "/metrics", fakeServiceBroker).Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+	Describe("request ids", func() {
+		BeforeEach(func() {
+			fakeServiceBroker = new(FakeServiceBroker)
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+		})
+		Context("when the platform sends a request identity", func() {
+			It("passes it to the broker and echoes it back", func() {
+				response := AuthorizedRequestWithHeaders("PUT", "/v2/service_instances/instance-1", map[string]string{
+					"X-Broker-Api-Request-Identity": "e26cea45-5ffc-4a1d-8a0b-5a6a2a5d1b4e",
+				}, fakeServiceBroker)
+				Expect(response.Header().Get("X-Request-Id")).To(Equal("e26cea45-5ffc-4a1d-8a0b-5a6a2a5d1b4e"))
+				Expect(fakeServiceBroker.ProvisionRequestId).To(Equal("e26cea45-5ffc-4a1d-8a0b-5a6a2a5d1b4e"))
+			})
+		})
+		Context("when the request has an X-Request-Id", func() {
+			It("uses it as the request id", func() {
+				AuthorizedRequestWithHeaders("PUT", "/v2/service_instances/instance-1", map[string]string{
+					"X-Request-Id": "from-the-router",
+				}, fakeServiceBroker)
+				Expect(fakeServiceBroker.ProvisionRequestId).To(Equal("from-the-router"))
+			})
+		})
+		Context("when the request has no id", func() {
+			It("generates one", func() {
+				response := AuthorizedRequest("PUT", "/v2/service_instances/instance-1", fakeServiceBroker)
+				Expect(response.Header().Get("X-Request-Id")).To(MatchRegexp("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$"))
+				Expect(fakeServiceBroker.ProvisionRequestId).To(Equal(response.Header().Get("X-Request-Id")))
+			})
+		})
+	})
+	Describe("api version", func() {
+		BeforeEach(func() {
+			fakeServiceBroker = new(FakeServiceBroker)
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+			os.Setenv("LOGSEARCH_BROKER_MIN_API_VERSION", "2.12")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+			os.Setenv("LOGSEARCH_BROKER_MIN_API_VERSION", "")
+		})
+		It("accepts requests at the minimum version", func() {
+			response := AuthorizedRequestWithHeaders("GET", "/v2/catalog", map[string]string{
+				"X-Broker-API-Version": "2.12",
+			}, fakeServiceBroker)
+			Expect(response.Code).To(Equal(200))
+		})
+		It("accepts requests above the minimum version", func() {
+			response := AuthorizedRequestWithHeaders("GET", "/v2/catalog", map[string]string{
+				"X-Broker-API-Version": "3.0",
+			}, fakeServiceBroker)
+			Expect(response.Code).To(Equal(200))
+		})
+		It("rejects requests below the minimum version with 412", func() {
+			response := AuthorizedRequestWithHeaders("GET", "/v2/catalog", map[string]string{
+				"X-Broker-API-Version": "2.4",
+			}, fakeServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusPreconditionFailed))
+			Expect(response.Body).To(MatchJSON(`{"description":"X-Broker-API-Version \"2.4\" is not supported, the minimum is 2.12"}`))
+		})
+		It("rejects requests without a version with 412", func() {
+			response := AuthorizedRequest("GET", "/v2/catalog", fakeServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusPreconditionFailed))
+		})
+		It("does not apply to the health endpoint", func() {
+			response := UnauthorizedRequest("GET", "/healthz", fakeServiceBroker)
+			Expect(response.Code).To(Equal(200))
+		})
+	})
+	Describe("originating identity", func() {
+		BeforeEach(func() {
+			fakeServiceBroker = new(FakeServiceBroker)
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+		})
+		It("decodes the identity and passes it to the broker", func() {
+			value := base64.StdEncoding.EncodeToString([]byte(`{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`))
+			AuthorizedRequestWithHeaders("PUT", "/v2/service_instances/instance-1", map[string]string{
+				"X-Broker-API-Originating-Identity": "cloudfoundry " + value,
+			}, fakeServiceBroker)
+			Expect(fakeServiceBroker.ProvisionIdentity).To(Equal(&OriginatingIdentity{
+				Platform: "cloudfoundry",
+				UserId:   "683ea748-3092-4ff4-b656-39cacc4d5360",
+			}))
+		})
+		It("passes no identity when the header is missing", func() {
+			AuthorizedRequest("PUT", "/v2/service_instances/instance-1", fakeServiceBroker)
+			Expect(fakeServiceBroker.ProvisionIdentity).To(BeNil())
+		})
+		It("rejects a malformed identity with 400", func() {
+			response := AuthorizedRequestWithHeaders("PUT", "/v2/service_instances/instance-1", map[string]string{
+				"X-Broker-API-Originating-Identity": "cloudfoundry not-base64!",
+			}, fakeServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+	Describe("ids", func() {
+		BeforeEach(func() {
+			fakeServiceBroker = new(FakeServiceBroker)
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+		})
+		It("refuses instance and binding ids that could name another path with 400, before the broker sees them", func() {
+			for _, route := range []string{
+				"/v2/service_instances/.",
+				"/v2/service_instances/..",
+				"/v2/service_instances/instance-1/service_bindings/..",
+				"/v2/service_instances/instance%2E1",
+			} {
+				response := AuthorizedRequest("DELETE", route, fakeServiceBroker)
+				Expect(response.Code).To(Equal(http.StatusBadRequest), route)
+			}
+		})
+		It("accepts GUIDs", func() {
+			Expect(ValidId("683ea748-3092-4ff4-b656-39cacc4d5360")).To(BeTrue())
+			Expect(ValidId("instance_1")).To(BeTrue())
+			Expect(ValidId("")).To(BeFalse())
+		})
+	})
+	Describe("audit", func() {
+		var auditedServiceBroker *FakeAuditedServiceBroker
+
+		BeforeEach(func() {
+			auditedServiceBroker = &FakeAuditedServiceBroker{Log: &FakeAuditLog{}}
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		It("records provisioning with the request id and originating identity", func() {
+			value := base64.StdEncoding.EncodeToString([]byte(`{"user_id":"user-1"}`))
+			AuthorizedRequestWithHeaders("PUT", "/v2/service_instances/instance-1", map[string]string{
+				"X-Broker-API-Originating-Identity": "cloudfoundry " + value,
+				"X-Request-Id":                      "request-1",
+			}, auditedServiceBroker)
+
+			Expect(auditedServiceBroker.Log.Entries).To(HaveLen(1))
+			entry := auditedServiceBroker.Log.Entries[0]
+			Expect(entry.Operation).To(Equal("provision"))
+			Expect(entry.InstanceId).To(Equal("instance-1"))
+			Expect(entry.RequestId).To(Equal("request-1"))
+			Expect(entry.OriginatingIdentity).To(Equal(&OriginatingIdentity{Platform: "cloudfoundry", UserId: "user-1"}))
+			Expect(entry.Outcome).To(Equal("success"))
+			Expect(entry.Parameters).To(HaveKey("plan_id"))
+		})
+		It("queries the log by instance and time range", func() {
+			response := AdminRequest("GET", "/admin/audit?instance_id=instance-1&from=2014-09-01T00:00:00Z&to=2014-09-02T00:00:00Z", auditedServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(auditedServiceBroker.Log.Queries).To(Equal([]AuditQuery{
+				AuditQuery{
+					InstanceId: "instance-1",
+					From:       time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC),
+					To:         time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC),
+				},
+			}))
+		})
+		It("rejects timestamps that are not RFC 3339", func() {
+			response := AdminRequest("GET", "/admin/audit?from=yesterday", auditedServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("requires credentials", func() {
+			response := UnauthorizedRequest("GET", "/admin/audit", auditedServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+		})
+		It("redacts anything that looks like a secret from the parameters", func() {
+			Expect(RedactParameters(map[string]interface{}{
+				"plan_id": "plan-1",
+				"nested": map[string]interface{}{
+					"password": "hunter2",
+					"hosts":    []interface{}{map[string]interface{}{"api_key": "abc"}},
+				},
+			})).To(Equal(map[string]interface{}{
+				"plan_id": "plan-1",
+				"nested": map[string]interface{}{
+					"password": "[REDACTED]",
+					"hosts":    []interface{}{map[string]interface{}{"api_key": "[REDACTED]"}},
+				},
+			}))
+		})
+	})
+	Describe("admin", func() {
+		var administeredServiceBroker *FakeAdministeredServiceBroker
+
+		BeforeEach(func() {
+			administeredServiceBroker = &FakeAdministeredServiceBroker{
+				FakeAuditedServiceBroker: FakeAuditedServiceBroker{Log: &FakeAuditLog{}},
+				Instances: []InstanceDetails{
+					InstanceDetails{Id: "instance-1", OrganizationGuid: "org-1", Process: ProcessDetails{State: ProcessRunning, Pid: 42}},
+					InstanceDetails{Id: "instance-2", OrganizationGuid: "org-2", Process: ProcessDetails{State: ProcessStopped}},
+				},
+			}
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		It("rejects the broker credentials", func() {
+			response := AuthorizedRequest("GET", "/admin/instances", administeredServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+		})
+		It("refuses every request when no admin credentials are configured", func() {
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+			response := RequestWithHeaders("GET", "/admin/instances", map[string]string{
+				"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(":")),
+			}, administeredServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+		})
+		It("lists instances matching the query filters", func() {
+			response := AdminRequest("GET", "/admin/instances?org=org-1&status=running", administeredServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(administeredServiceBroker.Filters).To(Equal([]InstanceFilter{
+				InstanceFilter{OrganizationGuid: "org-1", Status: ProcessRunning},
+			}))
+			Expect(response.Body.String()).To(ContainSubstring(`"id":"instance-1"`))
+			Expect(response.Body.String()).NotTo(ContainSubstring(`"id":"instance-2"`))
+		})
+		It("shows a single instance", func() {
+			response := AdminRequest("GET", "/admin/instances/instance-2", administeredServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body.String()).To(ContainSubstring(`"state":"stopped"`))
+		})
+		It("returns 404 for an unknown instance", func() {
+			response := AdminRequest("GET", "/admin/instances/instance-3", administeredServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+		It("restarts an instance and audits it", func() {
+			response := AdminRequest("POST", "/admin/instances/instance-1/restart", administeredServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(administeredServiceBroker.Restarted).To(Equal([]string{"instance-1"}))
+			Expect(administeredServiceBroker.Log.Entries).To(HaveLen(1))
+			Expect(administeredServiceBroker.Log.Entries[0].Operation).To(Equal("admin-restart"))
+		})
+		It("force deletes an instance and audits it", func() {
+			response := AdminRequest("DELETE", "/admin/instances/instance-2", administeredServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(administeredServiceBroker.ForceDeleted).To(Equal([]string{"instance-2"}))
+			Expect(administeredServiceBroker.Log.Entries[0].Operation).To(Equal("admin-force-delete"))
+			Expect(administeredServiceBroker.Log.Entries[0].Outcome).To(Equal("success"))
+		})
+		It("refuses ids that could name another path", func() {
+			response := AdminRequest("DELETE", "/admin/instances/..", administeredServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+			Expect(administeredServiceBroker.ForceDeleted).To(BeEmpty())
+		})
+		It("returns 404 when the broker does not support administration", func() {
+			response := AdminRequest("GET", "/admin/instances", new(FakeServiceBroker))
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+	Describe("quotas", func() {
+		var quotaServiceBroker *FakeQuotaServiceBroker
+
+		BeforeEach(func() {
+			quotaServiceBroker = &FakeQuotaServiceBroker{
+				Usage: []QuotaUsage{
+					{Quota: QuotaGlobal, Used: 3, Limit: 10},
+					{Quota: QuotaOrg, Scope: "org-1", Used: 2, Limit: 2},
+				},
+			}
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		It("refuses to provision past a quota, naming it", func() {
+			response := AuthorizedRequest("PUT", "/v2/service_instances/instance-1", quotaServiceBroker)
+			Expect(response.Code).To(Equal(http.StatusForbidden))
+			Expect(response.Body).To(MatchJSON(`{"description":"the org quota of 2 instances for org org-1 has been reached"}`))
+		})
+		It("reports quota usage to admins", func() {
+			response := AdminRequest("GET", "/admin/quotas", quotaServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body).To(MatchJSON(`{"quotas":[
+				{"quota":"global","used":3,"limit":10},
+				{"quota":"org","scope":"org-1","used":2,"limit":2}
+			]}`))
+		})
+	})
+
+	Describe("backups", func() {
+		var archivingServiceBroker *FakeArchivingServiceBroker
+
+		BeforeEach(func() {
+			archivingServiceBroker = &FakeArchivingServiceBroker{
+				FakeAuditedServiceBroker: FakeAuditedServiceBroker{Log: &FakeAuditLog{}},
+				Archive:                  "archive",
+				Report:                   RestoreReport{Instances: []string{"instance-1"}, Bindings: 2, Templates: []string{}},
+			}
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		It("downloads the archive", func() {
+			response := AdminRequest("GET", "/admin/backup", archivingServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Header().Get("Content-Type")).To(Equal("application/gzip"))
+			Expect(response.Header().Get("Content-Disposition")).To(MatchRegexp(`^attachment; filename="logsearch-backup-\d{8}T\d{6}Z\.tar\.gz"$`))
+			Expect(response.Body.String()).To(Equal("archive"))
+			Expect(archivingServiceBroker.Log.Entries).To(HaveLen(1))
+			Expect(archivingServiceBroker.Log.Entries[0].Operation).To(Equal("admin-backup"))
+		})
+		It("restores an uploaded archive", func() {
+			response := AdminRequestWithBody("POST", "/admin/restore", strings.NewReader("archive"), archivingServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body).To(MatchJSON(`{"instances":["instance-1"],"bindings":2,"templates":[]}`))
+			Expect(archivingServiceBroker.Restored).To(Equal([]string{"archive"}))
+			Expect(archivingServiceBroker.Log.Entries).To(HaveLen(1))
+			Expect(archivingServiceBroker.Log.Entries[0].Operation).To(Equal("admin-restore"))
+			Expect(archivingServiceBroker.Log.Entries[0].Outcome).To(Equal("success"))
+		})
+		It("rejects an invalid archive", func() {
+			archivingServiceBroker.RestoreErr = &InvalidArchiveError{Reason: "manifest.json is missing"}
+			response := AdminRequestWithBody("POST", "/admin/restore", strings.NewReader("archive"), archivingServiceBroker)
+			Expect(response.Code).To(Equal(400))
+			Expect(response.Body).To(MatchJSON(`{"description":"invalid archive: manifest.json is missing"}`))
+			Expect(archivingServiceBroker.Log.Entries[0].Outcome).To(Equal("invalid-archive"))
+		})
+		It("reports conflicts with existing instances", func() {
+			archivingServiceBroker.RestoreErr = &RestoreConflictError{Conflicts: []string{"instance instance-1 already exists"}}
+			response := AdminRequestWithBody("POST", "/admin/restore", strings.NewReader("archive"), archivingServiceBroker)
+			Expect(response.Code).To(Equal(409))
+			Expect(response.Body).To(MatchJSON(`{"description":"archive conflicts with existing instances: instance instance-1 already exists"}`))
+		})
+		It("is not found for brokers without backups", func() {
+			response := AdminRequest("GET", "/admin/backup", new(FakeServiceBroker))
+			Expect(response.Code).To(Equal(404))
+		})
+	})
+	Describe("provision parameters", func() {
+		var pipelineServiceBroker *FakePipelineServiceBroker
+
+		provision := func(body string) *httptest.ResponseRecorder {
+			return AuthorizedRequestWithBody("PUT", "/v2/service_instances/instance-1", strings.NewReader(body), pipelineServiceBroker)
+		}
+
+		BeforeEach(func() {
+			pipelineServiceBroker = &FakePipelineServiceBroker{
+				FakeAuditedServiceBroker: FakeAuditedServiceBroker{Log: &FakeAuditLog{}},
+				Pipelines: []PipelineDetails{
+					{Name: "json-lines", Description: "JSON documents", Default: true, Inputs: []PipelineInputDetails{{Protocol: "tcp", Format: "json"}}},
+				},
+			}
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "admin")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "admin-password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+			os.Setenv("LOGSEARCH_ADMIN_USERNAME", "")
+			os.Setenv("LOGSEARCH_ADMIN_PASSWORD", "")
+		})
+		It("passes them to the broker with the request fields", func() {
+			response := provision(`{"plan_id":"plan-1","parameters":{"pipeline":"json-lines"}}`)
+			Expect(response.Code).To(Equal(201))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("pipeline", "json-lines"))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("plan_id", "plan-1"))
+			Expect(pipelineServiceBroker.Log.Entries[0].Parameters).To(HaveKeyWithValue("pipeline", "json-lines"))
+		})
+		It("passes the org and space names from the context", func() {
+			response := provision(`{"organization_guid":"org-1","context":{"platform":"cloudfoundry","organization_name":"acme","space_name":"dev"}}`)
+			Expect(response.Code).To(Equal(201))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("organization_name", "acme"))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("space_name", "dev"))
+			Expect(pipelineServiceBroker.Params).ToNot(HaveKey("platform"))
+		})
+		It("rejects values the broker refuses", func() {
+			response := provision(`{"parameters":{"pipeline":"unknown"}}`)
+			Expect(response.Code).To(Equal(400))
+			Expect(response.Body).To(MatchJSON(`{"description":"invalid parameter 'pipeline': unknown pipeline 'unknown'"}`))
+			Expect(pipelineServiceBroker.Log.Entries[0].Outcome).To(Equal("invalid-parameter"))
+		})
+		It("passes numbers and booleans as they are written", func() {
+			response := provision(`{"parameters":{"retention_days":7,"max_bytes":1073741824,"ratio":0.5,"tls":true}}`)
+			Expect(response.Code).To(Equal(201))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("retention_days", "7"))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("max_bytes", "1073741824"))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("ratio", "0.5"))
+			Expect(pipelineServiceBroker.Params).To(HaveKeyWithValue("tls", "true"))
+		})
+		It("rejects values that are not strings, numbers or booleans", func() {
+			for _, value := range []string{`["json-lines"]`, `{"name":"json-lines"}`, `null`} {
+				response := provision(`{"parameters":{"pipeline":` + value + `}}`)
+				Expect(response.Code).To(Equal(400), value)
+				Expect(response.Body).To(MatchJSON(`{"description":"invalid parameter 'pipeline': must be a string, number or boolean"}`), value)
+			}
+			Expect(pipelineServiceBroker.Params).To(BeNil())
+		})
+		It("keeps them out of the broker log", func() {
+			logger := lagertest.NewTestLogger("service-broker-test")
+			request, _ := http.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader(`{"plan_id":"plan-1","parameters":{"pipeline":"json-lines","password":"s3cr3t"}}`))
+			request.SetBasicAuth("username", "password")
+			New(pipelineServiceBroker, logger).ServeHTTP(httptest.NewRecorder(), request)
+
+			Expect(string(logger.Contents())).To(ContainSubstring(`"plan-id":"plan-1"`))
+			Expect(string(logger.Contents())).ToNot(ContainSubstring("s3cr3t"))
+		})
+		It("does not let them replace the request fields", func() {
+			response := provision(`{"plan_id":"plan-1","parameters":{"plan_id":"plan-2"}}`)
+			Expect(response.Code).To(Equal(400))
+			Expect(response.Body).To(MatchJSON(`{"description":"invalid parameter 'plan_id': is set by the platform"}`))
+		})
+		It("lists the pipelines to admins", func() {
+			response := AdminRequest("GET", "/admin/pipelines", pipelineServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body).To(MatchJSON(`{"pipelines":[
+				{"name":"json-lines","description":"JSON documents","default":true,"inputs":[{"protocol":"tcp","format":"json"}],"tls":false}
+			]}`))
+		})
+	})
+	Describe("updates", func() {
+		var updatingServiceBroker *FakeUpdatingServiceBroker
+
+		update := func(body string, broker ServiceBroker) *httptest.ResponseRecorder {
+			return AuthorizedRequestWithBody("PATCH", "/v2/service_instances/instance-1", strings.NewReader(body), broker)
+		}
+
+		BeforeEach(func() {
+			updatingServiceBroker = &FakeUpdatingServiceBroker{
+				FakeAuditedServiceBroker: FakeAuditedServiceBroker{Log: &FakeAuditLog{}},
+			}
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+		})
+		It("passes the parameters to the broker and audits the update", func() {
+			response := update(`{"service_id":"service-1","parameters":{"filters":"drop {}"}}`, updatingServiceBroker)
+			Expect(response.Code).To(Equal(200))
+			Expect(response.Body).To(MatchJSON(`{}`))
+			Expect(updatingServiceBroker.InstanceId).To(Equal("instance-1"))
+			Expect(updatingServiceBroker.Params).To(Equal(map[string]string{"service_id": "service-1", "filters": "drop {}"}))
+			Expect(updatingServiceBroker.Log.Entries).To(HaveLen(1))
+			Expect(updatingServiceBroker.Log.Entries[0].Operation).To(Equal("update"))
+			Expect(updatingServiceBroker.Log.Entries[0].Parameters).To(HaveKeyWithValue("filters", "drop {}"))
+		})
+		It("keeps the parameters out of the broker log", func() {
+			updatingServiceBroker.UpdateErr = ServiceInstanceDoesNotExistsError
+			logger := lagertest.NewTestLogger("service-broker-test")
+			request, _ := http.NewRequest("PATCH", "/v2/service_instances/instance-1", strings.NewReader(`{"service_id":"service-1","parameters":{"password":"s3cr3t"}}`))
+			request.SetBasicAuth("username", "password")
+			New(updatingServiceBroker, logger).ServeHTTP(httptest.NewRecorder(), request)
+
+			Expect(string(logger.Contents())).To(ContainSubstring(`"service-id":"service-1"`))
+			Expect(string(logger.Contents())).ToNot(ContainSubstring("s3cr3t"))
+		})
+		It("passes a new plan only when one is given", func() {
+			update(`{"service_id":"service-1","plan_id":"plan-2"}`, updatingServiceBroker)
+			Expect(updatingServiceBroker.Params).To(HaveKeyWithValue("plan_id", "plan-2"))
+		})
+		It("rejects parameters the broker refuses, saying why", func() {
+			updatingServiceBroker.UpdateErr = &InvalidParameterError{Name: "filters", Reason: "line 1: filter plugin 'ruby' is not allowed: ruby {}"}
+			response := update(`{"parameters":{"filters":"ruby {}"}}`, updatingServiceBroker)
+			Expect(response.Code).To(Equal(400))
+			Expect(response.Body).To(MatchJSON(`{"description":"invalid parameter 'filters': line 1: filter plugin 'ruby' is not allowed: ruby {}"}`))
+			Expect(updatingServiceBroker.Log.Entries[0].Outcome).To(Equal("invalid-parameter"))
+		})
+		It("does not let parameters stand in for the plan", func() {
+			response := update(`{"parameters":{"plan_id":"plan-2"}}`, updatingServiceBroker)
+			Expect(response.Code).To(Equal(400))
+			Expect(updatingServiceBroker.Params).To(BeNil())
+		})
+		It("reports instances that do not exist", func() {
+			updatingServiceBroker.UpdateErr = ServiceInstanceDoesNotExistsError
+			response := update(`{}`, updatingServiceBroker)
+			Expect(response.Code).To(Equal(404))
+		})
+		It("is unprocessable for brokers without updates", func() {
+			response := update(`{}`, new(FakeServiceBroker))
+			Expect(response.Code).To(Equal(422))
+			Expect(response.Body).To(MatchJSON(`{"description":"instances of this service cannot be updated"}`))
+		})
+	})
+
+	Describe("bindings", func() {
+		var bindingServiceBroker *FakeParameterizedBindingServiceBroker
+
+		bind := func(body string, broker ServiceBroker) *httptest.ResponseRecorder {
+			return AuthorizedRequestWithBody("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1", strings.NewReader(body), broker)
+		}
+
+		BeforeEach(func() {
+			bindingServiceBroker = &FakeParameterizedBindingServiceBroker{
+				FakeBindingServiceBroker{FakeAuditedServiceBroker: FakeAuditedServiceBroker{Log: &FakeAuditLog{}}},
+			}
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "username")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "password")
+		})
+		AfterEach(func() {
+			os.Setenv("LOGSEARCH_BROKER_USERNAME", "")
+			os.Setenv("LOGSEARCH_BROKER_PASSWORD", "")
+		})
+		It("passes the parameters to brokers that take them and audits the binding", func() {
+			response := bind(`{"service_id":"service-1","plan_id":"plan-1","app_guid":"app-1","parameters":{"access":"read-only"}}`, bindingServiceBroker)
+			Expect(response.Code).To(Equal(201))
+			Expect(response.Body).To(MatchJSON(`{"credentials":{"username":"user-1"}}`))
+			Expect(bindingServiceBroker.Params).To(Equal(map[string]string{
+				"service_id": "service-1",
+				"plan_id":    "plan-1",
+				"app_guid":   "app-1",
+				"access":     "read-only",
+			}))
+			Expect(bindingServiceBroker.Log.Entries).To(HaveLen(1))
+			Expect(bindingServiceBroker.Log.Entries[0].Operation).To(Equal("bind"))
+			Expect(bindingServiceBroker.Log.Entries[0].Parameters).To(HaveKeyWithValue("access", "read-only"))
+		})
+		It("binds without a body", func() {
+			response := bind(``, bindingServiceBroker)
+			Expect(response.Code).To(Equal(201))
+			Expect(bindingServiceBroker.BindingId).To(Equal("binding-1"))
+		})
+		It("does not let parameters stand in for the app", func() {
+			response := bind(`{"parameters":{"app_guid":"app-2"}}`, bindingServiceBroker)
+			Expect(response.Code).To(Equal(400))
+			Expect(bindingServiceBroker.BindingId).To(BeEmpty())
+		})
+		It("rejects parameters the broker refuses, saying why", func() {
+			bindingServiceBroker.BindErr = &InvalidParameterError{Name: "access", Reason: "unknown access 'admin', expected read-write or read-only"}
+			response := bind(`{"parameters":{"access":"admin"}}`, bindingServiceBroker)
+			Expect(response.Code).To(Equal(400))
+			Expect(response.Body).To(MatchJSON(`{"description":"invalid parameter 'access': unknown access 'admin', expected read-write or read-only"}`))
+		})
+		It("binds brokers without parameters as before", func() {
+			plainBroker := &bindingServiceBroker.FakeBindingServiceBroker
+			response := bind(`{"service_id":"service-1"}`, plainBroker)
+			Expect(response.Code).To(Equal(201))
+			Expect(plainBroker.BindingId).To(Equal("binding-1"))
+		})
+	})
 })
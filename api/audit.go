@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// Implemented by service brokers that keep an audit log of their lifecycle operations
+type Auditor interface {
+	AuditLog() AuditLog
+}
+
+// An append-only record of broker lifecycle operations
+type AuditLog interface {
+	Record(entry AuditEntry) error
+	Query(query AuditQuery) ([]AuditEntry, error)
+}
+
+type (
+	AuditEntry struct {
+		Timestamp           time.Time              `json:"timestamp"`
+		Operation           string                 `json:"operation"`
+		InstanceId          string                 `json:"instance_id"`
+		BindingId           string                 `json:"binding_id,omitempty"`
+		RequestId           string                 `json:"request_id,omitempty"`
+		OriginatingIdentity *OriginatingIdentity   `json:"originating_identity,omitempty"`
+		Parameters          map[string]interface{} `json:"parameters,omitempty"`
+		Outcome             string                 `json:"outcome"`
+		Error               string                 `json:"error,omitempty"`
+		DurationMillis      float64                `json:"duration_ms"`
+	}
+
+	// Zero values match everything
+	AuditQuery struct {
+		InstanceId string
+		From       time.Time
+		To         time.Time
+	}
+
+	AuditResponse struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+)
+
+func (query AuditQuery) Matches(entry AuditEntry) bool {
+	if query.InstanceId != "" && entry.InstanceId != query.InstanceId {
+		return false
+	}
+	if !query.From.IsZero() && entry.Timestamp.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && entry.Timestamp.After(query.To) {
+		return false
+	}
+	return true
+}
+
+const redacted = "[REDACTED]"
+
+var secretParameter = regexp.MustCompile(`(?i)pass|secret|token|credential|key`)
+
+// Returns a copy of the parameters with the values of anything that looks like a secret replaced
+func RedactParameters(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+
+	redactedParams := map[string]interface{}{}
+	for name, value := range params {
+		switch {
+		case secretParameter.MatchString(name):
+			redactedParams[name] = redacted
+		default:
+			redactedParams[name] = redactValue(value)
+		}
+	}
+	return redactedParams
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return RedactParameters(v)
+	case []interface{}:
+		values := []interface{}{}
+		for _, element := range v {
+			values = append(values, redactValue(element))
+		}
+		return values
+	default:
+		return value
+	}
+}
+
+// Records the outcome of an operation in the broker's audit log, if it keeps one.
+// Failing to audit is logged but does not fail the operation.
+func RecordAudit(serviceBroker ServiceBroker, ctx context.Context, logger lager.Logger, entry AuditEntry, started time.Time, err error) {
+	auditor, ok := serviceBroker.(Auditor)
+	if !ok {
+		return
+	}
+
+	entry.Timestamp = started.UTC()
+	entry.RequestId = RequestIdFromContext(ctx)
+	entry.OriginatingIdentity = OriginatingIdentityFromContext(ctx)
+	entry.Parameters = RedactParameters(entry.Parameters)
+	entry.Outcome = operationOutcome(err)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	entry.DurationMillis = float64(time.Since(started)) / float64(time.Millisecond)
+
+	if auditErr := auditor.AuditLog().Record(entry); auditErr != nil {
+		logger.Error("audit-failed", auditErr, lager.Data{"operation": entry.Operation})
+	}
+}
+
+func parseAuditQuery(req *http.Request) (AuditQuery, error) {
+	values := req.URL.Query()
+	query := AuditQuery{
+		InstanceId: values.Get("instance_id"),
+	}
+
+	for name, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if values.Get(name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, values.Get(name))
+		if err != nil {
+			return AuditQuery{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+		}
+		*t = parsed
+	}
+
+	return query, nil
+}
+
+func stringParameters(params map[string]string) map[string]interface{} {
+	converted := map[string]interface{}{}
+	for name, value := range params {
+		converted[name] = value
+	}
+	return converted
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Implemented by service brokers that can move their whole state to another machine
+type StateArchiver interface {
+	// Writes every instance, binding, rendered config and template to a tar.gz archive
+	Backup(w io.Writer) error
+
+	// Recreates the instances in an archive written by Backup and starts their agents
+	Restore(ctx context.Context, r io.Reader) (RestoreReport, error)
+}
+
+type RestoreReport struct {
+	Instances []string `json:"instances"`
+	Bindings  int      `json:"bindings"`
+	// Templates written because the broker did not have them yet
+	Templates []string `json:"templates"`
+	// Agents that were restored but failed to start, by instance id
+	StartFailures map[string]string `json:"start_failures,omitempty"`
+}
+
+// 400 HTTP status code should be returned when an archive cannot be restored as it is.
+type InvalidArchiveError struct {
+	Reason string
+}
+
+func (err *InvalidArchiveError) Error() string {
+	return "invalid archive: " + err.Reason
+}
+
+// 409 HTTP status code should be returned when an archive holds instances or ports the broker already uses.
+type RestoreConflictError struct {
+	Conflicts []string
+}
+
+func (err *RestoreConflictError) Error() string {
+	return fmt.Sprintf("archive conflicts with existing instances: %s", strings.Join(err.Conflicts, "; "))
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const APIVersionHeader = "X-Broker-API-Version"
+
+// Rejects requests with 412 Precondition Failed when their X-Broker-API-Version
+// is missing or older than LOGSEARCH_BROKER_MIN_API_VERSION. Nothing is
+// enforced while no minimum is configured.
+func HandleAPIVersionCheck() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		minimum := os.Getenv("LOGSEARCH_BROKER_MIN_API_VERSION")
+		if minimum == "" {
+			return
+		}
+
+		version := req.Header.Get(APIVersionHeader)
+		if !versionAtLeast(version, minimum) {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(res).Encode(map[string]string{
+				"description": fmt.Sprintf("%s %q is not supported, the minimum is %s", APIVersionHeader, version, minimum),
+			})
+		}
+	}
+}
+
+func versionAtLeast(version string, minimum string) bool {
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	minMajor, minMinor, ok := parseVersion(minimum)
+	if !ok {
+		return false
+	}
+
+	if major != minMajor {
+		return major > minMajor
+	}
+	return minor >= minMinor
+}
+
+func parseVersion(version string) (int, int, bool) {
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"encoding/base64"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -11,9 +10,25 @@ import (
 func HandleAuthCheck() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		authHeader := parseAuthzHeader(req)
-		log.Printf("HTTP AUTH HEADER: %s", authHeader)
-		authEnvString := createAuthzStringFromEnv()
-		log.Printf("ENV AUTH HEADER: %s", authEnvString)
+		authEnvString := createAuthzStringFromEnv("LOGSEARCH_BROKER_USERNAME", "LOGSEARCH_BROKER_PASSWORD")
+		if authHeader != authEnvString {
+			http.Error(res, "Not Authorized", http.StatusUnauthorized)
+		}
+	}
+}
+
+// Checks requests against the operator credentials, which are kept apart from
+// the broker credentials given to the Cloud Controller. The admin API refuses
+// every request until both are set.
+func HandleAdminAuthCheck() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if os.Getenv("LOGSEARCH_ADMIN_USERNAME") == "" || os.Getenv("LOGSEARCH_ADMIN_PASSWORD") == "" {
+			http.Error(res, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+
+		authHeader := parseAuthzHeader(req)
+		authEnvString := createAuthzStringFromEnv("LOGSEARCH_ADMIN_USERNAME", "LOGSEARCH_ADMIN_PASSWORD")
 		if authHeader != authEnvString {
 			http.Error(res, "Not Authorized", http.StatusUnauthorized)
 		}
@@ -22,7 +37,6 @@ func HandleAuthCheck() http.HandlerFunc {
 
 func parseAuthzHeader(req *http.Request) string {
 	authzHeader := req.Header.Get("Authorization")
-	log.Printf("FULL HTTP AUTHZ HEADER: %s", authzHeader)
 
 	parts := strings.Split(authzHeader, " ")
 
@@ -37,10 +51,9 @@ func parseAuthzHeader(req *http.Request) string {
 	return "basic " + parts[1]
 }
 
-func createAuthzStringFromEnv() string {
-	username := os.Getenv("LOGSEARCH_BROKER_USERNAME")
-	password := os.Getenv("LOGSEARCH_BROKER_PASSWORD")
-	log.Printf("username: %s, password: %s", username, password)
+func createAuthzStringFromEnv(usernameVar string, passwordVar string) string {
+	username := os.Getenv(usernameVar)
+	password := os.Getenv(passwordVar)
 	data := []byte(username + ":" + password)
 	return "basic " + base64.StdEncoding.EncodeToString(data)
 }
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounter(
+		"logsearch_broker_http_requests_total",
+		"HTTP requests served by the broker, by route and status.",
+		"method", "route", "status",
+	)
+	requestDuration = metrics.NewHistogram(
+		"logsearch_broker_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route and status.",
+		metrics.DefBuckets,
+		"method", "route", "status",
+	)
+)
+
+func init() {
+	metrics.MustRegister(requestsTotal, requestDuration)
+}
+
+var routeType = reflect.TypeOf((*martini.Route)(nil)).Elem()
+
+// Counts and times every request by the route pattern it matched, so that
+// instance ids do not end up in label values.
+func HandleMetrics() martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+		c.Next()
+
+		route := "unmatched"
+		if matched := c.Get(routeType); matched.IsValid() {
+			route = matched.Interface().(martini.Route).Pattern()
+		}
+
+		status := http.StatusOK
+		if rw, ok := res.(martini.ResponseWriter); ok && rw.Status() != 0 {
+			status = rw.Status()
+		}
+
+		requestsTotal.Inc(req.Method, route, strconv.Itoa(status))
+		requestDuration.Observe(time.Since(started).Seconds(), req.Method, route, strconv.Itoa(status))
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Instance and binding ids name the directories and files of what they identify, so that "." or ".." cannot lead
+// outside of them
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Whether id may name an instance or a binding: letters, digits, '-' and '_' only, as in GUIDs
+func ValidId(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// Refuses the instance and binding ids of a route that are not valid ids with a 400
+func handleIds() martini.Handler {
+	return func(params martini.Params, r render.Render) {
+		for _, name := range []string{"instance_id", "binding_id"} {
+			if id, ok := params[name]; ok && !ValidId(id) {
+				r.JSON(400, ErrorResponse{
+					Description: fmt.Sprintf("%s '%s' may only hold letters, digits, '-' and '_'", name, id),
+				})
+				return
+			}
+		}
+	}
+}
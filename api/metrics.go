@@ -0,0 +1,49 @@
+package api
+
+import (
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+)
+
+var brokerOperations = metrics.NewCounter(
+	"logsearch_broker_operations_total",
+	"Service broker operations, by operation and outcome.",
+	"operation", "outcome",
+)
+
+func init() {
+	metrics.MustRegister(brokerOperations)
+}
+
+func recordOperation(operation string, err error) {
+	brokerOperations.Inc(operation, operationOutcome(err))
+}
+
+func operationOutcome(err error) string {
+	switch err.(type) {
+	case *QuotaExceededError:
+		return "quota-exceeded"
+	case *InvalidArchiveError:
+		return "invalid-archive"
+	case *RestoreConflictError:
+		return "restore-conflict"
+	case *InvalidParameterError:
+		return "invalid-parameter"
+	}
+
+	switch err {
+	case nil:
+		return "success"
+	case ServiceInstanceAlreadyExistsError:
+		return "instance-already-exists"
+	case ServiceInstanceLimitReachedError:
+		return "instance-limit-reached"
+	case ServiceInstanceDoesNotExistsError:
+		return "instance-missing"
+	case ServiceInstanceBindingAlreadyExistsError:
+		return "binding-already-exists"
+	case ServiceInstanceBindingDoesNotExistsError:
+		return "binding-missing"
+	default:
+		return "unknown-error"
+	}
+}
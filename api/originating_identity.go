@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// The platform user on whose behalf the platform called the broker
+type OriginatingIdentity struct {
+	Platform string `json:"platform"`
+	UserId   string `json:"user_id"`
+}
+
+// Parses an X-Broker-API-Originating-Identity header, which holds the platform
+// name followed by a base64 encoded JSON object identifying the user.
+func ParseOriginatingIdentity(header string) (OriginatingIdentity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return OriginatingIdentity{}, errors.New("originating identity must be a platform and a base64 encoded value")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return OriginatingIdentity{}, errors.New("originating identity value is not valid base64")
+	}
+
+	var value struct {
+		UserId   string `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(decoded, &value); err != nil {
+		return OriginatingIdentity{}, errors.New("originating identity value is not a JSON object")
+	}
+
+	identity := OriginatingIdentity{
+		Platform: parts[0],
+		UserId:   value.UserId,
+	}
+	if identity.UserId == "" {
+		identity.UserId = value.Username
+	}
+
+	return identity, nil
+}
+
+// Returns a copy of the context carrying the identity of the user who made the request
+func WithOriginatingIdentity(ctx context.Context, identity OriginatingIdentity) context.Context {
+	return context.WithValue(ctx, originatingIdentityKey, identity)
+}
+
+// Returns the identity of the user who made the request, or nil if the platform did not send one
+func OriginatingIdentityFromContext(ctx context.Context) *OriginatingIdentity {
+	identity, ok := ctx.Value(originatingIdentityKey).(OriginatingIdentity)
+	if !ok {
+		return nil
+	}
+	return &identity
+}
+
+// Adds the originating identity, when the platform sends one, to the request context
+func handleOriginatingIdentity() martini.Handler {
+	return func(c martini.Context, ctx context.Context, req *http.Request, r render.Render) {
+		header := req.Header.Get(OriginatingIdentityHeader)
+		if header == "" {
+			return
+		}
+
+		identity, err := ParseOriginatingIdentity(header)
+		if err != nil {
+			r.JSON(400, ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		c.MapTo(WithOriginatingIdentity(ctx, identity), (*context.Context)(nil))
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"fmt"
+)
+
+// Implemented by service brokers offering a choice of pipelines when provisioning
+type PipelineLister interface {
+	ListPipelines() ([]PipelineDetails, error)
+}
+
+type (
+	PipelineInputDetails struct {
+		Protocol string `json:"protocol"`
+		Format   string `json:"format"`
+	}
+
+	PipelineDetails struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Default     bool                   `json:"default"`
+		Inputs      []PipelineInputDetails `json:"inputs"`
+		// Whether instances also take syslog over TLS when the broker issues certificates
+		TLS bool `json:"tls"`
+	}
+
+	PipelinesResponse struct {
+		Pipelines []PipelineDetails `json:"pipelines"`
+	}
+)
+
+// 400 HTTP status code should be returned when a provision parameter is not acceptable.
+type InvalidParameterError struct {
+	Name   string
+	Reason string
+}
+
+func (err *InvalidParameterError) Error() string {
+	return fmt.Sprintf("invalid parameter '%s': %s", err.Name, err.Reason)
+}
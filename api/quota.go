@@ -0,0 +1,46 @@
+package api
+
+import (
+	"fmt"
+)
+
+// Implemented by service brokers that limit how many instances an org, space or plan may have
+type QuotaReporter interface {
+	QuotaUsage() ([]QuotaUsage, error)
+}
+
+// Quota kinds
+const (
+	QuotaGlobal = "global"
+	QuotaOrg    = "org"
+	QuotaSpace  = "space"
+	QuotaPlan   = "plan"
+)
+
+type (
+	// How many instances count against a quota. Scope is the org, space or plan guid the quota applies to.
+	QuotaUsage struct {
+		Quota string `json:"quota"`
+		Scope string `json:"scope,omitempty"`
+		Used  int    `json:"used"`
+		Limit int    `json:"limit"`
+	}
+
+	QuotasResponse struct {
+		Quotas []QuotaUsage `json:"quotas"`
+	}
+)
+
+// 403 HTTP status code should be returned when provisioning would take an org, space or plan past its quota.
+type QuotaExceededError struct {
+	Quota string
+	Scope string
+	Limit int
+}
+
+func (err *QuotaExceededError) Error() string {
+	if err.Scope == "" {
+		return fmt.Sprintf("the %s quota of %d instances has been reached", err.Quota, err.Limit)
+	}
+	return fmt.Sprintf("the %s quota of %d instances for %s %s has been reached", err.Quota, err.Limit, err.Quota, err.Scope)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/pivotal-golang/lager"
+)
+
+// Headers a request id is taken from, in order of preference
+var RequestIdHeaders = []string{
+	"X-Broker-Api-Request-Identity",
+	"X-Request-Id",
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIdKey
+	originatingIdentityKey
+)
+
+// Returns a copy of the context carrying the given logger
+func WithLogger(ctx context.Context, logger lager.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// Returns the logger carried by the context, or the fallback if there is none
+func LoggerFromContext(ctx context.Context, fallback lager.Logger) lager.Logger {
+	if logger, ok := ctx.Value(loggerKey).(lager.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// Returns a copy of the context carrying the given request id
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey, requestId)
+}
+
+// Returns the id of the request the context belongs to, or an empty string if there is none
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey).(string)
+	return requestId
+}
+
+// Tags every request with an id and a logger session carrying it. Both are
+// mapped for route handlers and the request ends with a single access log line.
+func handleRequestContext(logger lager.Logger) martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+
+		requestId := requestIdFromHeaders(req)
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+		res.Header().Set("X-Request-Id", requestId)
+
+		session := logger.Session("request", lager.Data{
+			"request-id": requestId,
+		})
+		ctx := WithRequestId(WithLogger(req.Context(), session), requestId)
+
+		c.MapTo(session, (*lager.Logger)(nil))
+		c.MapTo(ctx, (*context.Context)(nil))
+		c.Next()
+
+		status := http.StatusOK
+		if rw, ok := res.(martini.ResponseWriter); ok && rw.Status() != 0 {
+			status = rw.Status()
+		}
+
+		session.Info("completed", lager.Data{
+			"method":      req.Method,
+			"path":        req.URL.Path,
+			"status":      status,
+			"remote-addr": req.RemoteAddr,
+			"duration-ms": float64(time.Since(started)) / float64(time.Millisecond),
+		})
+	}
+}
+
+func requestIdFromHeaders(req *http.Request) string {
+	for _, header := range RequestIdHeaders {
+		if requestId := req.Header.Get(header); requestId != "" {
+			return requestId
+		}
+	}
+	return ""
+}
+
+// Generates a random (version 4) UUID
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,149 @@
+// Package audit persists the broker's audit log as JSON lines in size rotated files.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+)
+
+const fileName = "audit.log"
+
+// FileLog implements the api.AuditLog interface.
+//
+// Entries are appended to audit.log in the log directory. When a write would
+// take the file past MaxFileSize it is rotated to audit.log.1, the previous
+// audit.log.1 to audit.log.2 and so on, keeping at most MaxFiles files.
+type FileLog struct {
+	Directory   string
+	MaxFileSize int64
+	MaxFiles    int
+
+	mutex sync.Mutex
+}
+
+func NewFileLog(directory string, maxFileSize int64, maxFiles int) (*FileLog, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+
+	return &FileLog{
+		Directory:   directory,
+		MaxFileSize: maxFileSize,
+		MaxFiles:    maxFiles,
+	}, nil
+}
+
+func (auditLog *FileLog) Record(entry api.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	if err := auditLog.rotateIfFull(int64(len(line))); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(auditLog.filePath(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Query returns the matching entries, oldest first.
+func (auditLog *FileLog) Query(query api.AuditQuery) ([]api.AuditEntry, error) {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	entries := []api.AuditEntry{}
+	for i := auditLog.MaxFiles - 1; i >= 0; i-- {
+		matching, err := readEntries(auditLog.filePath(i), query)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, matching...)
+	}
+
+	return entries, nil
+}
+
+func (auditLog *FileLog) rotateIfFull(incoming int64) error {
+	info, err := os.Stat(auditLog.filePath(0))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if auditLog.MaxFileSize <= 0 || info.Size()+incoming <= auditLog.MaxFileSize {
+		return nil
+	}
+
+	if auditLog.MaxFiles <= 1 {
+		return os.Remove(auditLog.filePath(0))
+	}
+
+	if err := os.Remove(auditLog.filePath(auditLog.MaxFiles - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := auditLog.MaxFiles - 2; i >= 0; i-- {
+		err := os.Rename(auditLog.filePath(i), auditLog.filePath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (auditLog *FileLog) filePath(generation int) string {
+	if generation == 0 {
+		return path.Join(auditLog.Directory, fileName)
+	}
+	return path.Join(auditLog.Directory, fmt.Sprintf("%s.%d", fileName, generation))
+}
+
+func readEntries(filePath string, query api.AuditQuery) ([]api.AuditEntry, error) {
+	entries := []api.AuditEntry{}
+
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry api.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn final line from a crash mid-write is skipped rather than hiding everything after it
+			continue
+		}
+		if query.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
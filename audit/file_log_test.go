@@ -0,0 +1,116 @@
+package audit_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/audit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileLog", func() {
+	var tmpDir string
+	var auditLog *audit.FileLog
+	var monday, tuesday, wednesday time.Time
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "audit")
+		Ω(err).ToNot(HaveOccurred())
+
+		auditLog, err = audit.NewFileLog(path.Join(tmpDir, "audit"), 0, 3)
+		Ω(err).ToNot(HaveOccurred())
+
+		monday = time.Date(2014, 9, 1, 12, 0, 0, 0, time.UTC)
+		tuesday = monday.Add(24 * time.Hour)
+		wednesday = tuesday.Add(24 * time.Hour)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	record := func(timestamp time.Time, operation string, instanceId string) {
+		Ω(auditLog.Record(api.AuditEntry{
+			Timestamp:  timestamp,
+			Operation:  operation,
+			InstanceId: instanceId,
+			Outcome:    "success",
+		})).To(Succeed())
+	}
+
+	operations := func(entries []api.AuditEntry) []string {
+		ops := []string{}
+		for _, entry := range entries {
+			ops = append(ops, entry.Operation+" "+entry.InstanceId)
+		}
+		return ops
+	}
+
+	Context("querying", func() {
+		BeforeEach(func() {
+			record(monday, "provision", "instance-1")
+			record(tuesday, "provision", "instance-2")
+			record(wednesday, "deprovision", "instance-1")
+		})
+
+		It("returns every entry, oldest first, for an empty query", func() {
+			entries, err := auditLog.Query(api.AuditQuery{})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(operations(entries)).To(Equal([]string{"provision instance-1", "provision instance-2", "deprovision instance-1"}))
+		})
+
+		It("filters by instance id", func() {
+			entries, err := auditLog.Query(api.AuditQuery{InstanceId: "instance-1"})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(operations(entries)).To(Equal([]string{"provision instance-1", "deprovision instance-1"}))
+		})
+
+		It("filters by time range", func() {
+			entries, err := auditLog.Query(api.AuditQuery{From: tuesday, To: tuesday})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(operations(entries)).To(Equal([]string{"provision instance-2"}))
+		})
+
+		It("skips lines torn by a crash", func() {
+			f, err := os.OpenFile(path.Join(tmpDir, "audit", "audit.log"), os.O_WRONLY|os.O_APPEND, 0600)
+			Ω(err).ToNot(HaveOccurred())
+			f.WriteString(`{"timestamp":"2014-09-0`)
+			f.Close()
+
+			entries, err := auditLog.Query(api.AuditQuery{})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(entries).To(HaveLen(3))
+		})
+	})
+
+	Context("rotation", func() {
+		BeforeEach(func() {
+			auditLog.MaxFileSize = 150
+			for i := 0; i < 10; i++ {
+				record(monday.Add(time.Duration(i)*time.Hour), "bind", "instance-1")
+			}
+		})
+
+		It("keeps at most the configured number of files", func() {
+			files, err := ioutil.ReadDir(path.Join(tmpDir, "audit"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(files).To(HaveLen(3))
+			for _, file := range files {
+				Ω(file.Size()).To(BeNumerically("<=", 150))
+			}
+		})
+
+		It("drops the oldest entries", func() {
+			entries, err := auditLog.Query(api.AuditQuery{})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(len(entries)).To(BeNumerically("<", 10))
+			Ω(entries[len(entries)-1].Timestamp).To(Equal(monday.Add(9 * time.Hour)))
+		})
+	})
+})
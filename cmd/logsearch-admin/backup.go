@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+var errAgentsNotStarted = errors.New("some restored agents did not start")
+
+// Writes every instance to an archive, atomically so that a failed backup never replaces a good one
+func (c *cli) backup(args []string) error {
+	logger := c.logger.Session("cli-backup")
+	ctx := api.WithLogger(context.Background(), logger)
+
+	started := time.Now()
+	err := c.writeBackup(args[0])
+	api.RecordAudit(c.broker, ctx, logger, api.AuditEntry{
+		Operation:  "cli-backup",
+		Parameters: map[string]interface{}{"file": args[0]},
+	}, started, err)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "-" {
+		return nil
+	}
+	if c.json {
+		return c.printJSON(map[string]string{"file": args[0], "operation": "cli-backup", "outcome": "success"})
+	}
+	_, err = fmt.Fprintf(c.out, "%s: ok\n", args[0])
+	return err
+}
+
+func (c *cli) writeBackup(file string) error {
+	if file == "-" {
+		return c.broker.Backup(c.out)
+	}
+
+	var archive bytes.Buffer
+	if err := c.broker.Backup(&archive); err != nil {
+		return err
+	}
+	return system.AtomicFileWriter{}.WriteFile(file, archive.Bytes(), 0600)
+}
+
+func (c *cli) restore(args []string) error {
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	logger := c.logger.Session("cli-restore")
+	ctx := api.WithLogger(context.Background(), logger)
+
+	started := time.Now()
+	report, err := c.broker.Restore(ctx, in)
+	api.RecordAudit(c.broker, ctx, logger, api.AuditEntry{
+		Operation:  "cli-restore",
+		Parameters: map[string]interface{}{"file": args[0], "instances": report.Instances},
+	}, started, err)
+	if err != nil {
+		return err
+	}
+
+	if err := c.printRestoreReport(report); err != nil {
+		return err
+	}
+	if len(report.StartFailures) > 0 {
+		return errAgentsNotStarted
+	}
+	return nil
+}
+
+func (c *cli) printRestoreReport(report api.RestoreReport) error {
+	if c.json {
+		return c.printJSON(report)
+	}
+
+	fmt.Fprintf(c.out, "restored %d instances with %d bindings\n", len(report.Instances), report.Bindings)
+	for _, template := range report.Templates {
+		fmt.Fprintf(c.out, "wrote template %s\n", template)
+	}
+	failed := []string{}
+	for id := range report.StartFailures {
+		failed = append(failed, id)
+	}
+	sort.Strings(failed)
+	for _, id := range failed {
+		if _, err := fmt.Fprintf(c.out, "%s: not started: %s\n", id, report.StartFailures[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
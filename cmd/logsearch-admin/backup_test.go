@@ -0,0 +1,77 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("backup and restore", func() {
+	var tmpDir string
+	var configFile string
+	var archive string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logsearch-admin-backup")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(os.Mkdir(path.Join(tmpDir, "source"), 0755)).To(Succeed())
+		Ω(os.Mkdir(path.Join(tmpDir, "target"), 0755)).To(Succeed())
+		configFile = writeConfig(path.Join(tmpDir, "source"))
+		archive = path.Join(tmpDir, "backup.tar.gz")
+
+		provision(configFile, "instance-1", "instance-2")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("writes every instance to an archive only the owner can read", func() {
+		session := runAdmin("-config", configFile, "backup", archive)
+		Ω(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).To(Say("backup.tar.gz: ok"))
+
+		info, err := os.Stat(archive)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("restores the instances of an archive, exiting with 1 when their agents do not start", func() {
+		Ω(runAdmin("-config", configFile, "backup", archive).ExitCode()).To(Equal(0))
+		target := writeConfig(path.Join(tmpDir, "target"))
+		provision(target)
+
+		session := runAdmin("-config", target, "-json", "restore", archive)
+		Ω(session.ExitCode()).To(Equal(1))
+		var report api.RestoreReport
+		Ω(json.Unmarshal(session.Out.Contents(), &report)).To(Succeed())
+		Ω(report.Instances).To(Equal([]string{"instance-1", "instance-2"}))
+		Ω(report.StartFailures).To(HaveKey("instance-1"))
+		Ω(session.Err).To(Say("some restored agents did not start"))
+
+		Ω(runAdmin("-config", target, "show", "instance-2").ExitCode()).To(Equal(0))
+	})
+
+	It("refuses to restore instances the broker already has", func() {
+		Ω(runAdmin("-config", configFile, "backup", archive).ExitCode()).To(Equal(0))
+
+		session := runAdmin("-config", configFile, "restore", archive)
+		Ω(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).To(Say("instance-1"))
+	})
+
+	It("exits with 1 for an archive that cannot be read", func() {
+		Ω(ioutil.WriteFile(archive, []byte("not an archive"), 0600)).To(Succeed())
+
+		Ω(runAdmin("-config", configFile, "restore", archive).ExitCode()).To(Equal(1))
+		Ω(runAdmin("-config", configFile, "restore", path.Join(tmpDir, "missing.tar.gz")).ExitCode()).To(Equal(1))
+	})
+})
@@ -0,0 +1,66 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+var adminPath string
+
+func TestLogsearchAdmin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Logsearch Admin Suite")
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	adminPath, err = gexec.Build("github.com/malston/cf-logsearch-service-broker/cmd/logsearch-admin")
+	Ω(err).ToNot(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+})
+
+// A broker config keeping everything under dir, with the yaml lines of extra appended
+func writeConfig(dir string, extra ...string) string {
+	templates, err := filepath.Abs("../../logsearch/logstash/assets")
+	Ω(err).ToNot(HaveOccurred())
+
+	config := fmt.Sprintf(`---
+logstash:
+  host: "127.0.0.1"
+  conf_path: %q
+  data_directory: %q
+  log_directory: %q
+  service_instance_limit: 10
+  default_pipeline: "syslog-5424"
+%s
+`, templates, path.Join(dir, "data"), path.Join(dir, "logs"), strings.Join(extra, "\n"))
+
+	file := path.Join(dir, "config.yml")
+	Ω(ioutil.WriteFile(file, []byte(config), 0644)).To(Succeed())
+	return file
+}
+
+// Runs logsearch-admin to completion. PATH is emptied so that no logstash agent can be started.
+func runAdmin(args ...string) *gexec.Session {
+	command := exec.Command(adminPath, args...)
+	command.Env = append(os.Environ(), "PATH=")
+	session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+	Ω(err).ToNot(HaveOccurred())
+	Eventually(session, "10s").Should(gexec.Exit())
+	return session
+}
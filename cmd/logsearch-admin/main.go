@@ -0,0 +1,255 @@
+// Command logsearch-admin repairs broker state directly on disk, for when the broker itself is down.
+//
+//	logsearch-admin [-config path] [-json] <command> [instance-id | file]
+//
+// Commands are list, show, start, stop, rm, render-config, verify, fsck, backup, restore and retention.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+)
+
+type broker interface {
+	api.ServiceBroker
+	api.InstanceAdministrator
+	api.StateArchiver
+	StartInstance(ctx context.Context, instanceId string) error
+	StopInstance(ctx context.Context, instanceId string) error
+	RenderInstanceConfig(instanceId string) error
+	ApplyRetention(ctx context.Context, dryRun bool) ([]elasticsearch.RetentionResult, error)
+}
+
+type command struct {
+	// takes an instance id or a file
+	needsArg bool
+	hasFlags bool
+	// works from the configuration alone, without the broker, whose construction creates the audit log, the
+	// repository and the authority when they are missing
+	configOnly bool
+	run        func(cli *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"list":          {false, false, false, (*cli).list},
+	"show":          {true, false, false, (*cli).show},
+	"start":         {true, false, false, (*cli).start},
+	"stop":          {true, false, false, (*cli).stop},
+	"rm":            {true, false, false, (*cli).rm},
+	"render-config": {true, false, false, (*cli).renderConfig},
+	"verify":        {false, false, true, (*cli).verify},
+	"fsck":          {false, true, true, (*cli).fsck},
+	"backup":        {true, false, false, (*cli).backup},
+	"restore":       {true, false, false, (*cli).restore},
+	"retention":     {false, true, false, (*cli).retention},
+}
+
+type cli struct {
+	config logstash.ServiceConfiguration
+	broker broker
+	logger lager.Logger
+	json   bool
+	out    io.Writer
+}
+
+func main() {
+	configPath := flag.String("config", logstash.ConfigPath(), "path to the broker YAML configuration")
+	jsonOutput := flag.Bool("json", false, "print JSON instead of text")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok || (cmd.needsArg && flag.NArg() != 2) || (!cmd.needsArg && !cmd.hasFlags && flag.NArg() != 1) {
+		usage()
+		os.Exit(2)
+	}
+
+	logger := lager.NewLogger("logsearch-admin")
+	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
+
+	config, err := logstash.ParseConfig(*configPath)
+	if err != nil {
+		fail(fmt.Errorf("loading %s: %s", *configPath, err))
+	}
+
+	c := &cli{
+		config: config.ServiceConfiguration,
+		logger: logger,
+		json:   *jsonOutput,
+		out:    os.Stdout,
+	}
+	if !cmd.configOnly {
+		serviceBroker, err := logstash.NewServiceBrokerFromConfig(config.ServiceConfiguration, logger)
+		if err != nil {
+			fail(err)
+		}
+		// retention covers the instances of the elasticsearch service as the broker does
+		if config.ServiceConfiguration.Elasticsearch.OfferService {
+			serviceBroker.RetentionSources = []elasticsearch.RetentionSource{
+				elasticsearch.NewServiceBroker(config.ServiceConfiguration.Elasticsearch, logger),
+			}
+		}
+		c.broker = serviceBroker
+	}
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fail(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: logsearch-admin [-config path] [-json] <command> [instance-id | file]
+
+commands:
+  list                        list every instance with its process state
+  show <instance-id>          show an instance with its bindings
+  start <instance-id>         start the agent of an instance
+  stop <instance-id>          stop the agent of an instance
+  rm <instance-id>            stop the agent and remove the instance
+  render-config <instance-id> rewrite logstash.conf from the template
+  verify                      check the configuration and every instance
+  fsck [-repair]              classify every instance directory, optionally repairing them
+  backup <file>               write every instance to a tar.gz archive, - for stdout
+  restore <file>              recreate and start the instances of an archive, - for stdin
+  retention [-dry-run]        delete the indices older than the retention of their instances
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "logsearch-admin: %s\n", err)
+	os.Exit(1)
+}
+
+func (c *cli) list([]string) error {
+	instances, err := c.broker.ListInstances(api.InstanceFilter{})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(api.InstancesResponse{Instances: instances})
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tSTATE\tPID\tORG\tSPACE\tPLAN")
+	for _, instance := range instances {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			instance.Id, instance.Address, instance.Process.State, pid(instance.Process),
+			instance.OrganizationGuid, instance.SpaceGuid, instance.PlanId)
+	}
+	return w.Flush()
+}
+
+func (c *cli) show(args []string) error {
+	instanceId := args[0]
+	instance, err := c.broker.GetInstance(instanceId)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(instance)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", instance.Id)
+	fmt.Fprintf(w, "address:\t%s\n", instance.Address)
+	fmt.Fprintf(w, "state:\t%s\n", instance.Process.State)
+	fmt.Fprintf(w, "pid:\t%s\n", pid(instance.Process))
+	fmt.Fprintf(w, "service:\t%s\n", instance.ServiceId)
+	fmt.Fprintf(w, "plan:\t%s\n", instance.PlanId)
+	if instance.Pipeline != "" {
+		fmt.Fprintf(w, "pipeline:\t%s\n", instance.Pipeline)
+	}
+	fmt.Fprintf(w, "org:\t%s\n", instance.OrganizationGuid)
+	fmt.Fprintf(w, "space:\t%s\n", instance.SpaceGuid)
+	fmt.Fprintf(w, "created at:\t%s\n", formatTime(instance.CreatedAt))
+	if instance.CreatedBy != nil {
+		fmt.Fprintf(w, "created by:\t%s/%s\n", instance.CreatedBy.Platform, instance.CreatedBy.UserId)
+	}
+	if instance.Filters != "" {
+		fmt.Fprintf(w, "filters:\t%d lines\n", len(strings.Split(strings.TrimSpace(instance.Filters), "\n")))
+	}
+	fmt.Fprintf(w, "bindings:\t%d\n", len(instance.Bindings))
+	for _, binding := range instance.Bindings {
+		fmt.Fprintf(w, "  %s\t%s\n", binding.Id, formatTime(binding.CreatedAt))
+	}
+	return w.Flush()
+}
+
+func (c *cli) start(args []string) error {
+	return c.act("cli-start", args[0], c.broker.StartInstance)
+}
+
+func (c *cli) stop(args []string) error {
+	return c.act("cli-stop", args[0], c.broker.StopInstance)
+}
+
+func (c *cli) rm(args []string) error {
+	return c.act("cli-force-delete", args[0], c.broker.ForceDeleteInstance)
+}
+
+func (c *cli) renderConfig(args []string) error {
+	return c.act("cli-render-config", args[0], func(_ context.Context, instanceId string) error {
+		return c.broker.RenderInstanceConfig(instanceId)
+	})
+}
+
+// Runs an action against an instance, records it in the audit log and reports the outcome
+func (c *cli) act(operation, instanceId string, action func(ctx context.Context, instanceId string) error) error {
+	logger := c.logger.Session(operation, lager.Data{"instance-id": instanceId})
+	ctx := api.WithLogger(context.Background(), logger)
+
+	started := time.Now()
+	err := action(ctx, instanceId)
+	api.RecordAudit(c.broker, ctx, logger, api.AuditEntry{
+		Operation:  operation,
+		InstanceId: instanceId,
+	}, started, err)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(map[string]string{"instance_id": instanceId, "operation": operation, "outcome": "success"})
+	}
+	_, err = fmt.Fprintf(c.out, "%s: ok\n", instanceId)
+	return err
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func pid(process api.ProcessDetails) string {
+	if process.Pid == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", process.Pid)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
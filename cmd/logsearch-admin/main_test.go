@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+// Starts no agents, so instances can be provisioned without logstash
+type fakeProcessStarter struct{}
+
+func (fakeProcessStarter) Start(lager.Logger, *logstash.Instance, time.Duration) error { return nil }
+func (fakeProcessStarter) Stop(lager.Logger, *logstash.Instance, time.Duration) error  { return nil }
+func (fakeProcessStarter) Status(*logstash.Instance) api.ProcessDetails {
+	return api.ProcessDetails{State: api.ProcessStopped}
+}
+
+// Provisions instances the way the broker would, into the state of the config at configFile
+func provision(configFile string, instanceIds ...string) {
+	config, err := logstash.ParseConfig(configFile)
+	Ω(err).ToNot(HaveOccurred())
+	Ω(logstash.CreateDirectories(config.ServiceConfiguration)).To(Succeed())
+
+	broker, err := logstash.NewServiceBrokerFromConfig(config.ServiceConfiguration, lagertest.NewTestLogger("provision"))
+	Ω(err).ToNot(HaveOccurred())
+	broker.ProcessStarter = fakeProcessStarter{}
+	for _, instanceId := range instanceIds {
+		_, err := broker.Provision(context.Background(), instanceId, map[string]string{})
+		Ω(err).ToNot(HaveOccurred())
+	}
+
+	// a bolt database stays locked until it is closed
+	if closer, ok := broker.InstanceRepository.(io.Closer); ok {
+		Ω(closer.Close()).To(Succeed())
+	}
+}
+
+var _ = Describe("logsearch-admin", func() {
+	var tmpDir string
+	var configFile string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logsearch-admin")
+		Ω(err).ToNot(HaveOccurred())
+		configFile = writeConfig(tmpDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("arguments", func() {
+		It("prints the usage and exits with 2 without a command", func() {
+			session := runAdmin("-config", configFile)
+			Ω(session.ExitCode()).To(Equal(2))
+			Ω(session.Err).To(Say("usage: logsearch-admin"))
+		})
+
+		It("exits with 2 for unknown commands and wrong numbers of arguments", func() {
+			for _, args := range [][]string{{"unknown"}, {"show"}, {"show", "a", "b"}, {"list", "extra"}, {"backup"}} {
+				Ω(runAdmin(append([]string{"-config", configFile}, args...)...).ExitCode()).To(Equal(2), "%v", args)
+			}
+		})
+
+		It("exits with 1 when the config cannot be loaded", func() {
+			session := runAdmin("-config", path.Join(tmpDir, "missing.yml"), "list")
+			Ω(session.ExitCode()).To(Equal(1))
+			Ω(session.Err).To(Say("logsearch-admin: loading .*missing.yml"))
+		})
+
+		It("passes the flags after a command to it", func() {
+			session := runAdmin("-config", configFile, "fsck", "-unknown")
+			Ω(session.ExitCode()).To(Equal(1))
+		})
+	})
+
+	Describe("list and show", func() {
+		BeforeEach(func() {
+			provision(configFile, "instance-1", "instance-2")
+		})
+
+		It("lists every instance", func() {
+			session := runAdmin("-config", configFile, "list")
+			Ω(session.ExitCode()).To(Equal(0))
+			Ω(session.Out).To(Say("ID +ADDRESS +STATE"))
+			Ω(session.Out).To(Say(`instance-1 +127\.0\.0\.1:\d+ +stopped`))
+			Ω(session.Out).To(Say("instance-2"))
+		})
+
+		It("shows an instance as JSON with -json", func() {
+			session := runAdmin("-config", configFile, "-json", "show", "instance-2")
+			Ω(session.ExitCode()).To(Equal(0))
+			var instance api.InstanceDetails
+			Ω(json.Unmarshal(session.Out.Contents(), &instance)).To(Succeed())
+			Ω(instance.Id).To(Equal("instance-2"))
+			Ω(instance.Pipeline).To(Equal("syslog-5424"))
+		})
+
+		It("exits with 1 for an unknown instance", func() {
+			session := runAdmin("-config", configFile, "show", "unknown")
+			Ω(session.ExitCode()).To(Equal(1))
+			Ω(session.Err).To(Say("logsearch-admin: "))
+		})
+	})
+})
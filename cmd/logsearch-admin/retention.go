@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+)
+
+var errRetentionFailed = errors.New("retention could not delete some indices")
+
+// Makes one retention pass now, as a dry run with -dry-run or when the config says so
+func (c *cli) retention(args []string) error {
+	flags := flag.NewFlagSet("retention", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the indices that would be deleted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !c.config.Elasticsearch.Enabled() {
+		return errors.New("retention needs elasticsearch hosts")
+	}
+
+	ctx := api.WithLogger(context.Background(), c.logger.Session("cli-retention"))
+	results, err := c.broker.ApplyRetention(ctx, *dryRun || c.config.Elasticsearch.Retention.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		err = c.printJSON(results)
+	} else {
+		w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PREFIX\tINSTANCES\tDAYS\tDELETED\tERROR")
+		for _, result := range results {
+			days := "-"
+			if result.Days > 0 {
+				days = fmt.Sprintf("%d", result.Days)
+			}
+			errorText := result.Error
+			if errorText == "" {
+				errorText = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.IndexPrefix, joinOrDash(result.InstanceIds), days, joinOrDash(result.Deleted), errorText)
+		}
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			return errRetentionFailed
+		}
+	}
+	return nil
+}
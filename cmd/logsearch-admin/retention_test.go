@@ -0,0 +1,113 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+// Lists and deletes the indices it holds, failing deletes while failDeletes is set
+type fakeIndices struct {
+	sync.Mutex
+	indices     []string
+	failDeletes bool
+}
+
+func (es *fakeIndices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.Lock()
+	defer es.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case "GET":
+		prefix := strings.TrimSuffix(strings.TrimPrefix(name, "_cat/indices/"), "*")
+		rows := []map[string]string{}
+		for _, index := range es.indices {
+			if strings.HasPrefix(index, prefix) {
+				rows = append(rows, map[string]string{"index": index})
+			}
+		}
+		json.NewEncoder(w).Encode(rows)
+	case "DELETE":
+		if es.failDeletes {
+			http.Error(w, `{"error":"unavailable"}`, http.StatusInternalServerError)
+			return
+		}
+		deleted := map[string]bool{}
+		for _, index := range strings.Split(name, ",") {
+			deleted[index] = true
+		}
+		kept := []string{}
+		for _, index := range es.indices {
+			if !deleted[index] {
+				kept = append(kept, index)
+			}
+		}
+		es.indices = kept
+		w.Write([]byte(`{"acknowledged":true}`))
+	}
+}
+
+var _ = Describe("retention", func() {
+	var tmpDir string
+	var configFile string
+	var es *fakeIndices
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logsearch-admin-retention")
+		Ω(err).ToNot(HaveOccurred())
+
+		es = &fakeIndices{indices: []string{"logsearch-instance-1-2015.01.01", "logsearch-instance-1-2099.01.01"}}
+		server = httptest.NewServer(es)
+		configFile = writeConfig(tmpDir, fmt.Sprintf(`elasticsearch:
+  hosts: [%q]
+  retention:
+    default_days: 7
+`, server.URL))
+		provision(configFile, "instance-1")
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("deletes the indices older than the retention of their instance", func() {
+		session := runAdmin("-config", configFile, "retention")
+		Ω(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).To(Say(`logsearch-instance-1 +instance-1 +7 +logsearch-instance-1-2015\.01\.01 +-`))
+		Ω(es.indices).To(Equal([]string{"logsearch-instance-1-2099.01.01"}))
+	})
+
+	It("only lists them with -dry-run", func() {
+		session := runAdmin("-config", configFile, "retention", "-dry-run")
+		Ω(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).To(Say(`logsearch-instance-1-2015\.01\.01`))
+		Ω(es.indices).To(HaveLen(2))
+	})
+
+	It("exits with 1 when indices could not be deleted", func() {
+		es.failDeletes = true
+
+		session := runAdmin("-config", configFile, "retention")
+		Ω(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).To(Say("retention could not delete some indices"))
+	})
+
+	It("exits with 1 without elasticsearch hosts", func() {
+		session := runAdmin("-config", writeConfig(tmpDir), "retention")
+		Ω(session.ExitCode()).To(Equal(1))
+		Ω(session.Err).To(Say("retention needs elasticsearch hosts"))
+	})
+})
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+)
+
+type verifyReport struct {
+	Config    []string                `json:"config"`
+	Instances []*logstash.EntryReport `json:"instances"`
+}
+
+var (
+	errVerifyFailed    = errors.New("verification found problems")
+	errFsckUnsupported = errors.New("fsck only repairs the filesystem repository; use verify to check a bolt repository")
+)
+
+// Checks the broker configuration and templates and classifies every instance directory, changing nothing.
+// Unlike list it carries on past instances that fail to load.
+func (c *cli) verify([]string) error {
+	report := verifyReport{Config: []string{}}
+	if err := logstash.CheckConfig(c.config); err != nil {
+		report.Config = append(report.Config, err.Error())
+	}
+	if err := logstash.CheckTemplates(c.config); err != nil {
+		report.Config = append(report.Config, err.Error())
+	}
+
+	instances, err := c.checkInstances()
+	if err != nil {
+		return err
+	}
+	report.Instances = instances
+
+	return c.printVerifyReport(report)
+}
+
+// The bolt repository keeps its records in transactions, so only what its instances need on disk is checked. Its
+// database is opened read-only, which still fails while a broker holds it.
+func (c *cli) checkInstances() ([]*logstash.EntryReport, error) {
+	checker := logstash.NewChecker(c.config)
+	if c.config.Repository == logstash.RepositoryFileSystem {
+		return checker.Check()
+	}
+
+	repository, err := logstash.NewReadOnlyBoltInstanceRepository(c.config)
+	if os.IsNotExist(err) {
+		return []*logstash.EntryReport{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer repository.Close()
+
+	instances, err := repository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	return checker.CheckInstances(instances), nil
+}
+
+// Classifies every instance directory and, with -repair, fixes what it can
+func (c *cli) fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "stop orphaned agents, quarantine corrupt directories and fix the rest")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if c.config.Repository != logstash.RepositoryFileSystem {
+		return errFsckUnsupported
+	}
+
+	checker := logstash.NewChecker(c.config)
+	instances, err := checker.Check()
+	if err != nil {
+		return err
+	}
+
+	if !*repair {
+		return c.printVerifyReport(verifyReport{Config: []string{}, Instances: instances})
+	}
+
+	repairErr := checker.Repair(c.logger.Session("fsck"), instances)
+	if err := c.printVerifyReport(verifyReport{Config: []string{}, Instances: instances}); err != nil && err != errVerifyFailed {
+		return err
+	}
+	if repairErr != nil {
+		return repairErr
+	}
+
+	// the exit status reflects what is left after the repair
+	remaining, err := checker.Check()
+	if err != nil {
+		return err
+	}
+	for _, instance := range remaining {
+		if !instance.Healthy() {
+			return errVerifyFailed
+		}
+	}
+	return nil
+}
+
+func (c *cli) printVerifyReport(report verifyReport) error {
+	var err error
+	if c.json {
+		err = c.printJSON(report)
+	} else {
+		err = c.printReport(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(report.Config) > 0 {
+		return errVerifyFailed
+	}
+	for _, instance := range report.Instances {
+		if !instance.Healthy() {
+			return errVerifyFailed
+		}
+	}
+	return nil
+}
+
+func (c *cli) printReport(report verifyReport) error {
+	for _, problem := range report.Config {
+		fmt.Fprintf(c.out, "config: %s\n", problem)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPROBLEMS\tREPAIRS")
+	for _, instance := range report.Instances {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", instance.Id, instance.Status, joinOrDash(instance.Problems), joinOrDash(instance.Repairs))
+	}
+	return w.Flush()
+}
+
+func joinOrDash(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ", ")
+}
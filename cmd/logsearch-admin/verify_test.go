@@ -0,0 +1,94 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("verify", func() {
+	var tmpDir string
+	var configFile string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logsearch-admin-verify")
+		Ω(err).ToNot(HaveOccurred())
+		configFile = writeConfig(tmpDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("exits with 0 when the config and every instance are healthy", func() {
+		provision(configFile, "instance-1")
+
+		session := runAdmin("-config", configFile, "verify")
+		Ω(session.ExitCode()).To(Equal(0))
+		Ω(session.Out).To(Say("instance-1 +healthy"))
+	})
+
+	It("exits with 1 and names the problems of broken instances", func() {
+		provision(configFile, "instance-1")
+		Ω(os.Remove(path.Join(tmpDir, "data", "instance-1", "logstash.conf"))).To(Succeed())
+
+		session := runAdmin("-config", configFile, "verify")
+		Ω(session.ExitCode()).To(Equal(1))
+		Ω(session.Out).To(Say("instance-1 +missing-config"))
+		Ω(session.Err).To(Say("verification found problems"))
+	})
+
+	Context("with the bolt repository", func() {
+		BeforeEach(func() {
+			configFile = writeConfig(tmpDir, `  repository: "bolt"`)
+		})
+
+		It("checks the instances of the database", func() {
+			provision(configFile, "instance-1", "instance-2")
+			Ω(os.Remove(path.Join(tmpDir, "data", "instance-2", "logstash.conf"))).To(Succeed())
+
+			session := runAdmin("-config", configFile, "verify")
+			Ω(session.ExitCode()).To(Equal(1))
+			Ω(session.Out).To(Say("instance-1 +healthy"))
+			Ω(session.Out).To(Say("instance-2 +missing-config"))
+		})
+
+		It("fails with a clear message while a broker holds the database", func() {
+			provision(configFile, "instance-1")
+			config, err := logstash.ParseConfig(configFile)
+			Ω(err).ToNot(HaveOccurred())
+			repository, err := logstash.NewBoltInstanceRepository(config.ServiceConfiguration)
+			Ω(err).ToNot(HaveOccurred())
+			defer repository.Close()
+
+			for _, command := range []string{"verify", "list"} {
+				session := runAdmin("-config", configFile, command)
+				Ω(session.ExitCode()).To(Equal(1), command)
+				Ω(session.Err).To(Say("logstash-instances.db is locked by another process, e.g. a running broker"))
+			}
+		})
+
+		It("refuses to fsck it", func() {
+			session := runAdmin("-config", configFile, "fsck")
+			Ω(session.ExitCode()).To(Equal(1))
+			Ω(session.Err).To(Say("fsck only repairs the filesystem repository"))
+		})
+	})
+
+	It("reports missing directories without creating anything", func() {
+		session := runAdmin("-config", configFile, "verify")
+		Ω(session.ExitCode()).To(Equal(1))
+
+		entries, err := ioutil.ReadDir(tmpDir)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(entries).To(HaveLen(1))
+		Ω(entries[0].Name()).To(Equal("config.yml"))
+	})
+})
@@ -0,0 +1,237 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A client for the parts of the Elasticsearch REST API the broker uses, trying each host in turn until one answers
+type Client struct {
+	Hosts      []string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+const clientTimeout = 30 * time.Second
+
+func NewClient(config Configuration) *Client {
+	return &Client{
+		Hosts:      config.Hosts,
+		Username:   config.Username,
+		Password:   config.Password,
+		HTTPClient: &http.Client{Timeout: clientTimeout},
+	}
+}
+
+// An error response from Elasticsearch
+type Error struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (err *Error) Error() string {
+	if err.Type == "" {
+		return fmt.Sprintf("elasticsearch responded %d: %s", err.Status, err.Reason)
+	}
+	return fmt.Sprintf("elasticsearch responded %d: %s: %s", err.Status, err.Type, err.Reason)
+}
+
+func IsNotFound(err error) bool {
+	esErr, ok := err.(*Error)
+	return ok && esErr.Status == http.StatusNotFound
+}
+
+// A legacy index template, applied to every index created with a name matching one of its patterns
+type IndexTemplate struct {
+	IndexPatterns []string            `json:"index_patterns"`
+	Aliases       map[string]struct{} `json:"aliases,omitempty"`
+}
+
+// Ping succeeds when one of the hosts answers
+func (client *Client) Ping() error {
+	return client.do("GET", "/", nil, nil)
+}
+
+func (client *Client) PutIndexTemplate(name string, template IndexTemplate) error {
+	return client.do("PUT", "/_template/"+name, template, nil)
+}
+
+// DeleteIndexTemplate removes a template, succeeding when there is none
+func (client *Client) DeleteIndexTemplate(name string) error {
+	err := client.do("DELETE", "/_template/"+name, nil, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (client *Client) CreateIndex(name string) error {
+	return client.do("PUT", "/"+name, nil, nil)
+}
+
+// Indices lists the names of the indices matching pattern
+func (client *Client) Indices(pattern string) ([]string, error) {
+	rows := []struct {
+		Index string `json:"index"`
+	}{}
+	err := client.do("GET", "/_cat/indices/"+pattern+"?format=json&h=index", nil, &rows)
+	if IsNotFound(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, row := range rows {
+		names = append(names, row.Index)
+	}
+	return names, nil
+}
+
+// DeleteIndices removes indices by name, skipping those already gone
+func (client *Client) DeleteIndices(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return client.do("DELETE", "/"+strings.Join(names, ",")+"?ignore_unavailable=true", nil, nil)
+}
+
+// A role of the security API, granting privileges on indices
+type Role struct {
+	Indices []IndexPrivileges `json:"indices"`
+}
+
+type IndexPrivileges struct {
+	Names      []string `json:"names"`
+	Privileges []string `json:"privileges"`
+}
+
+// A user of the native realm of the security API
+type User struct {
+	Password string            `json:"password"`
+	Roles    []string          `json:"roles"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (client *Client) PutRole(name string, role Role) error {
+	return client.do("PUT", "/_security/role/"+name, role, nil)
+}
+
+// DeleteRole removes a role, succeeding when there is none
+func (client *Client) DeleteRole(name string) error {
+	err := client.do("DELETE", "/_security/role/"+name, nil, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (client *Client) PutUser(name string, user User) error {
+	return client.do("PUT", "/_security/user/"+name, user, nil)
+}
+
+// DeleteUser removes a user, succeeding when there is none
+func (client *Client) DeleteUser(name string) error {
+	err := client.do("DELETE", "/_security/user/"+name, nil, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Sends a request with body encoded as JSON and decodes the response into result, when given
+func (client *Client) do(method, path string, body, result interface{}) error {
+	if len(client.Hosts) == 0 {
+		return fmt.Errorf("no elasticsearch hosts are configured")
+	}
+
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	var lastErr error
+	for _, host := range client.Hosts {
+		response, err := client.send(method, strings.TrimRight(host, "/")+path, payload)
+		if err != nil {
+			// the next host may be up
+			lastErr = err
+			continue
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode >= 300 {
+			return responseError(response)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.NewDecoder(response.Body).Decode(result)
+	}
+	return lastErr
+}
+
+func (client *Client) send(method, url string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if client.Username != "" {
+		request.SetBasicAuth(client.Username, client.Password)
+	}
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(request)
+}
+
+// Reads the error Elasticsearch sent, which older versions give as a string rather than an object
+func responseError(response *http.Response) error {
+	esErr := &Error{Status: response.StatusCode, Reason: response.Status}
+
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return esErr
+	}
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &body) != nil || len(body.Error) == 0 {
+		return esErr
+	}
+
+	var detail struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	var message string
+	if json.Unmarshal(body.Error, &detail) == nil {
+		esErr.Type = detail.Type
+		esErr.Reason = detail.Reason
+	} else if json.Unmarshal(body.Error, &message) == nil {
+		esErr.Reason = message
+	}
+	return esErr
+}
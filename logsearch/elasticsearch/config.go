@@ -0,0 +1,130 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Index naming schemes
+const (
+	// Indices are named after the instance id
+	IndexNamingInstance = "instance"
+	// Indices are named after the org and space of the instance, falling back to their guids
+	IndexNamingOrgSpace = "org-space"
+)
+
+// The elasticsearch section of the broker config, describing the cluster logs are shipped to
+type Configuration struct {
+	Hosts    []string `yaml:"hosts"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	// Starts the index prefix of every instance
+	IndexPrefix string `yaml:"index_prefix"`
+	IndexNaming string `yaml:"index_naming"`
+	// Follows the index prefix of an instance, as a logstash sprintf pattern
+	IndexPattern string `yaml:"index_pattern"`
+	// Also offers the cluster as a service of its own, giving each instance an index alias
+	OfferService bool `yaml:"offer_service"`
+	// Where that service keeps its instances
+	DataDirectory string `yaml:"data_directory"`
+	// The URL applications bound to that service reach the cluster at, the first host by default
+	Url string `yaml:"url"`
+	// How long instances of either service keep their indices
+	Retention RetentionConfiguration `yaml:"retention"`
+}
+
+func (config *Configuration) SetDefaults() {
+	if config.IndexPrefix == "" {
+		config.IndexPrefix = "logsearch"
+	}
+	if config.IndexNaming == "" {
+		config.IndexNaming = IndexNamingInstance
+	}
+	if config.IndexPattern == "" {
+		config.IndexPattern = "%{+YYYY.MM.dd}"
+	}
+	config.Retention.SetDefaults()
+}
+
+// Whether logs are shipped to Elasticsearch at all
+func (config Configuration) Enabled() bool {
+	return len(config.Hosts) > 0
+}
+
+func (config Configuration) Check() error {
+	if config.IndexNaming != IndexNamingInstance && config.IndexNaming != IndexNamingOrgSpace {
+		return fmt.Errorf("Unknown elasticsearch index_naming '%s', expected '%s' or '%s'", config.IndexNaming, IndexNamingInstance, IndexNamingOrgSpace)
+	}
+	for _, host := range config.Hosts {
+		parsed, err := url.Parse(host)
+		if err != nil || strings.ContainsAny(host, "\"'") || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("elasticsearch host '%s' is not an http or https URL", host)
+		}
+	}
+	if config.Url != "" {
+		parsed, err := url.Parse(config.Url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("elasticsearch url '%s' is not an http or https URL", config.Url)
+		}
+	}
+	if config.OfferService && !config.Enabled() {
+		return fmt.Errorf("elasticsearch offer_service needs hosts")
+	}
+	if config.Retention.Enabled && !config.Enabled() {
+		return fmt.Errorf("elasticsearch retention needs hosts")
+	}
+	if err := config.Retention.Check(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(config.IndexPattern, "\"'\n") {
+		return fmt.Errorf("elasticsearch index_pattern may not contain quotes or newlines")
+	}
+	if IndexName(config.IndexPrefix) != config.IndexPrefix {
+		return fmt.Errorf("elasticsearch index_prefix '%s' is not a valid index name, e.g. '%s'", config.IndexPrefix, IndexName(config.IndexPrefix))
+	}
+	return nil
+}
+
+// The URL bound applications reach the cluster at
+func (config Configuration) ApplicationUrl() string {
+	if config.Url != "" {
+		return config.Url
+	}
+	if len(config.Hosts) == 0 {
+		return ""
+	}
+	return config.Hosts[0]
+}
+
+// The index prefix of a new instance, which keeps its logs apart from those of other tenants.
+// Names are only used with the org-space naming and fall back to the guids when the platform did not send them.
+func (config Configuration) InstanceIndexPrefix(instanceId, orgName, orgGuid, spaceName, spaceGuid string) string {
+	config.SetDefaults()
+	if config.IndexNaming != IndexNamingOrgSpace {
+		return IndexName(config.IndexPrefix, instanceId)
+	}
+	if orgName == "" {
+		orgName = orgGuid
+	}
+	if spaceName == "" {
+		spaceName = spaceGuid
+	}
+	return IndexName(config.IndexPrefix, orgName, spaceName)
+}
+
+var invalidIndexCharacters = regexp.MustCompile(`[^a-z0-9_.+-]+`)
+
+// Joins parts into a lower case index name, replacing what Elasticsearch does not allow in one
+func IndexName(parts ...string) string {
+	cleaned := []string{}
+	for _, part := range parts {
+		part = invalidIndexCharacters.ReplaceAllString(strings.ToLower(part), "_")
+		part = strings.Trim(part, "_-+.")
+		if part != "" {
+			cleaned = append(cleaned, part)
+		}
+	}
+	return strings.Join(cleaned, "-")
+}
@@ -0,0 +1,60 @@
+package elasticsearch_test
+
+import (
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration", func() {
+	var config elasticsearch.Configuration
+
+	BeforeEach(func() {
+		config = elasticsearch.Configuration{Hosts: []string{"http://127.0.0.1:9200"}}
+		config.SetDefaults()
+	})
+
+	It("is only enabled with hosts", func() {
+		Ω(config.Enabled()).To(BeTrue())
+		Ω(elasticsearch.Configuration{}.Enabled()).To(BeFalse())
+	})
+
+	It("names indices after the instance by default", func() {
+		Ω(config.InstanceIndexPrefix("Instance-1", "acme", "org-guid", "dev", "space-guid")).To(Equal("logsearch-instance-1"))
+	})
+
+	It("names indices after the org and space, falling back to their guids", func() {
+		config.IndexNaming = elasticsearch.IndexNamingOrgSpace
+		Ω(config.InstanceIndexPrefix("instance-1", "ACME Corp", "org-guid", "dev/test", "space-guid")).To(Equal("logsearch-acme_corp-dev_test"))
+		Ω(config.InstanceIndexPrefix("instance-1", "", "org-guid", "", "space-guid")).To(Equal("logsearch-org-guid-space-guid"))
+	})
+
+	It("makes valid index names", func() {
+		Ω(elasticsearch.IndexName("Logs", "_org*", "space?")).To(Equal("logs-org-space"))
+		Ω(elasticsearch.IndexName("logs", "", "-")).To(Equal("logs"))
+	})
+
+	It("checks the settings", func() {
+		Ω(config.Check()).To(Succeed())
+
+		config.IndexNaming = "team"
+		Ω(config.Check()).To(MatchError("Unknown elasticsearch index_naming 'team', expected 'instance' or 'org-space'"))
+
+		config.IndexNaming = elasticsearch.IndexNamingInstance
+		config.Hosts = []string{"127.0.0.1:9200"}
+		Ω(config.Check()).To(MatchError("elasticsearch host '127.0.0.1:9200' is not an http or https URL"))
+
+		config.Hosts = nil
+		config.IndexPrefix = "Logs"
+		Ω(config.Check()).To(MatchError("elasticsearch index_prefix 'Logs' is not a valid index name, e.g. 'logs'"))
+
+		config.IndexPrefix = "logs"
+		config.Url = "logs.example.com"
+		Ω(config.Check()).To(MatchError("elasticsearch url 'logs.example.com' is not an http or https URL"))
+
+		config.Url = ""
+		config.OfferService = true
+		Ω(config.Check()).To(MatchError("elasticsearch offer_service needs hosts"))
+	})
+})
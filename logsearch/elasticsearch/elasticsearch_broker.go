@@ -1,9 +1,340 @@
 package elasticsearch
 
 import (
+	"context"
+	"sort"
+	"time"
+
 	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	ServiceId = "ffe0c543-6645-4aa0-8178-39448989360e"
+	PlanId    = "c4ee9cc0-63ae-4a0a-a594-ee281b431657"
 )
 
+// ServiceBroker offers indices on a shared Elasticsearch cluster. Each instance gets an index
+// template giving its indices an alias, and each binding a user that may only use those indices.
 type ServiceBroker struct {
-	api.ServiceBroker
+	Config             Configuration
+	Client             *Client
+	InstanceRepository InstanceRepository
+	Logger             lager.Logger
+}
+
+func NewServiceBroker(config Configuration, logger lager.Logger) *ServiceBroker {
+	config.SetDefaults()
+	return &ServiceBroker{
+		Config:             config,
+		Client:             NewClient(config),
+		InstanceRepository: &FileSystemInstanceRepository{Directory: config.DataDirectory},
+		Logger:             logger,
+	}
+}
+
+// The credentials of a binding
+type Credentials struct {
+	Uri      string `json:"uri"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// read-write or read-only
+	Access string `json:"access"`
+	// The alias searching every index of the instance
+	Index string `json:"index"`
+	// Matches every index of the instance; applications writing their own indices must name them to match
+	IndexPattern string `json:"index_pattern"`
+}
+
+func (broker *ServiceBroker) GetCatalog() []api.Service {
+	return []api.Service{
+		api.Service{
+			Id:          ServiceId,
+			Name:        "logsearch-elasticsearch",
+			Description: "Indices on the shared Logsearch Elasticsearch cluster",
+			Bindable:    true,
+			Plans: []api.Plan{
+				api.Plan{
+					Id:          PlanId,
+					Name:        "shared",
+					Description: "An index alias on the shared cluster",
+					Metadata: api.PlanMetadata{
+						Bullets:     []string{},
+						DisplayName: "Shared",
+					},
+				},
+			},
+			Metadata: api.ServiceMetadata{
+				DisplayName:      "Logsearch Elasticsearch",
+				LongDescription:  "Indices of your own on the Elasticsearch cluster behind Logsearch",
+				DocumentationUrl: "http://documentation.com",
+				SupportUrl:       "http://support.com",
+				Listing: api.ServiceMetadataListing{
+					Blurb:    "Logsearch Elasticsearch ...",
+					ImageUrl: "http://image.com/image.png",
+				},
+				Provider: api.ServiceMetadataProvider{
+					Name: "Logsearch.io",
+				},
+			},
+			Tags: []string{
+				"elasticsearch",
+				"logsearch",
+			},
+		},
+	}
+}
+
+// Whether the broker offers serviceId
+func (broker *ServiceBroker) Offers(serviceId string) bool {
+	for _, service := range broker.GetCatalog() {
+		if service.Id == serviceId {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the broker provisioned instanceId
+func (broker *ServiceBroker) Owns(instanceId string) bool {
+	_, err := broker.InstanceRepository.FindById(instanceId)
+	return err == nil
+}
+
+// Provision creates the index template of the instance and an empty first index, so that its alias can be
+// searched right away. Whatever was created is removed again when a later step fails.
+func (broker *ServiceBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("creating-elasticsearch-instance")
+
+	if _, err := broker.InstanceRepository.FindById(instanceId); err == nil {
+		return "", api.ServiceInstanceAlreadyExistsError
+	}
+	if planId := params["plan_id"]; planId != "" && planId != PlanId {
+		return "", &api.InvalidParameterError{Name: "plan_id", Reason: "is not a plan of this service"}
+	}
+
+	indexPrefix := broker.Config.InstanceIndexPrefix(
+		instanceId,
+		params["organization_name"], params["organization_guid"],
+		params["space_name"], params["space_guid"],
+	)
+	if broker.Config.IndexNaming == IndexNamingOrgSpace {
+		// a space may hold several instances
+		indexPrefix = IndexName(indexPrefix, instanceId)
+	}
+
+	instance := &Instance{
+		Id:               instanceId,
+		IndexPrefix:      indexPrefix,
+		ServiceId:        params["service_id"],
+		PlanId:           params["plan_id"],
+		OrganizationGuid: params["organization_guid"],
+		SpaceGuid:        params["space_guid"],
+		CreatedBy:        api.OriginatingIdentityFromContext(ctx),
+		CreatedAt:        time.Now().UTC(),
+		Bindings:         []*Binding{},
+	}
+	if value, ok := params[RetentionParameter]; ok {
+		days, err := broker.Config.Retention.ParseOverride(instance.PlanId, value)
+		if err != nil {
+			return "", err
+		}
+		instance.RetentionDays = days
+	}
+
+	err := broker.Client.PutIndexTemplate(instance.IndexPrefix, IndexTemplate{
+		IndexPatterns: []string{instance.IndexPattern()},
+		Aliases:       map[string]struct{}{instance.Alias(): struct{}{}},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = broker.Client.CreateIndex(instance.initialIndex())
+	if err == nil {
+		err = broker.InstanceRepository.Save(instance)
+	}
+	if err != nil {
+		broker.removeIndices(logger, instance)
+		return "", err
+	}
+	logger.Info("created-elasticsearch-instance", lager.Data{"alias": instance.Alias()})
+
+	return "", nil
+}
+
+// Update changes how long the instance keeps its indices; nothing else about an instance can be changed.
+func (broker *ServiceBroker) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("updating-elasticsearch-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "service_id", RetentionParameter:
+		case "plan_id":
+			if params[name] != instance.PlanId {
+				return &api.InvalidParameterError{Name: name, Reason: "the plan of an instance cannot be changed"}
+			}
+		default:
+			return &api.InvalidParameterError{Name: name, Reason: "cannot be updated"}
+		}
+	}
+
+	value, ok := params[RetentionParameter]
+	if !ok {
+		return nil
+	}
+	days, err := broker.Config.Retention.ParseOverride(instance.PlanId, value)
+	if err != nil {
+		return err
+	}
+	instance.RetentionDays = days
+	return broker.InstanceRepository.Save(instance)
+}
+
+func (broker *ServiceBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	return broker.BindWithParameters(ctx, instanceId, bindingId, map[string]string{})
+}
+
+// BindWithParameters creates a user for the binding whose role only grants the access parameter,
+// read-write by default, on the indices of the instance.
+func (broker *ServiceBroker) BindWithParameters(ctx context.Context, instanceId string, bindingId string, params map[string]string) (interface{}, error) {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("binding-elasticsearch-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return nil, api.ServiceInstanceDoesNotExistsError
+	}
+	if instance.binding(bindingId) != nil {
+		return nil, api.ServiceInstanceBindingAlreadyExistsError
+	}
+
+	access, err := bindingAccess(params)
+	if err != nil {
+		return nil, err
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	binding := &Binding{
+		Id:        bindingId,
+		Username:  bindingUsername(instance, bindingId),
+		Access:    access,
+		CreatedBy: api.OriginatingIdentityFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := broker.createBindingUser(logger, instance, binding, password); err != nil {
+		return nil, err
+	}
+
+	instance.Bindings = append(instance.Bindings, binding)
+	if err := broker.InstanceRepository.Save(instance); err != nil {
+		if userErr := broker.deleteBindingUser(binding); userErr != nil {
+			logger.Error("removing-binding-user", userErr)
+		}
+		return nil, err
+	}
+	logger.Info("created-binding-user", lager.Data{"username": binding.Username, "access": access})
+
+	return Credentials{
+		Uri:          broker.Config.ApplicationUrl(),
+		Username:     binding.Username,
+		Password:     password,
+		Access:       access,
+		Index:        instance.Alias(),
+		IndexPattern: instance.IndexPattern(),
+	}, nil
+}
+
+func (broker *ServiceBroker) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("unbinding-elasticsearch-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+	binding := instance.binding(bindingId)
+	if binding == nil {
+		return api.ServiceInstanceBindingDoesNotExistsError
+	}
+
+	if err := broker.deleteBindingUser(binding); err != nil {
+		return err
+	}
+	instance.removeBinding(bindingId)
+	return broker.InstanceRepository.Save(instance)
+}
+
+// Deprovision deletes every index of the instance along with its template, and the users of bindings left behind
+func (broker *ServiceBroker) Deprovision(ctx context.Context, instanceId string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("deprovisioning-elasticsearch-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+
+	for _, binding := range instance.Bindings {
+		if err := broker.deleteBindingUser(binding); err != nil {
+			return err
+		}
+	}
+
+	indices, err := broker.Client.Indices(instance.IndexPattern())
+	if err != nil {
+		return err
+	}
+	if err := broker.Client.DeleteIndices(indices); err != nil {
+		return err
+	}
+	if err := broker.Client.DeleteIndexTemplate(instance.IndexPrefix); err != nil {
+		return err
+	}
+	logger.Info("deleted-indices", lager.Data{"indices": indices})
+
+	return broker.InstanceRepository.Delete(instanceId)
+}
+
+func (broker *ServiceBroker) RetentionTargets() ([]RetentionTarget, error) {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []RetentionTarget{}
+	for _, instance := range instances {
+		targets = append(targets, RetentionTarget{
+			InstanceId:  instance.Id,
+			PlanId:      instance.PlanId,
+			IndexPrefix: instance.IndexPrefix,
+			Days:        instance.RetentionDays,
+		})
+	}
+	return targets, nil
+}
+
+// Rolls back a failed provision, logging rather than returning what fails so the original error is reported
+func (broker *ServiceBroker) removeIndices(logger lager.Logger, instance *Instance) {
+	if err := broker.Client.DeleteIndices([]string{instance.initialIndex()}); err != nil {
+		logger.Error("removing-initial-index", err)
+	}
+	if err := broker.Client.DeleteIndexTemplate(instance.IndexPrefix); err != nil {
+		logger.Error("removing-index-template", err)
+	}
 }
@@ -0,0 +1,442 @@
+package elasticsearch_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Keeps templates and indices in memory, answering the parts of the REST API the broker uses
+type fakeElasticsearch struct {
+	sync.Mutex
+	templates map[string]elasticsearch.IndexTemplate
+	// aliases by index
+	indices  map[string][]string
+	roles    map[string]elasticsearch.Role
+	users    map[string]elasticsearch.User
+	requests []string
+	// answered with a 500 when a request starts with one of them, e.g. "PUT /logsearch-instance-1-init"
+	failing []string
+}
+
+func newFakeElasticsearch() *fakeElasticsearch {
+	return &fakeElasticsearch{
+		templates: map[string]elasticsearch.IndexTemplate{},
+		indices:   map[string][]string{},
+		roles:     map[string]elasticsearch.Role{},
+		users:     map[string]elasticsearch.User{},
+	}
+}
+
+func (es *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.Lock()
+	defer es.Unlock()
+
+	request := r.Method + " " + r.URL.Path
+	es.requests = append(es.requests, request)
+	for _, failing := range es.failing {
+		if strings.HasPrefix(request, failing) {
+			fail(w, 500, "exception", "failing on purpose")
+			return
+		}
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == "GET" && name == "":
+		w.Write([]byte(`{"cluster_name":"logsearch"}`))
+		return
+
+	case r.Method == "PUT" && strings.HasPrefix(name, "_template/"):
+		template := elasticsearch.IndexTemplate{}
+		json.NewDecoder(r.Body).Decode(&template)
+		es.templates[strings.TrimPrefix(name, "_template/")] = template
+
+	case r.Method == "DELETE" && strings.HasPrefix(name, "_template/"):
+		name = strings.TrimPrefix(name, "_template/")
+		if _, ok := es.templates[name]; !ok {
+			fail(w, 404, "index_template_missing_exception", "index_template ["+name+"] missing")
+			return
+		}
+		delete(es.templates, name)
+
+	case r.Method == "PUT" && strings.HasPrefix(name, "_security/role/"):
+		role := elasticsearch.Role{}
+		json.NewDecoder(r.Body).Decode(&role)
+		es.roles[strings.TrimPrefix(name, "_security/role/")] = role
+
+	case r.Method == "PUT" && strings.HasPrefix(name, "_security/user/"):
+		user := elasticsearch.User{}
+		json.NewDecoder(r.Body).Decode(&user)
+		es.users[strings.TrimPrefix(name, "_security/user/")] = user
+
+	case r.Method == "DELETE" && strings.HasPrefix(name, "_security/role/"):
+		name = strings.TrimPrefix(name, "_security/role/")
+		if _, ok := es.roles[name]; !ok {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"found":false}`))
+			return
+		}
+		delete(es.roles, name)
+
+	case r.Method == "DELETE" && strings.HasPrefix(name, "_security/user/"):
+		name = strings.TrimPrefix(name, "_security/user/")
+		if _, ok := es.users[name]; !ok {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"found":false}`))
+			return
+		}
+		delete(es.users, name)
+
+	case r.Method == "GET" && strings.HasPrefix(name, "_cat/indices/"):
+		rows := []map[string]string{}
+		for _, index := range es.sortedIndices() {
+			if matches(strings.TrimPrefix(name, "_cat/indices/"), index) {
+				rows = append(rows, map[string]string{"index": index})
+			}
+		}
+		json.NewEncoder(w).Encode(rows)
+		return
+
+	case r.Method == "PUT":
+		if _, ok := es.indices[name]; ok {
+			fail(w, 400, "resource_already_exists_exception", "index ["+name+"] already exists")
+			return
+		}
+		aliases := []string{}
+		for _, template := range es.templates {
+			for _, pattern := range template.IndexPatterns {
+				if matches(pattern, name) {
+					for alias := range template.Aliases {
+						aliases = append(aliases, alias)
+					}
+				}
+			}
+		}
+		es.indices[name] = aliases
+
+	case r.Method == "DELETE":
+		for _, index := range strings.Split(name, ",") {
+			delete(es.indices, index)
+		}
+
+	default:
+		fail(w, 400, "illegal_argument_exception", "unexpected request "+request)
+		return
+	}
+	w.Write([]byte(`{"acknowledged":true}`))
+}
+
+func (es *fakeElasticsearch) sortedIndices() []string {
+	names := []string{}
+	for name := range es.indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func matches(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == name
+}
+
+func fail(w http.ResponseWriter, status int, errorType, reason string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  map[string]string{"type": errorType, "reason": reason},
+		"status": status,
+	})
+}
+
+var _ = Describe("ServiceBroker", func() {
+	var (
+		es     *fakeElasticsearch
+		server *httptest.Server
+		tmpDir string
+		config elasticsearch.Configuration
+		broker *elasticsearch.ServiceBroker
+		ctx    context.Context
+		params map[string]string
+	)
+
+	BeforeEach(func() {
+		es = newFakeElasticsearch()
+		server = httptest.NewServer(es)
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "elasticsearch-broker")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = elasticsearch.Configuration{
+			Hosts:         []string{server.URL},
+			OfferService:  true,
+			DataDirectory: path.Join(tmpDir, "instances"),
+		}
+		ctx = context.Background()
+		params = map[string]string{
+			"service_id":        elasticsearch.ServiceId,
+			"plan_id":           elasticsearch.PlanId,
+			"organization_guid": "org-guid",
+			"space_guid":        "space-guid",
+		}
+	})
+
+	JustBeforeEach(func() {
+		broker = elasticsearch.NewServiceBroker(config, lagertest.NewTestLogger("elasticsearch-broker"))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("offers one service with one plan", func() {
+		catalog := broker.GetCatalog()
+		Ω(catalog).To(HaveLen(1))
+		Ω(catalog[0].Id).To(Equal(elasticsearch.ServiceId))
+		Ω(catalog[0].Plans[0].Id).To(Equal(elasticsearch.PlanId))
+		Ω(catalog[0].DashboardClient).To(BeNil())
+		Ω(broker.Offers(elasticsearch.ServiceId)).To(BeTrue())
+		Ω(broker.Offers("logstash-service-id")).To(BeFalse())
+	})
+
+	Describe("provisioning", func() {
+		It("creates an index template whose indices get the alias of the instance", func() {
+			_, err := broker.Provision(ctx, "Instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(es.templates).To(Equal(map[string]elasticsearch.IndexTemplate{
+				"logsearch-instance-1": {
+					IndexPatterns: []string{"logsearch-instance-1-*"},
+					Aliases:       map[string]struct{}{"logsearch-instance-1": struct{}{}},
+				},
+			}))
+			Ω(es.indices).To(Equal(map[string][]string{"logsearch-instance-1-init": {"logsearch-instance-1"}}))
+			Ω(broker.Owns("Instance-1")).To(BeTrue())
+		})
+
+		It("keeps the instances of a space apart with org-space naming", func() {
+			config.IndexNaming = elasticsearch.IndexNamingOrgSpace
+			params["organization_name"] = "acme"
+			params["space_name"] = "dev"
+			broker = elasticsearch.NewServiceBroker(config, lagertest.NewTestLogger("elasticsearch-broker"))
+
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(es.templates).To(HaveKey("logsearch-acme-dev-instance-1"))
+		})
+
+		It("refuses plans it does not offer", func() {
+			params["plan_id"] = "plan-1"
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).To(Equal(&api.InvalidParameterError{Name: "plan_id", Reason: "is not a plan of this service"}))
+			Ω(es.templates).To(BeEmpty())
+		})
+
+		It("refuses an instance that already exists", func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-1", params)
+			Ω(err).To(Equal(api.ServiceInstanceAlreadyExistsError))
+		})
+
+		It("removes the template again when the index cannot be created", func() {
+			es.failing = []string{"PUT /logsearch-instance-1-init"}
+
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).To(MatchError("elasticsearch responded 500: exception: failing on purpose"))
+			Ω(es.templates).To(BeEmpty())
+			Ω(broker.Owns("instance-1")).To(BeFalse())
+		})
+
+		It("tries the next host when one cannot be reached", func() {
+			config.Hosts = []string{"http://127.0.0.1:1", server.URL}
+			broker = elasticsearch.NewServiceBroker(config, lagertest.NewTestLogger("elasticsearch-broker"))
+
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(es.templates).To(HaveKey("logsearch-instance-1"))
+		})
+	})
+
+	Describe("binding", func() {
+		JustBeforeEach(func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the url, the index alias and a user of its own", func() {
+			credentials, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+			password := credentials.(elasticsearch.Credentials).Password
+			Ω(password).To(HaveLen(48))
+			Ω(credentials).To(Equal(elasticsearch.Credentials{
+				Uri:          server.URL,
+				Username:     "logsearch-instance-1-binding-1",
+				Password:     password,
+				Access:       "read-write",
+				Index:        "logsearch-instance-1",
+				IndexPattern: "logsearch-instance-1-*",
+			}))
+
+			Ω(es.users).To(Equal(map[string]elasticsearch.User{
+				"logsearch-instance-1-binding-1": {
+					Password: password,
+					Roles:    []string{"logsearch-instance-1-binding-1"},
+					Metadata: map[string]string{"instance_id": "instance-1", "binding_id": "binding-1"},
+				},
+			}))
+			Ω(es.roles).To(Equal(map[string]elasticsearch.Role{
+				"logsearch-instance-1-binding-1": {Indices: []elasticsearch.IndexPrivileges{{
+					Names:      []string{"logsearch-instance-1", "logsearch-instance-1-*"},
+					Privileges: []string{"read", "view_index_metadata", "write", "create_index"},
+				}}},
+			}))
+
+			_, err = broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).To(Equal(api.ServiceInstanceBindingAlreadyExistsError))
+		})
+
+		It("gives every binding a different password", func() {
+			first, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+			second, err := broker.Bind(ctx, "instance-1", "binding-2")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(first.(elasticsearch.Credentials).Password).ToNot(Equal(second.(elasticsearch.Credentials).Password))
+		})
+
+		It("only lets read-only bindings read", func() {
+			credentials, err := broker.BindWithParameters(ctx, "instance-1", "binding-1", map[string]string{"service_id": elasticsearch.ServiceId, "access": "read-only"})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(credentials.(elasticsearch.Credentials).Access).To(Equal("read-only"))
+			Ω(es.roles["logsearch-instance-1-binding-1"].Indices[0].Privileges).To(Equal([]string{"read", "view_index_metadata"}))
+		})
+
+		It("refuses unknown access and parameters", func() {
+			_, err := broker.BindWithParameters(ctx, "instance-1", "binding-1", map[string]string{"access": "admin"})
+			Ω(err).To(Equal(&api.InvalidParameterError{Name: "access", Reason: "unknown access 'admin', expected read-write or read-only"}))
+			_, err = broker.BindWithParameters(ctx, "instance-1", "binding-1", map[string]string{"index": "other"})
+			Ω(err).To(Equal(&api.InvalidParameterError{Name: "index", Reason: "cannot be given when binding"}))
+			Ω(es.users).To(BeEmpty())
+		})
+
+		It("removes the role again when the user cannot be created", func() {
+			es.failing = []string{"PUT /_security/user/"}
+
+			_, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).To(HaveOccurred())
+			Ω(es.roles).To(BeEmpty())
+
+			es.failing = nil
+			_, err = broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		Context("with a url for applications", func() {
+			BeforeEach(func() {
+				config.Url = "https://logs.example.com"
+			})
+
+			It("returns it instead of the first host", func() {
+				credentials, err := broker.Bind(ctx, "instance-1", "binding-1")
+				Ω(err).ToNot(HaveOccurred())
+				Ω(credentials.(elasticsearch.Credentials).Uri).To(Equal("https://logs.example.com"))
+			})
+		})
+
+		It("deletes the user and role when unbinding", func() {
+			_, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(broker.Unbind(ctx, "instance-1", "binding-1")).To(Succeed())
+			Ω(es.users).To(BeEmpty())
+			Ω(es.roles).To(BeEmpty())
+			Ω(broker.Unbind(ctx, "instance-1", "binding-1")).To(Equal(api.ServiceInstanceBindingDoesNotExistsError))
+		})
+
+		It("does not bind instances that do not exist", func() {
+			_, err := broker.Bind(ctx, "instance-2", "binding-1")
+			Ω(err).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+
+	Describe("deprovisioning", func() {
+		JustBeforeEach(func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-10", params)
+			Ω(err).ToNot(HaveOccurred())
+			es.indices["logsearch-instance-1-2015.06.01"] = []string{"logsearch-instance-1"}
+		})
+
+		It("deletes the indices and the template of the instance only", func() {
+			Ω(broker.Deprovision(ctx, "instance-1")).To(Succeed())
+
+			Ω(es.sortedIndices()).To(Equal([]string{"logsearch-instance-10-init"}))
+			Ω(es.templates).ToNot(HaveKey("logsearch-instance-1"))
+			Ω(es.templates).To(HaveKey("logsearch-instance-10"))
+			Ω(broker.Owns("instance-1")).To(BeFalse())
+		})
+
+		It("deletes the users of bindings left behind", func() {
+			_, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(broker.Deprovision(ctx, "instance-1")).To(Succeed())
+			Ω(es.users).To(BeEmpty())
+			Ω(es.roles).To(BeEmpty())
+		})
+
+		It("keeps the instance when the indices cannot be deleted", func() {
+			es.failing = []string{"DELETE /logsearch-instance-1-"}
+
+			Ω(broker.Deprovision(ctx, "instance-1")).ToNot(Succeed())
+			Ω(broker.Owns("instance-1")).To(BeTrue())
+		})
+
+		It("does not deprovision instances that do not exist", func() {
+			Ω(broker.Deprovision(ctx, "instance-2")).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+
+	Describe("health", func() {
+		BeforeEach(func() {
+			Ω(os.MkdirAll(config.DataDirectory, 0755)).To(Succeed())
+		})
+
+		It("checks the data directory and the cluster", func() {
+			Ω(broker.CheckHealth()).To(Equal([]api.HealthCheck{
+				{Name: "elasticsearch-data-directory", Status: api.HealthStatusOk},
+				{Name: "elasticsearch-cluster", Status: api.HealthStatusOk},
+			}))
+
+			es.failing = []string{"GET /"}
+			checks := broker.CheckHealth()
+			Ω(checks[1].Status).To(Equal(api.HealthStatusFailed))
+			Ω(checks[1].Error).To(ContainSubstring("failing on purpose"))
+		})
+
+		It("has no instances of its own to probe", func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(broker.CheckInstancesHealth()).To(BeEmpty())
+		})
+	})
+})
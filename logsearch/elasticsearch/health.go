@@ -0,0 +1,28 @@
+package elasticsearch
+
+import (
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// CheckHealth checks the directory of the instances and that the cluster answers, which every provision and
+// binding needs
+func (broker *ServiceBroker) CheckHealth() []api.HealthCheck {
+	return []api.HealthCheck{
+		healthCheck("elasticsearch-data-directory", system.CheckDirectoryWritable(broker.Config.DataDirectory)),
+		healthCheck("elasticsearch-cluster", broker.Client.Ping()),
+	}
+}
+
+// CheckInstancesHealth reports no instances: they are indices on the shared cluster, with no process of their own
+// to probe
+func (broker *ServiceBroker) CheckInstancesHealth() ([]api.InstanceHealth, error) {
+	return []api.InstanceHealth{}, nil
+}
+
+func healthCheck(name string, err error) api.HealthCheck {
+	if err != nil {
+		return api.HealthCheck{Name: name, Status: api.HealthStatusFailed, Error: err.Error()}
+	}
+	return api.HealthCheck{Name: name, Status: api.HealthStatusOk}
+}
@@ -0,0 +1,160 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// An instance of the elasticsearch service: an index template and alias on the shared cluster
+type Instance struct {
+	Id string `json:"id"`
+	// Starts the name of every index of the instance, and names its alias
+	IndexPrefix string `json:"index_prefix"`
+	// Days the indices of the instance are kept, overriding its plan; 0 when it has no override
+	RetentionDays    int                      `json:"retention_days,omitempty"`
+	ServiceId        string                   `json:"service_id"`
+	PlanId           string                   `json:"plan_id"`
+	OrganizationGuid string                   `json:"organization_guid"`
+	SpaceGuid        string                   `json:"space_guid"`
+	CreatedBy        *api.OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt        time.Time                `json:"created_at"`
+	Bindings         []*Binding               `json:"bindings"`
+}
+
+type Binding struct {
+	Id string `json:"id"`
+	// Names the user and role of the binding
+	Username  string                   `json:"username,omitempty"`
+	Access    string                   `json:"access,omitempty"`
+	CreatedBy *api.OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt time.Time                `json:"created_at"`
+}
+
+// The alias searching every index of the instance
+func (instance Instance) Alias() string {
+	return instance.IndexPrefix
+}
+
+// Matches every index of the instance
+func (instance Instance) IndexPattern() string {
+	return instance.IndexPrefix + "-*"
+}
+
+// The empty index created with the instance, so that its alias exists before anything is written
+func (instance Instance) initialIndex() string {
+	return instance.IndexPrefix + "-init"
+}
+
+func (instance Instance) binding(bindingId string) *Binding {
+	for _, binding := range instance.Bindings {
+		if binding.Id == bindingId {
+			return binding
+		}
+	}
+	return nil
+}
+
+func (instance *Instance) removeBinding(bindingId string) {
+	bindings := []*Binding{}
+	for _, binding := range instance.Bindings {
+		if binding.Id != bindingId {
+			bindings = append(bindings, binding)
+		}
+	}
+	instance.Bindings = bindings
+}
+
+type InstanceRepository interface {
+	Save(instance *Instance) error
+	FindById(instanceId string) (*Instance, error)
+	FindAll() ([]*Instance, error)
+	Delete(instanceId string) error
+}
+
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// Keeps each instance, with its bindings, in <id>.json in a directory
+type FileSystemInstanceRepository struct {
+	Directory string
+
+	// Used for every file the repository writes; an AtomicFileWriter when nil
+	FileWriter system.FileWriter
+}
+
+func (repository *FileSystemInstanceRepository) Save(instance *Instance) error {
+	if err := os.MkdirAll(repository.Directory, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	return repository.fileWriter().WriteFile(repository.instancePath(instance.Id), data, 0644)
+}
+
+func (repository *FileSystemInstanceRepository) FindById(instanceId string) (*Instance, error) {
+	data, err := ioutil.ReadFile(repository.instancePath(instanceId))
+	if os.IsNotExist(err) {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &Instance{}
+	if err := json.Unmarshal(data, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (repository *FileSystemInstanceRepository) FindAll() ([]*Instance, error) {
+	instances := []*Instance{}
+
+	files, err := ioutil.ReadDir(repository.Directory)
+	if os.IsNotExist(err) {
+		return instances, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		instance, err := repository.FindById(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (repository *FileSystemInstanceRepository) Delete(instanceId string) error {
+	err := os.Remove(repository.instancePath(instanceId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (repository *FileSystemInstanceRepository) instancePath(instanceId string) string {
+	return path.Join(repository.Directory, instanceId+".json")
+}
+
+func (repository *FileSystemInstanceRepository) fileWriter() system.FileWriter {
+	if repository.FileWriter == nil {
+		return system.AtomicFileWriter{}
+	}
+	return repository.FileWriter
+}
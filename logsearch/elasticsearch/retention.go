@@ -0,0 +1,262 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+)
+
+// The provision and update parameter overriding how many days an instance keeps its indices
+const RetentionParameter = "retention_days"
+
+// The retention section of the elasticsearch config, saying how long instances keep their indices
+type RetentionConfiguration struct {
+	// Runs a daily pass deleting old indices
+	Enabled bool `yaml:"enabled"`
+	// Only records what the daily pass would delete
+	DryRun bool `yaml:"dry_run"`
+	// The time of day the pass runs at, as HH:MM in UTC
+	RunAt string `yaml:"run_at"`
+	// Days kept by instances of plans without their own entry; 0 keeps everything
+	DefaultDays int `yaml:"default_days"`
+	// The most days instances of those plans may ask for; 0 allows no more than default_days
+	DefaultMaxDays int `yaml:"default_max_days"`
+	// By plan id
+	Plans map[string]PlanRetention `yaml:"plans"`
+}
+
+type PlanRetention struct {
+	Days    int `yaml:"days"`
+	MaxDays int `yaml:"max_days"`
+}
+
+func (config *RetentionConfiguration) SetDefaults() {
+	if config.RunAt == "" {
+		config.RunAt = "03:00"
+	}
+}
+
+func (config RetentionConfiguration) Check() error {
+	if _, _, err := parseRunAt(config.RunAt); err != nil {
+		return err
+	}
+	plans := map[string]PlanRetention{"default": {Days: config.DefaultDays, MaxDays: config.DefaultMaxDays}}
+	for planId, plan := range config.Plans {
+		plans[planId] = plan
+	}
+	for planId, plan := range plans {
+		if plan.Days < 0 || plan.MaxDays < 0 {
+			return fmt.Errorf("elasticsearch retention of plan '%s' may not be negative", planId)
+		}
+		if plan.MaxDays > 0 && (plan.Days == 0 || plan.Days > plan.MaxDays) {
+			return fmt.Errorf("elasticsearch retention of plan '%s' keeps more than its max_days", planId)
+		}
+	}
+	return nil
+}
+
+func (config RetentionConfiguration) plan(planId string) PlanRetention {
+	if plan, ok := config.Plans[planId]; ok {
+		return plan
+	}
+	return PlanRetention{Days: config.DefaultDays, MaxDays: config.DefaultMaxDays}
+}
+
+// The days an instance of planId keeps its indices: override when it has one, else the days of its plan.
+// 0 keeps every index.
+func (config RetentionConfiguration) Days(planId string, override int) int {
+	if override > 0 {
+		return override
+	}
+	return config.plan(planId).Days
+}
+
+// ParseOverride checks the retention_days parameter of an instance of planId, returning the days it asks for
+func (config RetentionConfiguration) ParseOverride(planId, value string) (int, error) {
+	days, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, &api.InvalidParameterError{Name: RetentionParameter, Reason: "must be a whole number of days"}
+	}
+	if days < 1 {
+		return 0, &api.InvalidParameterError{Name: RetentionParameter, Reason: "must be at least 1"}
+	}
+
+	plan := config.plan(planId)
+	limit := plan.MaxDays
+	if limit == 0 {
+		limit = plan.Days
+	}
+	if limit > 0 && days > limit {
+		return 0, &api.InvalidParameterError{Name: RetentionParameter, Reason: fmt.Sprintf("may be at most %d on this plan", limit)}
+	}
+	return days, nil
+}
+
+// An instance whose indices are subject to retention
+type RetentionTarget struct {
+	InstanceId  string
+	PlanId      string
+	IndexPrefix string
+	// The retention_days of the instance, 0 when it uses the days of its plan
+	Days int
+}
+
+// Implemented by brokers whose instances keep indices on the cluster
+type RetentionSource interface {
+	RetentionTargets() ([]RetentionTarget, error)
+}
+
+// What a retention pass did to the indices of one index prefix, which several instances may share
+type RetentionResult struct {
+	IndexPrefix string   `json:"index_prefix"`
+	InstanceIds []string `json:"instance_ids"`
+	Days        int      `json:"retention_days"`
+	DryRun      bool     `json:"dry_run"`
+	// Deleted, or with a dry run to be deleted
+	Deleted []string `json:"deleted"`
+	Error   string   `json:"error,omitempty"`
+	Err     error    `json:"-"`
+}
+
+// Retention deletes the time-suffixed indices of instances once they are older than their retention
+type Retention struct {
+	Client *Client
+	Config RetentionConfiguration
+	// The current time; time.Now when nil
+	Now func() time.Time
+}
+
+// Run makes one pass over targets, deleting nothing with dryRun. Instances sharing an index prefix keep
+// its indices for the longest retention among them; a prefix whose retention is 0 is left alone.
+func (retention *Retention) Run(targets []RetentionTarget, dryRun bool) []RetentionResult {
+	byPrefix := map[string]*RetentionResult{}
+	for _, target := range targets {
+		result, ok := byPrefix[target.IndexPrefix]
+		if !ok {
+			result = &RetentionResult{IndexPrefix: target.IndexPrefix, InstanceIds: []string{}, DryRun: dryRun, Deleted: []string{}}
+			byPrefix[target.IndexPrefix] = result
+		}
+		result.InstanceIds = append(result.InstanceIds, target.InstanceId)
+
+		days := retention.Config.Days(target.PlanId, target.Days)
+		if len(result.InstanceIds) == 1 || days == 0 || (result.Days != 0 && days > result.Days) {
+			result.Days = days
+		}
+	}
+
+	prefixes := []string{}
+	for prefix := range byPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	results := []RetentionResult{}
+	for _, prefix := range prefixes {
+		result := byPrefix[prefix]
+		sort.Strings(result.InstanceIds)
+		if result.Days > 0 {
+			result.Err = retention.apply(result)
+			if result.Err != nil {
+				result.Error = result.Err.Error()
+			}
+		}
+		results = append(results, *result)
+	}
+	return results
+}
+
+func (retention *Retention) apply(result *RetentionResult) error {
+	now := time.Now
+	if retention.Now != nil {
+		now = retention.Now
+	}
+	today := now().UTC().Truncate(24 * time.Hour)
+	cutoff := today.AddDate(0, 0, -result.Days)
+
+	indices, err := retention.Client.Indices(result.IndexPrefix + "-*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(indices)
+	for _, index := range indices {
+		if end, ok := indexPeriodEnd(result.IndexPrefix, index); ok && !end.After(cutoff) {
+			result.Deleted = append(result.Deleted, index)
+		}
+	}
+
+	if result.DryRun {
+		return nil
+	}
+	return retention.Client.DeleteIndices(result.Deleted)
+}
+
+// The date suffixes of daily and monthly indices, with how long each covers
+var indexDateLayouts = []struct {
+	layout string
+	months int
+	days   int
+}{
+	{"2006.01.02", 0, 1},
+	{"2006-01-02", 0, 1},
+	{"20060102", 0, 1},
+	{"2006.01", 1, 0},
+	{"2006-01", 1, 0},
+}
+
+// The end of the period an index of prefix covers, false for indices that are not time-suffixed
+func indexPeriodEnd(prefix, index string) (time.Time, bool) {
+	if !strings.HasPrefix(index, prefix+"-") {
+		return time.Time{}, false
+	}
+	suffix := strings.TrimPrefix(index, prefix+"-")
+	for _, layout := range indexDateLayouts {
+		if start, err := time.Parse(layout.layout, suffix); err == nil {
+			return start.AddDate(0, layout.months, layout.days), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// NextDailyRun is when a pass running daily at runAt, HH:MM in UTC, next runs after now
+func NextDailyRun(now time.Time, runAt string) (time.Time, error) {
+	hour, minute, err := parseRunAt(runAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// ScheduleDaily calls run every day at runAt, HH:MM in UTC, until stop is closed
+func ScheduleDaily(runAt string, stop <-chan struct{}, run func()) error {
+	for {
+		next, err := NextDailyRun(time.Now(), runAt)
+		if err != nil {
+			return err
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			run()
+		}
+	}
+}
+
+func parseRunAt(runAt string) (int, int, error) {
+	at, err := time.Parse("15:04", runAt)
+	if err != nil {
+		return 0, 0, fmt.Errorf("elasticsearch retention run_at '%s' is not a time of day such as 03:00", runAt)
+	}
+	return at.Hour(), at.Minute(), nil
+}
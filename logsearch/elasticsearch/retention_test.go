@@ -0,0 +1,218 @@
+package elasticsearch_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retention", func() {
+	var (
+		es        *fakeElasticsearch
+		server    *httptest.Server
+		retention *elasticsearch.Retention
+	)
+
+	BeforeEach(func() {
+		es = newFakeElasticsearch()
+		server = httptest.NewServer(es)
+		for _, index := range []string{
+			"logs-a-init",
+			"logs-a-2015.05.31",
+			"logs-a-2015-06-01",
+			"logs-a-20150602",
+			"logs-a-2015.06.03",
+			"logs-a-2015.04",
+			"logs-a-2015.05",
+			"logs-a-2015.06",
+			"logs-a-archive",
+			"logs-ab-2015.01.01",
+		} {
+			es.indices[index] = []string{}
+		}
+
+		retention = &elasticsearch.Retention{
+			Client: elasticsearch.NewClient(elasticsearch.Configuration{Hosts: []string{server.URL}}),
+			Config: elasticsearch.RetentionConfiguration{DefaultDays: 2},
+			Now:    func() time.Time { return time.Date(2015, 6, 4, 12, 0, 0, 0, time.UTC) },
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("deletes the daily and monthly indices older than the retention", func() {
+		results := retention.Run([]elasticsearch.RetentionTarget{{InstanceId: "instance-1", IndexPrefix: "logs-a"}}, false)
+
+		Ω(results).To(Equal([]elasticsearch.RetentionResult{{
+			IndexPrefix: "logs-a",
+			InstanceIds: []string{"instance-1"},
+			Days:        2,
+			Deleted:     []string{"logs-a-2015-06-01", "logs-a-2015.04", "logs-a-2015.05", "logs-a-2015.05.31"},
+		}}))
+		Ω(es.sortedIndices()).To(Equal([]string{
+			"logs-a-2015.06",
+			"logs-a-2015.06.03",
+			"logs-a-20150602",
+			"logs-a-archive",
+			"logs-a-init",
+			"logs-ab-2015.01.01",
+		}))
+	})
+
+	It("only lists what it would delete with a dry run", func() {
+		results := retention.Run([]elasticsearch.RetentionTarget{{InstanceId: "instance-1", IndexPrefix: "logs-a"}}, true)
+
+		Ω(results[0].DryRun).To(BeTrue())
+		Ω(results[0].Deleted).To(HaveLen(4))
+		Ω(es.indices).To(HaveLen(10))
+	})
+
+	It("keeps the indices of a shared prefix for the longest retention", func() {
+		results := retention.Run([]elasticsearch.RetentionTarget{
+			{InstanceId: "instance-2", IndexPrefix: "logs-a", Days: 5},
+			{InstanceId: "instance-1", IndexPrefix: "logs-a"},
+		}, false)
+
+		Ω(results[0].InstanceIds).To(Equal([]string{"instance-1", "instance-2"}))
+		Ω(results[0].Days).To(Equal(5))
+		Ω(results[0].Deleted).To(Equal([]string{"logs-a-2015.04"}))
+	})
+
+	It("keeps everything when an instance of the prefix keeps everything", func() {
+		retention.Config.Plans = map[string]elasticsearch.PlanRetention{"forever": {}}
+		results := retention.Run([]elasticsearch.RetentionTarget{
+			{InstanceId: "instance-1", IndexPrefix: "logs-a"},
+			{InstanceId: "instance-2", PlanId: "forever", IndexPrefix: "logs-a"},
+		}, false)
+
+		Ω(results[0].Days).To(Equal(0))
+		Ω(results[0].Deleted).To(BeEmpty())
+		Ω(es.indices).To(HaveLen(10))
+	})
+
+	It("reports the prefixes whose indices cannot be deleted", func() {
+		es.failing = []string{"DELETE /logs-a-"}
+		results := retention.Run([]elasticsearch.RetentionTarget{{InstanceId: "instance-1", IndexPrefix: "logs-a"}}, false)
+
+		Ω(results[0].Error).To(Equal("elasticsearch responded 500: exception: failing on purpose"))
+	})
+
+	It("limits the days instances may ask for by plan", func() {
+		config := elasticsearch.RetentionConfiguration{
+			DefaultDays:    7,
+			DefaultMaxDays: 30,
+			Plans:          map[string]elasticsearch.PlanRetention{"small": {Days: 3}, "unlimited": {}},
+		}
+
+		Ω(config.ParseOverride("", "30")).To(Equal(30))
+		_, err := config.ParseOverride("", "31")
+		Ω(err).To(Equal(&api.InvalidParameterError{Name: "retention_days", Reason: "may be at most 30 on this plan"}))
+		_, err = config.ParseOverride("small", "4")
+		Ω(err).To(Equal(&api.InvalidParameterError{Name: "retention_days", Reason: "may be at most 3 on this plan"}))
+		Ω(config.ParseOverride("unlimited", "365")).To(Equal(365))
+		_, err = config.ParseOverride("small", "0")
+		Ω(err).To(Equal(&api.InvalidParameterError{Name: "retention_days", Reason: "must be at least 1"}))
+		_, err = config.ParseOverride("small", "two")
+		Ω(err).To(Equal(&api.InvalidParameterError{Name: "retention_days", Reason: "must be a whole number of days"}))
+
+		Ω(config.Days("small", 0)).To(Equal(3))
+		Ω(config.Days("small", 2)).To(Equal(2))
+		Ω(config.Days("large", 0)).To(Equal(7))
+	})
+
+	It("runs daily at the configured time", func() {
+		now := time.Date(2015, 6, 4, 12, 0, 0, 0, time.UTC)
+		Ω(elasticsearch.NextDailyRun(now, "03:00")).To(Equal(time.Date(2015, 6, 5, 3, 0, 0, 0, time.UTC)))
+		Ω(elasticsearch.NextDailyRun(now, "12:30")).To(Equal(time.Date(2015, 6, 4, 12, 30, 0, 0, time.UTC)))
+		_, err := elasticsearch.NextDailyRun(now, "3am")
+		Ω(err).To(MatchError("elasticsearch retention run_at '3am' is not a time of day such as 03:00"))
+	})
+
+	It("checks the settings", func() {
+		config := elasticsearch.RetentionConfiguration{}
+		config.SetDefaults()
+		Ω(config.Check()).To(Succeed())
+
+		config.DefaultDays = -1
+		Ω(config.Check()).To(MatchError("elasticsearch retention of plan 'default' may not be negative"))
+
+		config.DefaultDays = 0
+		config.Plans = map[string]elasticsearch.PlanRetention{"small": {Days: 10, MaxDays: 5}}
+		Ω(config.Check()).To(MatchError("elasticsearch retention of plan 'small' keeps more than its max_days"))
+	})
+
+	Describe("of Elasticsearch service instances", func() {
+		var (
+			tmpDir string
+			broker *elasticsearch.ServiceBroker
+			ctx    context.Context
+			params map[string]string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "elasticsearch-retention")
+			Ω(err).ToNot(HaveOccurred())
+
+			config := elasticsearch.Configuration{
+				Hosts:         []string{server.URL},
+				OfferService:  true,
+				DataDirectory: path.Join(tmpDir, "instances"),
+				Retention:     elasticsearch.RetentionConfiguration{DefaultDays: 7, DefaultMaxDays: 30},
+			}
+			broker = elasticsearch.NewServiceBroker(config, lagertest.NewTestLogger("elasticsearch-retention"))
+			ctx = context.Background()
+			params = map[string]string{"service_id": elasticsearch.ServiceId, "plan_id": elasticsearch.PlanId}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("takes retention_days when provisioning and updating", func() {
+			params["retention_days"] = "14"
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(broker.RetentionTargets()).To(Equal([]elasticsearch.RetentionTarget{
+				{InstanceId: "instance-1", PlanId: elasticsearch.PlanId, IndexPrefix: "logsearch-instance-1", Days: 14},
+			}))
+
+			Ω(broker.Update(ctx, "instance-1", map[string]string{"service_id": elasticsearch.ServiceId, "retention_days": "30"})).To(Succeed())
+			targets, err := broker.RetentionTargets()
+			Ω(err).ToNot(HaveOccurred())
+			Ω(targets[0].Days).To(Equal(30))
+
+			Ω(broker.Update(ctx, "instance-1", map[string]string{"retention_days": "31"})).To(Equal(&api.InvalidParameterError{
+				Name:   "retention_days",
+				Reason: "may be at most 30 on this plan",
+			}))
+		})
+
+		It("refuses updates of anything else", func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(broker.Update(ctx, "instance-1", map[string]string{"plan_id": "other-plan"})).To(Equal(&api.InvalidParameterError{
+				Name:   "plan_id",
+				Reason: "the plan of an instance cannot be changed",
+			}))
+			Ω(broker.Update(ctx, "instance-1", map[string]string{"filters": ""})).To(Equal(&api.InvalidParameterError{
+				Name:   "filters",
+				Reason: "cannot be updated",
+			}))
+			Ω(broker.Update(ctx, "instance-2", map[string]string{})).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+})
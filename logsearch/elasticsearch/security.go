@@ -0,0 +1,104 @@
+package elasticsearch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/pivotal-golang/lager"
+)
+
+// The bind parameter choosing what a binding may do with the indices of its instance
+const AccessParameter = "access"
+
+// Binding access flavors
+const (
+	AccessReadWrite = "read-write"
+	AccessReadOnly  = "read-only"
+)
+
+// Index privileges by access; writing to a new daily index creates it
+var accessPrivileges = map[string][]string{
+	AccessReadWrite: {"read", "view_index_metadata", "write", "create_index"},
+	AccessReadOnly:  {"read", "view_index_metadata"},
+}
+
+// The access a binding asks for, read-write unless the access parameter says otherwise
+func bindingAccess(params map[string]string) (string, error) {
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "service_id", "plan_id", "app_guid", AccessParameter:
+		default:
+			return "", &api.InvalidParameterError{Name: name, Reason: "cannot be given when binding"}
+		}
+	}
+
+	access, ok := params[AccessParameter]
+	if !ok {
+		return AccessReadWrite, nil
+	}
+	if _, known := accessPrivileges[access]; !known {
+		return "", &api.InvalidParameterError{
+			Name:   AccessParameter,
+			Reason: fmt.Sprintf("unknown access '%s', expected %s or %s", access, AccessReadWrite, AccessReadOnly),
+		}
+	}
+	return access, nil
+}
+
+// The user and role of a binding, which share their name
+func bindingUsername(instance *Instance, bindingId string) string {
+	return IndexName(instance.IndexPrefix, bindingId)
+}
+
+// Creates the role and user of a binding, removing the role again when the user cannot be created
+func (broker *ServiceBroker) createBindingUser(logger lager.Logger, instance *Instance, binding *Binding, password string) error {
+	err := broker.Client.PutRole(binding.Username, Role{
+		Indices: []IndexPrivileges{{
+			Names:      []string{instance.Alias(), instance.IndexPattern()},
+			Privileges: accessPrivileges[binding.Access],
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = broker.Client.PutUser(binding.Username, User{
+		Password: password,
+		Roles:    []string{binding.Username},
+		Metadata: map[string]string{"instance_id": instance.Id, "binding_id": binding.Id},
+	})
+	if err != nil {
+		if roleErr := broker.Client.DeleteRole(binding.Username); roleErr != nil {
+			logger.Error("removing-binding-role", roleErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Deletes the user and role of a binding; bindings made before bindings had users have none
+func (broker *ServiceBroker) deleteBindingUser(binding *Binding) error {
+	if binding.Username == "" {
+		return nil
+	}
+	if err := broker.Client.DeleteUser(binding.Username); err != nil {
+		return err
+	}
+	return broker.Client.DeleteRole(binding.Username)
+}
+
+func generatePassword() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
@@ -0,0 +1,71 @@
+package ingress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// The ingress section of the broker config
+type Configuration struct {
+	// Takes the syslog of every logstash instance on one port, routed by the token of a binding
+	Enabled bool `yaml:"enabled"`
+	// The address the ingress listens on
+	Listen string `yaml:"listen"`
+	// The host given to bindings in their drain urls; the logstash host by default
+	Host string `yaml:"host"`
+	// Messages read from a connection that are not forwarded yet; a full queue stops reading from the connection
+	QueueSize int `yaml:"queue_size"`
+	// The longest message taken, in bytes
+	MaxMessageSize int `yaml:"max_message_size"`
+	// How long forwarding a message to an instance may take before its connection is given up
+	ForwardTimeoutSeconds int `yaml:"forward_timeout_seconds"`
+	// How long a connection may send nothing before it is closed
+	IdleTimeoutSeconds int `yaml:"idle_timeout_seconds"`
+	// Connections served at once; further ones are closed right after they are accepted
+	MaxConnections int `yaml:"max_connections"`
+}
+
+func (config *Configuration) SetDefaults() {
+	if config.Listen == "" {
+		config.Listen = "0.0.0.0:5514"
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 100
+	}
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = 64 * 1024
+	}
+	if config.ForwardTimeoutSeconds == 0 {
+		config.ForwardTimeoutSeconds = 10
+	}
+	if config.IdleTimeoutSeconds == 0 {
+		config.IdleTimeoutSeconds = 300
+	}
+	if config.MaxConnections == 0 {
+		config.MaxConnections = 1000
+	}
+}
+
+func (config Configuration) Check() error {
+	if !config.Enabled {
+		return nil
+	}
+	if _, err := config.Port(); err != nil {
+		return fmt.Errorf("ingress listen: %s", err)
+	}
+	if config.QueueSize < 0 || config.MaxMessageSize < 0 || config.ForwardTimeoutSeconds < 0 || config.IdleTimeoutSeconds < 0 || config.MaxConnections < 0 {
+		return errors.New("ingress queue_size, max_message_size, forward_timeout_seconds, idle_timeout_seconds and max_connections must be positive")
+	}
+	return nil
+}
+
+// The port of the listen address, which drain urls point at
+func (config Configuration) Port() (int, error) {
+	_, port, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
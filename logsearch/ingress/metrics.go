@@ -0,0 +1,39 @@
+package ingress
+
+import (
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+)
+
+var (
+	openConnections = metrics.NewGauge(
+		"logsearch_ingress_connections",
+		"Connections open to the ingress, by transport.",
+		"transport",
+	)
+	acceptedConnections = metrics.NewCounter(
+		"logsearch_ingress_connections_total",
+		"Connections accepted by the ingress, by transport.",
+		"transport",
+	)
+	refusedConnections = metrics.NewCounter(
+		"logsearch_ingress_refused_connections_total",
+		"Connections closed as they were accepted because max_connections were open.",
+	)
+	ingressMessages = metrics.NewCounter(
+		"logsearch_ingress_messages_total",
+		"Messages read by the ingress, by outcome: forwarded, unrouted, oversized or failed.",
+		"outcome",
+	)
+	forwardedBytes = metrics.NewCounter(
+		"logsearch_ingress_forwarded_bytes_total",
+		"Bytes of messages the ingress forwarded to instances.",
+	)
+	backpressureSeconds = metrics.NewCounter(
+		"logsearch_ingress_backpressure_seconds_total",
+		"Time connections were not read from because their queue was full.",
+	)
+)
+
+func init() {
+	metrics.MustRegister(openConnections, acceptedConnections, refusedConnections, ingressMessages, forwardedBytes, backpressureSeconds)
+}
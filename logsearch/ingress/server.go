@@ -0,0 +1,456 @@
+// Package ingress takes the syslog of every logstash instance on one port and forwards each message to the port of
+// its instance, found from the token of a binding.
+package ingress
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// Resolves the token of a binding to the address of the instance it ships to
+type Router interface {
+	// The host:port of the instance, ErrUnknownToken when no binding has the token
+	Route(token string) (string, error)
+}
+
+var ErrUnknownToken = errors.New("unknown ingress token")
+
+// How long a connection keeps the address of a token before asking the Router again, so unbinding takes effect on
+// connections that stay open
+const routeExpiry = 30 * time.Second
+
+// Server implements the ingress.
+//
+// A connection carries either syslog, octet counted or one message per line, with the token in the structured
+// data of each message, or HTTP POSTs of messages to /<token>, as http syslog drains send them. Every connection has
+// a queue of its own between reading and forwarding; when it is full the connection is not read from until the
+// instances have caught up, so a slow instance slows down its senders rather than the ingress. Connections that send
+// nothing for idle_timeout_seconds are closed, and beyond max_connections new ones are closed as they come.
+type Server struct {
+	Config Configuration
+	Router Router
+	Logger lager.Logger
+
+	mutex       sync.Mutex
+	listener    net.Listener
+	connections map[net.Conn]bool
+	closed      bool
+}
+
+func NewServer(config Configuration, router Router, logger lager.Logger) *Server {
+	return &Server{
+		Config: config,
+		Router: router,
+		Logger: logger,
+	}
+}
+
+// ListenAndServe serves the listen address of the config until the server is closed
+func (server *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", server.Config.Listen)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// Serve takes the connections of listener until the server is closed
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	server.listener = listener
+	server.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.isClosed() {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				server.Logger.Error("accepting-connection", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		tracked, closed := server.track(conn)
+		if closed {
+			conn.Close()
+			return nil
+		}
+		if !tracked {
+			refusedConnections.Inc()
+			conn.Close()
+			continue
+		}
+		go server.handle(conn)
+	}
+}
+
+// Close stops listening and closes every connection once it has forwarded what it read
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closed {
+		return nil
+	}
+	server.closed = true
+	for conn := range server.connections {
+		conn.Close()
+	}
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Close()
+}
+
+func (server *Server) isClosed() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.closed
+}
+
+// Whether the connection is served, which it is not once the server is closed or max_connections are served
+func (server *Server) track(conn net.Conn) (tracked bool, closed bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closed {
+		return false, true
+	}
+	if len(server.connections) >= server.Config.MaxConnections {
+		return false, false
+	}
+	if server.connections == nil {
+		server.connections = map[net.Conn]bool{}
+	}
+	server.connections[conn] = true
+	return true, false
+}
+
+// Gives the sender of conn idle_timeout_seconds to send something more
+func (server *Server) extendDeadline(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(server.Config.IdleTimeoutSeconds) * time.Second))
+}
+
+func (server *Server) forget(conn net.Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	delete(server.connections, conn)
+}
+
+func (server *Server) handle(conn net.Conn) {
+	defer server.forget(conn)
+	defer conn.Close()
+
+	logger := server.Logger.Session("connection", lager.Data{"remote-addr": conn.RemoteAddr().String()})
+	reader := bufio.NewReader(conn)
+	server.extendDeadline(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	// syslog starts with a PRI or an octet count, HTTP with a method
+	transport := "syslog"
+	if first[0] >= 'A' && first[0] <= 'Z' {
+		transport = "http"
+	}
+	acceptedConnections.Inc(transport)
+	openConnections.Add(1, transport)
+	defer openConnections.Add(-1, transport)
+
+	forwarder := newForwarder(server, logger)
+	defer forwarder.close()
+	if transport == "http" {
+		server.serveHTTP(conn, reader, forwarder)
+	} else {
+		server.serveSyslog(conn, reader, forwarder)
+	}
+}
+
+func (server *Server) serveSyslog(conn net.Conn, reader *bufio.Reader, forwarder *forwarder) {
+	for {
+		server.extendDeadline(conn)
+		message, err := readMessage(reader, server.Config.MaxMessageSize)
+		if err == errTooLong {
+			ingressMessages.Inc("oversized")
+			continue
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				forwarder.logger.Info("closing-idle-connection")
+			} else if err != io.EOF && !server.isClosed() {
+				forwarder.logger.Info("reading-failed", lager.Data{"error": err.Error()})
+			}
+			return
+		}
+		if len(message) == 0 {
+			continue
+		}
+
+		token, message := extractToken(message)
+		if token == "" {
+			forwarder.unrouted(ErrUnknownToken)
+			continue
+		}
+		address, err := forwarder.route(token)
+		if err != nil {
+			forwarder.unrouted(err)
+			continue
+		}
+		forwarder.enqueue(delivery{address: address, message: message})
+	}
+}
+
+func (server *Server) serveHTTP(conn net.Conn, reader *bufio.Reader, forwarder *forwarder) {
+	for {
+		server.extendDeadline(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+
+		status := server.serveRequest(request, forwarder)
+		// an unread body would be taken for the next request
+		closing := request.Close || status == http.StatusRequestEntityTooLarge
+		if !closing {
+			if _, err := io.Copy(ioutil.Discard, request.Body); err != nil {
+				closing = true
+			}
+		}
+		request.Body.Close()
+
+		response := &http.Response{
+			StatusCode: status,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Request:    request,
+			Header:     http.Header{},
+			Close:      closing,
+		}
+		if err := response.Write(conn); err != nil || closing {
+			return
+		}
+	}
+}
+
+// Queues the messages of a request, one per line, for the instance of the token in its path
+func (server *Server) serveRequest(request *http.Request, forwarder *forwarder) int {
+	if request.Method != "POST" {
+		return http.StatusMethodNotAllowed
+	}
+	token := strings.TrimPrefix(request.URL.Path, "/")
+	if token == "" || strings.Contains(token, "/") {
+		forwarder.unrouted(ErrUnknownToken)
+		return http.StatusNotFound
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, int64(server.Config.MaxMessageSize)+1))
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	if len(body) > server.Config.MaxMessageSize {
+		ingressMessages.Inc("oversized")
+		return http.StatusRequestEntityTooLarge
+	}
+
+	address, err := forwarder.route(token)
+	if err != nil {
+		forwarder.unrouted(err)
+		if err == ErrUnknownToken {
+			return http.StatusNotFound
+		}
+		return http.StatusServiceUnavailable
+	}
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		// the token of the path wins; one in the structured data is only dropped
+		_, message := extractToken(line)
+		forwarder.enqueue(delivery{address: address, message: message})
+	}
+	return http.StatusNoContent
+}
+
+type delivery struct {
+	address string
+	message []byte
+}
+
+type route struct {
+	address string
+	expires time.Time
+}
+
+// Forwards the messages read from one connection. Routes are only used by the reading goroutine, the connections
+// to instances only by the forwarding one.
+type forwarder struct {
+	server *Server
+	logger lager.Logger
+
+	queue chan delivery
+	done  chan struct{}
+
+	routes map[string]route
+	// whether the connection logged an unroutable message already
+	loggedUnrouted bool
+
+	upstreams map[string]*upstream
+	// addresses the connection could not forward to, logged once until they work again
+	failing map[string]bool
+}
+
+func newForwarder(server *Server, logger lager.Logger) *forwarder {
+	forwarder := &forwarder{
+		server:    server,
+		logger:    logger,
+		queue:     make(chan delivery, server.Config.QueueSize),
+		done:      make(chan struct{}),
+		routes:    map[string]route{},
+		upstreams: map[string]*upstream{},
+		failing:   map[string]bool{},
+	}
+	go forwarder.run()
+	return forwarder
+}
+
+func (forwarder *forwarder) route(token string) (string, error) {
+	if cached, ok := forwarder.routes[token]; ok && time.Now().Before(cached.expires) {
+		return cached.address, nil
+	}
+	address, err := forwarder.server.Router.Route(token)
+	if err != nil {
+		delete(forwarder.routes, token)
+		return "", err
+	}
+	forwarder.routes[token] = route{address: address, expires: time.Now().Add(routeExpiry)}
+	return address, nil
+}
+
+func (forwarder *forwarder) unrouted(err error) {
+	ingressMessages.Inc("unrouted")
+	if err != ErrUnknownToken {
+		forwarder.logger.Error("routing-failed", err)
+		return
+	}
+	if !forwarder.loggedUnrouted {
+		forwarder.logger.Info("dropping-unrouted-messages")
+		forwarder.loggedUnrouted = true
+	}
+}
+
+// Queues a message, waiting for room when the instances are slower than the sender
+func (forwarder *forwarder) enqueue(message delivery) {
+	select {
+	case forwarder.queue <- message:
+		return
+	default:
+	}
+
+	started := time.Now()
+	forwarder.queue <- message
+	backpressureSeconds.Add(time.Since(started).Seconds())
+}
+
+// Forwards what is still queued and closes the connections to instances
+func (forwarder *forwarder) close() {
+	close(forwarder.queue)
+	<-forwarder.done
+}
+
+func (forwarder *forwarder) run() {
+	defer close(forwarder.done)
+	for message := range forwarder.queue {
+		forwarder.forward(message)
+	}
+	for _, connection := range forwarder.upstreams {
+		connection.Close()
+	}
+}
+
+func (forwarder *forwarder) forward(message delivery) {
+	timeout := time.Duration(forwarder.server.Config.ForwardTimeoutSeconds) * time.Second
+	line := append(message.message, '\n')
+
+	var err error
+	// an instance restarted since its connection was opened takes a second attempt
+	for attempt := 0; attempt < 2; attempt++ {
+		connection, ok := forwarder.upstreams[message.address]
+		if ok && connection.isClosed() {
+			connection.Close()
+			ok = false
+		}
+		if !ok {
+			connection, err = dialUpstream(message.address, timeout)
+			if err != nil {
+				break
+			}
+			forwarder.upstreams[message.address] = connection
+		}
+
+		connection.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err = connection.Write(line); err == nil {
+			ingressMessages.Inc("forwarded")
+			forwardedBytes.Add(float64(len(line)))
+			delete(forwarder.failing, message.address)
+			return
+		}
+		connection.Close()
+		delete(forwarder.upstreams, message.address)
+	}
+
+	ingressMessages.Inc("failed")
+	if !forwarder.failing[message.address] {
+		forwarder.logger.Error("forwarding-failed", err, lager.Data{"address": message.address})
+		forwarder.failing[message.address] = true
+	}
+}
+
+// A connection to an instance. Instances never write to the ingress, so a read only returns once they closed their
+// end, which a write would not notice before a message is lost.
+type upstream struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func dialUpstream(address string, timeout time.Duration) (*upstream, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	connection := &upstream{Conn: conn, closed: make(chan struct{})}
+	go func() {
+		defer close(connection.closed)
+		io.Copy(ioutil.Discard, conn)
+	}()
+	return connection, nil
+}
+
+func (connection *upstream) isClosed() bool {
+	select {
+	case <-connection.closed:
+		return true
+	default:
+		return false
+	}
+}
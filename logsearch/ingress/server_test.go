@@ -0,0 +1,364 @@
+package ingress_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/ingress"
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Routes the tokens it knows to their addresses
+type fakeRouter map[string]string
+
+func (router fakeRouter) Route(token string) (string, error) {
+	address, ok := router[token]
+	if !ok {
+		return "", ingress.ErrUnknownToken
+	}
+	return address, nil
+}
+
+// A logstash tcp input, passing on the lines it reads once it is resumed
+type fakeInstance struct {
+	listener net.Listener
+	lines    chan string
+	resume   chan struct{}
+
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeInstance(paused bool) *fakeInstance {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ω(err).ToNot(HaveOccurred())
+	instance := &fakeInstance{listener: listener, lines: make(chan string, 10000), resume: make(chan struct{})}
+	if !paused {
+		close(instance.resume)
+	}
+	go instance.serve(listener)
+	return instance
+}
+
+func (instance *fakeInstance) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		instance.mutex.Lock()
+		instance.conns = append(instance.conns, conn)
+		instance.mutex.Unlock()
+
+		go func() {
+			defer conn.Close()
+			<-instance.resume
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 128*1024), 128*1024)
+			for scanner.Scan() {
+				instance.lines <- scanner.Text()
+			}
+		}()
+	}
+}
+
+// Drops every connection and listens again on the same address
+func (instance *fakeInstance) restart() {
+	instance.close()
+	listener, err := net.Listen("tcp", instance.address())
+	Ω(err).ToNot(HaveOccurred())
+	instance.listener = listener
+	go instance.serve(listener)
+}
+
+func (instance *fakeInstance) close() {
+	instance.listener.Close()
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	for _, conn := range instance.conns {
+		conn.Close()
+	}
+	instance.conns = nil
+}
+
+func (instance *fakeInstance) address() string {
+	return instance.listener.Addr().String()
+}
+
+var _ = Describe("Server", func() {
+	var config ingress.Configuration
+	var router fakeRouter
+	var server *ingress.Server
+	var address string
+	var instance1, instance2 *fakeInstance
+
+	send := func(data string) {
+		conn, err := net.Dial("tcp", address)
+		Ω(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(data))
+		Ω(err).ToNot(HaveOccurred())
+	}
+
+	// The value of a sample, e.g. logsearch_ingress_messages_total{outcome="forwarded"}
+	metricValue := func(sample string) float64 {
+		var buffer bytes.Buffer
+		Ω(metrics.DefaultRegistry.Write(&buffer)).To(Succeed())
+		for _, line := range strings.Split(buffer.String(), "\n") {
+			if strings.HasPrefix(line, sample+" ") {
+				value, err := strconv.ParseFloat(strings.TrimPrefix(line, sample+" "), 64)
+				Ω(err).ToNot(HaveOccurred())
+				return value
+			}
+		}
+		return 0
+	}
+
+	BeforeEach(func() {
+		config = ingress.Configuration{Enabled: true, Listen: "127.0.0.1:0"}
+		config.SetDefaults()
+		instance1 = newFakeInstance(false)
+		instance2 = newFakeInstance(false)
+		router = fakeRouter{"token-1": instance1.address(), "token-2": instance2.address()}
+	})
+
+	JustBeforeEach(func() {
+		listener, err := net.Listen("tcp", config.Listen)
+		Ω(err).ToNot(HaveOccurred())
+		address = listener.Addr().String()
+		server = ingress.NewServer(config, router, lagertest.NewTestLogger("ingress"))
+		go server.Serve(listener)
+	})
+
+	AfterEach(func() {
+		Ω(server.Close()).To(Succeed())
+		instance1.close()
+		instance2.close()
+	})
+
+	Describe("syslog", func() {
+		It("forwards each message to the instance of its token, without the token", func() {
+			first := `<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] hello`
+			second := `<14>1 2015-06-01T00:00:01Z host app - - [meta sequence="2"][logsearch@32473 token="token-2"] world`
+			third := `<14>1 2015-06-01T00:00:02Z host app - - [logsearch token="token-1"] again`
+			forwarded := metricValue(`logsearch_ingress_messages_total{outcome="forwarded"}`)
+			send(first + "\n" + fmt.Sprintf("%d %s", len(second), second) + third)
+
+			Eventually(instance1.lines).Should(Receive(Equal(`<14>1 2015-06-01T00:00:00Z host app - - - hello`)))
+			Eventually(instance1.lines).Should(Receive(Equal(`<14>1 2015-06-01T00:00:02Z host app - - - again`)))
+			Eventually(instance2.lines).Should(Receive(Equal(`<14>1 2015-06-01T00:00:01Z host app - - [meta sequence="2"] world`)))
+			Ω(metricValue(`logsearch_ingress_messages_total{outcome="forwarded"}`)).To(BeNumerically("==", forwarded+3))
+		})
+
+		It("drops messages without a known token and reads on", func() {
+			unrouted := metricValue(`logsearch_ingress_messages_total{outcome="unrouted"}`)
+			send(strings.Join([]string{
+				`<14>Jun  1 00:00:00 host app: not rfc 5424`,
+				`<14>1 2015-06-01T00:00:00Z host app - - - no structured data`,
+				`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="unknown"] unknown`,
+				`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] known`,
+			}, "\n"))
+
+			Eventually(instance1.lines).Should(Receive(HaveSuffix("known")))
+			Consistently(instance1.lines).ShouldNot(Receive())
+			Ω(metricValue(`logsearch_ingress_messages_total{outcome="unrouted"}`)).To(BeNumerically("==", unrouted+3))
+		})
+
+		Context("with a small max_message_size", func() {
+			BeforeEach(func() {
+				config.MaxMessageSize = 100
+			})
+
+			It("skips longer messages", func() {
+				long := `<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] ` + strings.Repeat("x", 200)
+				short := `<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] short`
+				send(long + "\n" + fmt.Sprintf("%d %s", len(long), long) + short + "\n")
+
+				Eventually(instance1.lines).Should(Receive(HaveSuffix("short")))
+				Consistently(instance1.lines).ShouldNot(Receive())
+			})
+		})
+
+		Context("when an instance reads slower than its sender writes", func() {
+			BeforeEach(func() {
+				config.QueueSize = 1
+				instance1 = newFakeInstance(true)
+				router["token-1"] = instance1.address()
+			})
+
+			It("stops reading from the connection until the instance catches up", func() {
+				message := `<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] ` + strings.Repeat("x", 60000) + "\n"
+				count := 1000
+				waited := metricValue("logsearch_ingress_backpressure_seconds_total")
+				sent := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					send(strings.Repeat(message, count))
+					close(sent)
+				}()
+
+				Consistently(sent, "500ms").ShouldNot(BeClosed())
+				close(instance1.resume)
+				Eventually(sent, "10s").Should(BeClosed())
+				for i := 0; i < count; i++ {
+					Eventually(instance1.lines, "10s").Should(Receive())
+				}
+				Ω(metricValue("logsearch_ingress_backpressure_seconds_total")).To(BeNumerically(">", waited+0.1))
+			})
+		})
+	})
+
+	Describe("http", func() {
+		post := func(path string, body string) int {
+			response, err := http.Post("http://"+address+path, "text/plain", strings.NewReader(body))
+			Ω(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("forwards the messages posted to the path of a token", func() {
+			Ω(post("/token-1", "<14>1 2015-06-01T00:00:00Z host app - - - first\n")).To(Equal(http.StatusNoContent))
+			Ω(post("/token-2", `<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] second`)).To(Equal(http.StatusNoContent))
+
+			Eventually(instance1.lines).Should(Receive(Equal("<14>1 2015-06-01T00:00:00Z host app - - - first")))
+			Eventually(instance2.lines).Should(Receive(Equal("<14>1 2015-06-01T00:00:00Z host app - - - second")))
+		})
+
+		It("refuses unknown tokens and requests that are not posts", func() {
+			Ω(post("/unknown", "<14>1 2015-06-01T00:00:00Z host app - - - lost")).To(Equal(http.StatusNotFound))
+			Ω(post("/", "<14>1 2015-06-01T00:00:00Z host app - - - lost")).To(Equal(http.StatusNotFound))
+
+			response, err := http.Get("http://" + address + "/token-1")
+			Ω(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			Ω(response.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+			Consistently(instance1.lines).ShouldNot(Receive())
+		})
+	})
+
+	It("reconnects to an instance that restarted", func() {
+		conn, err := net.Dial("tcp", address)
+		Ω(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] before` + "\n"))
+		Ω(err).ToNot(HaveOccurred())
+		Eventually(instance1.lines).Should(Receive(HaveSuffix("before")))
+
+		instance1.restart()
+		// as long as an agent takes to come back, for the ingress to see its connection close
+		time.Sleep(100 * time.Millisecond)
+		_, err = conn.Write([]byte(`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] after` + "\n"))
+		Ω(err).ToNot(HaveOccurred())
+		Eventually(instance1.lines, "2s").Should(Receive(HaveSuffix("after")))
+	})
+
+	// Whether the ingress closes conn within timeout
+	closedWithin := func(conn net.Conn, timeout time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err := conn.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return false
+		}
+		return err != nil
+	}
+
+	Context("with an idle_timeout_seconds", func() {
+		BeforeEach(func() {
+			config.IdleTimeoutSeconds = 1
+		})
+
+		It("keeps connections open while they send", func() {
+			conn, err := net.Dial("tcp", address)
+			Ω(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			for i := 0; i < 4; i++ {
+				_, err = conn.Write([]byte(`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] busy` + "\n"))
+				Ω(err).ToNot(HaveOccurred())
+				Eventually(instance1.lines).Should(Receive(HaveSuffix("busy")))
+				time.Sleep(400 * time.Millisecond)
+			}
+			Ω(closedWithin(conn, 100*time.Millisecond)).To(BeFalse())
+		})
+
+		It("closes connections that send nothing for that long", func() {
+			conn, err := net.Dial("tcp", address)
+			Ω(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte(`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] once` + "\n"))
+			Ω(err).ToNot(HaveOccurred())
+			Eventually(instance1.lines).Should(Receive(HaveSuffix("once")))
+
+			Ω(closedWithin(conn, 3*time.Second)).To(BeTrue())
+		})
+
+		It("closes idle http connections between requests", func() {
+			conn, err := net.Dial("tcp", address)
+			Ω(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			body := "<14>1 2015-06-01T00:00:00Z host app - - - kept alive"
+			fmt.Fprintf(conn, "POST /token-1 HTTP/1.1\r\nHost: ingress\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(response.StatusCode).To(Equal(http.StatusNoContent))
+
+			Ω(closedWithin(conn, 3*time.Second)).To(BeTrue())
+		})
+	})
+
+	Context("with max_connections", func() {
+		BeforeEach(func() {
+			config.MaxConnections = 1
+		})
+
+		It("closes connections beyond it until one of those it serves is closed", func() {
+			first, err := net.Dial("tcp", address)
+			Ω(err).ToNot(HaveOccurred())
+			_, err = first.Write([]byte(`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] first` + "\n"))
+			Ω(err).ToNot(HaveOccurred())
+			Eventually(instance1.lines).Should(Receive(HaveSuffix("first")))
+			refused := metricValue("logsearch_ingress_refused_connections_total")
+
+			second, err := net.Dial("tcp", address)
+			Ω(err).ToNot(HaveOccurred())
+			defer second.Close()
+			Ω(closedWithin(second, 2*time.Second)).To(BeTrue())
+			Ω(metricValue("logsearch_ingress_refused_connections_total")).To(BeNumerically("==", refused+1))
+
+			first.Close()
+			Eventually(func() bool {
+				third, err := net.Dial("tcp", address)
+				Ω(err).ToNot(HaveOccurred())
+				defer third.Close()
+				return closedWithin(third, 100*time.Millisecond)
+			}).Should(BeFalse())
+		})
+	})
+
+	It("closes the connections it serves when closed", func() {
+		conn, err := net.Dial("tcp", address)
+		Ω(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(`<14>1 2015-06-01T00:00:00Z host app - - [logsearch token="token-1"] open` + "\n"))
+		Ω(err).ToNot(HaveOccurred())
+		Eventually(instance1.lines).Should(Receive())
+
+		Ω(server.Close()).To(Succeed())
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Ω(err).To(HaveOccurred())
+		if netErr, ok := err.(net.Error); ok {
+			Ω(netErr.Timeout()).To(BeFalse())
+		}
+	})
+})
@@ -0,0 +1,206 @@
+package ingress
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// The SD-ID of the structured data element carrying the token of a binding, e.g. [logsearch token="..."];
+// enterprise ids such as logsearch@32473 are taken too
+const StructuredDataId = "logsearch"
+
+// Longer octet counts are taken for garbage rather than skipped like messages over max_message_size
+const maxFrameLength = 16 * 1024 * 1024
+
+var (
+	// The message was longer than max_message_size and was skipped
+	errTooLong = errors.New("message too long")
+	// The stream cannot be read on from here
+	errMalformedFrame = errors.New("malformed octet count")
+)
+
+// Reads the next message of a syslog stream, octet counted (RFC 6587) when it starts with a digit and terminated by
+// a newline otherwise. Messages longer than max are skipped with errTooLong.
+func readMessage(reader *bufio.Reader, max int) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		return readCounted(reader, max)
+	}
+	return readLine(reader, max)
+}
+
+func readCounted(reader *bufio.Reader, max int) ([]byte, error) {
+	length := 0
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == ' ' {
+			break
+		}
+		if b < '0' || b > '9' || length > maxFrameLength {
+			return nil, errMalformedFrame
+		}
+		length = length*10 + int(b-'0')
+	}
+
+	if length > max {
+		if _, err := reader.Discard(length); err != nil {
+			return nil, err
+		}
+		return nil, errTooLong
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func readLine(reader *bufio.Reader, max int) ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 {
+			// skip the rest of the line, keeping the stream in step
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, errTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// the last message of a stream may not be terminated
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// Finds the token of a binding in the structured data of an RFC 5424 message. The message is returned without the
+// element carrying the token, so the token does not end up in the indices of the instance. Messages that are not
+// RFC 5424 have no token.
+func extractToken(message []byte) (string, []byte) {
+	start := structuredData(message)
+	if start < 0 || message[start] != '[' {
+		return "", message
+	}
+
+	token := ""
+	kept := []byte{}
+	position := start
+	for position < len(message) && message[position] == '[' {
+		end, id, params, ok := parseElement(message, position)
+		if !ok {
+			return "", message
+		}
+		if token == "" && isTokenElement(id) && params["token"] != "" {
+			token = params["token"]
+		} else {
+			kept = append(kept, message[position:end]...)
+		}
+		position = end
+	}
+	if token == "" {
+		return "", message
+	}
+	if len(kept) == 0 {
+		kept = []byte("-")
+	}
+
+	stripped := append([]byte{}, message[:start]...)
+	stripped = append(stripped, kept...)
+	return token, append(stripped, message[position:]...)
+}
+
+// The offset of the STRUCTURED-DATA of an RFC 5424 message, following PRI, VERSION, TIMESTAMP, HOSTNAME, APP-NAME,
+// PROCID and MSGID; -1 for other messages
+func structuredData(message []byte) int {
+	if len(message) == 0 || message[0] != '<' {
+		return -1
+	}
+	pri := bytes.IndexByte(message, '>')
+	// RFC 3164 messages go on with a month instead of a version
+	if pri < 2 || pri > 4 || pri+1 >= len(message) || message[pri+1] < '1' || message[pri+1] > '9' {
+		return -1
+	}
+
+	position := pri
+	for field := 0; field < 6; field++ {
+		next := bytes.IndexByte(message[position:], ' ')
+		if next < 0 {
+			return -1
+		}
+		position += next + 1
+	}
+	if position >= len(message) {
+		return -1
+	}
+	return position
+}
+
+// Parses the SD-ELEMENT starting at position, returning the offset following it
+func parseElement(message []byte, position int) (int, string, map[string]string, bool) {
+	position++
+	idEnd := position
+	for idEnd < len(message) && message[idEnd] != ' ' && message[idEnd] != ']' {
+		idEnd++
+	}
+	id := string(message[position:idEnd])
+	position = idEnd
+
+	params := map[string]string{}
+	for position < len(message) && message[position] == ' ' {
+		position++
+		equals := bytes.IndexByte(message[position:], '=')
+		if equals < 1 || position+equals+1 >= len(message) || message[position+equals+1] != '"' {
+			return 0, "", nil, false
+		}
+		name := string(message[position : position+equals])
+		position += equals + 2
+
+		value := []byte{}
+		for {
+			if position >= len(message) {
+				return 0, "", nil, false
+			}
+			b := message[position]
+			if b == '"' {
+				break
+			}
+			if b == '\\' && position+1 < len(message) && bytes.IndexByte([]byte(`"\]`), message[position+1]) >= 0 {
+				position++
+				b = message[position]
+			}
+			value = append(value, b)
+			position++
+		}
+		params[name] = string(value)
+		position++
+	}
+
+	if position >= len(message) || message[position] != ']' {
+		return 0, "", nil, false
+	}
+	return position + 1, id, params, true
+}
+
+func isTokenElement(id string) bool {
+	return id == StructuredDataId || strings.HasPrefix(id, StructuredDataId+"@")
+}
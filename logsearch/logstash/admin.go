@@ -0,0 +1,157 @@
+package logstash
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/pivotal-golang/lager"
+)
+
+func (broker *logstashServiceBroker) ListInstances(filter InstanceFilter) ([]InstanceDetails, error) {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+
+	details := []InstanceDetails{}
+	for _, instance := range instances {
+		instanceDetails := broker.instanceDetails(instance)
+		if filter.Matches(instanceDetails) {
+			details = append(details, instanceDetails)
+		}
+	}
+
+	return details, nil
+}
+
+func (broker *logstashServiceBroker) GetInstance(instanceId string) (InstanceDetails, error) {
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return InstanceDetails{}, ServiceInstanceDoesNotExistsError
+	}
+
+	bindings, err := broker.InstanceRepository.FindBindings(instanceId)
+	if err != nil {
+		return InstanceDetails{}, err
+	}
+
+	details := broker.instanceDetails(instance)
+	details.Bindings = []BindingDetails{}
+	for _, binding := range bindings {
+		details.Bindings = append(details.Bindings, BindingDetails{
+			Id:        binding.Id,
+			CreatedBy: binding.CreatedBy,
+			CreatedAt: binding.CreatedAt,
+		})
+	}
+
+	return details, nil
+}
+
+func (broker *logstashServiceBroker) RestartInstance(ctx context.Context, instanceId string) error {
+	err := broker.StopInstance(ctx, instanceId)
+	if err != nil {
+		return err
+	}
+
+	err = broker.StartInstance(ctx, instanceId)
+	agentRestarts.Inc()
+
+	return err
+}
+
+// StartInstance starts the agent of an instance, leaving it alone if it is already running.
+func (broker *logstashServiceBroker) StartInstance(ctx context.Context, instanceId string) error {
+	logger := LoggerFromContext(ctx, broker.Logger)
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return ServiceInstanceDoesNotExistsError
+	}
+
+	if broker.ProcessStarter.Status(instance).State == ProcessRunning {
+		return nil
+	}
+
+	started := time.Now()
+	err = broker.ProcessStarter.Start(logger, instance, time.Duration(30)*time.Second)
+	agentStartDuration.Observe(time.Since(started).Seconds(), outcome(err))
+
+	return err
+}
+
+func (broker *logstashServiceBroker) StopInstance(ctx context.Context, instanceId string) error {
+	logger := LoggerFromContext(ctx, broker.Logger)
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return ServiceInstanceDoesNotExistsError
+	}
+
+	return broker.ProcessStarter.Stop(logger, instance, agentStopTimeout)
+}
+
+// RenderInstanceConfig rewrites the logstash.conf of an instance from the current template.
+// The agent only picks the change up when it is restarted.
+func (broker *logstashServiceBroker) RenderInstanceConfig(instanceId string) error {
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return ServiceInstanceDoesNotExistsError
+	}
+
+	return RenderConfig(instance)
+}
+
+// ForceDeleteInstance removes an instance even when its metadata can no longer
+// be read, stopping its agent first whenever the pid file is still there.
+func (broker *logstashServiceBroker) ForceDeleteInstance(ctx context.Context, instanceId string) error {
+	logger := LoggerFromContext(ctx, broker.Logger)
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		instance = &Instance{
+			Id:       instanceId,
+			Basepath: path.Join(broker.ServiceConfiguration.InstanceDataDirectory, instanceId),
+			LogDir:   path.Join(broker.ServiceConfiguration.InstanceLogDirectory, instanceId),
+		}
+		if _, statErr := os.Stat(instance.Basepath); statErr != nil {
+			return ServiceInstanceDoesNotExistsError
+		}
+		logger.Info("deleting-unreadable-instance", lager.Data{"error": err.Error()})
+	}
+
+	err = broker.ProcessStarter.Stop(logger, instance, agentStopTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = broker.InstanceRepository.Delete(instanceId)
+	if err != nil {
+		return err
+	}
+
+	if instanceCount, err := broker.InstanceRepository.GetInstanceCount(); err == nil {
+		serviceInstances.Set(float64(instanceCount))
+	}
+
+	return nil
+}
+
+func (broker *logstashServiceBroker) instanceDetails(instance *Instance) InstanceDetails {
+	return InstanceDetails{
+		Id:               instance.Id,
+		ServiceId:        instance.ServiceId,
+		PlanId:           instance.PlanId,
+		OrganizationGuid: instance.OrganizationGuid,
+		SpaceGuid:        instance.SpaceGuid,
+		Address:          instance.Address(),
+		CreatedBy:        instance.CreatedBy,
+		CreatedAt:        instance.CreatedAt,
+		Pipeline:         instance.Pipeline,
+		Filters:          instance.Filters,
+		Process:          broker.ProcessStarter.Status(instance),
+	}
+}
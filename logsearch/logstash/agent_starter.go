@@ -3,43 +3,104 @@ package logstash
 import (
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	. "github.com/malston/cf-logsearch-service-broker/api"
 	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
 )
 
 // LogstashAgentStarter implements the broker.go ProcessStarter interface.
 type LogstashAgentStarter struct {
-	CommandRunner system.CommandRunner
-	IsReady       IsReady
+	CommandRunner    system.CommandRunner
+	IsReady          IsReady
+	IsUDPReady       IsUDPReady
+	IsProcessRunning func(pid int) bool
+	StopProcess      func(pid int, timeout time.Duration) error
 }
 
 type Action func(success chan<- struct{}, terminate <-chan struct{})
 
 type IsReady func(address *net.TCPAddr) bool
 
-func NewProcessStarter(commandRunner system.CommandRunner) ProcessStarter {
+type IsUDPReady func(address *net.UDPAddr) bool
+
+// NewProcessStarter probes the ports of agents for probeTimeout at a time, so that a port that drops connections
+// does not hold up a start or a health check.
+func NewProcessStarter(commandRunner system.CommandRunner, probeTimeout time.Duration) *LogstashAgentStarter {
 	return &LogstashAgentStarter{
-		CommandRunner: commandRunner,
-		IsReady:       isListening,
+		CommandRunner:    commandRunner,
+		IsReady:          isListening(probeTimeout),
+		IsUDPReady:       isUDPListening,
+		IsProcessRunning: system.IsProcessRunning,
+		StopProcess:      system.StopProcess,
 	}
 }
 
-func (starter *LogstashAgentStarter) Start(instance *Instance, timeout time.Duration) error {
-	err := starter.CommandRunner.Run("logstash", instance.CommandArgs()...)
+func (starter *LogstashAgentStarter) Start(logger lager.Logger, instance *Instance, timeout time.Duration) error {
+	pid, err := starter.CommandRunner.Run(logger, "logstash", instance.CommandArgs()...)
 	if err != nil {
 		return fmt.Errorf("logstash failed to start: %s", err)
 	}
+	err = system.WritePidFile(instance.PidFilePath(), pid)
+	if err != nil {
+		return err
+	}
 	address, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", instance.Host, instance.Port))
 	if err != nil {
-		log.Printf("could not resolve address %s:%d because %s", instance.Host, instance.Port, err)
+		logger.Error("resolve-address", err, lager.Data{"address": instance.Address()})
 	}
 
 	return starter.Wait(address, timeout)
 }
 
+// Stop terminates the agent for an instance, if it is running, and removes its pid file. A process that took over
+// the pid of an agent that exited is left alone.
+func (starter *LogstashAgentStarter) Stop(logger lager.Logger, instance *Instance, timeout time.Duration) error {
+	pid, err := system.ReadPidFile(instance.PidFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == system.ErrPidReused {
+		logger.Info("removing-stale-pid-file", lager.Data{"pid": pid})
+		return os.Remove(instance.PidFilePath())
+	}
+	if err != nil {
+		return err
+	}
+
+	if starter.IsProcessRunning(pid) {
+		logger.Info("stopping-agent", lager.Data{"pid": pid})
+		if err := starter.StopProcess(pid, timeout); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(instance.PidFilePath())
+}
+
+// Status reports whether the agent recorded in the instance's pid file is still running.
+func (starter *LogstashAgentStarter) Status(instance *Instance) ProcessDetails {
+	pid, err := system.ReadPidFile(instance.PidFilePath())
+	if err == system.ErrPidReused {
+		return ProcessDetails{State: ProcessStopped, Pid: pid}
+	}
+	if err != nil {
+		return ProcessDetails{State: ProcessStopped}
+	}
+
+	if !starter.IsProcessRunning(pid) {
+		return ProcessDetails{State: ProcessStopped, Pid: pid}
+	}
+	return ProcessDetails{State: ProcessRunning, Pid: pid}
+}
+
 func (starter *LogstashAgentStarter) Wait(address *net.TCPAddr, timeout time.Duration) error {
 	return PerformActionWithin(timeout, func(success chan<- struct{}, terminate <-chan struct{}) {
 		for {
@@ -56,9 +117,89 @@ func (starter *LogstashAgentStarter) Wait(address *net.TCPAddr, timeout time.Dur
 	})
 }
 
-func isListening(address *net.TCPAddr) bool {
-	_, err := net.DialTCP("tcp", nil, address)
-	return err == nil
+// Probe checks the tcp and udp inputs of a running agent at the same time, timing how long each check takes.
+func (starter *LogstashAgentStarter) Probe(instance *Instance) []PortHealth {
+	tcp := PortHealth{Protocol: "tcp", Status: HealthStatusFailed}
+	udp := PortHealth{Protocol: "udp", Status: HealthStatusFailed}
+
+	var wait sync.WaitGroup
+	if tcpAddress, err := net.ResolveTCPAddr("tcp", instance.Address()); err == nil {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			tcp.Status, tcp.LatencyMillis = timeProbe(func() bool {
+				return starter.IsReady(tcpAddress)
+			})
+		}()
+	}
+	if udpAddress, err := net.ResolveUDPAddr("udp", instance.Address()); err == nil {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			udp.Status, udp.LatencyMillis = timeProbe(func() bool {
+				return starter.IsUDPReady(udpAddress)
+			})
+		}()
+	}
+	wait.Wait()
+
+	return []PortHealth{tcp, udp}
+}
+
+func timeProbe(probe func() bool) (string, float64) {
+	started := time.Now()
+	ready := probe()
+	latency := float64(time.Since(started)) / float64(time.Millisecond)
+	if !ready {
+		return HealthStatusFailed, latency
+	}
+	return HealthStatusOk, latency
+}
+
+func isListening(timeout time.Duration) IsReady {
+	return func(address *net.TCPAddr) bool {
+		conn, err := net.DialTimeout("tcp", address.String(), timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+}
+
+// A datagram sent to see whether a udp input answers would end up in its pipeline, so the sockets bound to the
+// port are looked up in the socket tables of the kernel instead.
+func isUDPListening(address *net.UDPAddr) bool {
+	for _, table := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		if boundUDPPort(table, address.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a socket table of /proc/net lists a socket bound to port, whatever its address
+func boundUDPPort(table string, port int) bool {
+	data, err := ioutil.ReadFile(table)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// local_address is <hex address>:<hex port>
+		separator := strings.LastIndex(fields[1], ":")
+		if separator < 0 {
+			continue
+		}
+		bound, err := strconv.ParseInt(fields[1][separator+1:], 16, 32)
+		if err == nil && int(bound) == port {
+			return true
+		}
+	}
+	return false
 }
 
 func PerformActionWithin(timeout time.Duration, action Action) error {
@@ -2,13 +2,19 @@ package logstash_test
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/malston/cf-logsearch-service-broker/api"
 	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
 	"github.com/pivotal-golang/lager/lagertest"
 
 	. "github.com/onsi/ginkgo"
@@ -19,11 +25,11 @@ type FakeCommandRunner struct {
 	Commands []string
 }
 
-func (fakeCommandRunner *FakeCommandRunner) Run(name string, args ...string) error {
+func (fakeCommandRunner *FakeCommandRunner) Run(_ lager.Logger, name string, args ...string) (int, error) {
 	cmd := name + " " + strings.Join(args, " ")
 	fakeCommandRunner.Commands = append(fakeCommandRunner.Commands, cmd)
 
-	return nil
+	return 4242, nil
 }
 
 var _ = Describe("Starter", func() {
@@ -31,37 +37,70 @@ var _ = Describe("Starter", func() {
 	var commandRunner *FakeCommandRunner
 	var instance *logstash.Instance
 	var isReadyFunc logstash.IsReady
+	var isUDPReadyFunc logstash.IsUDPReady
 	var starter *logstash.LogstashAgentStarter
+	var runningPids map[int]bool
+	var stoppedPids []int
+	var tmpDir string
 
 	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "agent-starter")
+		Ω(err).ToNot(HaveOccurred())
+
 		logger = lagertest.NewTestLogger("agent-starter")
 		commandRunner = &FakeCommandRunner{}
 		instance = &logstash.Instance{
-			Port: 6000,
-			Host: "localhost",
+			Port:     6000,
+			Host:     "localhost",
+			Basepath: tmpDir,
+			LogDir:   tmpDir,
 		}
+		runningPids = map[int]bool{}
+		stoppedPids = []int{}
 		isReadyFunc = func(address *net.TCPAddr) bool {
 			return true
 		}
+		isUDPReadyFunc = func(address *net.UDPAddr) bool {
+			return true
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
 	})
 	JustBeforeEach(func() {
 		starter = &logstash.LogstashAgentStarter{
 			CommandRunner: commandRunner,
 			IsReady:       isReadyFunc,
+			IsUDPReady:    isUDPReadyFunc,
+			IsProcessRunning: func(pid int) bool {
+				return runningPids[pid]
+			},
+			StopProcess: func(pid int, timeout time.Duration) error {
+				stoppedPids = append(stoppedPids, pid)
+				delete(runningPids, pid)
+				return nil
+			},
 		}
 	})
 	Describe("Start a logstash agent", func() {
 		Context("when the agent starts succesfully", func() {
 			It("should not error", func() {
-				err := starter.Start(instance, 1*time.Second)
+				err := starter.Start(logger, instance, 1*time.Second)
 				Expect(err).NotTo(HaveOccurred())
 			})
 			It("should execute the right command to start logstash", func() {
-				starter.Start(instance, 1*time.Second)
+				starter.Start(logger, instance, 1*time.Second)
 				Ω(commandRunner.Commands).To(Equal([]string{
-					"logstash agent --debug -f logstash.conf -l logstash.stdout.log -w " + (strconv.Itoa(runtime.NumCPU() / 2)),
+					"logstash agent --debug -f " + tmpDir + "/logstash.conf -l " + tmpDir + "/logstash.stdout.log -w " + (strconv.Itoa(runtime.NumCPU() / 2)),
 				}))
 			})
+			It("should record the pid of the agent", func() {
+				starter.Start(logger, instance, 1*time.Second)
+				pid, err := ioutil.ReadFile(instance.PidFilePath())
+				Ω(err).ToNot(HaveOccurred())
+				Ω(strings.Fields(string(pid))[0]).To(Equal("4242"))
+			})
 		})
 
 		Context("when the agent fails to start", func() {
@@ -73,9 +112,113 @@ var _ = Describe("Starter", func() {
 
 			It("returns the same error that the Wait returns", func() {
 				connectionTimeoutErr := errors.New("timeout")
-				err := starter.Start(instance, 1*time.Second)
+				err := starter.Start(logger, instance, 1*time.Second)
 				Ω(err).To(Equal(connectionTimeoutErr))
 			})
 		})
 	})
+
+	Describe("Stop a logstash agent", func() {
+		Context("when the agent is running", func() {
+			JustBeforeEach(func() {
+				Ω(starter.Start(logger, instance, 1*time.Second)).To(Succeed())
+				runningPids[4242] = true
+			})
+
+			It("reports it as running", func() {
+				Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessRunning, Pid: 4242}))
+			})
+
+			It("stops the process and removes the pid file", func() {
+				Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+				Ω(stoppedPids).To(Equal([]int{4242}))
+				_, err := os.Stat(instance.PidFilePath())
+				Ω(os.IsNotExist(err)).To(BeTrue())
+				Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessStopped}))
+			})
+		})
+
+		Context("when the agent was never started", func() {
+			It("does nothing", func() {
+				Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+				Ω(stoppedPids).To(BeEmpty())
+			})
+		})
+
+		Context("when the agent has died", func() {
+			JustBeforeEach(func() {
+				Ω(starter.Start(logger, instance, 1*time.Second)).To(Succeed())
+			})
+
+			It("reports it as stopped and only removes the pid file", func() {
+				Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessStopped, Pid: 4242}))
+				Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+				Ω(stoppedPids).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Stop an agent whose pid was taken by another process", func() {
+		var pid int
+
+		BeforeEach(func() {
+			// the test process stands in for the process that got the pid of the exited agent
+			pid = os.Getpid()
+			started, err := system.ProcessStartTime(pid)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(ioutil.WriteFile(instance.PidFilePath(), []byte(fmt.Sprintf("%d %d", pid, started-1)), 0644)).To(Succeed())
+			runningPids[pid] = true
+		})
+
+		It("reports the agent as stopped and leaves the process alone", func() {
+			Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessStopped, Pid: pid}))
+			Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+			Ω(stoppedPids).To(BeEmpty())
+			_, err := os.Stat(instance.PidFilePath())
+			Ω(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Probe a logstash agent", func() {
+		Context("when both inputs are listening", func() {
+			It("reports both ports as ok", func() {
+				ports := starter.Probe(instance)
+				Ω(ports).To(HaveLen(2))
+				Ω(ports[0].Protocol).To(Equal("tcp"))
+				Ω(ports[0].Status).To(Equal(api.HealthStatusOk))
+				Ω(ports[1].Protocol).To(Equal("udp"))
+				Ω(ports[1].Status).To(Equal(api.HealthStatusOk))
+			})
+		})
+
+		Context("when the udp input is not listening", func() {
+			BeforeEach(func() {
+				isUDPReadyFunc = func(address *net.UDPAddr) bool {
+					return false
+				}
+			})
+
+			It("reports only the udp port as failed", func() {
+				ports := starter.Probe(instance)
+				Ω(ports[0].Status).To(Equal(api.HealthStatusOk))
+				Ω(ports[1].Status).To(Equal(api.HealthStatusFailed))
+			})
+		})
+
+		Context("with the probes of NewProcessStarter", func() {
+			BeforeEach(func() {
+				starter = logstash.NewProcessStarter(commandRunner, 100*time.Millisecond)
+			})
+
+			It("connects to the tcp input", func() {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Ω(err).ToNot(HaveOccurred())
+				defer listener.Close()
+				instance.Host = "127.0.0.1"
+				instance.Port = listener.Addr().(*net.TCPAddr).Port
+
+				Ω(starter.Probe(instance)[0].Status).To(Equal(api.HealthStatusOk))
+			})
+		})
+	})
 })
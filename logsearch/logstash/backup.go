@@ -0,0 +1,543 @@
+package logstash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
+)
+
+// BackupFormatVersion is written to the manifest of every archive; Restore
+// refuses archives written by a newer broker.
+//
+// An archive holds
+//
+//	manifest.json
+//	templates/<name>                        every *.tmpl in the conf_path
+//	templates/pipelines/<pipeline>/<file>   the logstash.conf.tmpl and pipeline.yml of every pipeline
+//	instances/<id>/instance.json            metadata and port
+//	instances/<id>/tls/server.key           the key of the certificate of the TLS input, if there is one
+//	instances/<id>/logstash.conf            the rendered config, if there is one
+//	instances/<id>/bindings/<binding>.json
+const BackupFormatVersion = 1
+
+// Restore reads an archive into memory before writing anything, so it refuses entries and archives larger than these
+const (
+	maxBackupEntrySize   = 16 << 20
+	maxBackupArchiveSize = 256 << 20
+)
+
+type backupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Instances int       `json:"instances"`
+}
+
+// The contents of an archive, once read and checked
+type backupArchive struct {
+	manifest  *backupManifest
+	templates map[string][]byte
+	instances map[string]*instanceRecord
+	keys      map[string][]byte
+	configs   map[string][]byte
+	bindings  map[string][]*Binding
+}
+
+func (broker *logstashServiceBroker) Backup(w io.Writer) error {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	now := time.Now().UTC()
+
+	writeJSON := func(name string, v interface{}, mode int64) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeTarFile(tarWriter, name, data, mode, now)
+	}
+
+	err = writeJSON("manifest.json", backupManifest{Version: BackupFormatVersion, CreatedAt: now, Instances: len(instances)}, 0644)
+	if err != nil {
+		return err
+	}
+
+	templates, err := broker.templates()
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedNames(templates) {
+		if err := writeTarFile(tarWriter, path.Join("templates", name), templates[name], 0644, now); err != nil {
+			return err
+		}
+	}
+
+	// what belongs to an instance may hold credentials, so it is only readable by its owner once unpacked
+	for _, instance := range instances {
+		dir := path.Join("instances", instance.Id)
+		if err := writeJSON(path.Join(dir, "instance.json"), instanceRecord{Instance: *instance, Port: instance.Port}, 0600); err != nil {
+			return err
+		}
+
+		if instance.TLS != nil {
+			key, err := ioutil.ReadFile(instance.TLSKeyPath())
+			if err != nil {
+				return err
+			}
+			if err := writeTarFile(tarWriter, path.Join(dir, "tls", "server.key"), key, 0600, now); err != nil {
+				return err
+			}
+		}
+
+		config, err := ioutil.ReadFile(instance.ConfigPath())
+		if err == nil {
+			if err := writeTarFile(tarWriter, path.Join(dir, "logstash.conf"), config, 0600, now); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		bindings, err := broker.InstanceRepository.FindBindings(instance.Id)
+		if err != nil {
+			return err
+		}
+		for _, binding := range bindings {
+			if err := writeJSON(path.Join(dir, "bindings", binding.Id+".json"), binding, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// Restore recreates the instances of an archive written by Backup, with their
+// bindings and rendered configs, and starts their agents. Templates are only
+// written when the broker does not have them, so deployed templates win.
+//
+// Nothing is written unless the whole archive is valid, none of its instances
+// or ports are taken and its instances fit within service_instance_limit and
+// the quotas; instances restored before a failure are removed again.
+func (broker *logstashServiceBroker) Restore(ctx context.Context, r io.Reader) (RestoreReport, error) {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	report := RestoreReport{Instances: []string{}, Templates: []string{}}
+
+	archive, err := readBackupArchive(r)
+	if err != nil {
+		return report, err
+	}
+
+	// provisions wait, so that they cannot take the ports and slots checked here
+	broker.provisioning.Lock()
+	defer broker.provisioning.Unlock()
+
+	if err := broker.checkRestore(archive); err != nil {
+		return report, err
+	}
+
+	templates, err := broker.templates()
+	if err != nil {
+		return report, err
+	}
+	for _, name := range sortedNames(archive.templates) {
+		if _, ok := templates[name]; ok {
+			continue
+		}
+		file := path.Join(broker.ServiceConfiguration.DefaultConfigPath, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return report, err
+		}
+		err := (system.AtomicFileWriter{}).WriteFile(file, archive.templates[name], 0644)
+		if err != nil {
+			return report, err
+		}
+		report.Templates = append(report.Templates, name)
+	}
+
+	for _, id := range archive.instanceIds() {
+		if err := broker.restoreInstance(archive, id); err != nil {
+			logger.Error("restore-instance-failed", err, lager.Data{"instance-id": id})
+			for _, restored := range report.Instances {
+				broker.InstanceRepository.Delete(restored)
+			}
+			return RestoreReport{Instances: []string{}, Templates: report.Templates}, err
+		}
+		report.Instances = append(report.Instances, id)
+		report.Bindings += len(archive.bindings[id])
+	}
+
+	if instanceCount, err := broker.InstanceRepository.GetInstanceCount(); err == nil {
+		serviceInstances.Set(float64(instanceCount))
+	}
+
+	for _, id := range report.Instances {
+		if err := broker.StartInstance(ctx, id); err != nil {
+			logger.Error("start-restored-instance-failed", err, lager.Data{"instance-id": id})
+			if report.StartFailures == nil {
+				report.StartFailures = map[string]string{}
+			}
+			report.StartFailures[id] = err.Error()
+		}
+	}
+
+	return report, nil
+}
+
+func (broker *logstashServiceBroker) restoreInstance(archive *backupArchive, id string) error {
+	record := archive.instances[id]
+	instance := record.Instance
+	instance.Port = record.Port
+	instance.Basepath = path.Join(broker.ServiceConfiguration.InstanceDataDirectory, id)
+	instance.LogDir = path.Join(broker.ServiceConfiguration.InstanceLogDirectory, id)
+	instance.TemplatePath = broker.ServiceConfiguration.templatePath(instance.Pipeline)
+	instance.Elasticsearch = broker.ServiceConfiguration.Elasticsearch
+	instance.Host = broker.ServiceConfiguration.Host
+	if instance.TLS != nil {
+		tls := *instance.TLS
+		tls.Key = string(archive.keys[id])
+		instance.TLS = &tls
+	}
+
+	if err := broker.InstanceRepository.Save(&instance); err != nil {
+		return err
+	}
+
+	// the agent keeps running the config it had rather than one rendered from a newer template
+	if config, ok := archive.configs[id]; ok {
+		if err := (system.AtomicFileWriter{}).WriteFile(instance.ConfigPath(), config, 0600); err != nil {
+			return err
+		}
+	}
+
+	for _, binding := range archive.bindings[id] {
+		if err := broker.InstanceRepository.SaveBinding(binding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The templates in the conf_path and the files of its pipelines, by path relative to the conf_path
+func (broker *logstashServiceBroker) templates() (map[string][]byte, error) {
+	config := broker.ServiceConfiguration
+	templates := map[string][]byte{}
+
+	read := func(name string) error {
+		data, err := ioutil.ReadFile(path.Join(config.DefaultConfigPath, name))
+		if err != nil {
+			return err
+		}
+		templates[name] = data
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(config.DefaultConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".tmpl") {
+			continue
+		}
+		if err := read(file.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	pipelines, err := LoadPipelines(config)
+	if err != nil {
+		return nil, err
+	}
+	for name := range pipelines {
+		for _, file := range pipelineFiles {
+			if err := read(path.Join(pipelinesDirectory, name, file)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return templates, nil
+}
+
+func readBackupArchive(r io.Reader) (*backupArchive, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, &InvalidArchiveError{Reason: err.Error()}
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	archive := &backupArchive{
+		templates: map[string][]byte{},
+		instances: map[string]*instanceRecord{},
+		keys:      map[string][]byte{},
+		configs:   map[string][]byte{},
+		bindings:  map[string][]*Binding{},
+	}
+	var size int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &InvalidArchiveError{Reason: err.Error()}
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, &InvalidArchiveError{Reason: fmt.Sprintf("%s is not a regular file", header.Name)}
+		}
+
+		if header.Size > maxBackupEntrySize {
+			return nil, &InvalidArchiveError{Reason: fmt.Sprintf("%s is larger than %d bytes", header.Name, maxBackupEntrySize)}
+		}
+		var data bytes.Buffer
+		n, err := io.Copy(&data, io.LimitReader(tarReader, maxBackupEntrySize+1))
+		if err != nil {
+			return nil, &InvalidArchiveError{Reason: err.Error()}
+		}
+		if n > maxBackupEntrySize {
+			return nil, &InvalidArchiveError{Reason: fmt.Sprintf("%s is larger than %d bytes", header.Name, maxBackupEntrySize)}
+		}
+		if size += n; size > maxBackupArchiveSize {
+			return nil, &InvalidArchiveError{Reason: fmt.Sprintf("archive is larger than %d bytes", maxBackupArchiveSize)}
+		}
+		if err := archive.add(header.Name, data.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.validate(); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// Files the archive layout does not know about are rejected rather than ignored, so nothing is silently lost
+func (archive *backupArchive) add(name string, data []byte) error {
+	invalid := func(reason string, args ...interface{}) error {
+		return &InvalidArchiveError{Reason: fmt.Sprintf("%s: %s", name, fmt.Sprintf(reason, args...))}
+	}
+
+	if path.Clean(name) != name || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+		return invalid("unsafe path")
+	}
+
+	parts := strings.Split(name, "/")
+	switch {
+	case name == "manifest.json":
+		archive.manifest = &backupManifest{}
+		if err := json.Unmarshal(data, archive.manifest); err != nil {
+			return invalid("%s", err)
+		}
+
+	case len(parts) == 2 && parts[0] == "templates" && strings.HasSuffix(parts[1], ".tmpl"):
+		archive.templates[parts[1]] = data
+
+	case len(parts) == 4 && parts[0] == "templates" && parts[1] == pipelinesDirectory && isPipelineFile(parts[3]):
+		if !pipelineName.MatchString(parts[2]) {
+			return invalid("invalid pipeline name")
+		}
+		archive.templates[path.Join(parts[1:]...)] = data
+
+	case len(parts) == 3 && parts[0] == "instances" && parts[2] == "instance.json":
+		record := &instanceRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return invalid("%s", err)
+		}
+		if record.Id != parts[1] {
+			return invalid("holds instance '%s'", record.Id)
+		}
+		if record.Port <= 0 || record.Port > 65535 {
+			return invalid("port %d is out of range", record.Port)
+		}
+		if record.TLS != nil && (record.TLS.Port <= 0 || record.TLS.Port > 65535) {
+			return invalid("tls port %d is out of range", record.TLS.Port)
+		}
+		archive.instances[parts[1]] = record
+
+	case len(parts) == 4 && parts[0] == "instances" && parts[2] == "tls" && parts[3] == "server.key":
+		archive.keys[parts[1]] = data
+
+	case len(parts) == 3 && parts[0] == "instances" && parts[2] == "logstash.conf":
+		archive.configs[parts[1]] = data
+
+	case len(parts) == 4 && parts[0] == "instances" && parts[2] == "bindings" && strings.HasSuffix(parts[3], ".json"):
+		binding := &Binding{}
+		if err := json.Unmarshal(data, binding); err != nil {
+			return invalid("%s", err)
+		}
+		if binding.InstanceId != parts[1] || binding.Id+".json" != parts[3] {
+			return invalid("holds binding '%s' of instance '%s'", binding.Id, binding.InstanceId)
+		}
+		archive.bindings[parts[1]] = append(archive.bindings[parts[1]], binding)
+
+	default:
+		return invalid("unexpected file")
+	}
+
+	return nil
+}
+
+func (archive *backupArchive) validate() error {
+	if archive.manifest == nil {
+		return &InvalidArchiveError{Reason: "manifest.json is missing"}
+	}
+	if archive.manifest.Version < 1 || archive.manifest.Version > BackupFormatVersion {
+		return &InvalidArchiveError{Reason: fmt.Sprintf("unsupported version %d, expected at most %d", archive.manifest.Version, BackupFormatVersion)}
+	}
+	if archive.manifest.Instances != len(archive.instances) {
+		return &InvalidArchiveError{Reason: fmt.Sprintf("manifest lists %d instances but %d were found", archive.manifest.Instances, len(archive.instances))}
+	}
+
+	for id := range archive.configs {
+		if _, ok := archive.instances[id]; !ok {
+			return &InvalidArchiveError{Reason: fmt.Sprintf("config of unknown instance '%s'", id)}
+		}
+	}
+	for id := range archive.keys {
+		if _, ok := archive.instances[id]; !ok {
+			return &InvalidArchiveError{Reason: fmt.Sprintf("tls key of unknown instance '%s'", id)}
+		}
+	}
+	for _, id := range archive.instanceIds() {
+		if archive.instances[id].TLS != nil && len(archive.keys[id]) == 0 {
+			return &InvalidArchiveError{Reason: fmt.Sprintf("tls key of instance '%s' is missing", id)}
+		}
+	}
+	for id := range archive.bindings {
+		if _, ok := archive.instances[id]; !ok {
+			return &InvalidArchiveError{Reason: fmt.Sprintf("bindings of unknown instance '%s'", id)}
+		}
+	}
+	return nil
+}
+
+// Reports every instance id or port the archive shares with the existing instances, within itself or with other
+// processes of the host, and whether its instances would exceed service_instance_limit or a quota
+func (broker *logstashServiceBroker) checkRestore(archive *backupArchive) error {
+	existing, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return err
+	}
+	instanceCount, err := broker.InstanceRepository.GetInstanceCount()
+	if err != nil {
+		return err
+	}
+
+	conflicts := []string{}
+	ports := map[int]string{}
+	ids := map[string]bool{}
+	for _, instance := range existing {
+		for _, port := range instance.ports() {
+			ports[port] = instance.Id
+		}
+		ids[instance.Id] = true
+	}
+
+	// quotas count the instances of the archive checked before, as if they had been provisioned in turn
+	accepted := existing
+	for _, id := range archive.instanceIds() {
+		record := archive.instances[id]
+		if ids[id] {
+			conflicts = append(conflicts, fmt.Sprintf("instance %s already exists", id))
+			continue
+		}
+		if portConflicts := checkRestoredPorts(ports, id, record.ports()); len(portConflicts) > 0 {
+			conflicts = append(conflicts, portConflicts...)
+			continue
+		}
+
+		instance := record.Instance
+		if err := broker.ServiceConfiguration.Quotas.Check(accepted, &instance); err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("instance %s: %s", id, err))
+			continue
+		}
+		accepted = append(accepted, &instance)
+	}
+
+	if restored := len(archive.instances); instanceCount+restored > broker.ServiceInstanceLimit {
+		conflicts = append(conflicts, fmt.Sprintf("%d instances would exceed the service instance limit of %d with the %d there are",
+			restored, broker.ServiceInstanceLimit, instanceCount))
+	}
+
+	if len(conflicts) > 0 {
+		return &RestoreConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// Reports the ports of a restored instance that another instance or a process of the host holds, claiming them
+// for the instance otherwise
+func checkRestoredPorts(ports map[int]string, id string, restored []int) []string {
+	for _, port := range restored {
+		if holder, ok := ports[port]; ok {
+			return []string{fmt.Sprintf("port %d of instance %s is used by instance %s", port, id, holder)}
+		}
+	}
+	for _, port := range restored {
+		ports[port] = id
+	}
+	conflicts := []string{}
+	for _, port := range restored {
+		if !system.IsPortFree(port) {
+			conflicts = append(conflicts, fmt.Sprintf("port %d of instance %s is in use on this host", port, id))
+		}
+	}
+	return conflicts
+}
+
+func (archive *backupArchive) instanceIds() []string {
+	ids := []string{}
+	for id := range archive.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func writeTarFile(tarWriter *tar.Writer, name string, data []byte, mode int64, modTime time.Time) error {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tarWriter.Write(data)
+	return err
+}
+
+func sortedNames(files map[string][]byte) []string {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
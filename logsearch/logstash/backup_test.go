@@ -0,0 +1,401 @@
+package logstash_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Records the instances it starts and refuses to start the ones in Failing
+type RecordingProcessStarter struct {
+	fakeProcessStarter
+	Started []string
+	Failing map[string]bool
+}
+
+func (starter *RecordingProcessStarter) Start(logger lager.Logger, instance *logstash.Instance, timeout time.Duration) error {
+	if starter.Failing[instance.Id] {
+		return os.ErrPermission
+	}
+	starter.Started = append(starter.Started, instance.Id)
+	return nil
+}
+
+func tarGz(files map[string]string) *bytes.Buffer {
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, contents := range files {
+		Ω(tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := tarWriter.Write([]byte(contents))
+		Ω(err).ToNot(HaveOccurred())
+	}
+	Ω(tarWriter.Close()).To(Succeed())
+	Ω(gzipWriter.Close()).To(Succeed())
+	return &archive
+}
+
+var _ = Describe("Backup and restore", func() {
+	var tmpDir string
+	var ctx context.Context
+
+	newBroker := func(name string, withTemplate bool, configure ...func(*logstash.ServiceConfiguration)) (logstash.ServiceConfiguration, *RecordingProcessStarter, api.StateArchiver) {
+		config := logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     path.Join(tmpDir, name, "conf"),
+			InstanceDataDirectory: path.Join(tmpDir, name, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, name, "logs"),
+			AuditDirectory:        path.Join(tmpDir, name, "audit"),
+			ServiceInstanceLimit:  10,
+		}
+		for _, change := range configure {
+			change(&config)
+		}
+		Ω(os.MkdirAll(config.DefaultConfigPath, 0755)).To(Succeed())
+		Ω(os.MkdirAll(config.InstanceDataDirectory, 0755)).To(Succeed())
+		if withTemplate {
+			template, err := ioutil.ReadFile("assets/logstash.conf.tmpl")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(ioutil.WriteFile(path.Join(config.DefaultConfigPath, "logstash.conf.tmpl"), template, 0644)).To(Succeed())
+		}
+
+		broker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger(name))
+		Ω(err).ToNot(HaveOccurred())
+		starter := &RecordingProcessStarter{Failing: map[string]bool{}}
+		broker.ProcessStarter = starter
+		port := 6000
+		broker.FindFreePort = func() (int, error) {
+			port++
+			return port, nil
+		}
+		return config, starter, broker
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-backup")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Context("with a backup of a broker", func() {
+		var sourceConfig logstash.ServiceConfiguration
+		var archive bytes.Buffer
+
+		BeforeEach(func() {
+			var source api.StateArchiver
+			sourceConfig, _, source = newBroker("source", true)
+			serviceBroker := source.(api.ServiceBroker)
+
+			_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"plan_id": "plan-1", "organization_guid": "org-1"})
+			Ω(err).ToNot(HaveOccurred())
+			_, err = serviceBroker.Provision(ctx, "instance-2", map[string]string{"plan_id": "plan-1"})
+			Ω(err).ToNot(HaveOccurred())
+			_, err = serviceBroker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+
+			// configs are restored as they were, not re-rendered
+			configPath := path.Join(sourceConfig.InstanceDataDirectory, "instance-2", "logstash.conf")
+			Ω(ioutil.WriteFile(configPath, []byte("input { tcp { port => 6002 } }\n"), 0644)).To(Succeed())
+
+			archive.Reset()
+			Ω(source.Backup(&archive)).To(Succeed())
+		})
+
+		It("recreates and starts every instance on an empty broker", func() {
+			config, starter, target := newBroker("target", false)
+
+			report, err := target.Restore(ctx, &archive)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(report).To(Equal(api.RestoreReport{
+				Instances: []string{"instance-1", "instance-2"},
+				Bindings:  1,
+				Templates: []string{"logstash.conf.tmpl"},
+			}))
+			Ω(starter.Started).To(Equal([]string{"instance-1", "instance-2"}))
+
+			administrator := target.(api.InstanceAdministrator)
+			instance, err := administrator.GetInstance("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.Address).To(Equal("127.0.0.1:6001"))
+			Ω(instance.PlanId).To(Equal("plan-1"))
+			Ω(instance.OrganizationGuid).To(Equal("org-1"))
+			Ω(instance.Bindings).To(HaveLen(1))
+			Ω(instance.Bindings[0].Id).To(Equal("binding-1"))
+
+			Ω(ioutil.ReadFile(path.Join(config.InstanceDataDirectory, "instance-2", "logstash.conf"))).To(Equal([]byte("input { tcp { port => 6002 } }\n")))
+			Ω(ioutil.ReadFile(path.Join(config.InstanceDataDirectory, "instance-1", "logstash.conf"))).To(ContainSubstring("6001"))
+			_, err = os.Stat(path.Join(config.DefaultConfigPath, "logstash.conf.tmpl"))
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("keeps what may hold credentials private in the archive and once restored", func() {
+			gzipReader, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+			Ω(err).ToNot(HaveOccurred())
+			tarReader := tar.NewReader(gzipReader)
+			modes := map[string]int64{}
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Ω(err).ToNot(HaveOccurred())
+				modes[header.Name] = header.Mode
+			}
+			Ω(modes).To(Equal(map[string]int64{
+				"manifest.json":                                0644,
+				"templates/logstash.conf.tmpl":                 0644,
+				"instances/instance-1/instance.json":           0600,
+				"instances/instance-1/logstash.conf":           0600,
+				"instances/instance-1/bindings/binding-1.json": 0600,
+				"instances/instance-2/instance.json":           0600,
+				"instances/instance-2/logstash.conf":           0600,
+			}))
+
+			config, _, target := newBroker("target", false)
+			_, err = target.Restore(ctx, &archive)
+			Ω(err).ToNot(HaveOccurred())
+			info, err := os.Stat(path.Join(config.InstanceDataDirectory, "instance-2", "logstash.conf"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("leaves the templates of the broker alone", func() {
+			config, _, target := newBroker("target", false)
+			Ω(ioutil.WriteFile(path.Join(config.DefaultConfigPath, "logstash.conf.tmpl"), []byte(`output { <%= logstash["Port"] %> }`), 0644)).To(Succeed())
+
+			report, err := target.Restore(ctx, &archive)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(report.Templates).To(BeEmpty())
+			Ω(ioutil.ReadFile(path.Join(config.DefaultConfigPath, "logstash.conf.tmpl"))).To(Equal([]byte(`output { <%= logstash["Port"] %> }`)))
+		})
+
+		It("reports agents that fail to start", func() {
+			_, starter, target := newBroker("target", true)
+			starter.Failing["instance-2"] = true
+
+			report, err := target.Restore(ctx, &archive)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(report.Instances).To(HaveLen(2))
+			Ω(report.StartFailures).To(HaveKey("instance-2"))
+		})
+
+		It("refuses instances or ports that are already taken", func() {
+			_, starter, target := newBroker("target", true)
+			serviceBroker := target.(api.ServiceBroker)
+			_, err := serviceBroker.Provision(ctx, "instance-2", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+			_, err = serviceBroker.Provision(ctx, "instance-3", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+			starter.Started = nil
+
+			_, err = target.Restore(ctx, &archive)
+			Ω(err).To(Equal(&api.RestoreConflictError{Conflicts: []string{
+				"port 6001 of instance instance-1 is used by instance instance-2",
+				"instance instance-2 already exists",
+			}}))
+
+			instances, err := target.(api.InstanceAdministrator).ListInstances(api.InstanceFilter{})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instances).To(HaveLen(2))
+			Ω(starter.Started).To(BeEmpty())
+		})
+
+		It("refuses instances beyond the instance limit or a quota", func() {
+			_, starter, target := newBroker("target", true, func(config *logstash.ServiceConfiguration) {
+				config.ServiceInstanceLimit = 1
+				config.Quotas = logstash.QuotaConfiguration{PerPlan: map[string]int{"plan-1": 1}}
+			})
+
+			_, err := target.Restore(ctx, &archive)
+			Ω(err).To(Equal(&api.RestoreConflictError{Conflicts: []string{
+				"instance instance-2: the plan quota of 1 instances for plan plan-1 has been reached",
+				"2 instances would exceed the service instance limit of 1 with the 0 there are",
+			}}))
+			Ω(starter.Started).To(BeEmpty())
+		})
+
+		It("refuses ports another process of the host listens on", func() {
+			listener, err := net.Listen("tcp", ":6002")
+			Ω(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			_, _, target := newBroker("target", true)
+
+			_, err = target.Restore(ctx, &archive)
+			Ω(err).To(Equal(&api.RestoreConflictError{Conflicts: []string{
+				"port 6002 of instance instance-2 is in use on this host",
+			}}))
+		})
+	})
+
+	Context("with a backup of an instance listening for TLS", func() {
+		var sourceConfig logstash.ServiceConfiguration
+		var archive bytes.Buffer
+
+		withTLS := func(name string) func(*logstash.ServiceConfiguration) {
+			return func(config *logstash.ServiceConfiguration) {
+				config.DefaultConfigPath = "assets"
+				config.DefaultPipeline = "syslog-5424"
+				config.TLS = logstash.TLSConfiguration{Enabled: true, CADirectory: path.Join(tmpDir, name, "ca"), CertificateDays: 30}
+			}
+		}
+
+		BeforeEach(func() {
+			var source api.StateArchiver
+			sourceConfig, _, source = newBroker("source", false, withTLS("source"))
+			_, err := source.(api.ServiceBroker).Provision(ctx, "instance-1", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+
+			archive.Reset()
+			Ω(source.Backup(&archive)).To(Succeed())
+		})
+
+		It("keeps the key of the certificate out of the metadata and restores it owner-only", func() {
+			gzipReader, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+			Ω(err).ToNot(HaveOccurred())
+			tarReader := tar.NewReader(gzipReader)
+			modes := map[string]int64{}
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Ω(err).ToNot(HaveOccurred())
+				modes[header.Name] = header.Mode
+				if header.Name == "instances/instance-1/instance.json" {
+					metadata, err := ioutil.ReadAll(tarReader)
+					Ω(err).ToNot(HaveOccurred())
+					Ω(string(metadata)).ToNot(ContainSubstring("PRIVATE KEY"))
+				}
+			}
+			Ω(modes).To(HaveKeyWithValue("instances/instance-1/tls/server.key", int64(0600)))
+
+			config, _, target := newBroker("target", false, withTLS("target"))
+			_, err = target.Restore(ctx, &archive)
+			Ω(err).ToNot(HaveOccurred())
+
+			key := path.Join("tls", "server.key")
+			restored, err := ioutil.ReadFile(path.Join(config.InstanceDataDirectory, "instance-1", key))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(ioutil.ReadFile(path.Join(sourceConfig.InstanceDataDirectory, "instance-1", key))).To(Equal(restored))
+			info, err := os.Stat(path.Join(config.InstanceDataDirectory, "instance-1", key))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("refuses the port of a TLS input that another instance has", func() {
+			_, _, target := newBroker("target", false, withTLS("target"))
+			_, err := target.(api.ServiceBroker).Provision(ctx, "instance-2", map[string]string{"pipeline": "json-lines"})
+			Ω(err).ToNot(HaveOccurred())
+
+			conflicting := tarGz(map[string]string{
+				"manifest.json":                       `{"version": 1, "instances": 1}`,
+				"instances/instance-1/instance.json":  `{"id": "instance-1", "port": 6005, "tls": {"port": 6001, "certificate": "certificate"}}`,
+				"instances/instance-1/tls/server.key": "key",
+			})
+			_, err = target.Restore(ctx, conflicting)
+			Ω(err).To(Equal(&api.RestoreConflictError{Conflicts: []string{
+				"port 6001 of instance instance-1 is used by instance instance-2",
+			}}))
+		})
+	})
+
+	Describe("validating an archive", func() {
+		var config logstash.ServiceConfiguration
+		var target api.StateArchiver
+
+		BeforeEach(func() {
+			config, _, target = newBroker("target", true)
+		})
+
+		restoring := func(archive *bytes.Buffer) error {
+			_, err := target.Restore(ctx, archive)
+			return err
+		}
+
+		It("rejects what is not a tar.gz", func() {
+			Ω(restoring(bytes.NewBufferString("not an archive"))).To(BeAssignableToTypeOf(&api.InvalidArchiveError{}))
+		})
+
+		It("requires a manifest", func() {
+			err := restoring(tarGz(map[string]string{}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "manifest.json is missing"}))
+		})
+
+		It("refuses archives from a newer broker", func() {
+			err := restoring(tarGz(map[string]string{"manifest.json": `{"version": 2}`}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "unsupported version 2, expected at most 1"}))
+		})
+
+		It("refuses paths outside of the archive layout", func() {
+			err := restoring(tarGz(map[string]string{
+				"manifest.json":       `{"version": 1}`,
+				"templates/../x.tmpl": "",
+			}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "templates/../x.tmpl: unsafe path"}))
+
+			err = restoring(tarGz(map[string]string{
+				"manifest.json": `{"version": 1}`,
+				"etc/passwd":    "",
+			}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "etc/passwd: unexpected file"}))
+		})
+
+		It("refuses entries too large to read into memory", func() {
+			err := restoring(tarGz(map[string]string{
+				"manifest.json":      `{"version": 1}`,
+				"templates/big.tmpl": strings.Repeat("x", 16<<20+1),
+			}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "templates/big.tmpl is larger than 16777216 bytes"}))
+		})
+
+		It("checks every instance before writing any", func() {
+			err := restoring(tarGz(map[string]string{
+				"manifest.json":                      `{"version": 1, "instances": 2}`,
+				"instances/instance-1/instance.json": `{"id": "instance-1", "port": 6001}`,
+				"instances/instance-2/instance.json": `{"id": "instance-2", "port": 6001}`,
+			}))
+			Ω(err).To(Equal(&api.RestoreConflictError{Conflicts: []string{
+				"port 6001 of instance instance-2 is used by instance instance-1",
+			}}))
+
+			err = restoring(tarGz(map[string]string{
+				"manifest.json":                      `{"version": 1, "instances": 1}`,
+				"instances/instance-1/instance.json": `{"id": "instance-9", "port": 6001}`,
+			}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "instances/instance-1/instance.json: holds instance 'instance-9'"}))
+
+			files, err := ioutil.ReadDir(config.InstanceDataDirectory)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(files).To(BeEmpty())
+		})
+
+		It("requires the key of every instance listening for TLS", func() {
+			err := restoring(tarGz(map[string]string{
+				"manifest.json":                      `{"version": 1, "instances": 1}`,
+				"instances/instance-1/instance.json": `{"id": "instance-1", "port": 6001, "tls": {"port": 6002, "certificate": "certificate"}}`,
+			}))
+			Ω(err).To(Equal(&api.InvalidArchiveError{Reason: "tls key of instance 'instance-1' is missing"}))
+		})
+	})
+})
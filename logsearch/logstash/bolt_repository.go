@@ -0,0 +1,345 @@
+package logstash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	. "github.com/malston/cf-logsearch-service-broker/api"
+)
+
+var (
+	instancesBucket = []byte("instances")
+	bindingsBucket  = []byte("bindings")
+	portsBucket     = []byte("ports")
+)
+
+// How long to wait for another process, e.g. a running broker, to release the database
+const boltOpenTimeout = time.Second
+
+// BoltInstanceRepository implements the InstanceRepository interface on an
+// embedded Bolt database. Instance, binding and port records are kept in the
+// database and changed in transactions; the data and log directories the
+// agent needs are still created alongside.
+//
+// The database is laid out in three buckets:
+//
+//	instances  instance id -> instance record
+//	bindings   instance id -> bucket of binding id -> binding
+//	ports      port -> instance id, for the ports of TLS inputs too, so that no two instances share a port
+type BoltInstanceRepository struct {
+	LogstashConf ServiceConfiguration
+
+	db *bolt.DB
+}
+
+// The port is not part of the instance metadata, which is derived from the
+// directory layout by the filesystem repository, so it is stored alongside.
+type instanceRecord struct {
+	Instance
+	Port int `json:"port"`
+}
+
+// The ports the record claims in the ports bucket
+func (record instanceRecord) ports() []int {
+	instance := record.Instance
+	instance.Port = record.Port
+	return instance.ports()
+}
+
+func NewBoltInstanceRepository(config ServiceConfiguration) (*BoltInstanceRepository, error) {
+	if err := os.MkdirAll(path.Dir(config.InstanceDatabase), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := openBolt(config.InstanceDatabase, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{instancesBucket, bindingsBucket, portsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltInstanceRepository{
+		LogstashConf: config,
+		db:           db,
+	}, nil
+}
+
+// NewReadOnlyBoltInstanceRepository opens an existing database for reading. Readers share the lock of the database
+// with each other but not with a broker, which holds it for as long as it runs.
+func NewReadOnlyBoltInstanceRepository(config ServiceConfiguration) (*BoltInstanceRepository, error) {
+	if _, err := os.Stat(config.InstanceDatabase); err != nil {
+		return nil, err
+	}
+
+	db, err := openBolt(config.InstanceDatabase, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{instancesBucket, bindingsBucket, portsBucket} {
+			if tx.Bucket(bucket) == nil {
+				return fmt.Errorf("database %s has no %s bucket", config.InstanceDatabase, bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltInstanceRepository{
+		LogstashConf: config,
+		db:           db,
+	}, nil
+}
+
+func openBolt(file string, options *bolt.Options) (*bolt.DB, error) {
+	db, err := bolt.Open(file, 0600, options)
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is locked by another process, e.g. a running broker; stop it first or use the admin API", file)
+	}
+	return db, err
+}
+
+func (instanceRepository *BoltInstanceRepository) Close() error {
+	return instanceRepository.db.Close()
+}
+
+func (instanceRepository *BoltInstanceRepository) Save(instance *Instance) error {
+	if !ValidId(instance.Id) {
+		return ErrInvalidId
+	}
+	err := os.MkdirAll(instance.baseDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(instance.LogDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = instanceRepository.db.Update(func(tx *bolt.Tx) error {
+		instances := tx.Bucket(instancesBucket)
+		ports := tx.Bucket(portsBucket)
+
+		for _, port := range instance.ports() {
+			if owner := ports.Get([]byte(strconv.Itoa(port))); owner != nil && string(owner) != instance.Id {
+				return &PortInUseError{Port: port, InstanceId: string(owner)}
+			}
+		}
+
+		// a saved instance may have moved to other ports
+		if previous := instances.Get([]byte(instance.Id)); previous != nil {
+			var record instanceRecord
+			if err := json.Unmarshal(previous, &record); err != nil {
+				return err
+			}
+			for _, port := range record.ports() {
+				if err := ports.Delete([]byte(strconv.Itoa(port))); err != nil {
+					return err
+				}
+			}
+		}
+
+		data, err := json.Marshal(instanceRecord{Instance: *instance, Port: instance.Port})
+		if err != nil {
+			return err
+		}
+		if err := instances.Put([]byte(instance.Id), data); err != nil {
+			return err
+		}
+		for _, port := range instance.ports() {
+			if err := ports.Put([]byte(strconv.Itoa(port)), []byte(instance.Id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return RenderConfig(instance)
+}
+
+func (instanceRepository *BoltInstanceRepository) FindById(instanceId string) (*Instance, error) {
+	var instance *Instance
+	err := instanceRepository.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(instancesBucket).Get([]byte(instanceId))
+		if data == nil {
+			return ErrInstanceNotFound
+		}
+
+		var err error
+		instance, err = instanceRepository.decodeInstance(data)
+		return err
+	})
+	return instance, err
+}
+
+func (instanceRepository *BoltInstanceRepository) FindAll() ([]*Instance, error) {
+	instances := []*Instance{}
+	err := instanceRepository.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(instancesBucket).ForEach(func(_, data []byte) error {
+			instance, err := instanceRepository.decodeInstance(data)
+			if err != nil {
+				return err
+			}
+			instances = append(instances, instance)
+			return nil
+		})
+	})
+	return instances, err
+}
+
+func (instanceRepository *BoltInstanceRepository) GetInstanceCount() (int, error) {
+	count := 0
+	err := instanceRepository.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(instancesBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// Delete removes the records of an instance and its bindings, then its data and log directories.
+func (instanceRepository *BoltInstanceRepository) Delete(instanceId string) error {
+	if !ValidId(instanceId) {
+		return ErrInvalidId
+	}
+	err := instanceRepository.db.Update(func(tx *bolt.Tx) error {
+		instances := tx.Bucket(instancesBucket)
+
+		data := instances.Get([]byte(instanceId))
+		if data == nil {
+			return nil
+		}
+		var record instanceRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+
+		for _, port := range record.ports() {
+			if err := tx.Bucket(portsBucket).Delete([]byte(strconv.Itoa(port))); err != nil {
+				return err
+			}
+		}
+		err := tx.Bucket(bindingsBucket).DeleteBucket([]byte(instanceId))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return instances.Delete([]byte(instanceId))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(path.Join(instanceRepository.LogstashConf.InstanceDataDirectory, instanceId))
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path.Join(instanceRepository.LogstashConf.InstanceLogDirectory, instanceId))
+}
+
+func (instanceRepository *BoltInstanceRepository) SaveBinding(binding *Binding) error {
+	return instanceRepository.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(instancesBucket).Get([]byte(binding.InstanceId)) == nil {
+			return ErrInstanceNotFound
+		}
+
+		bindings, err := tx.Bucket(bindingsBucket).CreateBucketIfNotExists([]byte(binding.InstanceId))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(binding)
+		if err != nil {
+			return err
+		}
+		return bindings.Put([]byte(binding.Id), data)
+	})
+}
+
+func (instanceRepository *BoltInstanceRepository) FindBindingById(instanceId string, bindingId string) (*Binding, error) {
+	var binding *Binding
+	err := instanceRepository.db.View(func(tx *bolt.Tx) error {
+		bindings := tx.Bucket(bindingsBucket).Bucket([]byte(instanceId))
+		if bindings == nil {
+			return ErrBindingNotFound
+		}
+		data := bindings.Get([]byte(bindingId))
+		if data == nil {
+			return ErrBindingNotFound
+		}
+
+		binding = &Binding{}
+		return json.Unmarshal(data, binding)
+	})
+	return binding, err
+}
+
+func (instanceRepository *BoltInstanceRepository) FindBindings(instanceId string) ([]*Binding, error) {
+	bindings := []*Binding{}
+	err := instanceRepository.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bindingsBucket).Bucket([]byte(instanceId))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			binding := &Binding{}
+			if err := json.Unmarshal(data, binding); err != nil {
+				return err
+			}
+			bindings = append(bindings, binding)
+			return nil
+		})
+	})
+	return bindings, err
+}
+
+func (instanceRepository *BoltInstanceRepository) DeleteBinding(instanceId string, bindingId string) error {
+	return instanceRepository.db.Update(func(tx *bolt.Tx) error {
+		bindings := tx.Bucket(bindingsBucket).Bucket([]byte(instanceId))
+		if bindings == nil || bindings.Get([]byte(bindingId)) == nil {
+			return ErrBindingNotFound
+		}
+		return bindings.Delete([]byte(bindingId))
+	})
+}
+
+// Fills in the fields that are derived from the configuration rather than stored
+func (instanceRepository *BoltInstanceRepository) decodeInstance(data []byte) (*Instance, error) {
+	var record instanceRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	instance := record.Instance
+	instance.Port = record.Port
+	instance.Host = instanceRepository.LogstashConf.Host
+	instance.Basepath = path.Join(instanceRepository.LogstashConf.InstanceDataDirectory, instance.Id)
+	instance.LogDir = path.Join(instanceRepository.LogstashConf.InstanceLogDirectory, instance.Id)
+	instance.TemplatePath = instanceRepository.LogstashConf.templatePath(instance.Pipeline)
+	instance.Elasticsearch = instanceRepository.LogstashConf.Elasticsearch
+
+	return &instance, nil
+}
@@ -0,0 +1,71 @@
+package logstash_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BoltInstanceRepository", func() {
+	newRepository := func(config logstash.ServiceConfiguration) logstash.InstanceRepository {
+		repository, err := logstash.NewBoltInstanceRepository(config)
+		Ω(err).ToNot(HaveOccurred())
+		return repository
+	}
+	itBehavesLikeAnInstanceRepository(newRepository)
+	Describe("ports", func() {
+		itRefusesPortsOfOtherInstances(newRepository)
+	})
+
+	Context("in its database", func() {
+		var tmpDir string
+		var config logstash.ServiceConfiguration
+		var repository *logstash.BoltInstanceRepository
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "logstash-bolt")
+			Ω(err).ToNot(HaveOccurred())
+
+			config = logstash.ServiceConfiguration{
+				Host:                  "127.0.0.1",
+				DefaultConfigPath:     "assets",
+				InstanceDataDirectory: path.Join(tmpDir, "data"),
+				InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+				InstanceDatabase:      path.Join(tmpDir, "db", "instances.db"),
+				Repository:            logstash.RepositoryBolt,
+			}
+			repository, err = logstash.NewBoltInstanceRepository(config)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			repository.Close()
+			os.RemoveAll(tmpDir)
+		})
+
+		It("is selected by the configuration", func() {
+			Ω(repository.Close()).To(Succeed())
+			selected, err := logstash.NewInstanceRepository(config)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(selected).To(BeAssignableToTypeOf(&logstash.BoltInstanceRepository{}))
+			repository = selected.(*logstash.BoltInstanceRepository)
+		})
+
+		It("keeps its records across restarts", func() {
+			instance := newTestInstance(config, "instance-1", 5000)
+			Ω(repository.Save(instance)).To(Succeed())
+			Ω(repository.Close()).To(Succeed())
+
+			var err error
+			repository, err = logstash.NewBoltInstanceRepository(config)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(repository.FindById("instance-1")).To(Equal(instance))
+		})
+	})
+})
@@ -1,29 +1,60 @@
 package logstash
 
 import (
+	"context"
 	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/audit"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/malston/cf-logsearch-service-broker/pki"
 	"github.com/malston/cf-logsearch-service-broker/system"
 	"github.com/pivotal-golang/lager"
-	"log"
+	"io"
 	"path"
+	"sort"
+	"sync"
 	"time"
 )
 
 // logstashServiceBroker implements the api.ServiceBroker interface.
 type logstashServiceBroker struct {
 	ProcessStarter       ProcessStarter
+	ProcessProber        ProcessProber
 	ServiceConfiguration ServiceConfiguration
 	InstanceRepository   InstanceRepository
 	ServiceInstanceLimit int
 	Logger               lager.Logger
 	FindFreePort         func() (int, error)
+	Audit                AuditLog
+	// Issues the certificates of TLS inputs; nil unless tls is enabled or was before
+	Authority *pki.Authority
+	// The brokers of other services whose instances keep indices on the cluster, which the retention pass covers too
+	RetentionSources []elasticsearch.RetentionSource
+
+	// Held from counting the instances until a new one is saved, so that concurrent provisions cannot exceed
+	// service_instance_limit or a quota
+	provisioning sync.Mutex
+
+	// Closed by Close, which stops the retention schedule
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 type ProcessStarter interface {
-	Start(instance *Instance, timeout time.Duration) error
+	Start(logger lager.Logger, instance *Instance, timeout time.Duration) error
+	Stop(logger lager.Logger, instance *Instance, timeout time.Duration) error
+	Status(instance *Instance) ProcessDetails
+}
+
+const agentStopTimeout = 10 * time.Second
+
+type ProcessProber interface {
+	Probe(instance *Instance) []PortHealth
 }
 
-func NewServiceBroker(brokerLogger lager.Logger) *logstashServiceBroker {
+// LoadConfig reads the broker config at ConfigPath, checks it and its templates and creates the instance directories
+// of every service it offers, exiting through the logger when any of it fails.
+func LoadConfig(brokerLogger lager.Logger) Config {
 	brokerConfigPath := ConfigPath()
 	config, err := ParseConfig(brokerConfigPath)
 	if err != nil {
@@ -36,22 +67,97 @@ func NewServiceBroker(brokerLogger lager.Logger) *logstashServiceBroker {
 		brokerLogger.Fatal("Checking config file", err)
 	}
 
-	repo := &FileSystemInstanceRepository{
-		LogstashConf: config.ServiceConfiguration,
+	if err = CreateDirectories(config.ServiceConfiguration); err != nil {
+		brokerLogger.Fatal("Creating instance directories", err)
+	}
+
+	if err = CheckTemplates(config.ServiceConfiguration); err != nil {
+		brokerLogger.Fatal("Checking template", err)
+	}
+
+	return config
+}
+
+// ScheduleRetention runs the daily retention pass in the background when the config enables it, until the broker is
+// closed.
+func (broker *logstashServiceBroker) ScheduleRetention() {
+	if !broker.ServiceConfiguration.Elasticsearch.Retention.Enabled {
+		return
+	}
+	go func() {
+		if err := broker.scheduleRetention(broker.stop); err != nil {
+			broker.Logger.Error("scheduling-retention", err)
+		}
+	}()
+}
+
+// NewServiceBrokerFromConfig builds a broker from an already parsed and checked configuration.
+func NewServiceBrokerFromConfig(config ServiceConfiguration, brokerLogger lager.Logger) (*logstashServiceBroker, error) {
+	backend, err := NewInstanceRepository(config)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := NewCachingInstanceRepository(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := audit.NewFileLog(
+		config.AuditDirectory,
+		int64(config.AuditMaxFileSizeMB)*1024*1024,
+		config.AuditMaxFiles,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	authority, err := loadAuthority(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	commandRunner := system.OSCommandRunner{}
+	starter := NewProcessStarter(commandRunner, time.Duration(config.ProbeTimeoutMilliseconds)*time.Millisecond)
+
+	if unloadable, err := repo.UnloadableInstances(); err == nil && len(unloadable) > 0 {
+		brokerLogger.Error("unloadable-instances", errUnloadableInstances, lager.Data{"instance-ids": unloadable})
 	}
 
-	commandRunner := system.OSCommandRunner{
-		brokerLogger,
+	serviceInstanceLimit.Set(float64(config.ServiceInstanceLimit))
+	if instanceCount, err := repo.GetInstanceCount(); err == nil {
+		serviceInstances.Set(float64(instanceCount))
 	}
 
 	return &logstashServiceBroker{
-		ServiceConfiguration: config.ServiceConfiguration,
-		ProcessStarter:       NewProcessStarter(commandRunner),
+		ServiceConfiguration: config,
+		ProcessStarter:       starter,
+		ProcessProber:        starter,
 		InstanceRepository:   repo,
-		ServiceInstanceLimit: config.ServiceConfiguration.ServiceInstanceLimit,
+		ServiceInstanceLimit: config.ServiceInstanceLimit,
 		Logger:               brokerLogger,
 		FindFreePort:         system.FindFreePort,
-	}
+		Audit:                auditLog,
+		Authority:            authority,
+		stop:                 make(chan struct{}),
+	}, nil
+}
+
+// Close stops what the broker runs in the background and closes its repository. Instances keep running.
+func (broker *logstashServiceBroker) Close() error {
+	var err error
+	broker.closeOnce.Do(func() {
+		if broker.stop != nil {
+			close(broker.stop)
+		}
+		if closer, ok := broker.InstanceRepository.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+func (broker *logstashServiceBroker) AuditLog() AuditLog {
+	return broker.Audit
 }
 
 func (broker *logstashServiceBroker) GetCatalog() []Service {
@@ -61,11 +167,6 @@ func (broker *logstashServiceBroker) GetCatalog() []Service {
 			Name:        "logsearch-service",
 			Description: "Logsearch Service for Cloud Foundry v2",
 			Bindable:    true,
-			DashboardClient: DashboardClient{
-				Id:          "logsearch-service-client",
-				Secret:      "s3cr3t",
-				RedirectUri: "https://dashboard.com",
-			},
 			Plans: []Plan{
 				Plan{
 					Id:          "dc851bfa-b23c-4e07-ae4d-26a5c403ce97",
@@ -98,77 +199,371 @@ func (broker *logstashServiceBroker) GetCatalog() []Service {
 	}
 }
 
-func (broker *logstashServiceBroker) Provision(instanceId string, params map[string]string) (string, error) {
-	log.Printf("CREATING INSTANCE--------------------------------------------------")
+func (broker *logstashServiceBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	logger.Info("creating-instance")
 
-	instanceCount, err := broker.InstanceRepository.GetInstanceCount()
+	instance, err := broker.createInstance(ctx, instanceId, params)
 	if err != nil {
 		return "", err
 	}
+
+	started := time.Now()
+	err = broker.ProcessStarter.Start(logger, instance, time.Duration(30)*time.Second)
+	agentStartDuration.Observe(time.Since(started).Seconds(), outcome(err))
+	if err != nil {
+		return "", err
+	}
+	logger.Info("created-instance", lager.Data{"address": instance.Address()})
+
+	return "http://locahost/dashboard/instances/" + instanceId, nil
+}
+
+// Checks the limits and parameters of a new instance and saves it
+func (broker *logstashServiceBroker) createInstance(ctx context.Context, instanceId string, params map[string]string) (*Instance, error) {
+	broker.provisioning.Lock()
+	defer broker.provisioning.Unlock()
+
+	instanceCount, err := broker.InstanceRepository.GetInstanceCount()
+	if err != nil {
+		return nil, err
+	}
+	serviceInstances.Set(float64(instanceCount))
 	if instanceCount >= broker.ServiceInstanceLimit {
-		return "", ServiceInstanceLimitReachedError
+		return nil, ServiceInstanceLimitReachedError
 	}
 
 	_, err = broker.InstanceRepository.FindById(instanceId)
 	if err == nil {
-		return "", ServiceInstanceAlreadyExistsError
+		return nil, ServiceInstanceAlreadyExistsError
 	}
 
-	instance, err := broker.buildInstance(instanceId)
+	instance, err := broker.buildInstance(instanceId, params, stack.ComponentFromContext(ctx))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	instance.CreatedBy = OriginatingIdentityFromContext(ctx)
+
+	if filters, ok := params[FiltersParameter]; ok {
+		if err := broker.checkFilters(instance, filters); err != nil {
+			return nil, err
+		}
+		instance.Filters = filters
+	}
+
+	if value, ok := params[elasticsearch.RetentionParameter]; ok {
+		days, err := broker.parseRetention(instance.PlanId, value)
+		if err != nil {
+			return nil, err
+		}
+		instance.RetentionDays = days
+	}
+
+	if broker.ServiceConfiguration.Quotas.Enabled() {
+		instances, err := broker.InstanceRepository.FindAll()
+		if err != nil {
+			return nil, err
+		}
+		err = broker.ServiceConfiguration.Quotas.Check(instances, instance)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	err = broker.InstanceRepository.Save(instance)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	err = broker.ProcessStarter.Start(instance, time.Duration(30)*time.Second)
+	serviceInstances.Set(float64(instanceCount + 1))
+	return instance, nil
+}
+
+// Update replaces the filters of an instance or the certificate of its TLS input, re-rendering its config and
+// restarting its agent, and how long its indices are kept. The plan and pipeline of an instance cannot be changed.
+func (broker *logstashServiceBroker) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	logger.Info("updating-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
 	if err != nil {
-		return "", err
+		return ServiceInstanceDoesNotExistsError
 	}
+	previous := *instance
 
-	return "http://locahost/dashboard/instances/" + instanceId, nil
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "service_id", FiltersParameter, elasticsearch.RetentionParameter:
+		case RotateCertificateParameter:
+			if err := broker.checkRotation(instance, params[name]); err != nil {
+				return err
+			}
+		case "plan_id":
+			if params[name] != instance.PlanId {
+				return &InvalidParameterError{Name: name, Reason: "the plan of an instance cannot be changed"}
+			}
+		default:
+			return &InvalidParameterError{Name: name, Reason: "cannot be updated"}
+		}
+	}
+
+	value, retain := params[elasticsearch.RetentionParameter]
+	if retain {
+		days, err := broker.parseRetention(instance.PlanId, value)
+		if err != nil {
+			return err
+		}
+		instance.RetentionDays = days
+	}
+
+	filters, restart := params[FiltersParameter]
+	if restart {
+		if err := broker.checkFilters(instance, filters); err != nil {
+			return err
+		}
+		instance.Filters = filters
+	}
+
+	_, rotate := params[RotateCertificateParameter]
+	if rotate {
+		// a rollback writes back the key of the certificate it restores
+		key, err := readTLSKey(instance)
+		if err != nil {
+			return err
+		}
+		previousTLS := *instance.TLS
+		previousTLS.Key = key
+		previous.TLS = &previousTLS
+
+		if err := broker.issueCertificate(instance); err != nil {
+			return err
+		}
+		logger.Info("rotated-certificate", lager.Data{"not-after": instance.TLS.NotAfter})
+	}
+
+	if !retain && !restart && !rotate {
+		return nil
+	}
+	err = broker.InstanceRepository.Save(instance)
+	if err != nil {
+		return err
+	}
+	logger.Info("updated-instance", lager.Data{"pipeline": instance.Pipeline, "retention-days": instance.RetentionDays})
+
+	// only the filters and the certificate are part of the config of the agent
+	if !restart && !rotate {
+		return nil
+	}
+	err = broker.RestartInstance(ctx, instanceId)
+	if err == nil {
+		return nil
+	}
+
+	// the agent did not come back with the new config, so it goes back to the one it ran
+	logger.Error("restarting-updated-instance-failed", err)
+	if rollbackErr := broker.InstanceRepository.Save(&previous); rollbackErr != nil {
+		logger.Error("rolling-back-update-failed", rollbackErr)
+	} else if startErr := broker.StartInstance(ctx, instanceId); startErr != nil {
+		logger.Error("starting-rolled-back-instance-failed", startErr)
+	}
+	return err
+}
+
+func (broker *logstashServiceBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	return broker.BindWithParameters(ctx, instanceId, bindingId, map[string]string{})
 }
 
-func (broker *logstashServiceBroker) Bind(instanceId string, bindingId string) (interface{}, error) {
-	log.Printf("BINDING INSTANCE--------------------------------------------------")
+// BindWithParameters refuses every parameter but those of the binding request itself; logstash bindings take none.
+func (broker *logstashServiceBroker) BindWithParameters(ctx context.Context, instanceId string, bindingId string, params map[string]string) (interface{}, error) {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	logger.Info("binding-instance")
+
 	instance, err := broker.InstanceRepository.FindById(instanceId)
 	if err != nil {
 		return nil, ServiceInstanceDoesNotExistsError
 	}
 
-	return struct {
-		Host string `json:"host"`
-		Port int    `json:"port"`
-	}{
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "service_id", "plan_id", "app_guid":
+		default:
+			return nil, &InvalidParameterError{Name: name, Reason: "cannot be given when binding"}
+		}
+	}
+
+	_, err = broker.InstanceRepository.FindBindingById(instanceId, bindingId)
+	if err == nil {
+		return nil, ServiceInstanceBindingAlreadyExistsError
+	}
+
+	binding := &Binding{
+		Id:         bindingId,
+		InstanceId: instanceId,
+		CreatedBy:  OriginatingIdentityFromContext(ctx),
+		CreatedAt:  time.Now().UTC(),
+	}
+	credentials := Credentials{
 		Host: instance.Host,
 		Port: instance.Port,
-	}, nil
+	}
+	if broker.ServiceConfiguration.Ingress.Enabled {
+		if binding.IngressToken, err = newIngressToken(instanceId); err != nil {
+			return nil, err
+		}
+		if credentials.Ingress, err = broker.ingressCredentials(binding.IngressToken); err != nil {
+			return nil, err
+		}
+	}
+
+	err = broker.InstanceRepository.SaveBinding(binding)
+	if err != nil {
+		return nil, err
+	}
+
+	// instances keep listening for TLS when tls is no longer enabled
+	if instance.TLS != nil {
+		credentials.SyslogDrainUrl = instance.syslogTLSDrainUrl()
+		if broker.Authority != nil {
+			credentials.CACertificate = broker.Authority.CertificatePEM()
+		}
+	}
+	return credentials, nil
 }
 
-func (broker *logstashServiceBroker) Unbind(instanceId string, bindingId string) error {
-	return nil
+// The credentials of a binding
+type Credentials struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// The TLS input of the instance and the certificate verifying it, when it has one
+	SyslogDrainUrl string `json:"syslog_drain_url,omitempty"`
+	CACertificate  string `json:"ca_certificate,omitempty"`
+	// The ingress, when the broker runs one
+	Ingress *IngressCredentials `json:"ingress,omitempty"`
+}
+
+func (broker *logstashServiceBroker) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	logger.Info("unbinding-instance")
+
+	_, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return ServiceInstanceDoesNotExistsError
+	}
+
+	_, err = broker.InstanceRepository.FindBindingById(instanceId, bindingId)
+	if err != nil {
+		return ServiceInstanceBindingDoesNotExistsError
+	}
+
+	return broker.InstanceRepository.DeleteBinding(instanceId, bindingId)
 }
 
-func (broker *logstashServiceBroker) Deprovision(instanceId string) error {
+func (broker *logstashServiceBroker) Deprovision(ctx context.Context, instanceId string) error {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	logger.Info("deprovisioning-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return ServiceInstanceDoesNotExistsError
+	}
+
+	err = broker.ProcessStarter.Stop(logger, instance, agentStopTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = broker.InstanceRepository.Delete(instanceId)
+	if err != nil {
+		return err
+	}
+	serviceInstances.Add(-1)
+
 	return nil
 }
 
-func (broker *logstashServiceBroker) buildInstance(instanceId string) (*Instance, error) {
-	port, err := broker.FindFreePort()
+// A free port that no instance claims, running or not, nor is one of taken
+func (broker *logstashServiceBroker) findFreePort(taken ...int) (int, error) {
+	claimed := map[int]bool{}
+	if lister, ok := broker.InstanceRepository.(claimedPortLister); ok {
+		owners, err := lister.ClaimedPorts()
+		if err != nil {
+			return 0, err
+		}
+		for port := range owners {
+			claimed[port] = true
+		}
+	} else {
+		instances, err := broker.InstanceRepository.FindAll()
+		if err != nil {
+			return 0, err
+		}
+		claimed = claimedPorts(instances)
+	}
+	for _, port := range taken {
+		claimed[port] = true
+	}
+	return findUnclaimedPort(broker.FindFreePort, claimed)
+}
+
+func (broker *logstashServiceBroker) buildInstance(instanceId string, params map[string]string, component *stack.Component) (*Instance, error) {
+	pipeline, err := broker.choosePipeline(params, component)
 	if err != nil {
 		return nil, err
 	}
+	pipelineName := ""
+	if pipeline != nil {
+		pipelineName = pipeline.Name
+	}
+
+	port, err := broker.findFreePort()
+	if err != nil {
+		return nil, err
+	}
+
+	// the components of a stack write to the indices of the stack
+	indexId := instanceId
+	if component != nil {
+		indexId = component.StackId
+	}
+	indexPrefix := broker.ServiceConfiguration.Elasticsearch.InstanceIndexPrefix(
+		indexId,
+		params["organization_name"], params["organization_guid"],
+		params["space_name"], params["space_guid"],
+	)
 
 	instance := &Instance{
-		Id:           instanceId,
-		Basepath:     path.Join(broker.ServiceConfiguration.InstanceDataDirectory, instanceId),
-		LogDir:       path.Join(broker.ServiceConfiguration.InstanceLogDirectory, instanceId),
-		TemplatePath: broker.ServiceConfiguration.DefaultConfigPath,
-		Port:         port,
-		Host:         broker.ServiceConfiguration.Host,
+		Id:            instanceId,
+		Basepath:      path.Join(broker.ServiceConfiguration.InstanceDataDirectory, instanceId),
+		LogDir:        path.Join(broker.ServiceConfiguration.InstanceLogDirectory, instanceId),
+		TemplatePath:  broker.ServiceConfiguration.templatePath(pipelineName),
+		Pipeline:      pipelineName,
+		Port:          port,
+		Host:          broker.ServiceConfiguration.Host,
+		IndexPrefix:   indexPrefix,
+		Elasticsearch: broker.ServiceConfiguration.Elasticsearch,
+		Stack:         component,
+
+		ServiceId:        params["service_id"],
+		PlanId:           params["plan_id"],
+		OrganizationGuid: params["organization_guid"],
+		SpaceGuid:        params["space_guid"],
+		CreatedAt:        time.Now().UTC(),
+	}
+
+	if broker.ServiceConfiguration.TLS.Enabled && pipeline != nil && pipeline.TLS {
+		if err := broker.issueCertificate(instance); err != nil {
+			return nil, err
+		}
 	}
 
 	return instance, nil
@@ -0,0 +1,231 @@
+package logstash
+
+import (
+	"sort"
+	"sync"
+)
+
+// CachingInstanceRepository keeps an in-memory index of the instances held by
+// another repository, so that listing, counting and finding instances does no
+// I/O. The index is loaded when the repository is created and updated on every
+// successful write; bindings are passed straight through. It also indexes the
+// ports of the instances and refuses to save an instance on the port of another.
+//
+// Changes made behind its back, e.g. by logsearch-admin while the broker is
+// running, are only seen after a restart.
+type CachingInstanceRepository struct {
+	InstanceRepository
+
+	mutex     sync.RWMutex
+	instances map[string]*Instance
+	// ids the backend holds but cannot load, counted as instances until they are saved again or deleted
+	unloadable map[string]bool
+	// the instance holding each port
+	ports map[int]string
+	// held from checking the ports of an instance until the index records them
+	saving sync.Mutex
+}
+
+// Implemented by backends that can hold instances they cannot load
+type unloadableInstanceLister interface {
+	UnloadableInstances() ([]string, error)
+}
+
+// Implemented by backends whose instances can hold ports without being loadable
+type claimedPortLister interface {
+	ClaimedPorts() (map[int]string, error)
+}
+
+func NewCachingInstanceRepository(backend InstanceRepository) (*CachingInstanceRepository, error) {
+	instances, err := backend.FindAll()
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string]*Instance{}
+	for _, instance := range instances {
+		index[instance.Id] = instance
+	}
+
+	unloadable := map[string]bool{}
+	if lister, ok := backend.(unloadableInstanceLister); ok {
+		ids, err := lister.UnloadableInstances()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			unloadable[id] = true
+		}
+	}
+
+	ports := map[int]string{}
+	if lister, ok := backend.(claimedPortLister); ok {
+		ports, err = lister.ClaimedPorts()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, instance := range instances {
+			for _, port := range instance.ports() {
+				ports[port] = instance.Id
+			}
+		}
+	}
+
+	return &CachingInstanceRepository{
+		InstanceRepository: backend,
+		instances:          index,
+		unloadable:         unloadable,
+		ports:              ports,
+	}, nil
+}
+
+// Save refuses a port another instance holds, whether its agent is running or not.
+func (instanceRepository *CachingInstanceRepository) Save(instance *Instance) error {
+	instanceRepository.saving.Lock()
+	defer instanceRepository.saving.Unlock()
+
+	instanceRepository.mutex.RLock()
+	for _, port := range instance.ports() {
+		if owner, ok := instanceRepository.ports[port]; ok && owner != instance.Id {
+			instanceRepository.mutex.RUnlock()
+			return &PortInUseError{Port: port, InstanceId: owner}
+		}
+	}
+	instanceRepository.mutex.RUnlock()
+
+	err := instanceRepository.InstanceRepository.Save(instance)
+	if err != nil {
+		return err
+	}
+
+	saved := *instance
+	instanceRepository.mutex.Lock()
+	instanceRepository.releasePorts(instance.Id)
+	for _, port := range saved.ports() {
+		instanceRepository.ports[port] = saved.Id
+	}
+	instanceRepository.instances[instance.Id] = &saved
+	delete(instanceRepository.unloadable, instance.Id)
+	instanceRepository.mutex.Unlock()
+
+	return nil
+}
+
+// ClaimedPorts returns the instance holding each port, from the index.
+func (instanceRepository *CachingInstanceRepository) ClaimedPorts() (map[int]string, error) {
+	instanceRepository.mutex.RLock()
+	defer instanceRepository.mutex.RUnlock()
+
+	claimed := map[int]string{}
+	for port, owner := range instanceRepository.ports {
+		claimed[port] = owner
+	}
+	return claimed, nil
+}
+
+// Drops the ports of an instance from the index; the caller holds the mutex
+func (instanceRepository *CachingInstanceRepository) releasePorts(instanceId string) {
+	if instance, ok := instanceRepository.instances[instanceId]; ok {
+		for _, port := range instance.ports() {
+			if instanceRepository.ports[port] == instanceId {
+				delete(instanceRepository.ports, port)
+			}
+		}
+		return
+	}
+
+	// the ports of a directory that cannot be loaded are only known from the index
+	if instanceRepository.unloadable[instanceId] {
+		for port, owner := range instanceRepository.ports {
+			if owner == instanceId {
+				delete(instanceRepository.ports, port)
+			}
+		}
+	}
+}
+
+func (instanceRepository *CachingInstanceRepository) FindById(instanceId string) (*Instance, error) {
+	instanceRepository.mutex.RLock()
+	defer instanceRepository.mutex.RUnlock()
+
+	instance, ok := instanceRepository.instances[instanceId]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+
+	// callers may change the instance they get back without changing the index
+	found := *instance
+	return &found, nil
+}
+
+// FindAll returns the instances ordered by id, as the backends do.
+func (instanceRepository *CachingInstanceRepository) FindAll() ([]*Instance, error) {
+	instanceRepository.mutex.RLock()
+	defer instanceRepository.mutex.RUnlock()
+
+	instances := []*Instance{}
+	for _, instance := range instanceRepository.instances {
+		found := *instance
+		instances = append(instances, &found)
+	}
+	sort.Sort(instancesById(instances))
+
+	return instances, nil
+}
+
+func (instanceRepository *CachingInstanceRepository) GetInstanceCount() (int, error) {
+	instanceRepository.mutex.RLock()
+	defer instanceRepository.mutex.RUnlock()
+
+	return len(instanceRepository.instances) + len(instanceRepository.unloadable), nil
+}
+
+// UnloadableInstances returns the ids the backend held but could not load when the index was built, sorted.
+func (instanceRepository *CachingInstanceRepository) UnloadableInstances() ([]string, error) {
+	instanceRepository.mutex.RLock()
+	defer instanceRepository.mutex.RUnlock()
+
+	ids := []string{}
+	for id := range instanceRepository.unloadable {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (instanceRepository *CachingInstanceRepository) Delete(instanceId string) error {
+	instanceRepository.saving.Lock()
+	defer instanceRepository.saving.Unlock()
+
+	err := instanceRepository.InstanceRepository.Delete(instanceId)
+	if err != nil {
+		return err
+	}
+
+	instanceRepository.mutex.Lock()
+	instanceRepository.releasePorts(instanceId)
+	delete(instanceRepository.instances, instanceId)
+	delete(instanceRepository.unloadable, instanceId)
+	instanceRepository.mutex.Unlock()
+
+	return nil
+}
+
+// Close closes the backend if it holds resources, e.g. the Bolt database.
+func (instanceRepository *CachingInstanceRepository) Close() error {
+	if closer, ok := instanceRepository.InstanceRepository.(interface {
+		Close() error
+	}); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type instancesById []*Instance
+
+func (instances instancesById) Len() int           { return len(instances) }
+func (instances instancesById) Less(i, j int) bool { return instances[i].Id < instances[j].Id }
+func (instances instancesById) Swap(i, j int) {
+	instances[i], instances[j] = instances[j], instances[i]
+}
@@ -0,0 +1,212 @@
+package logstash_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Counts the reads that reach the repository behind the cache
+type CountingInstanceRepository struct {
+	logstash.InstanceRepository
+	Reads int
+}
+
+func (repository *CountingInstanceRepository) FindById(instanceId string) (*logstash.Instance, error) {
+	repository.Reads++
+	return repository.InstanceRepository.FindById(instanceId)
+}
+
+func (repository *CountingInstanceRepository) FindAll() ([]*logstash.Instance, error) {
+	repository.Reads++
+	return repository.InstanceRepository.FindAll()
+}
+
+func (repository *CountingInstanceRepository) GetInstanceCount() (int, error) {
+	repository.Reads++
+	return repository.InstanceRepository.GetInstanceCount()
+}
+
+var _ = Describe("CachingInstanceRepository", func() {
+	newRepository := func(config logstash.ServiceConfiguration) logstash.InstanceRepository {
+		repository, err := logstash.NewCachingInstanceRepository(&logstash.FileSystemInstanceRepository{LogstashConf: config})
+		Ω(err).ToNot(HaveOccurred())
+		return repository
+	}
+	itBehavesLikeAnInstanceRepository(newRepository)
+	Describe("ports", func() {
+		itRefusesPortsOfOtherInstances(newRepository)
+	})
+
+	Context("in front of the filesystem", func() {
+		var tmpDir string
+		var config logstash.ServiceConfiguration
+		var backend *CountingInstanceRepository
+		var repository *logstash.CachingInstanceRepository
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "logstash-cache")
+			Ω(err).ToNot(HaveOccurred())
+
+			config = logstash.ServiceConfiguration{
+				Host:                  "127.0.0.1",
+				DefaultConfigPath:     "assets",
+				InstanceDataDirectory: path.Join(tmpDir, "data"),
+				InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			}
+			filesystem := &logstash.FileSystemInstanceRepository{LogstashConf: config}
+			Ω(filesystem.Save(newTestInstance(config, "instance-1", 5000))).To(Succeed())
+
+			backend = &CountingInstanceRepository{InstanceRepository: filesystem}
+			repository, err = logstash.NewCachingInstanceRepository(backend)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("loads the existing instances once", func() {
+			Ω(repository.GetInstanceCount()).To(Equal(1))
+			Ω(repository.FindById("instance-1")).ToNot(BeNil())
+			Ω(repository.FindAll()).To(HaveLen(1))
+			Ω(backend.Reads).To(Equal(1))
+		})
+
+		It("keeps its index up to date with its own writes without reading back", func() {
+			Ω(repository.Save(newTestInstance(config, "instance-2", 5001))).To(Succeed())
+			Ω(repository.Delete("instance-1")).To(Succeed())
+
+			instances, err := repository.FindAll()
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instances).To(HaveLen(1))
+			Ω(instances[0].Id).To(Equal("instance-2"))
+			Ω(backend.Reads).To(Equal(1))
+		})
+
+		It("does not let callers change the index", func() {
+			found, err := repository.FindById("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			found.Port = 6000
+
+			Ω(repository.FindById("instance-1")).To(Equal(newTestInstance(config, "instance-1", 5000)))
+		})
+
+		It("keeps an instance out of the index when saving it fails", func() {
+			instance := newTestInstance(config, "instance-2", 5001)
+			instance.TemplatePath = path.Join(tmpDir, "missing")
+			Ω(repository.Save(instance)).ToNot(Succeed())
+			Ω(repository.GetInstanceCount()).To(Equal(1))
+		})
+
+		It("counts the directories the backend cannot load until they are saved or deleted", func() {
+			for _, id := range []string{"no-port-1", "no-port-2"} {
+				Ω(os.MkdirAll(path.Join(config.InstanceDataDirectory, id), 0755)).To(Succeed())
+			}
+			repository, err := logstash.NewCachingInstanceRepository(&logstash.FileSystemInstanceRepository{LogstashConf: config})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(repository.GetInstanceCount()).To(Equal(3))
+			Ω(repository.UnloadableInstances()).To(Equal([]string{"no-port-1", "no-port-2"}))
+
+			Ω(repository.Save(newTestInstance(config, "no-port-1", 5001))).To(Succeed())
+			Ω(repository.Delete("no-port-2")).To(Succeed())
+			Ω(repository.GetInstanceCount()).To(Equal(2))
+			Ω(repository.UnloadableInstances()).To(BeEmpty())
+		})
+
+		It("refuses the port of a directory the backend cannot load until it is deleted", func() {
+			corrupt := path.Join(config.InstanceDataDirectory, "corrupt")
+			Ω(os.MkdirAll(corrupt, 0755)).To(Succeed())
+			Ω(ioutil.WriteFile(path.Join(corrupt, "logstash.port"), []byte("5001"), 0644)).To(Succeed())
+			Ω(ioutil.WriteFile(path.Join(corrupt, "instance.json"), []byte("{"), 0644)).To(Succeed())
+			repository, err := logstash.NewCachingInstanceRepository(&logstash.FileSystemInstanceRepository{LogstashConf: config})
+			Ω(err).ToNot(HaveOccurred())
+
+			err = repository.Save(newTestInstance(config, "instance-2", 5001))
+			Ω(err).To(Equal(&logstash.PortInUseError{Port: 5001, InstanceId: "corrupt"}))
+			Ω(repository.Delete("corrupt")).To(Succeed())
+			Ω(repository.Save(newTestInstance(config, "instance-2", 5001))).To(Succeed())
+		})
+
+		It("checks ports against its index without reading the instances back", func() {
+			err := repository.Save(newTestInstance(config, "instance-2", 5000))
+			Ω(err).To(Equal(&logstash.PortInUseError{Port: 5000, InstanceId: "instance-1"}))
+			Ω(backend.Reads).To(Equal(1))
+		})
+	})
+})
+
+type fakeProcessStarter struct{}
+
+func (fakeProcessStarter) Start(lager.Logger, *logstash.Instance, time.Duration) error { return nil }
+func (fakeProcessStarter) Stop(lager.Logger, *logstash.Instance, time.Duration) error  { return nil }
+func (fakeProcessStarter) Status(*logstash.Instance) api.ProcessDetails {
+	return api.ProcessDetails{State: api.ProcessStopped}
+}
+
+// Provisions into a broker that already has existingInstances instances, with or without the cache
+func benchmarkProvision(b *testing.B, existingInstances int, cached bool) {
+	tmpDir, err := ioutil.TempDir("", "logstash-provision-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := logstash.ServiceConfiguration{
+		Host:                  "127.0.0.1",
+		DefaultConfigPath:     "assets",
+		InstanceDataDirectory: path.Join(tmpDir, "data"),
+		InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+		AuditDirectory:        path.Join(tmpDir, "audit"),
+		ServiceInstanceLimit:  existingInstances + b.N + 1,
+	}
+
+	// the layout of instances provisioned before metadata was recorded is the cheapest to create
+	for i := 0; i < existingInstances; i++ {
+		dir := path.Join(config.InstanceDataDirectory, fmt.Sprintf("existing-%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, "logstash.port"), []byte(strconv.Itoa(10000+i)), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	broker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("provision-bench"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	broker.ProcessStarter = fakeProcessStarter{}
+	if !cached {
+		broker.InstanceRepository = &logstash.FileSystemInstanceRepository{LogstashConf: config}
+	}
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := broker.Provision(ctx, fmt.Sprintf("new-%d", i), map[string]string{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProvisionCached100(b *testing.B)    { benchmarkProvision(b, 100, true) }
+func BenchmarkProvisionCached1000(b *testing.B)   { benchmarkProvision(b, 1000, true) }
+func BenchmarkProvisionCached5000(b *testing.B)   { benchmarkProvision(b, 5000, true) }
+func BenchmarkProvisionUncached100(b *testing.B)  { benchmarkProvision(b, 100, false) }
+func BenchmarkProvisionUncached1000(b *testing.B) { benchmarkProvision(b, 1000, false) }
+func BenchmarkProvisionUncached5000(b *testing.B) { benchmarkProvision(b, 5000, false) }
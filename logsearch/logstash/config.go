@@ -4,21 +4,58 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/fraenkel/candiedyaml"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/ingress"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
 )
 
 type ServiceConfiguration struct {
-	Host                  string            `yaml:"host"`
-	DefaultConfigPath     string            `yaml:"conf_path"`
-	InstanceDataDirectory string            `yaml:"data_directory"`
-	InstanceLogDirectory  string            `yaml:"log_directory"`
-	ServiceInstanceLimit  int               `yaml:"service_instance_limit"`
-	CommandMapping        map[string]string `yaml:"command_mapping"`
+	Host                  string             `yaml:"host"`
+	DefaultConfigPath     string             `yaml:"conf_path"`
+	InstanceDataDirectory string             `yaml:"data_directory"`
+	InstanceLogDirectory  string             `yaml:"log_directory"`
+	ServiceInstanceLimit  int                `yaml:"service_instance_limit"`
+	CommandMapping        map[string]string  `yaml:"command_mapping"`
+	AuditDirectory        string             `yaml:"audit_directory"`
+	AuditMaxFileSizeMB    int                `yaml:"audit_max_file_size_mb"`
+	AuditMaxFiles         int                `yaml:"audit_max_files"`
+	Repository            string             `yaml:"repository"`
+	InstanceDatabase      string             `yaml:"instance_database"`
+	Quotas                QuotaConfiguration `yaml:"quotas"`
+	TLS                   TLSConfiguration   `yaml:"tls"`
+	// How long a probe of an agent port waits to connect, while the agent starts and in health checks
+	ProbeTimeoutMilliseconds int `yaml:"probe_timeout_milliseconds"`
+	// Checks a config rendered from the template at startup, e.g. [logstash, agent, --configtest, -f];
+	// the path of the config is appended and the command is looked up in CommandMapping
+	ConfigTestCommand []string `yaml:"config_test_command"`
+	// The pipeline new instances get unless their plan or the pipeline parameter picks another;
+	// empty renders the logstash.conf.tmpl in conf_path
+	DefaultPipeline string `yaml:"default_pipeline"`
+	// Pipelines by plan id
+	PlanPipelines map[string]string `yaml:"plan_pipelines"`
+	// Where the registry records the service of every instance it provisions
+	ServiceInstancesFile string `yaml:"service_instances_file"`
+	// The elasticsearch section of the broker config, which ParseConfig copies here
+	Elasticsearch elasticsearch.Configuration `yaml:"-"`
+	// The redis section of the broker config, which ParseConfig copies here
+	Redis redis.Configuration `yaml:"-"`
+	// The stack section of the broker config, which ParseConfig copies here
+	Stack stack.Configuration `yaml:"-"`
+	// The ingress section of the broker config, which ParseConfig copies here
+	Ingress ingress.Configuration `yaml:"-"`
 }
 
 type Config struct {
-	ServiceConfiguration ServiceConfiguration `yaml:"logstash"`
+	ServiceConfiguration ServiceConfiguration        `yaml:"logstash"`
+	Elasticsearch        elasticsearch.Configuration `yaml:"elasticsearch"`
+	Redis                redis.Configuration         `yaml:"redis"`
+	Stack                stack.Configuration         `yaml:"stack"`
+	Ingress              ingress.Configuration       `yaml:"ingress"`
 }
 
 func ParseConfig(path string) (Config, error) {
@@ -32,32 +69,142 @@ func ParseConfig(path string) (Config, error) {
 		return Config{}, err
 	}
 
+	config.ServiceConfiguration.Elasticsearch = config.Elasticsearch
+	config.ServiceConfiguration.Redis = config.Redis
+	config.ServiceConfiguration.Stack = config.Stack
+	config.ServiceConfiguration.Ingress = config.Ingress
+	setDefaults(&config.ServiceConfiguration)
+
 	return config, nil
 }
 
+func setDefaults(config *ServiceConfiguration) {
+	// the audit log lives next to the instance data so it shares its storage
+	if config.AuditDirectory == "" {
+		config.AuditDirectory = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "logstash-audit")
+	}
+	if config.AuditMaxFileSizeMB == 0 {
+		config.AuditMaxFileSizeMB = 10
+	}
+	if config.AuditMaxFiles == 0 {
+		config.AuditMaxFiles = 5
+	}
+	if config.Repository == "" {
+		config.Repository = RepositoryFileSystem
+	}
+	if config.ProbeTimeoutMilliseconds == 0 {
+		config.ProbeTimeoutMilliseconds = 500
+	}
+	config.Elasticsearch.SetDefaults()
+	if config.Elasticsearch.DataDirectory == "" {
+		config.Elasticsearch.DataDirectory = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "elasticsearch-instances")
+	}
+	config.Redis.SetDefaults()
+	if config.Redis.Host == "" {
+		config.Redis.Host = config.Host
+	}
+	if config.Redis.DataDirectory == "" {
+		config.Redis.DataDirectory = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "redis-instances")
+	}
+	if config.Redis.LogDirectory == "" {
+		config.Redis.LogDirectory = path.Join(path.Dir(path.Clean(config.InstanceLogDirectory)), "redis-logs")
+	}
+	config.Stack.SetDefaults()
+	if config.Stack.DataDirectory == "" {
+		config.Stack.DataDirectory = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "stack-instances")
+	}
+	config.Ingress.SetDefaults()
+	if config.Ingress.Host == "" {
+		config.Ingress.Host = config.Host
+	}
+	if config.TLS.CADirectory == "" {
+		config.TLS.CADirectory = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "logstash-ca")
+	}
+	if config.TLS.CertificateDays == 0 {
+		config.TLS.CertificateDays = 365
+	}
+	if config.ServiceInstancesFile == "" {
+		config.ServiceInstancesFile = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "service-instances.json")
+	}
+	if config.InstanceDatabase == "" {
+		config.InstanceDatabase = path.Join(path.Dir(path.Clean(config.InstanceDataDirectory)), "logstash-instances.db")
+	}
+}
+
 func CheckConfig(config ServiceConfiguration) error {
-	err := checkPathExists(config.DefaultConfigPath, "Logstash DefaultConfigPath")
-	if err != nil {
-		return err
+	if config.Repository != "" && config.Repository != RepositoryFileSystem && config.Repository != RepositoryBolt {
+		return fmt.Errorf("Unknown repository '%s', expected '%s' or '%s'", config.Repository, RepositoryFileSystem, RepositoryBolt)
 	}
 
-	err = checkPathExists(config.InstanceDataDirectory, "Logstash InstanceDataDirectory")
-	if err != nil {
-		if err := os.MkdirAll(config.InstanceDataDirectory, 0777); err != nil {
-			return err
+	if err := config.Elasticsearch.Check(); err != nil {
+		return err
+	}
+	for _, credential := range []string{config.Elasticsearch.Username, config.Elasticsearch.Password} {
+		if strings.Contains(credential, "\n") {
+			return errors.New("elasticsearch credentials may not contain newlines")
+		}
+		if strings.HasSuffix(credential, `\`) {
+			return errors.New("elasticsearch credentials may not end in a backslash")
 		}
 	}
 
-	err = checkPathExists(config.InstanceLogDirectory, "Logstash InstanceLogDirectory")
-	if err != nil {
-		if err := os.MkdirAll(config.InstanceLogDirectory, 0777); err != nil {
+	if config.ProbeTimeoutMilliseconds < 0 {
+		return errors.New("probe_timeout_milliseconds must be positive")
+	}
+
+	if config.TLS.CertificateDays < 0 {
+		return errors.New("tls certificate_days must be positive")
+	}
+
+	if err := config.Redis.Check(); err != nil {
+		return err
+	}
+
+	if err := config.Stack.Check(); err != nil {
+		return err
+	}
+	if config.Stack.OfferService && !config.Elasticsearch.Enabled() {
+		return errors.New("stack offer_service needs elasticsearch hosts")
+	}
+
+	if err := config.Ingress.Check(); err != nil {
+		return err
+	}
+
+	return checkPathExists(config.DefaultConfigPath, "Logstash DefaultConfigPath")
+}
+
+// CreateDirectories creates the data and log directories of instances. CheckConfig only reads, so health checks
+// and the admin CLI can run it; the broker calls this once at startup.
+func CreateDirectories(config ServiceConfiguration) error {
+	dirs := []string{config.InstanceDataDirectory, config.InstanceLogDirectory}
+	// those of the other services too, which their health checks expect before the first provision
+	if config.Elasticsearch.OfferService {
+		dirs = append(dirs, config.Elasticsearch.DataDirectory)
+	}
+	if config.Redis.OfferService || config.Stack.OfferService {
+		dirs = append(dirs, config.Redis.DataDirectory, config.Redis.LogDirectory)
+	}
+	if config.Stack.OfferService {
+		dirs = append(dirs, config.Stack.DataDirectory)
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0777); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
+// The executable to run for a command, as mapped in command_mapping
+func (config ServiceConfiguration) command(name string) string {
+	if mapped, ok := config.CommandMapping[name]; ok && mapped != "" {
+		return mapped
+	}
+	return name
+}
+
 func checkPathExists(path string, description string) error {
 	_, err := os.Stat(path)
 	if err != nil {
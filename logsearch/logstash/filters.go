@@ -0,0 +1,437 @@
+package logstash
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+)
+
+// The provision and update parameter holding filters to add to the pipeline of an instance
+const FiltersParameter = "filters"
+
+// How large the filters of an instance may be
+const maxFiltersSize = 64 * 1024
+
+// The filter plugins users may configure. Plugins that run code, read files or reach other
+// hosts, such as ruby, exec, translate or elasticsearch, are left out.
+var allowedFilterPlugins = map[string]bool{
+	"cidr":        true,
+	"clone":       true,
+	"csv":         true,
+	"date":        true,
+	"de_dot":      true,
+	"dissect":     true,
+	"drop":        true,
+	"fingerprint": true,
+	"geoip":       true,
+	"grok":        true,
+	"json":        true,
+	"kv":          true,
+	"mutate":      true,
+	"prune":       true,
+	"split":       true,
+	"syslog_pri":  true,
+	"truncate":    true,
+	"urldecode":   true,
+	"useragent":   true,
+	"xml":         true,
+}
+
+// Settings of allowed plugins that point them at files on the broker host
+var forbiddenFilterSettings = map[string]bool{
+	"database":            true,
+	"dictionary_path":     true,
+	"network_path":        true,
+	"patterns_dir":        true,
+	"patterns_files_glob": true,
+	"regexes":             true,
+}
+
+// A problem with user filters, at the Line holding Text
+type FilterError struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+func (err *FilterError) Error() string {
+	if err.Line == 0 {
+		return err.Reason
+	}
+	return fmt.Sprintf("line %d: %s: %s", err.Line, err.Reason, err.Text)
+}
+
+// ValidateFilters checks that filters only hold allowed filter plugins, optionally within
+// conditionals, so they can be placed in the filter section of a pipeline.
+func ValidateFilters(filters string) error {
+	if len(filters) > maxFiltersSize {
+		return &FilterError{Reason: fmt.Sprintf("filters may be at most %d bytes", maxFiltersSize)}
+	}
+
+	tokens, err := lexFilters(filters)
+	if err != nil {
+		return err
+	}
+	parser := &filterParser{source: strings.Split(filters, "\n"), tokens: tokens}
+	for _, token := range tokens {
+		// logstash would substitute the environment of the agent
+		if strings.Contains(token.text, "${") {
+			return parser.errorAt(token, "environment variables may not be used")
+		}
+	}
+	if err := parser.plugins(false); err != nil {
+		return err
+	}
+	if !parser.done() {
+		return parser.errorAt(parser.peek(), "unexpected '}'")
+	}
+	return nil
+}
+
+// The filters an update or provision asks for, checked against the template they will be rendered into
+func (broker *logstashServiceBroker) checkFilters(instance *Instance, filters string) error {
+	invalid := func(err error) error {
+		return &InvalidParameterError{Name: FiltersParameter, Reason: err.Error()}
+	}
+
+	if err := ValidateFilters(filters); err != nil {
+		return invalid(err)
+	}
+	if strings.TrimSpace(filters) == "" {
+		return nil
+	}
+
+	// a marker rather than the filters themselves, which may happen to appear in the template
+	const marker = "# user filters"
+	sample := *instance
+	sample.Filters = marker
+	templateFile := path.Join(sample.TempatePath(), "logstash.conf.tmpl")
+	rendered, err := renderTemplate(templateFile, configData(&sample))
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(rendered, []byte(marker)) {
+		return invalid(fmt.Errorf("%s has no place for filters", templateFile))
+	}
+	return nil
+}
+
+type filterTokenKind int
+
+const (
+	tokenWord filterTokenKind = iota
+	tokenString
+	tokenRegexp
+	tokenSymbol
+	// past the last token
+	tokenEnd
+)
+
+var twoCharacterSymbols = map[string]bool{"=>": true, "==": true, "!=": true, "=~": true, "!~": true, "<=": true, ">=": true}
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	line int
+}
+
+// Splits filters into words, quoted strings, regular expressions and symbols, dropping comments
+func lexFilters(filters string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	line := 1
+	source := []rune(filters)
+
+	for i := 0; i < len(source); {
+		c := source[i]
+		start := line
+		switch {
+		case c == '\n':
+			line++
+			i++
+
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+
+		// as in the grammar of logstash, a backslash only escapes the quote that ends the string; it does not escape
+		// itself, so "a\\" goes on past its last quote
+		case c == '"' || c == '\'' || (c == '/' && afterMatchOperator(tokens)):
+			end := i + 1
+			for ; end < len(source) && source[end] != c; end++ {
+				if source[end] == '\\' && end+1 < len(source) && source[end+1] == c {
+					end++
+				} else if source[end] == '\n' {
+					line++
+				}
+			}
+			if end >= len(source) {
+				return nil, &FilterError{Line: start, Text: lineText(filters, start), Reason: fmt.Sprintf("unterminated %c", c)}
+			}
+			kind := tokenString
+			if c == '/' {
+				kind = tokenRegexp
+			}
+			tokens = append(tokens, filterToken{kind: kind, text: string(source[i+1 : end]), line: start})
+			i = end + 1
+
+		case isWordRune(c):
+			end := i
+			for end < len(source) && isWordRune(source[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: string(source[i:end]), line: line})
+			i = end
+
+		default:
+			text := string(c)
+			if i+1 < len(source) && twoCharacterSymbols[string(source[i:i+2])] {
+				text = string(source[i : i+2])
+			}
+			tokens = append(tokens, filterToken{kind: tokenSymbol, text: text, line: line})
+			i += len([]rune(text))
+		}
+	}
+
+	return tokens, nil
+}
+
+func afterMatchOperator(tokens []filterToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	return last.kind == tokenSymbol && (last.text == "=~" || last.text == "!~")
+}
+
+func isWordRune(c rune) bool {
+	return c == '_' || c == '-' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func lineText(source string, line int) string {
+	lines := strings.Split(source, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[line-1])
+}
+
+type filterParser struct {
+	source   []string
+	tokens   []filterToken
+	position int
+}
+
+func (parser *filterParser) done() bool {
+	return parser.position >= len(parser.tokens)
+}
+
+func (parser *filterParser) peek() filterToken {
+	if parser.done() {
+		line := len(parser.source)
+		if len(parser.tokens) > 0 {
+			line = parser.tokens[len(parser.tokens)-1].line
+		}
+		return filterToken{kind: tokenEnd, line: line}
+	}
+	return parser.tokens[parser.position]
+}
+
+func (parser *filterParser) next() filterToken {
+	token := parser.peek()
+	parser.position++
+	return token
+}
+
+func (parser *filterParser) errorAt(token filterToken, reason string, args ...interface{}) error {
+	if token.kind == tokenEnd {
+		reason += " before the end of the filters"
+	}
+	return &FilterError{
+		Line:   token.line,
+		Text:   strings.TrimSpace(parser.source[token.line-1]),
+		Reason: fmt.Sprintf(reason, args...),
+	}
+}
+
+func (parser *filterParser) expect(symbol string) error {
+	token := parser.next()
+	if token.kind != tokenSymbol || token.text != symbol {
+		return parser.errorAt(token, "expected '%s'", symbol)
+	}
+	return nil
+}
+
+// Parses plugins and conditionals up to the end of the filters or, within a block, up to its '}'
+func (parser *filterParser) plugins(inBlock bool) error {
+	for !parser.done() {
+		token := parser.peek()
+		if token.kind == tokenSymbol && token.text == "}" {
+			if inBlock {
+				return nil
+			}
+			return parser.errorAt(token, "unexpected '}'")
+		}
+		if token.kind != tokenWord {
+			return parser.errorAt(token, "expected a filter plugin")
+		}
+
+		var err error
+		switch token.text {
+		case "if":
+			err = parser.conditional()
+		case "else":
+			err = parser.errorAt(token, "else without if")
+		case "input", "filter", "output":
+			err = parser.errorAt(token, "only filter plugins may be given, not %s sections", token.text)
+		default:
+			err = parser.plugin()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if inBlock {
+		return parser.errorAt(parser.peek(), "expected '}'")
+	}
+	return nil
+}
+
+// Parses an if with its else ifs and else
+func (parser *filterParser) conditional() error {
+	for {
+		keyword := parser.next()
+		if keyword.text == "if" {
+			if err := parser.condition(); err != nil {
+				return err
+			}
+		}
+		if err := parser.block(); err != nil {
+			return err
+		}
+
+		if next := parser.peek(); next.kind != tokenWord || next.text != "else" {
+			return nil
+		}
+		parser.next()
+		if next := parser.peek(); next.kind == tokenWord && next.text == "if" {
+			continue
+		}
+		if err := parser.block(); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// Skips a condition up to the '{' of its block; conditions only compare fields and values
+func (parser *filterParser) condition() error {
+	start := parser.peek()
+	for !parser.done() {
+		token := parser.peek()
+		if token.kind == tokenSymbol && token.text == "{" {
+			if token == start {
+				return parser.errorAt(token, "expected a condition")
+			}
+			return nil
+		}
+		if token.kind == tokenSymbol && token.text == "}" {
+			return parser.errorAt(token, "expected '{'")
+		}
+		parser.next()
+	}
+	return parser.errorAt(parser.peek(), "expected '{'")
+}
+
+func (parser *filterParser) block() error {
+	if err := parser.expect("{"); err != nil {
+		return err
+	}
+	if err := parser.plugins(true); err != nil {
+		return err
+	}
+	return parser.expect("}")
+}
+
+// Parses a plugin and its settings, refusing plugins and settings that are not allowed
+func (parser *filterParser) plugin() error {
+	name := parser.next()
+	if !allowedFilterPlugins[name.text] {
+		return parser.errorAt(name, "filter plugin '%s' is not allowed", name.text)
+	}
+	if err := parser.expect("{"); err != nil {
+		return err
+	}
+
+	for {
+		setting := parser.next()
+		if setting.kind == tokenSymbol && setting.text == "}" {
+			return nil
+		}
+		if setting.kind != tokenWord && setting.kind != tokenString {
+			return parser.errorAt(setting, "expected a setting of %s", name.text)
+		}
+		if forbiddenFilterSettings[setting.text] {
+			return parser.errorAt(setting, "setting '%s' of %s is not allowed", setting.text, name.text)
+		}
+		if err := parser.expect("=>"); err != nil {
+			return err
+		}
+		if err := parser.value(); err != nil {
+			return err
+		}
+	}
+}
+
+// Parses a value: a word, number, string, or an array or hash of values
+func (parser *filterParser) value() error {
+	token := parser.next()
+	switch {
+	case token.kind == tokenWord || token.kind == tokenString:
+		return nil
+
+	case token.kind == tokenSymbol && token.text == "[":
+		for {
+			if next := parser.peek(); next.kind == tokenSymbol && next.text == "]" {
+				parser.next()
+				return nil
+			}
+			if err := parser.value(); err != nil {
+				return err
+			}
+			if next := parser.peek(); next.kind == tokenSymbol && next.text == "," {
+				parser.next()
+			}
+		}
+
+	case token.kind == tokenSymbol && token.text == "{":
+		for {
+			if next := parser.peek(); next.kind == tokenSymbol && next.text == "}" {
+				parser.next()
+				return nil
+			}
+			key := parser.next()
+			if key.kind != tokenWord && key.kind != tokenString {
+				return parser.errorAt(key, "expected a key")
+			}
+			if err := parser.expect("=>"); err != nil {
+				return err
+			}
+			if err := parser.value(); err != nil {
+				return err
+			}
+			if next := parser.peek(); next.kind == tokenSymbol && next.text == "," {
+				parser.next()
+			}
+		}
+	}
+
+	return parser.errorAt(token, "expected a value")
+}
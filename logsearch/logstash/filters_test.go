@@ -0,0 +1,225 @@
+package logstash_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateFilters", func() {
+	It("accepts allowed plugins within conditionals", func() {
+		Ω(logstash.ValidateFilters(`
+# parse the access log of the router
+if [type] == "syslog" and [message] =~ /^\d+ \{/ {
+	grok {
+		match => { "message" => "%{COMBINEDAPACHELOG}" }
+		tag_on_failure => [ "_routerparsefailure" ]
+	}
+} else if "json" in [tags] {
+	json { source => "message" }
+} else {
+	mutate {
+		add_field => { "team" => 'payments' }
+		remove_field => [ "host", "port" ]
+	}
+	drop { }
+}
+date { match => [ "timestamp", "ISO8601" ] }
+`)).To(Succeed())
+	})
+
+	It("accepts quotes escaped with a backslash and backslashes of their own", func() {
+		Ω(logstash.ValidateFilters(`mutate { add_tag => [ "say \"hi\"", 'it\'s', "C:\\logs\\app" ] }`)).To(Succeed())
+	})
+
+	It("accepts no filters", func() {
+		Ω(logstash.ValidateFilters("")).To(Succeed())
+		Ω(logstash.ValidateFilters("  # nothing yet\n")).To(Succeed())
+	})
+
+	for _, rejected := range []struct{ name, filters, expected string }{
+		{"code", "grok { match => { \"message\" => \"%{WORD:x}\" } }\nruby { code => \"system('id')\" }\n",
+			"line 2: filter plugin 'ruby' is not allowed: ruby { code => \"system('id')\" }"},
+		{"commands", "if [x] {\n  exec { command => \"rm -rf /\" }\n}",
+			"line 2: filter plugin 'exec' is not allowed: exec { command => \"rm -rf /\" }"},
+		{"outputs", "output {\n  file { path => \"/etc/passwd\" }\n}",
+			"line 1: only filter plugins may be given, not output sections: output {"},
+		{"closing the filter section", "mutate { }\n}\noutput { file { path => \"/tmp/x\" } }",
+			"line 2: unexpected '}': }"},
+		{"reading files", "grok {\n  patterns_dir => [\"/etc\"]\n}",
+			"line 2: setting 'patterns_dir' of grok is not allowed: patterns_dir => [\"/etc\"]"},
+		{"reading networks", "cidr {\n  network_path => \"/etc/shadow\"\n}",
+			"line 2: setting 'network_path' of cidr is not allowed: network_path => \"/etc/shadow\""},
+		{"environment variables", "mutate { add_field => { \"secret\" => \"${BROKER_PASSWORD}\" } }",
+			"line 1: environment variables may not be used: mutate { add_field => { \"secret\" => \"${BROKER_PASSWORD}\" } }"},
+		{"unterminated strings", "mutate {\n  add_tag => [ \"x ]\n}",
+			"line 2: unterminated \": add_tag => [ \"x ]"},
+		{"missing braces", "mutate {\n  add_tag => [ \"x\" ]\n",
+			"line 2: expected a setting of mutate before the end of the filters: add_tag => [ \"x\" ]"},
+		{"stray else", "else { drop {} }",
+			"line 1: else without if: else { drop {} }"},
+		// logstash reads on past the quote after a double backslash, as only \" escapes a quote
+		{"a backslash ending a double quoted string", `mutate { add_tag => "a\\" add_tag => "} } output { exec { command => 'touch /tmp/pwned' } } filter { #" }`,
+			`line 1: unexpected '}': mutate { add_tag => "a\\" add_tag => "} } output { exec { command => 'touch /tmp/pwned' } } filter { #" }`},
+		{"a backslash ending a single quoted string", `mutate { add_tag => 'a\\' add_tag => '} } output { exec { command => "touch /tmp/pwned" } } filter { #' }`,
+			`line 1: unexpected '}': mutate { add_tag => 'a\\' add_tag => '} } output { exec { command => "touch /tmp/pwned" } } filter { #' }`},
+	} {
+		rejected := rejected
+		It("rejects "+rejected.name+", naming the line", func() {
+			Ω(logstash.ValidateFilters(rejected.filters)).To(MatchError(rejected.expected))
+		})
+	}
+})
+
+var _ = Describe("Filters of an instance", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var broker api.ServiceBroker
+	var starter *RecordingProcessStarter
+	var ctx context.Context
+
+	const filters = "mutate {\n  add_tag => [ \"payments\" ]\n}"
+
+	renderedConfig := func(instanceId string) string {
+		rendered, err := ioutil.ReadFile(path.Join(config.InstanceDataDirectory, instanceId, "logstash.conf"))
+		Ω(err).ToNot(HaveOccurred())
+		return string(rendered)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-filters")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+			DefaultPipeline:       "json-lines",
+		}
+	})
+
+	JustBeforeEach(func() {
+		logstashBroker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("filters"))
+		Ω(err).ToNot(HaveOccurred())
+		starter = &RecordingProcessStarter{Failing: map[string]bool{}}
+		logstashBroker.ProcessStarter = starter
+		logstashBroker.FindFreePort = func() (int, error) { return 6001, nil }
+		broker = logstashBroker
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("renders the filters given when provisioning into the filter section", func() {
+		_, err := broker.Provision(ctx, "instance-1", map[string]string{"filters": filters})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(renderedConfig("instance-1")).To(MatchRegexp(`(?s)filter \{.*add_tag => \[ "payments" \].*\}\s*output \{`))
+
+		instance, err := broker.(api.InstanceAdministrator).GetInstance("instance-1")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(instance.Filters).To(Equal(filters))
+	})
+
+	It("refuses filters that are not allowed without creating the instance", func() {
+		_, err := broker.Provision(ctx, "instance-1", map[string]string{"filters": "ruby { code => 'exit' }"})
+		Ω(err).To(Equal(&api.InvalidParameterError{
+			Name:   "filters",
+			Reason: "line 1: filter plugin 'ruby' is not allowed: ruby { code => 'exit' }",
+		}))
+		_, err = os.Stat(path.Join(config.InstanceDataDirectory, "instance-1"))
+		Ω(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	Context("with a template that has no place for filters", func() {
+		BeforeEach(func() {
+			config.DefaultConfigPath = path.Join(tmpDir, "conf")
+			config.DefaultPipeline = ""
+			Ω(os.MkdirAll(config.DefaultConfigPath, 0755)).To(Succeed())
+			Ω(ioutil.WriteFile(path.Join(config.DefaultConfigPath, "logstash.conf.tmpl"), []byte(`input { tcp { port => <%= logstash["Port"] %> } }`), 0644)).To(Succeed())
+		})
+
+		It("refuses filters rather than dropping them", func() {
+			_, err := broker.Provision(ctx, "instance-1", map[string]string{"filters": filters})
+			Ω(err).To(BeAssignableToTypeOf(&api.InvalidParameterError{}))
+			Ω(err.Error()).To(HaveSuffix("logstash.conf.tmpl has no place for filters"))
+		})
+	})
+
+	Describe("updating", func() {
+		var updater api.InstanceUpdater
+
+		JustBeforeEach(func() {
+			updater = broker.(api.InstanceUpdater)
+			_, err := broker.Provision(ctx, "instance-1", map[string]string{"plan_id": "plan-1"})
+			Ω(err).ToNot(HaveOccurred())
+			starter.Started = nil
+		})
+
+		It("re-renders the config with the new filters and restarts the agent", func() {
+			Ω(updater.Update(ctx, "instance-1", map[string]string{"plan_id": "plan-1", "filters": filters})).To(Succeed())
+			Ω(renderedConfig("instance-1")).To(ContainSubstring(`add_tag => [ "payments" ]`))
+			Ω(starter.Started).To(Equal([]string{"instance-1"}))
+
+			Ω(updater.Update(ctx, "instance-1", map[string]string{"filters": ""})).To(Succeed())
+			Ω(renderedConfig("instance-1")).ToNot(ContainSubstring("payments"))
+		})
+
+		It("keeps the filters when the config is rendered again", func() {
+			Ω(updater.Update(ctx, "instance-1", map[string]string{"filters": filters})).To(Succeed())
+
+			repository := &logstash.FileSystemInstanceRepository{LogstashConf: config}
+			instance, err := repository.FindById("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(os.Remove(instance.ConfigPath())).To(Succeed())
+			Ω(logstash.RenderConfig(instance)).To(Succeed())
+			Ω(renderedConfig("instance-1")).To(ContainSubstring(`add_tag => [ "payments" ]`))
+		})
+
+		It("leaves the instance alone when the filters are refused", func() {
+			err := updater.Update(ctx, "instance-1", map[string]string{"filters": "mutate {\n  add_tag => [ \"x\" ]\n}\noutput { }"})
+			Ω(err).To(MatchError("invalid parameter 'filters': line 4: only filter plugins may be given, not output sections: output { }"))
+			Ω(starter.Started).To(BeEmpty())
+		})
+
+		It("goes back to the previous filters when the agent does not restart", func() {
+			starter.Failing["instance-1"] = true
+
+			err := updater.Update(ctx, "instance-1", map[string]string{"filters": filters})
+			Ω(err).To(Equal(os.ErrPermission))
+			Ω(renderedConfig("instance-1")).ToNot(ContainSubstring("payments"))
+
+			instance, err := broker.(api.InstanceAdministrator).GetInstance("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.Filters).To(BeEmpty())
+		})
+
+		It("refuses to change anything but the filters", func() {
+			Ω(updater.Update(ctx, "instance-1", map[string]string{"plan_id": "plan-2"})).To(Equal(&api.InvalidParameterError{
+				Name:   "plan_id",
+				Reason: "the plan of an instance cannot be changed",
+			}))
+			Ω(updater.Update(ctx, "instance-1", map[string]string{"pipeline": "nginx-access"})).To(Equal(&api.InvalidParameterError{
+				Name:   "pipeline",
+				Reason: "cannot be updated",
+			}))
+		})
+
+		It("does not update instances that do not exist", func() {
+			Ω(updater.Update(ctx, "instance-2", map[string]string{"filters": filters})).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+})
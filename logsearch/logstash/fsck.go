@@ -0,0 +1,344 @@
+package logstash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
+)
+
+// Problems the checker can find with an instance directory
+const (
+	ProblemMissingPortFile        = "missing-port-file"
+	ProblemUnparseablePort        = "unparseable-port"
+	ProblemCorruptMetadata        = "corrupt-metadata"
+	ProblemMissingLogDir          = "missing-log-dir"
+	ProblemMissingConfig          = "missing-config"
+	ProblemDuplicatePort          = "duplicate-port"
+	ProblemRunningWithoutMetadata = "running-without-metadata"
+)
+
+const EntryHealthy = "healthy"
+
+// Bad instance directories are moved here. It is hidden so that it is never mistaken for an instance.
+const quarantineDirectory = ".quarantine"
+
+// The outcome of checking one entry of the instance data directory
+type EntryReport struct {
+	Id       string   `json:"id"`
+	Status   string   `json:"status"`
+	Problems []string `json:"problems"`
+	Port     int      `json:"port,omitempty"`
+	TLSPort  int      `json:"tls_port,omitempty"`
+	Pid      int      `json:"pid,omitempty"`
+	Repairs  []string `json:"repairs,omitempty"`
+
+	// which of the ports of a ProblemDuplicatePort an older instance holds
+	duplicatePort    bool
+	duplicateTLSPort bool
+}
+
+// Checker finds orphaned and corrupt state in the instance data directory
+// and repairs it. Repairing while the broker is provisioning can race with it,
+// so it is best done while the broker is stopped or idle.
+type Checker struct {
+	Config           ServiceConfiguration
+	ProcessStarter   ProcessStarter
+	IsProcessRunning func(pid int) bool
+	StopProcess      func(pid int, timeout time.Duration) error
+	FindFreePort     func() (int, error)
+}
+
+func NewChecker(config ServiceConfiguration) *Checker {
+	return &Checker{
+		Config:           config,
+		ProcessStarter:   NewProcessStarter(system.OSCommandRunner{}, time.Duration(config.ProbeTimeoutMilliseconds)*time.Millisecond),
+		IsProcessRunning: system.IsProcessRunning,
+		StopProcess:      system.StopProcess,
+		FindFreePort:     system.FindFreePort,
+	}
+}
+
+func (report EntryReport) Healthy() bool {
+	return len(report.Problems) == 0
+}
+
+func (report EntryReport) Has(problem string) bool {
+	for _, p := range report.Problems {
+		if p == problem {
+			return true
+		}
+	}
+	return false
+}
+
+// Check classifies every instance directory, sorted by id.
+func (checker *Checker) Check() ([]*EntryReport, error) {
+	reports := []*EntryReport{}
+
+	entries, err := ioutil.ReadDir(checker.Config.InstanceDataDirectory)
+	if err != nil {
+		return reports, err
+	}
+
+	// the instance that keeps a port shared by several is the oldest one
+	type owner struct {
+		report    *EntryReport
+		createdAt time.Time
+		tls       bool
+	}
+	ports := map[int][]owner{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		report, createdAt := checker.checkEntry(entry.Name())
+		if report.Port != 0 {
+			ports[report.Port] = append(ports[report.Port], owner{report, createdAt, false})
+		}
+		if report.TLSPort != 0 {
+			ports[report.TLSPort] = append(ports[report.TLSPort], owner{report, createdAt, true})
+		}
+		reports = append(reports, report)
+	}
+
+	for _, owners := range ports {
+		sort.SliceStable(owners, func(i, j int) bool {
+			return owners[i].createdAt.Before(owners[j].createdAt)
+		})
+		for _, duplicate := range owners[1:] {
+			if !duplicate.report.Has(ProblemDuplicatePort) {
+				duplicate.report.Problems = append(duplicate.report.Problems, ProblemDuplicatePort)
+			}
+			if duplicate.tls {
+				duplicate.report.duplicateTLSPort = true
+			} else {
+				duplicate.report.duplicatePort = true
+			}
+		}
+	}
+
+	for _, report := range reports {
+		report.Status = EntryHealthy
+		if !report.Healthy() {
+			report.Status = report.Problems[0]
+		}
+	}
+
+	return reports, nil
+}
+
+// CheckInstances classifies the instances of a repository that keeps their records outside the data directory, such
+// as the bolt repository, which already refuses to give a port to two instances. Only their log directories and
+// configs are checked.
+func (checker *Checker) CheckInstances(instances []*Instance) []*EntryReport {
+	reports := []*EntryReport{}
+	for _, instance := range instances {
+		report := &EntryReport{Id: instance.Id, Problems: []string{}, Port: instance.Port}
+		if instance.TLS != nil {
+			report.TLSPort = instance.TLS.Port
+		}
+		if _, err := os.Stat(instance.LogDir); err != nil {
+			report.Problems = append(report.Problems, ProblemMissingLogDir)
+		}
+		if info, err := os.Stat(instance.ConfigPath()); err != nil || info.Size() == 0 {
+			report.Problems = append(report.Problems, ProblemMissingConfig)
+		}
+		if pid, err := system.ReadPidFile(instance.PidFilePath()); err == nil && checker.IsProcessRunning(pid) {
+			report.Pid = pid
+		}
+
+		report.Status = EntryHealthy
+		if !report.Healthy() {
+			report.Status = report.Problems[0]
+		}
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Id < reports[j].Id
+	})
+	return reports
+}
+
+func (checker *Checker) checkEntry(instanceId string) (*EntryReport, time.Time) {
+	report := &EntryReport{Id: instanceId, Problems: []string{}}
+	basepath := path.Join(checker.Config.InstanceDataDirectory, instanceId)
+
+	loadable := true
+	portBytes, err := ioutil.ReadFile(path.Join(basepath, "logstash.port"))
+	if err != nil {
+		report.Problems = append(report.Problems, ProblemMissingPortFile)
+		loadable = false
+	} else if port, err := strconv.Atoi(strings.TrimSpace(string(portBytes))); err != nil || port <= 0 {
+		report.Problems = append(report.Problems, ProblemUnparseablePort)
+		loadable = false
+	} else {
+		report.Port = port
+	}
+
+	instance := &Instance{}
+	metadata, err := ioutil.ReadFile(path.Join(basepath, "instance.json"))
+	if err == nil {
+		if err := json.Unmarshal(metadata, instance); err != nil {
+			report.Problems = append(report.Problems, ProblemCorruptMetadata)
+			loadable = false
+		} else if instance.TLS != nil {
+			report.TLSPort = instance.TLS.Port
+		}
+	} else if !os.IsNotExist(err) {
+		report.Problems = append(report.Problems, ProblemCorruptMetadata)
+		loadable = false
+	}
+
+	if _, err := os.Stat(path.Join(checker.Config.InstanceLogDirectory, instanceId)); err != nil {
+		report.Problems = append(report.Problems, ProblemMissingLogDir)
+	}
+
+	if info, err := os.Stat(path.Join(basepath, "logstash.conf")); err != nil || info.Size() == 0 {
+		report.Problems = append(report.Problems, ProblemMissingConfig)
+	}
+
+	if pid, err := system.ReadPidFile(path.Join(basepath, "logstash.pid")); err == nil && checker.IsProcessRunning(pid) {
+		report.Pid = pid
+		if !loadable {
+			report.Problems = append(report.Problems, ProblemRunningWithoutMetadata)
+		}
+	}
+
+	return report, instance.CreatedAt
+}
+
+// Repair fixes what it can of each report, recording what it did in the report:
+//
+//   - agents running without usable metadata are stopped
+//   - directories without a usable port file or metadata are moved into the quarantine directory
+//   - missing log directories are created
+//   - instances sharing a port or the port of their TLS input with an older one are moved to a port that is free
+//     and no other instance claims, and restarted if they were running
+//   - missing or empty configs are rendered again
+func (checker *Checker) Repair(logger lager.Logger, reports []*EntryReport) error {
+	claimed := map[int]bool{}
+	for _, report := range reports {
+		claimed[report.Port] = true
+		claimed[report.TLSPort] = true
+	}
+
+	for _, report := range reports {
+		if err := checker.repairEntry(logger.Session("repair", lager.Data{"instance-id": report.Id}), report, claimed); err != nil {
+			return fmt.Errorf("repairing %s: %s", report.Id, err)
+		}
+	}
+	return nil
+}
+
+func (checker *Checker) repairEntry(logger lager.Logger, report *EntryReport, claimed map[int]bool) error {
+	if report.Has(ProblemRunningWithoutMetadata) {
+		if err := checker.StopProcess(report.Pid, agentStopTimeout); err != nil {
+			return err
+		}
+		report.Repairs = append(report.Repairs, fmt.Sprintf("stopped agent %d", report.Pid))
+	}
+
+	if report.Has(ProblemMissingPortFile) || report.Has(ProblemUnparseablePort) || report.Has(ProblemCorruptMetadata) {
+		quarantined, err := checker.quarantine(report.Id)
+		if err != nil {
+			return err
+		}
+		logger.Info("quarantined", lager.Data{"path": quarantined})
+		report.Repairs = append(report.Repairs, "quarantined to "+quarantined)
+		return nil
+	}
+
+	repository := &FileSystemInstanceRepository{LogstashConf: checker.Config}
+
+	if report.Has(ProblemMissingLogDir) {
+		if err := os.MkdirAll(path.Join(checker.Config.InstanceLogDirectory, report.Id), 0755); err != nil {
+			return err
+		}
+		report.Repairs = append(report.Repairs, "created log directory")
+	}
+
+	if report.Has(ProblemDuplicatePort) {
+		if report.duplicatePort {
+			port, err := findUnclaimedPort(checker.FindFreePort, claimed)
+			if err != nil {
+				return err
+			}
+			claimed[port] = true
+			err = system.AtomicFileWriter{}.WriteFile(path.Join(checker.Config.InstanceDataDirectory, report.Id, "logstash.port"), []byte(strconv.Itoa(port)), 0644)
+			if err != nil {
+				return err
+			}
+			report.Repairs = append(report.Repairs, fmt.Sprintf("moved from port %d to %d", report.Port, port))
+			report.Port = port
+		}
+
+		instance, err := repository.FindById(report.Id)
+		if err != nil {
+			return err
+		}
+		if report.duplicateTLSPort {
+			port, err := findUnclaimedPort(checker.FindFreePort, claimed)
+			if err != nil {
+				return err
+			}
+			claimed[port] = true
+			instance.TLS.Port = port
+			if err := repository.createMetadata(instance); err != nil {
+				return err
+			}
+			report.Repairs = append(report.Repairs, fmt.Sprintf("moved the TLS input from port %d to %d", report.TLSPort, port))
+			report.TLSPort = port
+		}
+		if err := RenderConfig(instance); err != nil {
+			return err
+		}
+
+		if checker.ProcessStarter.Status(instance).State == ProcessRunning {
+			if err := checker.ProcessStarter.Stop(logger, instance, agentStopTimeout); err != nil {
+				return err
+			}
+			if err := checker.ProcessStarter.Start(logger, instance, time.Duration(30)*time.Second); err != nil {
+				return err
+			}
+			agentRestarts.Inc()
+			report.Repairs = append(report.Repairs, "restarted agent")
+		}
+		return nil
+	}
+
+	if report.Has(ProblemMissingConfig) {
+		instance, err := repository.FindById(report.Id)
+		if err != nil {
+			return err
+		}
+		if err := RenderConfig(instance); err != nil {
+			return err
+		}
+		report.Repairs = append(report.Repairs, "rendered config")
+	}
+
+	return nil
+}
+
+func (checker *Checker) quarantine(instanceId string) (string, error) {
+	dir := path.Join(checker.Config.InstanceDataDirectory, quarantineDirectory)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	quarantined := path.Join(dir, fmt.Sprintf("%s-%d", instanceId, time.Now().Unix()))
+	return quarantined, os.Rename(path.Join(checker.Config.InstanceDataDirectory, instanceId), quarantined)
+}
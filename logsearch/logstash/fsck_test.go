@@ -0,0 +1,266 @@
+package logstash_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checker", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var repository *logstash.FileSystemInstanceRepository
+	var checker *logstash.Checker
+	var runningPids map[int]bool
+	var stoppedPids []int
+
+	save := func(id string, port int, createdAt time.Time) {
+		Ω(repository.Save(&logstash.Instance{
+			Id:           id,
+			Basepath:     path.Join(config.InstanceDataDirectory, id),
+			LogDir:       path.Join(config.InstanceLogDirectory, id),
+			TemplatePath: config.DefaultConfigPath,
+			Host:         config.Host,
+			Port:         port,
+			CreatedAt:    createdAt,
+		})).To(Succeed())
+	}
+
+	// Saves an instance onto the port of another, which the repository refuses to do
+	saveDuplicate := func(id string, port int, createdAt time.Time) {
+		save(id, port+1000, createdAt)
+		Ω(ioutil.WriteFile(path.Join(config.InstanceDataDirectory, id, "logstash.port"), []byte(strconv.Itoa(port)), 0644)).To(Succeed())
+	}
+
+	// Saves an instance whose TLS input listens on the port of another
+	saveTLSDuplicate := func(id string, port int, createdAt time.Time) {
+		save(id, port+1000, createdAt)
+		instance, err := repository.FindById(id)
+		Ω(err).ToNot(HaveOccurred())
+		instance.TLS = &logstash.InstanceTLS{Port: port, Certificate: "certificate"}
+		metadata, err := json.Marshal(instance)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ioutil.WriteFile(instance.MetadataPath(), metadata, 0600)).To(Succeed())
+	}
+
+	check := func() map[string]*logstash.EntryReport {
+		reports, err := checker.Check()
+		Ω(err).ToNot(HaveOccurred())
+		byId := map[string]*logstash.EntryReport{}
+		for _, report := range reports {
+			byId[report.Id] = report
+		}
+		return byId
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-fsck")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+		}
+		repository = &logstash.FileSystemInstanceRepository{LogstashConf: config}
+		runningPids = map[int]bool{}
+		stoppedPids = []int{}
+
+		isProcessRunning := func(pid int) bool {
+			return runningPids[pid]
+		}
+		checker = &logstash.Checker{
+			Config: config,
+			ProcessStarter: &logstash.LogstashAgentStarter{
+				CommandRunner:    &FakeCommandRunner{},
+				IsProcessRunning: isProcessRunning,
+			},
+			IsProcessRunning: isProcessRunning,
+			StopProcess: func(pid int, _ time.Duration) error {
+				stoppedPids = append(stoppedPids, pid)
+				runningPids[pid] = false
+				return nil
+			},
+			FindFreePort: func() (int, error) {
+				return 7000, nil
+			},
+		}
+
+		save("healthy", 5000, time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("reports a well formed instance as healthy", func() {
+		report := check()["healthy"]
+		Ω(report.Status).To(Equal(logstash.EntryHealthy))
+		Ω(report.Problems).To(BeEmpty())
+	})
+
+	It("finds a directory without a port file", func() {
+		Ω(os.MkdirAll(path.Join(config.InstanceDataDirectory, "no-port"), 0755)).To(Succeed())
+		Ω(check()["no-port"].Status).To(Equal(logstash.ProblemMissingPortFile))
+	})
+
+	It("finds a port file that is not a number", func() {
+		save("bad-port", 5001, time.Now())
+		Ω(ioutil.WriteFile(path.Join(config.InstanceDataDirectory, "bad-port", "logstash.port"), []byte("five"), 0644)).To(Succeed())
+		Ω(check()["bad-port"].Status).To(Equal(logstash.ProblemUnparseablePort))
+	})
+
+	It("finds a missing log directory", func() {
+		Ω(os.RemoveAll(path.Join(config.InstanceLogDirectory, "healthy"))).To(Succeed())
+		Ω(check()["healthy"].Status).To(Equal(logstash.ProblemMissingLogDir))
+	})
+
+	It("blames the newer of two instances sharing a port", func() {
+		saveDuplicate("newer", 5000, time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC))
+		reports := check()
+		Ω(reports["healthy"].Healthy()).To(BeTrue())
+		Ω(reports["newer"].Status).To(Equal(logstash.ProblemDuplicatePort))
+	})
+
+	It("blames the newer of two instances when the TLS input of one has the port of the other", func() {
+		saveTLSDuplicate("newer", 5000, time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC))
+		reports := check()
+		Ω(reports["healthy"].Healthy()).To(BeTrue())
+		Ω(reports["newer"].Status).To(Equal(logstash.ProblemDuplicatePort))
+		Ω(reports["newer"].TLSPort).To(Equal(5000))
+	})
+
+	It("finds an agent running without metadata", func() {
+		dir := path.Join(config.InstanceDataDirectory, "orphan")
+		Ω(os.MkdirAll(dir, 0755)).To(Succeed())
+		Ω(ioutil.WriteFile(path.Join(dir, "logstash.pid"), []byte("4242"), 0644)).To(Succeed())
+		runningPids[4242] = true
+
+		report := check()["orphan"]
+		Ω(report.Has(logstash.ProblemRunningWithoutMetadata)).To(BeTrue())
+		Ω(report.Pid).To(Equal(4242))
+	})
+
+	It("counts a corrupt directory as an instance without failing to list the others", func() {
+		Ω(os.MkdirAll(path.Join(config.InstanceDataDirectory, "no-port"), 0755)).To(Succeed())
+		Ω(repository.GetInstanceCount()).To(Equal(2))
+		Ω(repository.UnloadableInstances()).To(Equal([]string{"no-port"}))
+		Ω(repository.FindAll()).To(HaveLen(1))
+	})
+
+	Describe("repair", func() {
+		var logger *lagertest.TestLogger
+
+		BeforeEach(func() {
+			logger = lagertest.NewTestLogger("fsck")
+		})
+
+		repair := func() {
+			reports, err := checker.Check()
+			Ω(err).ToNot(HaveOccurred())
+			Ω(checker.Repair(logger, reports)).To(Succeed())
+		}
+
+		It("stops orphaned agents and quarantines their directories", func() {
+			dir := path.Join(config.InstanceDataDirectory, "orphan")
+			Ω(os.MkdirAll(dir, 0755)).To(Succeed())
+			Ω(ioutil.WriteFile(path.Join(dir, "logstash.pid"), []byte("4242"), 0644)).To(Succeed())
+			runningPids[4242] = true
+
+			repair()
+
+			Ω(stoppedPids).To(Equal([]int{4242}))
+			_, err := os.Stat(dir)
+			Ω(os.IsNotExist(err)).To(BeTrue())
+			quarantined, err := ioutil.ReadDir(path.Join(config.InstanceDataDirectory, ".quarantine"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(quarantined).To(HaveLen(1))
+		})
+
+		It("recreates missing log directories and configs", func() {
+			Ω(os.RemoveAll(path.Join(config.InstanceLogDirectory, "healthy"))).To(Succeed())
+			Ω(os.Remove(path.Join(config.InstanceDataDirectory, "healthy", "logstash.conf"))).To(Succeed())
+
+			repair()
+
+			Ω(check()["healthy"].Healthy()).To(BeTrue())
+		})
+
+		It("moves the newer of two instances sharing a port to a free one", func() {
+			saveDuplicate("newer", 5000, time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC))
+
+			repair()
+
+			instance, err := repository.FindById("newer")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.Port).To(Equal(7000))
+			config, err := ioutil.ReadFile(instance.ConfigPath())
+			Ω(err).ToNot(HaveOccurred())
+			Ω(string(config)).To(ContainSubstring(`port => "7000"`))
+			Ω(check()["newer"].Healthy()).To(BeTrue())
+		})
+
+		It("moves the TLS input of the newer of two instances sharing a port to a free one", func() {
+			saveTLSDuplicate("newer", 5000, time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC))
+
+			repair()
+
+			instance, err := repository.FindById("newer")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.Port).To(Equal(6000))
+			Ω(instance.TLS.Port).To(Equal(7000))
+			Ω(check()["newer"].Healthy()).To(BeTrue())
+		})
+
+		It("does not move an instance to the port of a stopped one", func() {
+			save("stopped", 7000, time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC))
+			saveDuplicate("newer", 5000, time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC))
+			ports := []int{7000, 7001}
+			checker.FindFreePort = func() (int, error) {
+				port := ports[0]
+				ports = ports[1:]
+				return port, nil
+			}
+
+			repair()
+
+			instance, err := repository.FindById("newer")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.Port).To(Equal(7001))
+		})
+
+		It("restarts the running agent of a moved instance and counts the restart", func() {
+			saveDuplicate("newer", 5000, time.Date(2014, 9, 2, 0, 0, 0, 0, time.UTC))
+			Ω(ioutil.WriteFile(path.Join(config.InstanceDataDirectory, "newer", "logstash.pid"), []byte("4343"), 0644)).To(Succeed())
+			runningPids[4343] = true
+			starter := checker.ProcessStarter.(*logstash.LogstashAgentStarter)
+			starter.StopProcess = checker.StopProcess
+			starter.IsReady = func(*net.TCPAddr) bool { return true }
+			restarts := metricValue("logsearch_agent_restarts_total")
+
+			reports, err := checker.Check()
+			Ω(err).ToNot(HaveOccurred())
+			Ω(checker.Repair(logger, reports)).To(Succeed())
+
+			Ω(stoppedPids).To(Equal([]int{4343}))
+			for _, report := range reports {
+				if report.Id == "newer" {
+					Ω(report.Repairs).To(ContainElement("restarted agent"))
+				}
+			}
+			Ω(metricValue("logsearch_agent_restarts_total")).To(BeNumerically("==", restarts+1))
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package logstash
+
+import (
+	"sync"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// How many instances are probed at once
+const healthProbeConcurrency = 8
+
+func (broker *logstashServiceBroker) CheckHealth() []HealthCheck {
+	return []HealthCheck{
+		healthCheck("data-directory", system.CheckDirectoryWritable(broker.ServiceConfiguration.InstanceDataDirectory)),
+		healthCheck("config", CheckConfig(broker.ServiceConfiguration)),
+	}
+}
+
+func (broker *logstashServiceBroker) CheckInstancesHealth() ([]InstanceHealth, error) {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+
+	// a broken pipeline library is reported by the template check, so probe every port rather than fail here
+	pipelines, _ := LoadPipelines(broker.ServiceConfiguration)
+
+	health := make([]InstanceHealth, len(instances))
+	slots := make(chan struct{}, healthProbeConcurrency)
+	var wait sync.WaitGroup
+	for i, instance := range instances {
+		wait.Add(1)
+		slots <- struct{}{}
+		go func(i int, instance *Instance) {
+			defer wait.Done()
+			defer func() { <-slots }()
+			health[i] = broker.probeInstance(instance, pipelines[instance.Pipeline])
+		}(i, instance)
+	}
+	wait.Wait()
+
+	return health, nil
+}
+
+func (broker *logstashServiceBroker) probeInstance(instance *Instance, pipeline *Pipeline) InstanceHealth {
+	ports := broker.ProcessProber.Probe(instance)
+	if pipeline != nil {
+		ports = acceptedPorts(pipeline, ports)
+	}
+
+	status := HealthStatusOk
+	for _, port := range ports {
+		if port.Status != HealthStatusOk {
+			status = HealthStatusFailed
+		}
+	}
+
+	return InstanceHealth{
+		InstanceId: instance.Id,
+		Address:    instance.Address(),
+		Status:     status,
+		Ports:      ports,
+	}
+}
+
+// Drops the probes of protocols a pipeline has no input for
+func acceptedPorts(pipeline *Pipeline, ports []PortHealth) []PortHealth {
+	accepted := []PortHealth{}
+	for _, port := range ports {
+		if pipeline.Accepts(port.Protocol) {
+			accepted = append(accepted, port)
+		}
+	}
+	return accepted
+}
+
+func healthCheck(name string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Status: HealthStatusFailed, Error: err.Error()}
+	}
+	return HealthCheck{Name: name, Status: HealthStatusOk}
+}
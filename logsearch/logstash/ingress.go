@@ -0,0 +1,74 @@
+package logstash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/ingress"
+)
+
+// What a binding sends to the ingress with, when the broker runs one
+type IngressCredentials struct {
+	// For syslog drains over http, which post to the path of the token
+	DrainUrl string `json:"drain_url"`
+	// For syslog senders, which put the token in a [logsearch token="..."] structured data element
+	SyslogUrl string `json:"syslog_url"`
+	Token     string `json:"token"`
+}
+
+// A token of a binding to instanceId. It starts with the instance id, so routing it reads the bindings of a
+// single instance.
+func newIngressToken(instanceId string) (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return instanceId + "." + hex.EncodeToString(secret), nil
+}
+
+func (broker *logstashServiceBroker) ingressCredentials(token string) (*IngressCredentials, error) {
+	config := broker.ServiceConfiguration.Ingress
+	port, err := config.Port()
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(config.Host, strconv.Itoa(port))
+	return &IngressCredentials{
+		DrainUrl:  fmt.Sprintf("http://%s/%s", address, token),
+		SyslogUrl: "syslog://" + address,
+		Token:     token,
+	}, nil
+}
+
+// Route implements ingress.Router: the token of a binding leads to the port of its instance for as long as the
+// binding exists.
+func (broker *logstashServiceBroker) Route(token string) (string, error) {
+	separator := strings.LastIndex(token, ".")
+	if separator < 1 {
+		return "", ingress.ErrUnknownToken
+	}
+	instanceId := token[:separator]
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err == ErrInstanceNotFound {
+		return "", ingress.ErrUnknownToken
+	}
+	if err != nil {
+		return "", err
+	}
+	bindings, err := broker.InstanceRepository.FindBindings(instanceId)
+	if err != nil {
+		return "", err
+	}
+	for _, binding := range bindings {
+		if binding.IngressToken != "" && subtle.ConstantTimeCompare([]byte(binding.IngressToken), []byte(token)) == 1 {
+			return instance.Address(), nil
+		}
+	}
+	return "", ingress.ErrUnknownToken
+}
@@ -0,0 +1,142 @@
+package logstash_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/ingress"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ingress", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var broker api.ServiceBroker
+	var router ingress.Router
+	var agent net.Listener
+	var ctx context.Context
+
+	bind := func(instanceId string, bindingId string) logstash.Credentials {
+		credentials, err := broker.Bind(ctx, instanceId, bindingId)
+		Ω(err).ToNot(HaveOccurred())
+		return credentials.(logstash.Credentials)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-ingress")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+
+		// stands in for the agent of every instance
+		agent, err = net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+			DefaultPipeline:       "syslog-5424",
+			Ingress: ingress.Configuration{
+				Enabled: true,
+				Listen:  "0.0.0.0:5514",
+				Host:    "ingress.example.com",
+			},
+		}
+		config.Ingress.SetDefaults()
+	})
+
+	JustBeforeEach(func() {
+		logstashBroker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("ingress"))
+		Ω(err).ToNot(HaveOccurred())
+		logstashBroker.ProcessStarter = fakeProcessStarter{}
+		logstashBroker.FindFreePort = func() (int, error) {
+			return agent.Addr().(*net.TCPAddr).Port, nil
+		}
+		broker = logstashBroker
+		router = logstashBroker
+
+		_, err = broker.Provision(ctx, "instance-1", map[string]string{})
+		Ω(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		agent.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("gives every binding a token of its own and the urls of the ingress", func() {
+		first := bind("instance-1", "binding-1")
+		second := bind("instance-1", "binding-2")
+
+		Ω(first.Ingress).ToNot(BeNil())
+		Ω(first.Ingress.Token).To(HavePrefix("instance-1."))
+		Ω(first.Ingress.Token).ToNot(Equal(second.Ingress.Token))
+		Ω(first.Ingress.DrainUrl).To(Equal("http://ingress.example.com:5514/" + first.Ingress.Token))
+		Ω(first.Ingress.SyslogUrl).To(Equal("syslog://ingress.example.com:5514"))
+
+		binding, err := os.Stat(path.Join(tmpDir, "data", "instance-1", "bindings", "binding-1.json"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(binding.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("routes the tokens of bindings to their instance until they are unbound", func() {
+		token := bind("instance-1", "binding-1").Ingress.Token
+
+		Ω(router.Route(token)).To(Equal(agent.Addr().String()))
+		for _, unknown := range []string{"", "instance-1", "instance-1.", token + "0", "instance-2." + strings.Split(token, ".")[1]} {
+			_, err := router.Route(unknown)
+			Ω(err).To(Equal(ingress.ErrUnknownToken), unknown)
+		}
+
+		Ω(broker.Unbind(ctx, "instance-1", "binding-1")).To(Succeed())
+		_, err := router.Route(token)
+		Ω(err).To(Equal(ingress.ErrUnknownToken))
+	})
+
+	It("forwards what the ingress takes with a token to the agent of the instance", func() {
+		token := bind("instance-1", "binding-1").Ingress.Token
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ToNot(HaveOccurred())
+		server := ingress.NewServer(config.Ingress, router, lagertest.NewTestLogger("ingress"))
+		go server.Serve(listener)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Ω(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		fmt.Fprintf(conn, "<14>1 2015-06-01T00:00:00Z host app - - [logsearch token=\"%s\"] hello\n", token)
+
+		received, err := agent.Accept()
+		Ω(err).ToNot(HaveOccurred())
+		defer received.Close()
+		line, err := bufio.NewReader(received).ReadString('\n')
+		Ω(err).ToNot(HaveOccurred())
+		Ω(line).To(Equal("<14>1 2015-06-01T00:00:00Z host app - - - hello\n"))
+	})
+
+	Context("when the ingress is not enabled", func() {
+		BeforeEach(func() {
+			config.Ingress.Enabled = false
+		})
+
+		It("gives bindings no token", func() {
+			Ω(bind("instance-1", "binding-1").Ingress).To(BeNil())
+		})
+	})
+})
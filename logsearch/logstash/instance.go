@@ -5,15 +5,49 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"time"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
 )
 
 type Instance struct {
-	Id           string
-	Basepath     string
-	LogDir       string
-	Host         string
-	Port         int
-	TemplatePath string
+	Id           string `json:"id"`
+	Basepath     string `json:"-"`
+	LogDir       string `json:"-"`
+	Host         string `json:"-"`
+	Port         int    `json:"-"`
+	TemplatePath string `json:"-"`
+	// The pipeline in conf_path/pipelines the config was rendered from, empty for the template in conf_path
+	Pipeline string `json:"pipeline,omitempty"`
+	// Filter plugins given by the user, rendered into the filter section of the pipeline
+	Filters string `json:"filters,omitempty"`
+	// Starts the name of every index the instance writes to
+	IndexPrefix string `json:"index_prefix,omitempty"`
+	// Days the indices of the instance are kept, overriding its plan; 0 when it has no override
+	RetentionDays int `json:"retention_days,omitempty"`
+	// The certificate of the TLS input of the instance, nil when it listens without TLS
+	TLS *InstanceTLS `json:"tls,omitempty"`
+	// The stack the instance is the shipper or indexer of, nil for an instance of its own
+	Stack            *stack.Component            `json:"stack,omitempty"`
+	Elasticsearch    elasticsearch.Configuration `json:"-"`
+	ServiceId        string                      `json:"service_id"`
+	PlanId           string                      `json:"plan_id"`
+	OrganizationGuid string                      `json:"organization_guid"`
+	SpaceGuid        string                      `json:"space_guid"`
+	CreatedBy        *OriginatingIdentity        `json:"created_by,omitempty"`
+	CreatedAt        time.Time                   `json:"created_at"`
+}
+
+// A binding of an application to an instance
+type Binding struct {
+	Id         string               `json:"id"`
+	InstanceId string               `json:"instance_id"`
+	CreatedBy  *OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt  time.Time            `json:"created_at"`
+	// Routes the syslog of the binding from the ingress to the instance
+	IngressToken string `json:"ingress_token,omitempty"`
 }
 
 func (instance Instance) CommandArgs() []string {
@@ -30,6 +64,14 @@ func (instance Instance) Address() string {
 	return fmt.Sprintf("%s:%d", instance.Host, instance.Port)
 }
 
+// The port of the instance and that of its TLS input, when it has one
+func (instance Instance) ports() []int {
+	if instance.TLS == nil {
+		return []int{instance.Port}
+	}
+	return []int{instance.Port, instance.TLS.Port}
+}
+
 func (instance Instance) ConfigPath() string {
 	return path.Join(instance.baseDir(), "logstash.conf")
 }
@@ -38,6 +80,26 @@ func (instance Instance) LogFilePath() string {
 	return path.Join(instance.LogDir, "logstash.stdout.log")
 }
 
+func (instance Instance) PidFilePath() string {
+	return path.Join(instance.baseDir(), "logstash.pid")
+}
+
+func (instance Instance) MetadataPath() string {
+	return path.Join(instance.baseDir(), "instance.json")
+}
+
+func (instance Instance) BindingsDir() string {
+	return path.Join(instance.baseDir(), "bindings")
+}
+
+func (instance Instance) TLSCertificatePath() string {
+	return path.Join(instance.baseDir(), "tls", "server.crt")
+}
+
+func (instance Instance) TLSKeyPath() string {
+	return path.Join(instance.baseDir(), "tls", "server.key")
+}
+
 func (instance Instance) DataFilePath() string {
 	return instance.baseDir()
 }
@@ -46,6 +108,21 @@ func (instance Instance) TempatePath() string {
 	return instance.TemplatePath
 }
 
+// The index prefix of the instance; instances provisioned before indices were named by the broker use their id
+func (instance Instance) indexPrefix() string {
+	if instance.IndexPrefix != "" {
+		return instance.IndexPrefix
+	}
+	return elasticsearch.IndexName(instance.elasticsearchConfig().IndexPrefix, instance.Id)
+}
+
+// The elasticsearch settings of the instance, with defaults for those the config leaves out
+func (instance Instance) elasticsearchConfig() elasticsearch.Configuration {
+	config := instance.Elasticsearch
+	config.SetDefaults()
+	return config
+}
+
 func (instance Instance) baseDir() string {
 	return instance.Basepath
 }
@@ -1,6 +1,12 @@
 package logstash_test
 
 import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -11,3 +17,17 @@ func TestLogstash(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Logstash Suite")
 }
+
+// The value of a sample, e.g. logsearch_agent_restarts_total
+func metricValue(sample string) float64 {
+	var buffer bytes.Buffer
+	Ω(metrics.DefaultRegistry.Write(&buffer)).To(Succeed())
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		if strings.HasPrefix(line, sample+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, sample+" "), 64)
+			Ω(err).ToNot(HaveOccurred())
+			return value
+		}
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package logstash
+
+import (
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+)
+
+var (
+	agentStartDuration = metrics.NewHistogram(
+		"logsearch_agent_start_duration_seconds",
+		"Time taken for a logstash agent to start accepting connections, by outcome.",
+		metrics.DefBuckets,
+		"outcome",
+	)
+	agentRestarts = metrics.NewCounter(
+		"logsearch_agent_restarts_total",
+		"Logstash agents restarted by the broker.",
+	)
+	serviceInstances = metrics.NewGauge(
+		"logsearch_service_instances",
+		"Provisioned logstash service instances.",
+	)
+	retentionDeletedIndices = metrics.NewCounter(
+		"logsearch_retention_deleted_indices_total",
+		"Indices deleted because they were older than the retention of their instance.",
+	)
+	serviceInstanceLimit = metrics.NewGauge(
+		"logsearch_service_instance_limit",
+		"Maximum number of logstash service instances the broker will provision.",
+	)
+)
+
+func init() {
+	metrics.MustRegister(agentStartDuration, agentRestarts, retentionDeletedIndices, serviceInstances, serviceInstanceLimit)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,204 @@
+package logstash_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Elasticsearch output", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var ctx context.Context
+
+	nextPort := 6000
+	provision := func(instanceId string, params map[string]string) string {
+		broker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("output"))
+		Ω(err).ToNot(HaveOccurred())
+		broker.ProcessStarter = fakeProcessStarter{}
+		broker.FindFreePort = func() (int, error) {
+			nextPort++
+			return nextPort, nil
+		}
+
+		_, err = broker.Provision(ctx, instanceId, params)
+		Ω(err).ToNot(HaveOccurred())
+
+		rendered, err := ioutil.ReadFile(path.Join(config.InstanceDataDirectory, instanceId, "logstash.conf"))
+		Ω(err).ToNot(HaveOccurred())
+		return string(rendered)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-output")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+			DefaultPipeline:       "syslog-5424",
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("prints events to the agent log without elasticsearch hosts", func() {
+		rendered := provision("instance-1", map[string]string{})
+		Ω(rendered).To(ContainSubstring("stdout {\n\t\tcodec => rubydebug\n\t}"))
+		Ω(rendered).ToNot(ContainSubstring("elasticsearch {"))
+	})
+
+	Context("with elasticsearch hosts", func() {
+		BeforeEach(func() {
+			config.Elasticsearch = elasticsearch.Configuration{
+				Hosts:    []string{"https://es-1:9200", "https://es-2:9200"},
+				Username: "logstash",
+				Password: `pa"ss\word`,
+			}
+		})
+
+		It("ships events to indices named after the instance", func() {
+			rendered := provision("Instance-1", map[string]string{})
+			Ω(rendered).To(ContainSubstring(`output {
+	# elasticsearch when the broker config names its hosts, stdout otherwise
+	elasticsearch {
+		hosts => ["https://es-1:9200", "https://es-2:9200"]
+		index => "logsearch-instance-1-%{+YYYY.MM.dd}"
+		user => "logstash"
+		password => "pa\"ss\word"
+	}
+}`))
+		})
+
+		It("keeps the config holding the credentials from other users", func() {
+			provision("instance-1", map[string]string{})
+			info, err := os.Stat(path.Join(tmpDir, "data", "instance-1", "logstash.conf"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("names indices after the org and space the platform sends", func() {
+			config.Elasticsearch.IndexNaming = elasticsearch.IndexNamingOrgSpace
+			config.Elasticsearch.IndexPattern = "%{+YYYY.ww}"
+
+			rendered := provision("instance-1", map[string]string{"organization_name": "ACME", "organization_guid": "org-1", "space_name": "Dev", "space_guid": "space-1"})
+			Ω(rendered).To(ContainSubstring(`index => "logsearch-acme-dev-%{+YYYY.ww}"`))
+
+			rendered = provision("instance-2", map[string]string{"organization_guid": "org-1", "space_guid": "space-1"})
+			Ω(rendered).To(ContainSubstring(`index => "logsearch-org-1-space-1-%{+YYYY.ww}"`))
+		})
+
+		It("keeps the index prefix of an instance when the naming changes", func() {
+			provision("instance-1", map[string]string{"organization_name": "acme", "space_name": "dev"})
+
+			config.Elasticsearch.IndexNaming = elasticsearch.IndexNamingOrgSpace
+			repository := &logstash.FileSystemInstanceRepository{LogstashConf: config}
+			instance, err := repository.FindById("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.IndexPrefix).To(Equal("logsearch-instance-1"))
+			Ω(logstash.RenderConfig(instance)).To(Succeed())
+			Ω(ioutil.ReadFile(instance.ConfigPath())).To(ContainSubstring(`index => "logsearch-instance-1-%{+YYYY.MM.dd}"`))
+		})
+
+		It("names the indices of instances provisioned before index prefixes after their id", func() {
+			instance := &logstash.Instance{
+				Id:            "instance-1",
+				Basepath:      path.Join(tmpDir, "legacy"),
+				TemplatePath:  "assets",
+				Port:          6001,
+				Elasticsearch: config.Elasticsearch,
+			}
+			Ω(os.MkdirAll(instance.Basepath, 0755)).To(Succeed())
+			Ω(logstash.RenderConfig(instance)).To(Succeed())
+			Ω(ioutil.ReadFile(instance.ConfigPath())).To(ContainSubstring(`index => "logsearch-instance-1-%{+YYYY.MM.dd}"`))
+		})
+	})
+
+	Describe("the broker config", func() {
+		var configPath string
+
+		BeforeEach(func() {
+			configPath = path.Join(tmpDir, "config.yml")
+		})
+
+		It("reads the elasticsearch section", func() {
+			Ω(ioutil.WriteFile(configPath, []byte(`---
+logstash:
+  data_directory: "tmp/logstash-data"
+elasticsearch:
+  hosts: ["http://10.0.0.1:9200"]
+  username: logstash
+  password: secret
+  index_naming: org-space
+`), 0644)).To(Succeed())
+
+			parsed, err := logstash.ParseConfig(configPath)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(parsed.ServiceConfiguration.Elasticsearch).To(Equal(elasticsearch.Configuration{
+				Hosts:         []string{"http://10.0.0.1:9200"},
+				Username:      "logstash",
+				Password:      "secret",
+				IndexPrefix:   "logsearch",
+				IndexNaming:   "org-space",
+				IndexPattern:  "%{+YYYY.MM.dd}",
+				DataDirectory: "tmp/elasticsearch-instances",
+				Retention:     elasticsearch.RetentionConfiguration{RunAt: "03:00"},
+			}))
+		})
+
+		It("reads the redis section of the broker config", func() {
+			Ω(ioutil.WriteFile(configPath, []byte(`---
+logstash:
+  host: "10.0.0.2"
+  data_directory: "tmp/logstash-data"
+  log_directory: "tmp/logstash-logs"
+redis:
+  offer_service: true
+  plans:
+  - {id: plan-1, name: small, maxmemory: 32mb}
+`), 0644)).To(Succeed())
+
+			parsed, err := logstash.ParseConfig(configPath)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(parsed.ServiceConfiguration.Redis).To(Equal(redis.Configuration{
+				OfferService:  true,
+				Host:          "10.0.0.2",
+				Command:       "redis-server",
+				DataDirectory: "tmp/redis-instances",
+				LogDirectory:  "tmp/redis-logs",
+				Plans:         []redis.PlanConfiguration{{Id: "plan-1", Name: "small", MaxMemory: "32mb"}},
+			}))
+		})
+
+		It("refuses credentials that cannot be quoted", func() {
+			config.Elasticsearch.SetDefaults()
+			config.Elasticsearch.Password = "pa\nss"
+			Ω(logstash.CheckConfig(config)).To(MatchError("elasticsearch credentials may not contain newlines"))
+
+			config.Elasticsearch.Password = `pass\`
+			Ω(logstash.CheckConfig(config)).To(MatchError("elasticsearch credentials may not end in a backslash"))
+
+			config.Elasticsearch.Password = `"it's"`
+			Ω(logstash.CheckConfig(config)).To(Succeed())
+			config.Elasticsearch.Password = `C:\pass\word`
+			Ω(logstash.CheckConfig(config)).To(Succeed())
+		})
+	})
+})
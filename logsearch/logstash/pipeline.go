@@ -0,0 +1,221 @@
+package logstash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fraenkel/candiedyaml"
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+)
+
+// A named pipeline in conf_path/pipelines/<name>, holding its logstash.conf.tmpl
+// and a pipeline.yml describing what its inputs accept
+type Pipeline struct {
+	Name        string          `yaml:"-"`
+	Description string          `yaml:"description"`
+	Inputs      []PipelineInput `yaml:"inputs"`
+	// shipper or indexer for the pipelines of the stack service, which only its components get
+	Stack string `yaml:"stack"`
+	// Whether the template has a TLS input, so instances get a certificate when the broker issues them
+	TLS bool `yaml:"tls"`
+}
+
+type PipelineInput struct {
+	// tcp or udp, both on the port of the instance
+	Protocol string `yaml:"protocol"`
+	Format   string `yaml:"format"`
+}
+
+const (
+	pipelinesDirectory   = "pipelines"
+	pipelineMetadataFile = "pipeline.yml"
+
+	// The provision parameter choosing a pipeline
+	PipelineParameter = "pipeline"
+)
+
+var pipelineName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// The files making up a pipeline
+var pipelineFiles = []string{pipelineMetadataFile, "logstash.conf.tmpl"}
+
+func isPipelineFile(name string) bool {
+	for _, file := range pipelineFiles {
+		if name == file {
+			return true
+		}
+	}
+	return false
+}
+
+// The directory holding the logstash.conf.tmpl of a pipeline. Instances
+// provisioned before pipelines existed have none and use the template in conf_path.
+func (config ServiceConfiguration) templatePath(pipeline string) string {
+	if pipeline == "" {
+		return config.DefaultConfigPath
+	}
+	return path.Join(config.DefaultConfigPath, pipelinesDirectory, pipeline)
+}
+
+// LoadPipelines reads every pipeline in conf_path/pipelines, by name; there are none without that directory.
+func LoadPipelines(config ServiceConfiguration) (map[string]*Pipeline, error) {
+	pipelines := map[string]*Pipeline{}
+
+	dirs, err := ioutil.ReadDir(path.Join(config.DefaultConfigPath, pipelinesDirectory))
+	if os.IsNotExist(err) {
+		return pipelines, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		pipeline, err := loadPipeline(config, dir.Name())
+		if err != nil {
+			return nil, err
+		}
+		pipelines[pipeline.Name] = pipeline
+	}
+
+	return pipelines, nil
+}
+
+func loadPipeline(config ServiceConfiguration, name string) (*Pipeline, error) {
+	if !pipelineName.MatchString(name) {
+		return nil, fmt.Errorf("pipeline '%s': names may only hold lower case letters, digits and dashes", name)
+	}
+
+	dir := config.templatePath(name)
+	file, err := os.Open(path.Join(dir, pipelineMetadataFile))
+	if err != nil {
+		return nil, fmt.Errorf("pipeline '%s': %s", name, err)
+	}
+	defer file.Close()
+
+	pipeline := &Pipeline{}
+	if err := candiedyaml.NewDecoder(file).Decode(pipeline); err != nil {
+		return nil, fmt.Errorf("pipeline '%s': %s: %s", name, pipelineMetadataFile, err)
+	}
+	pipeline.Name = name
+
+	if len(pipeline.Inputs) == 0 {
+		return nil, fmt.Errorf("pipeline '%s': %s lists no inputs", name, pipelineMetadataFile)
+	}
+	for _, input := range pipeline.Inputs {
+		if input.Protocol != "tcp" && input.Protocol != "udp" {
+			return nil, fmt.Errorf("pipeline '%s': unknown input protocol '%s', expected tcp or udp", name, input.Protocol)
+		}
+	}
+	if pipeline.Stack != "" && pipeline.Stack != stack.RoleShipper && pipeline.Stack != stack.RoleIndexer {
+		return nil, fmt.Errorf("pipeline '%s': unknown stack role '%s', expected %s or %s", name, pipeline.Stack, stack.RoleShipper, stack.RoleIndexer)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "logstash.conf.tmpl")); err != nil {
+		return nil, fmt.Errorf("pipeline '%s': %s", name, err)
+	}
+
+	return pipeline, nil
+}
+
+// Whether the pipeline listens on protocol
+func (pipeline *Pipeline) Accepts(protocol string) bool {
+	for _, input := range pipeline.Inputs {
+		if input.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// The pipeline of a new instance: the pipeline parameter, else the default of its plan, else default_pipeline;
+// nil for the template in conf_path. The pipelines of the stack service are only for the components of a stack
+// with their role.
+func (broker *logstashServiceBroker) choosePipeline(params map[string]string, component *stack.Component) (*Pipeline, error) {
+	config := broker.ServiceConfiguration
+
+	name, requested := params[PipelineParameter]
+	if !requested {
+		name = config.PlanPipelines[params["plan_id"]]
+		if name == "" {
+			name = config.DefaultPipeline
+		}
+		if name == "" {
+			return nil, nil
+		}
+	}
+
+	pipelines, err := LoadPipelines(config)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, ok := pipelines[name]
+	if component != nil {
+		if !ok || pipeline.Stack != component.Role {
+			return nil, &InvalidParameterError{
+				Name:   PipelineParameter,
+				Reason: fmt.Sprintf("pipeline '%s' is not a stack %s pipeline", name, component.Role),
+			}
+		}
+		return pipeline, nil
+	}
+	if !ok || pipeline.Stack != "" {
+		return nil, &InvalidParameterError{
+			Name:   PipelineParameter,
+			Reason: fmt.Sprintf("unknown pipeline '%s', expected one of %s", name, strings.Join(pipelineNames(ownPipelines(pipelines)), ", ")),
+		}
+	}
+	return pipeline, nil
+}
+
+func (broker *logstashServiceBroker) ListPipelines() ([]PipelineDetails, error) {
+	pipelines, err := LoadPipelines(broker.ServiceConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	details := []PipelineDetails{}
+	for _, name := range pipelineNames(ownPipelines(pipelines)) {
+		pipeline := pipelines[name]
+		inputs := []PipelineInputDetails{}
+		for _, input := range pipeline.Inputs {
+			inputs = append(inputs, PipelineInputDetails{Protocol: input.Protocol, Format: input.Format})
+		}
+		details = append(details, PipelineDetails{
+			Name:        name,
+			Description: pipeline.Description,
+			Default:     name == broker.ServiceConfiguration.DefaultPipeline,
+			Inputs:      inputs,
+			TLS:         pipeline.TLS,
+		})
+	}
+	return details, nil
+}
+
+func pipelineNames(pipelines map[string]*Pipeline) []string {
+	names := []string{}
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The pipelines instances of their own may use, leaving out those of the stack service
+func ownPipelines(pipelines map[string]*Pipeline) map[string]*Pipeline {
+	own := map[string]*Pipeline{}
+	for name, pipeline := range pipelines {
+		if pipeline.Stack == "" {
+			own[name] = pipeline
+		}
+	}
+	return own
+}
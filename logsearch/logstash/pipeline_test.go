@@ -0,0 +1,347 @@
+package logstash_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Reports every port of every instance as accepting connections
+type fakeProcessProber struct{}
+
+func (fakeProcessProber) Probe(*logstash.Instance) []api.PortHealth {
+	return []api.PortHealth{
+		{Protocol: "tcp", Status: api.HealthStatusOk},
+		{Protocol: "udp", Status: api.HealthStatusOk},
+	}
+}
+
+var _ = Describe("Pipelines", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var ctx context.Context
+
+	writePipeline := func(name string, metadata string, template string) {
+		dir := path.Join(config.DefaultConfigPath, "pipelines", name)
+		Ω(os.MkdirAll(dir, 0755)).To(Succeed())
+		Ω(ioutil.WriteFile(path.Join(dir, "pipeline.yml"), []byte(metadata), 0644)).To(Succeed())
+		if template != "" {
+			Ω(ioutil.WriteFile(path.Join(dir, "logstash.conf.tmpl"), []byte(template), 0644)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-pipelines")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     path.Join(tmpDir, "conf"),
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+		}
+		Ω(os.MkdirAll(config.DefaultConfigPath, 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("loading", func() {
+		It("reads the bundled pipelines and what their inputs accept", func() {
+			config.DefaultConfigPath = "assets"
+			pipelines, err := logstash.LoadPipelines(config)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(pipelines).To(HaveLen(7))
+			for _, name := range []string{"cf-app-logs", "json-lines", "syslog-3164", "syslog-5424", "nginx-access", "stack-shipper", "stack-indexer"} {
+				Ω(pipelines).To(HaveKey(name))
+				Ω(pipelines[name].Description).ToNot(BeEmpty())
+				Ω(pipelines[name].Accepts("tcp")).To(BeTrue())
+			}
+			Ω(pipelines["cf-app-logs"].Accepts("udp")).To(BeFalse())
+			Ω(pipelines["syslog-5424"].Accepts("udp")).To(BeTrue())
+			Ω(pipelines["stack-shipper"].Stack).To(Equal("shipper"))
+			Ω(pipelines["stack-indexer"].Stack).To(Equal("indexer"))
+		})
+
+		It("renders every bundled pipeline", func() {
+			config.DefaultConfigPath = "assets"
+			config.DefaultPipeline = "syslog-5424"
+			Ω(logstash.CheckTemplates(config)).To(Succeed())
+		})
+
+		It("has no pipelines without a pipelines directory", func() {
+			Ω(logstash.LoadPipelines(config)).To(BeEmpty())
+		})
+
+		It("rejects pipelines without inputs, with unknown protocols or without a template", func() {
+			writePipeline("empty", "description: nothing\n", "input {}\n")
+			_, err := logstash.LoadPipelines(config)
+			Ω(err).To(MatchError("pipeline 'empty': pipeline.yml lists no inputs"))
+
+			writePipeline("empty", "inputs:\n- protocol: http\n", "input {}\n")
+			_, err = logstash.LoadPipelines(config)
+			Ω(err).To(MatchError("pipeline 'empty': unknown input protocol 'http', expected tcp or udp"))
+
+			Ω(os.RemoveAll(path.Join(config.DefaultConfigPath, "pipelines", "empty"))).To(Succeed())
+			writePipeline("untemplated", "inputs:\n- protocol: tcp\n", "")
+			_, err = logstash.LoadPipelines(config)
+			Ω(err).To(HaveOccurred())
+			Ω(err.Error()).To(HavePrefix("pipeline 'untemplated': "))
+		})
+
+		It("rejects unknown stack roles", func() {
+			writePipeline("buffered", "stack: buffer\ninputs:\n- protocol: tcp\n", "input {}\n")
+			_, err := logstash.LoadPipelines(config)
+			Ω(err).To(MatchError("pipeline 'buffered': unknown stack role 'buffer', expected shipper or indexer"))
+		})
+
+		It("rejects names that are not lower case", func() {
+			writePipeline("JSON", "inputs:\n- protocol: tcp\n", "input {}\n")
+			_, err := logstash.LoadPipelines(config)
+			Ω(err).To(MatchError("pipeline 'JSON': names may only hold lower case letters, digits and dashes"))
+		})
+	})
+
+	Describe("checking templates", func() {
+		BeforeEach(func() {
+			writePipeline("json-lines", "inputs:\n- protocol: tcp\n", `input { tcp { port => <%= logstash["Port"] %> codec => json_lines } }`+"\n")
+		})
+
+		It("does not need the template in conf_path once there is a default pipeline", func() {
+			Ω(logstash.CheckTemplates(config)).ToNot(Succeed())
+			config.DefaultPipeline = "json-lines"
+			Ω(logstash.CheckTemplates(config)).To(Succeed())
+		})
+
+		It("refuses default and plan pipelines that do not exist", func() {
+			config.DefaultPipeline = "json"
+			Ω(logstash.CheckTemplates(config)).To(MatchError("default_pipeline: unknown pipeline 'json'"))
+
+			config.DefaultPipeline = "json-lines"
+			config.PlanPipelines = map[string]string{"plan-1": "nginx"}
+			Ω(logstash.CheckTemplates(config)).To(MatchError("plan_pipelines: plan 'plan-1' uses unknown pipeline 'nginx'"))
+		})
+
+		It("needs the stack pipelines to exist with their roles when offering the stack service", func() {
+			config.DefaultPipeline = "json-lines"
+			config.Stack = stack.Configuration{OfferService: true}
+			config.Stack.SetDefaults()
+			Ω(logstash.CheckTemplates(config)).To(MatchError("stack: 'stack-shipper' is not a stack shipper pipeline"))
+
+			writePipeline("stack-shipper", "stack: shipper\ninputs:\n- protocol: tcp\n", "output { <%! redis[\"Output\"] %> }\n")
+			writePipeline("stack-indexer", "inputs:\n- protocol: tcp\n", "input { <%! redis[\"Input\"] %> }\n")
+			Ω(logstash.CheckTemplates(config)).To(MatchError("stack: 'stack-indexer' is not a stack indexer pipeline"))
+
+			writePipeline("stack-indexer", "stack: indexer\ninputs:\n- protocol: tcp\n", "input { <%! redis[\"Input\"] %> }\n")
+			Ω(logstash.CheckTemplates(config)).To(Succeed())
+		})
+
+		It("points at a % outside of a tag rather than hanging", func() {
+			config.DefaultPipeline = "json-lines"
+			writePipeline("syslog", "inputs:\n- protocol: tcp\n", "filter {\n  grok { match => [\"message\", \"%{SYSLOGLINE}\"] }\n}\n")
+			Ω(logstash.CheckTemplates(config)).To(Equal(&logstash.TemplateError{
+				File: path.Join(config.DefaultConfigPath, "pipelines", "syslog", "logstash.conf.tmpl"),
+				Line: 2,
+				Err:  `a literal % must be written as <%= "%" %>`,
+			}))
+		})
+	})
+
+	Describe("provisioning", func() {
+		var serviceBroker api.ServiceBroker
+
+		BeforeEach(func() {
+			config.DefaultConfigPath = "assets"
+			config.PlanPipelines = map[string]string{"plan-nginx": "nginx-access"}
+		})
+
+		JustBeforeEach(func() {
+			broker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("pipelines"))
+			Ω(err).ToNot(HaveOccurred())
+			broker.ProcessStarter = fakeProcessStarter{}
+			broker.ProcessProber = fakeProcessProber{}
+			port := 6000
+			broker.FindFreePort = func() (int, error) {
+				port++
+				return port, nil
+			}
+			serviceBroker = broker
+		})
+
+		pipelineOf := func(instanceId string) string {
+			instance, err := serviceBroker.(api.InstanceAdministrator).GetInstance(instanceId)
+			Ω(err).ToNot(HaveOccurred())
+			return instance.Pipeline
+		}
+
+		It("uses the template in conf_path without a default pipeline", func() {
+			_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"plan_id": "plan-1"})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(pipelineOf("instance-1")).To(BeEmpty())
+		})
+
+		Context("with a default pipeline", func() {
+			BeforeEach(func() {
+				config.DefaultPipeline = "syslog-5424"
+			})
+
+			It("prefers the pipeline parameter, then the plan, then the default", func() {
+				_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"plan_id": "plan-nginx", "pipeline": "json-lines"})
+				Ω(err).ToNot(HaveOccurred())
+				_, err = serviceBroker.Provision(ctx, "instance-2", map[string]string{"plan_id": "plan-nginx"})
+				Ω(err).ToNot(HaveOccurred())
+				_, err = serviceBroker.Provision(ctx, "instance-3", map[string]string{"plan_id": "plan-1"})
+				Ω(err).ToNot(HaveOccurred())
+
+				Ω(pipelineOf("instance-1")).To(Equal("json-lines"))
+				Ω(pipelineOf("instance-2")).To(Equal("nginx-access"))
+				Ω(pipelineOf("instance-3")).To(Equal("syslog-5424"))
+
+				config, err := ioutil.ReadFile(path.Join(tmpDir, "data", "instance-1", "logstash.conf"))
+				Ω(err).ToNot(HaveOccurred())
+				Ω(string(config)).To(ContainSubstring("json_lines"))
+				Ω(string(config)).To(ContainSubstring("6001"))
+			})
+
+			It("keeps the pipeline of an instance in the repository", func() {
+				_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"pipeline": "nginx-access"})
+				Ω(err).ToNot(HaveOccurred())
+
+				repository := &logstash.FileSystemInstanceRepository{LogstashConf: config}
+				instance, err := repository.FindById("instance-1")
+				Ω(err).ToNot(HaveOccurred())
+				Ω(instance.Pipeline).To(Equal("nginx-access"))
+				Ω(instance.TempatePath()).To(Equal("assets/pipelines/nginx-access"))
+			})
+
+			It("refuses unknown pipelines without creating the instance", func() {
+				_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"pipeline": "csv"})
+				Ω(err).To(Equal(&api.InvalidParameterError{
+					Name:   "pipeline",
+					Reason: "unknown pipeline 'csv', expected one of cf-app-logs, json-lines, nginx-access, syslog-3164, syslog-5424",
+				}))
+				_, err = serviceBroker.(api.InstanceAdministrator).GetInstance("instance-1")
+				Ω(err).To(Equal(api.ServiceInstanceDoesNotExistsError))
+			})
+
+			It("keeps the stack pipelines for the components of a stack", func() {
+				_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"pipeline": "stack-shipper"})
+				Ω(err).To(Equal(&api.InvalidParameterError{
+					Name:   "pipeline",
+					Reason: "unknown pipeline 'stack-shipper', expected one of cf-app-logs, json-lines, nginx-access, syslog-3164, syslog-5424",
+				}))
+
+				shipper := stack.WithComponent(ctx, stack.Component{StackId: "stack-1", Role: stack.RoleShipper})
+				_, err = serviceBroker.Provision(shipper, "instance-1", map[string]string{"pipeline": "stack-indexer"})
+				Ω(err).To(Equal(&api.InvalidParameterError{Name: "pipeline", Reason: "pipeline 'stack-indexer' is not a stack shipper pipeline"}))
+				_, err = serviceBroker.Provision(shipper, "instance-1", map[string]string{"pipeline": "stack-shipper"})
+				Ω(err).ToNot(HaveOccurred())
+			})
+
+			It("wires the components of a stack to its buffer and its indices", func() {
+				buffer := stack.Buffer{Host: "127.0.0.1", Port: 6380, Password: "secret", Key: "logsearch"}
+				shipper := stack.WithComponent(ctx, stack.Component{StackId: "stack-1", Role: stack.RoleShipper, Buffer: buffer})
+				indexer := stack.WithComponent(ctx, stack.Component{StackId: "stack-1", Role: stack.RoleIndexer, Buffer: buffer})
+				_, err := serviceBroker.Provision(shipper, "stack-1-shipper", map[string]string{"pipeline": "stack-shipper"})
+				Ω(err).ToNot(HaveOccurred())
+				_, err = serviceBroker.Provision(indexer, "stack-1-indexer", map[string]string{"pipeline": "stack-indexer"})
+				Ω(err).ToNot(HaveOccurred())
+
+				plugin := "redis {\n\t\thost => \"127.0.0.1\"\n\t\tport => 6380\n\t\tpassword => \"secret\"\n\t\tdata_type => \"list\"\n\t\tkey => \"logsearch\"\n\t}"
+				conf, err := ioutil.ReadFile(path.Join(tmpDir, "data", "stack-1-shipper", "logstash.conf"))
+				Ω(err).ToNot(HaveOccurred())
+				Ω(string(conf)).To(ContainSubstring("output {\n\t# the buffer of the stack, which its indexer reads\n\t" + plugin))
+				Ω(string(conf)).ToNot(ContainSubstring("stdout"))
+				// it holds the password of the buffer
+				info, err := os.Stat(path.Join(tmpDir, "data", "stack-1-shipper", "logstash.conf"))
+				Ω(err).ToNot(HaveOccurred())
+				Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+				conf, err = ioutil.ReadFile(path.Join(tmpDir, "data", "stack-1-indexer", "logstash.conf"))
+				Ω(err).ToNot(HaveOccurred())
+				Ω(string(conf)).To(ContainSubstring("input {\n\t# the buffer of the stack, which its shipper writes\n\t" + plugin))
+				Ω(string(conf)).To(ContainSubstring("stdout"))
+
+				repository := &logstash.FileSystemInstanceRepository{LogstashConf: config}
+				for _, id := range []string{"stack-1-shipper", "stack-1-indexer"} {
+					instance, err := repository.FindById(id)
+					Ω(err).ToNot(HaveOccurred())
+					Ω(instance.Stack.Buffer).To(Equal(buffer))
+					Ω(instance.IndexPrefix).To(Equal("logsearch-stack-1"))
+				}
+			})
+
+			It("only probes the protocols the pipeline listens on", func() {
+				_, err := serviceBroker.Provision(ctx, "instance-1", map[string]string{"pipeline": "cf-app-logs"})
+				Ω(err).ToNot(HaveOccurred())
+				_, err = serviceBroker.Provision(ctx, "instance-2", map[string]string{})
+				Ω(err).ToNot(HaveOccurred())
+
+				health, err := serviceBroker.(api.HealthChecker).CheckInstancesHealth()
+				Ω(err).ToNot(HaveOccurred())
+				ports := map[string]int{}
+				for _, instance := range health {
+					ports[instance.InstanceId] = len(instance.Ports)
+				}
+				Ω(ports).To(Equal(map[string]int{"instance-1": 1, "instance-2": 2}))
+			})
+
+			It("lists the pipelines with the default marked", func() {
+				pipelines, err := serviceBroker.(api.PipelineLister).ListPipelines()
+				Ω(err).ToNot(HaveOccurred())
+				Ω(pipelines).To(HaveLen(5))
+				Ω(pipelines[0].Name).To(Equal("cf-app-logs"))
+				Ω(pipelines[0].Inputs).To(Equal([]api.PipelineInputDetails{{Protocol: "tcp", Format: "RFC 5424 syslog from the Loggregator syslog drain"}}))
+				Ω(pipelines[4].Name).To(Equal("syslog-5424"))
+				Ω(pipelines[4].Default).To(BeTrue())
+			})
+		})
+	})
+
+	It("backs up and restores the pipelines of a broker", func() {
+		writePipeline("json-lines", "inputs:\n- protocol: tcp\n", `input { tcp { port => <%= logstash["Port"] %> } }`+"\n")
+		config.DefaultPipeline = "json-lines"
+		source, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("pipelines"))
+		Ω(err).ToNot(HaveOccurred())
+		source.ProcessStarter = fakeProcessStarter{}
+		source.FindFreePort = func() (int, error) { return 6001, nil }
+		_, err = source.Provision(ctx, "instance-1", map[string]string{})
+		Ω(err).ToNot(HaveOccurred())
+
+		var archive bytes.Buffer
+		Ω(source.Backup(&archive)).To(Succeed())
+
+		target := config
+		target.DefaultConfigPath = path.Join(tmpDir, "target", "conf")
+		target.InstanceDataDirectory = path.Join(tmpDir, "target", "data")
+		target.InstanceLogDirectory = path.Join(tmpDir, "target", "logs")
+		Ω(os.MkdirAll(target.DefaultConfigPath, 0755)).To(Succeed())
+		restoring, err := logstash.NewServiceBrokerFromConfig(target, lagertest.NewTestLogger("pipelines"))
+		Ω(err).ToNot(HaveOccurred())
+		restoring.ProcessStarter = fakeProcessStarter{}
+
+		report, err := restoring.Restore(ctx, &archive)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(report.Templates).To(Equal([]string{"pipelines/json-lines/logstash.conf.tmpl", "pipelines/json-lines/pipeline.yml"}))
+		Ω(logstash.LoadPipelines(target)).To(HaveKey("json-lines"))
+
+		instance, err := restoring.GetInstance("instance-1")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(instance.Pipeline).To(Equal("json-lines"))
+	})
+})
@@ -0,0 +1,113 @@
+package logstash
+
+import (
+	"sort"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+)
+
+// Limits on the number of instances, on top of the broker wide
+// service_instance_limit. A limit of 0 means unlimited.
+type QuotaConfiguration struct {
+	// Instances each org may have, unless overridden
+	PerOrg int `yaml:"per_org"`
+	// Instances each space may have
+	PerSpace int `yaml:"per_space"`
+	// Instances of each plan, by plan id, across the broker
+	PerPlan map[string]int `yaml:"per_plan"`
+	// Per-org limits by org guid, replacing PerOrg. An override of 0 exempts the org from PerOrg.
+	OrgOverrides map[string]int `yaml:"org_overrides"`
+}
+
+// Enabled reports whether any quota is set, so provisioning can skip counting instances otherwise.
+func (quotas QuotaConfiguration) Enabled() bool {
+	return quotas.PerOrg > 0 || quotas.PerSpace > 0 || len(quotas.PerPlan) > 0 || len(quotas.OrgOverrides) > 0
+}
+
+func (quotas QuotaConfiguration) orgLimit(orgGuid string) int {
+	if limit, ok := quotas.OrgOverrides[orgGuid]; ok {
+		return limit
+	}
+	return quotas.PerOrg
+}
+
+// Check returns a QuotaExceededError for the first quota provisioning the candidate
+// would exceed, given the instances that already exist.
+func (quotas QuotaConfiguration) Check(instances []*Instance, candidate *Instance) error {
+	orgCount, spaceCount, planCount := 0, 0, 0
+	for _, instance := range instances {
+		if candidate.OrganizationGuid != "" && instance.OrganizationGuid == candidate.OrganizationGuid {
+			orgCount++
+		}
+		if candidate.SpaceGuid != "" && instance.SpaceGuid == candidate.SpaceGuid {
+			spaceCount++
+		}
+		if candidate.PlanId != "" && instance.PlanId == candidate.PlanId {
+			planCount++
+		}
+	}
+
+	if limit := quotas.orgLimit(candidate.OrganizationGuid); candidate.OrganizationGuid != "" && limit > 0 && orgCount >= limit {
+		return &QuotaExceededError{Quota: QuotaOrg, Scope: candidate.OrganizationGuid, Limit: limit}
+	}
+	if limit := quotas.PerSpace; candidate.SpaceGuid != "" && limit > 0 && spaceCount >= limit {
+		return &QuotaExceededError{Quota: QuotaSpace, Scope: candidate.SpaceGuid, Limit: limit}
+	}
+	if limit := quotas.PerPlan[candidate.PlanId]; candidate.PlanId != "" && limit > 0 && planCount >= limit {
+		return &QuotaExceededError{Quota: QuotaPlan, Scope: candidate.PlanId, Limit: limit}
+	}
+	return nil
+}
+
+// Usage reports the usage of every quota that applies to at least one instance or is configured for a plan or org
+func (quotas QuotaConfiguration) Usage(instanceLimit int, instances []*Instance) []QuotaUsage {
+	orgs, spaces, plans := map[string]int{}, map[string]int{}, map[string]int{}
+	for _, instance := range instances {
+		if instance.OrganizationGuid != "" {
+			orgs[instance.OrganizationGuid]++
+		}
+		if instance.SpaceGuid != "" {
+			spaces[instance.SpaceGuid]++
+		}
+		if instance.PlanId != "" {
+			plans[instance.PlanId]++
+		}
+	}
+	for org := range quotas.OrgOverrides {
+		orgs[org] += 0
+	}
+	for plan := range quotas.PerPlan {
+		plans[plan] += 0
+	}
+
+	usage := []QuotaUsage{
+		QuotaUsage{Quota: QuotaGlobal, Used: len(instances), Limit: instanceLimit},
+	}
+	for _, org := range sortedKeys(orgs) {
+		usage = append(usage, QuotaUsage{Quota: QuotaOrg, Scope: org, Used: orgs[org], Limit: quotas.orgLimit(org)})
+	}
+	for _, space := range sortedKeys(spaces) {
+		usage = append(usage, QuotaUsage{Quota: QuotaSpace, Scope: space, Used: spaces[space], Limit: quotas.PerSpace})
+	}
+	for _, plan := range sortedKeys(plans) {
+		usage = append(usage, QuotaUsage{Quota: QuotaPlan, Scope: plan, Used: plans[plan], Limit: quotas.PerPlan[plan]})
+	}
+	return usage
+}
+
+func (broker *logstashServiceBroker) QuotaUsage() ([]QuotaUsage, error) {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	return broker.ServiceConfiguration.Quotas.Usage(broker.ServiceInstanceLimit, instances), nil
+}
+
+func sortedKeys(counts map[string]int) []string {
+	keys := []string{}
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,175 @@
+package logstash_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Takes a while to save an instance
+type slowRepository struct {
+	logstash.InstanceRepository
+}
+
+func (repository slowRepository) Save(instance *logstash.Instance) error {
+	time.Sleep(10 * time.Millisecond)
+	return repository.InstanceRepository.Save(instance)
+}
+
+var _ = Describe("Quotas", func() {
+	var quotas logstash.QuotaConfiguration
+	var instances []*logstash.Instance
+
+	instanceIn := func(org, space, plan string) *logstash.Instance {
+		return &logstash.Instance{OrganizationGuid: org, SpaceGuid: space, PlanId: plan}
+	}
+
+	BeforeEach(func() {
+		quotas = logstash.QuotaConfiguration{
+			PerOrg:       2,
+			PerSpace:     1,
+			PerPlan:      map[string]int{"plan-small": 3},
+			OrgOverrides: map[string]int{"org-big": 5},
+		}
+		instances = []*logstash.Instance{
+			instanceIn("org-1", "space-1", "plan-small"),
+			instanceIn("org-1", "space-2", "plan-small"),
+			instanceIn("org-big", "space-3", "plan-large"),
+		}
+	})
+
+	It("allows an instance within every quota", func() {
+		Ω(quotas.Check(instances, instanceIn("org-2", "space-4", "plan-small"))).To(Succeed())
+	})
+
+	It("names an exhausted org quota", func() {
+		err := quotas.Check(instances, instanceIn("org-1", "space-4", "plan-large"))
+		Ω(err).To(Equal(&api.QuotaExceededError{Quota: api.QuotaOrg, Scope: "org-1", Limit: 2}))
+		Ω(err.Error()).To(Equal("the org quota of 2 instances for org org-1 has been reached"))
+	})
+
+	It("lets an override raise the org quota", func() {
+		Ω(quotas.Check(instances, instanceIn("org-big", "space-4", "plan-large"))).To(Succeed())
+	})
+
+	It("lets an override of 0 exempt an org from the org quota", func() {
+		quotas.OrgOverrides["org-1"] = 0
+		Ω(quotas.Check(instances, instanceIn("org-1", "space-4", "plan-large"))).To(Succeed())
+	})
+
+	It("names an exhausted space quota", func() {
+		err := quotas.Check(instances, instanceIn("org-big", "space-3", "plan-large"))
+		Ω(err).To(Equal(&api.QuotaExceededError{Quota: api.QuotaSpace, Scope: "space-3", Limit: 1}))
+	})
+
+	It("names an exhausted plan quota", func() {
+		instances = append(instances, instanceIn("org-big", "space-5", "plan-small"))
+		err := quotas.Check(instances, instanceIn("org-2", "space-4", "plan-small"))
+		Ω(err).To(Equal(&api.QuotaExceededError{Quota: api.QuotaPlan, Scope: "plan-small", Limit: 3}))
+	})
+
+	It("treats missing limits as unlimited", func() {
+		Ω(logstash.QuotaConfiguration{}.Check(instances, instanceIn("org-1", "space-1", "plan-small"))).To(Succeed())
+	})
+
+	It("is only enabled when a limit is set", func() {
+		Ω(quotas.Enabled()).To(BeTrue())
+		Ω(logstash.QuotaConfiguration{}.Enabled()).To(BeFalse())
+		Ω(logstash.QuotaConfiguration{PerPlan: map[string]int{"plan-small": 3}}.Enabled()).To(BeTrue())
+	})
+
+	It("reports the usage of each quota", func() {
+		Ω(quotas.Usage(10, instances)).To(Equal([]api.QuotaUsage{
+			{Quota: api.QuotaGlobal, Used: 3, Limit: 10},
+			{Quota: api.QuotaOrg, Scope: "org-1", Used: 2, Limit: 2},
+			{Quota: api.QuotaOrg, Scope: "org-big", Used: 1, Limit: 5},
+			{Quota: api.QuotaSpace, Scope: "space-1", Used: 1, Limit: 1},
+			{Quota: api.QuotaSpace, Scope: "space-2", Used: 1, Limit: 1},
+			{Quota: api.QuotaSpace, Scope: "space-3", Used: 1, Limit: 1},
+			{Quota: api.QuotaPlan, Scope: "plan-large", Used: 1, Limit: 0},
+			{Quota: api.QuotaPlan, Scope: "plan-small", Used: 2, Limit: 3},
+		}))
+	})
+
+	It("is read from the broker config", func() {
+		tmpDir, err := ioutil.TempDir("", "logstash-quotas")
+		Ω(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		configPath := path.Join(tmpDir, "config.yml")
+		Ω(ioutil.WriteFile(configPath, []byte(`---
+logstash:
+  data_directory: "tmp/logstash-data"
+  quotas:
+    per_org: 2
+    per_space: 1
+    per_plan:
+      plan-small: 3
+    org_overrides:
+      org-big: 5
+`), 0644)).To(Succeed())
+
+		config, err := logstash.ParseConfig(configPath)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(config.ServiceConfiguration.Quotas).To(Equal(quotas))
+	})
+
+	It("holds when instances are provisioned concurrently", func() {
+		tmpDir, err := ioutil.TempDir("", "logstash-quotas")
+		Ω(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		broker, err := logstash.NewServiceBrokerFromConfig(logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  3,
+			DefaultPipeline:       "syslog-5424",
+			Quotas:                logstash.QuotaConfiguration{PerOrg: 2},
+		}, lagertest.NewTestLogger("quotas"))
+		Ω(err).ToNot(HaveOccurred())
+		broker.ProcessStarter = fakeProcessStarter{}
+
+		var wait sync.WaitGroup
+		var mutex sync.Mutex
+		port, provisioned := 6000, 0
+		broker.FindFreePort = func() (int, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			port++
+			return port, nil
+		}
+		// a slow save leaves time for the other provisions to count the instances
+		broker.InstanceRepository = slowRepository{broker.InstanceRepository}
+
+		for i := 0; i < 10; i++ {
+			wait.Add(1)
+			go func(i int) {
+				defer wait.Done()
+				_, err := broker.Provision(context.Background(), fmt.Sprintf("instance-%d", i), map[string]string{"organization_guid": "org-1"})
+				if err == nil {
+					mutex.Lock()
+					provisioned++
+					mutex.Unlock()
+				}
+			}(i)
+		}
+		wait.Wait()
+
+		Ω(provisioned).To(Equal(2))
+		Ω(broker.InstanceRepository.GetInstanceCount()).To(Equal(2))
+	})
+})
@@ -1,23 +1,102 @@
 package logstash
 
 import (
-	"github.com/karlseguin/gerb"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
 )
 
 type InstanceRepository interface {
 	Save(instance *Instance) error
 	FindById(instanceID string) (*Instance, error)
+	FindAll() ([]*Instance, error)
 	GetInstanceCount() (int, error)
+	Delete(instanceID string) error
+
+	SaveBinding(binding *Binding) error
+	FindBindingById(instanceID string, bindingID string) (*Binding, error)
+	FindBindings(instanceID string) ([]*Binding, error)
+	DeleteBinding(instanceID string, bindingID string) error
+}
+
+var (
+	ErrInstanceNotFound = errors.New("instance not found")
+	ErrBindingNotFound  = errors.New("binding not found")
+	// Ids name directories and files, so those that could lead outside of them are refused before any path is built
+	ErrInvalidId = errors.New("instance and binding ids may only hold letters, digits, '-' and '_'")
+
+	errUnloadableInstances = errors.New("instance directories cannot be loaded; they count against the service_instance_limit until logsearch-admin fsck -repair quarantines them")
+)
+
+// Returned when an instance is saved with a port another instance has
+type PortInUseError struct {
+	Port       int
+	InstanceId string
+}
+
+func (err *PortInUseError) Error() string {
+	return fmt.Sprintf("port %d is already used by instance %s", err.Port, err.InstanceId)
+}
+
+// How many free ports are tried before giving up on finding one no instance claims
+const unclaimedPortAttempts = 100
+
+// Asks findFreePort for ports until it gives one that is not claimed. A stopped instance does not hold its port, so
+// the port being free is not enough.
+func findUnclaimedPort(findFreePort func() (int, error), claimed map[int]bool) (int, error) {
+	for attempt := 0; attempt < unclaimedPortAttempts; attempt++ {
+		port, err := findFreePort()
+		if err != nil {
+			return 0, err
+		}
+		if !claimed[port] {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free port that no instance claims")
+}
+
+// The ports of instances, including those of their TLS inputs
+func claimedPorts(instances []*Instance) map[int]bool {
+	claimed := map[int]bool{}
+	for _, instance := range instances {
+		for _, port := range instance.ports() {
+			claimed[port] = true
+		}
+	}
+	return claimed
+}
+
+// Repository backends, selected with the repository setting
+const (
+	RepositoryFileSystem = "filesystem"
+	RepositoryBolt       = "bolt"
+)
+
+// NewInstanceRepository creates the repository backend selected in the configuration.
+func NewInstanceRepository(config ServiceConfiguration) (InstanceRepository, error) {
+	switch config.Repository {
+	case RepositoryFileSystem, "":
+		return &FileSystemInstanceRepository{LogstashConf: config}, nil
+	case RepositoryBolt:
+		return NewBoltInstanceRepository(config)
+	}
+	return nil, fmt.Errorf("unknown repository '%s'", config.Repository)
 }
 
 type FileSystemInstanceRepository struct {
 	LogstashConf ServiceConfiguration
+
+	// Used for every file the repository writes; an AtomicFileWriter when nil
+	FileWriter system.FileWriter
 }
 
 type ConfigFile struct {
@@ -26,6 +105,9 @@ type ConfigFile struct {
 }
 
 func (instanceRepository *FileSystemInstanceRepository) FindById(instanceId string) (*Instance, error) {
+	if !ValidId(instanceId) {
+		return nil, ErrInstanceNotFound
+	}
 	instanceDataDir := path.Join(instanceRepository.instanceDataDirectory(), instanceId)
 
 	_, err := os.Stat(instanceDataDir)
@@ -43,21 +125,53 @@ func (instanceRepository *FileSystemInstanceRepository) FindById(instanceId stri
 		return nil, err
 	}
 
-	instance := &Instance{
-		Id:   instanceId,
-		Port: port,
-		Host: instanceRepository.LogstashConf.Host,
+	instance := &Instance{}
+
+	// instances created before metadata was recorded only have a port file
+	metadata, err := ioutil.ReadFile(path.Join(instanceDataDir, "instance.json"))
+	if err == nil {
+		if err := json.Unmarshal(metadata, instance); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
 
+	instance.Id = instanceId
+	instance.Port = port
+	instance.Host = instanceRepository.LogstashConf.Host
+	instance.Basepath = instanceDataDir
+	instance.LogDir = path.Join(instanceRepository.instanceLogDirectory(), instanceId)
+	instance.TemplatePath = instanceRepository.LogstashConf.templatePath(instance.Pipeline)
+	instance.Elasticsearch = instanceRepository.LogstashConf.Elasticsearch
+
 	return instance, nil
 }
 
+// FindAll leaves out the directories that cannot be loaded, see UnloadableInstances.
+func (instanceRepository *FileSystemInstanceRepository) FindAll() ([]*Instance, error) {
+	instances, _, err := instanceRepository.findAllInstances()
+	return instances, err
+}
+
+// GetInstanceCount counts the directories that cannot be loaded too, so that they keep their place under the
+// service_instance_limit until fsck repairs or quarantines them.
 func (instanceRepository *FileSystemInstanceRepository) GetInstanceCount() (int, error) {
-	instances, err := instanceRepository.findAllInstances()
-	return len(instances), err
+	instances, unloadable, err := instanceRepository.findAllInstances()
+	return len(instances) + len(unloadable), err
+}
+
+// UnloadableInstances returns the ids of the instance directories that cannot be loaded, e.g. for a missing port
+// file.
+func (instanceRepository *FileSystemInstanceRepository) UnloadableInstances() ([]string, error) {
+	_, unloadable, err := instanceRepository.findAllInstances()
+	return unloadable, err
 }
 
 func (instanceRepository *FileSystemInstanceRepository) Save(instance *Instance) error {
+	if !ValidId(instance.Id) {
+		return ErrInvalidId
+	}
 	err := instanceRepository.createBaseDirectory(instance)
 	if err != nil {
 		return err
@@ -73,10 +187,12 @@ func (instanceRepository *FileSystemInstanceRepository) Save(instance *Instance)
 		return err
 	}
 
-	err = instanceRepository.createConfig(
-		map[string]interface{}{"Host": instance.Host, "Port": instance.Port},
-		path.Join(instance.TempatePath(), "logstash.conf.tmpl"),
-		path.Join(instance.DataFilePath(), "logstash.conf"))
+	err = instanceRepository.createMetadata(instance)
+	if err != nil {
+		return err
+	}
+
+	err = renderConfig(instanceRepository.fileWriter(), instance)
 	if err != nil {
 		return err
 	}
@@ -84,6 +200,68 @@ func (instanceRepository *FileSystemInstanceRepository) Save(instance *Instance)
 	return nil
 }
 
+// Delete removes the data and log directories of an instance, along with its bindings.
+func (instanceRepository *FileSystemInstanceRepository) Delete(instanceId string) error {
+	if !ValidId(instanceId) {
+		return ErrInvalidId
+	}
+	err := os.RemoveAll(path.Join(instanceRepository.instanceDataDirectory(), instanceId))
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path.Join(instanceRepository.instanceLogDirectory(), instanceId))
+}
+
+// ClaimedPorts returns the instance holding each port, reading every directory once. Save does not refuse the port
+// of another instance, as it would have to read them all each time; the CachingInstanceRepository checks its index
+// built from these ports instead. The port file is read on its own, so that a directory whose metadata is corrupt
+// still holds its port; the TLS port is read from the metadata.
+func (instanceRepository *FileSystemInstanceRepository) ClaimedPorts() (map[int]string, error) {
+	claimed := map[int]string{}
+	instanceDirs, err := ioutil.ReadDir(instanceRepository.instanceDataDirectory())
+	if os.IsNotExist(err) {
+		return claimed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instanceDir := range instanceDirs {
+		if !instanceDir.IsDir() || strings.HasPrefix(instanceDir.Name(), ".") {
+			continue
+		}
+		for _, port := range directoryPorts(path.Join(instanceRepository.instanceDataDirectory(), instanceDir.Name())) {
+			// two directories sharing a port are reported by fsck; either one is enough to refuse it
+			if _, ok := claimed[port]; !ok {
+				claimed[port] = instanceDir.Name()
+			}
+		}
+	}
+	return claimed, nil
+}
+
+// The ports an instance directory holds, as far as they can be read
+func directoryPorts(dir string) []int {
+	ports := []int{}
+	portBytes, err := ioutil.ReadFile(path.Join(dir, "logstash.port"))
+	if err == nil {
+		if port, err := strconv.Atoi(strings.TrimSpace(string(portBytes))); err == nil {
+			ports = append(ports, port)
+		}
+	}
+
+	metadata, err := ioutil.ReadFile(path.Join(dir, "instance.json"))
+	if err != nil {
+		return ports
+	}
+	instance := &Instance{}
+	if err := json.Unmarshal(metadata, instance); err == nil && instance.TLS != nil {
+		ports = append(ports, instance.TLS.Port)
+	}
+	return ports
+}
+
 func (instanceRepository *FileSystemInstanceRepository) createBaseDirectory(instance *Instance) error {
 	mkdirErr := os.MkdirAll(instance.baseDir(), 0755)
 	if mkdirErr != nil {
@@ -103,11 +281,101 @@ func (instanceRepository *FileSystemInstanceRepository) createLogDirectory(insta
 }
 
 func (instanceRepository *FileSystemInstanceRepository) createBindData(instance *Instance) error {
-
 	port := strconv.FormatInt(int64(instance.Port), 10)
-	ioutil.WriteFile(path.Join(instance.baseDir(), "logstash.port"), []byte(port), 0644)
+	return instanceRepository.fileWriter().WriteFile(path.Join(instance.baseDir(), "logstash.port"), []byte(port), 0644)
+}
 
-	return nil
+func (instanceRepository *FileSystemInstanceRepository) createMetadata(instance *Instance) error {
+	metadata, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+
+	// the metadata of a stack component holds the password of its buffer
+	return instanceRepository.fileWriter().WriteFile(instance.MetadataPath(), metadata, 0600)
+}
+
+func (instanceRepository *FileSystemInstanceRepository) SaveBinding(binding *Binding) error {
+	if !ValidId(binding.Id) {
+		return ErrInvalidId
+	}
+	instance, err := instanceRepository.FindById(binding.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(instance.BindingsDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+
+	// the binding holds its ingress token
+	return instanceRepository.fileWriter().WriteFile(path.Join(instance.BindingsDir(), binding.Id+".json"), data, 0600)
+}
+
+func (instanceRepository *FileSystemInstanceRepository) FindBindingById(instanceId string, bindingId string) (*Binding, error) {
+	if !ValidId(instanceId) || !ValidId(bindingId) {
+		return nil, ErrBindingNotFound
+	}
+	data, err := ioutil.ReadFile(instanceRepository.bindingPath(instanceId, bindingId))
+	if err != nil {
+		return nil, err
+	}
+
+	binding := &Binding{}
+	if err := json.Unmarshal(data, binding); err != nil {
+		return nil, err
+	}
+
+	return binding, nil
+}
+
+func (instanceRepository *FileSystemInstanceRepository) FindBindings(instanceId string) ([]*Binding, error) {
+	bindings := []*Binding{}
+	if !ValidId(instanceId) {
+		return bindings, nil
+	}
+
+	bindingFiles, err := ioutil.ReadDir(path.Join(instanceRepository.instanceDataDirectory(), instanceId, "bindings"))
+	if os.IsNotExist(err) {
+		return bindings, nil
+	}
+	if err != nil {
+		return bindings, err
+	}
+
+	for _, bindingFile := range bindingFiles {
+		binding, err := instanceRepository.FindBindingById(instanceId, strings.TrimSuffix(bindingFile.Name(), ".json"))
+		if err != nil {
+			return bindings, err
+		}
+		bindings = append(bindings, binding)
+	}
+
+	return bindings, nil
+}
+
+func (instanceRepository *FileSystemInstanceRepository) DeleteBinding(instanceId string, bindingId string) error {
+	if !ValidId(instanceId) || !ValidId(bindingId) {
+		return ErrInvalidId
+	}
+	return os.Remove(instanceRepository.bindingPath(instanceId, bindingId))
+}
+
+func (instanceRepository *FileSystemInstanceRepository) bindingPath(instanceId string, bindingId string) string {
+	return path.Join(instanceRepository.instanceDataDirectory(), instanceId, "bindings", bindingId+".json")
+}
+
+func (instanceRepository *FileSystemInstanceRepository) fileWriter() system.FileWriter {
+	if instanceRepository.FileWriter == nil {
+		return system.AtomicFileWriter{}
+	}
+	return instanceRepository.FileWriter
 }
 
 func (instanceRepository *FileSystemInstanceRepository) instanceDataDirectory() string {
@@ -118,49 +386,61 @@ func (instanceRepository *FileSystemInstanceRepository) instanceLogDirectory() s
 	return instanceRepository.LogstashConf.InstanceLogDirectory
 }
 
-func (instanceRepository *FileSystemInstanceRepository) findAllInstances() ([]*Instance, error) {
+// The instances that load and the ids of the directories that do not
+func (instanceRepository *FileSystemInstanceRepository) findAllInstances() ([]*Instance, []string, error) {
 	instances := []*Instance{}
-	log.Printf("ALL INSTANCES--------------------------------------------------")
+	unloadable := []string{}
 
+	// a broker restoring onto a new disk has no data directory until the first instance is saved
 	instanceDirs, err := ioutil.ReadDir(instanceRepository.instanceDataDirectory())
+	if os.IsNotExist(err) {
+		return instances, unloadable, nil
+	}
 	if err != nil {
-		log.Printf("ALL INSTANCES-----err reading dir %v", err)
-		return instances, err
+		return instances, unloadable, err
 	}
 
-	log.Printf("LOOPING ALL INSTANCES--------------------------------------------------")
 	for _, instanceDir := range instanceDirs {
+		if !instanceDir.IsDir() || strings.HasPrefix(instanceDir.Name(), ".") {
+			continue
+		}
 
+		// one corrupt directory must not fail every provision; the Checker reports and quarantines it
 		instance, err := instanceRepository.FindById(instanceDir.Name())
-		log.Printf("ALL INSTANCES-----instance name: %s", instanceDir.Name())
-
 		if err != nil {
-			log.Printf("ALL INSTANCES-----err finding dir name: %s : err: %v", instanceDir.Name(), err)
-			return instances, err
+			unloadable = append(unloadable, instanceDir.Name())
+			continue
 		}
 
-		log.Printf("ALL INSTANCES---------- append instance %v", instance)
 		instances = append(instances, instance)
 	}
 
-	return instances, nil
+	return instances, unloadable, nil
 }
 
-func (instanceRepository *FileSystemInstanceRepository) createConfig(logstashConf map[string]interface{}, templateFile, outputFile string) error {
+// RenderConfig writes the logstash.conf of an instance from the logstash.conf.tmpl in its template path.
+func RenderConfig(instance *Instance) error {
+	return renderConfig(system.AtomicFileWriter{}, instance)
+}
 
-	data := map[string]interface{}{
-		"logstash": logstashConf,
+func renderConfig(writer system.FileWriter, instance *Instance) error {
+	if err := writeTLSFiles(writer, instance); err != nil {
+		return err
 	}
+	return createConfig(
+		writer,
+		configData(instance),
+		path.Join(instance.TempatePath(), "logstash.conf.tmpl"),
+		instance.ConfigPath())
+}
 
-	f, err := os.Create(outputFile)
-	defer f.Close()
-
-	tc, err := gerb.ParseFile(true, templateFile)
+// The config is rendered in memory first so that a failed or empty render never replaces a working config. It holds
+// the credentials of outputs, so only the broker and its agents may read it.
+func createConfig(writer system.FileWriter, data map[string]interface{}, templateFile, outputFile string) error {
+	rendered, err := renderTemplate(templateFile, data)
 	if err != nil {
-		log.Println("executing template:", err)
 		return err
 	}
-	tc.Render(f, data)
 
-	return nil
+	return writer.WriteFile(outputFile, rendered, 0600)
 }
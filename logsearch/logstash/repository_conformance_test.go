@@ -0,0 +1,254 @@
+package logstash_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func newTestInstance(config logstash.ServiceConfiguration, id string, port int) *logstash.Instance {
+	return &logstash.Instance{
+		Id:               id,
+		Basepath:         path.Join(config.InstanceDataDirectory, id),
+		LogDir:           path.Join(config.InstanceLogDirectory, id),
+		TemplatePath:     config.DefaultConfigPath,
+		Host:             config.Host,
+		Port:             port,
+		PlanId:           "plan-1",
+		OrganizationGuid: "org-1",
+		SpaceGuid:        "space-1",
+		CreatedBy:        &api.OriginatingIdentity{Platform: "cloudfoundry", UserId: "user-1"},
+		CreatedAt:        time.Date(2014, 9, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// The behaviour every InstanceRepository implementation must share
+func itBehavesLikeAnInstanceRepository(newRepository func(config logstash.ServiceConfiguration) logstash.InstanceRepository) {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var repository logstash.InstanceRepository
+	var instance *logstash.Instance
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-repository")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			InstanceDatabase:      path.Join(tmpDir, "instances.db"),
+		}
+		Ω(os.MkdirAll(config.InstanceDataDirectory, 0755)).To(Succeed())
+		repository = newRepository(config)
+		instance = newTestInstance(config, "instance-1", 5000)
+	})
+
+	AfterEach(func() {
+		if closer, ok := repository.(io.Closer); ok {
+			closer.Close()
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	It("has no instances to begin with", func() {
+		Ω(repository.FindAll()).To(BeEmpty())
+		Ω(repository.GetInstanceCount()).To(Equal(0))
+	})
+
+	It("does not find an instance that was never saved", func() {
+		_, err := repository.FindById("missing")
+		Ω(err).To(HaveOccurred())
+	})
+
+	It("refuses ids that could name a path outside of the instance directories", func() {
+		Ω(repository.Save(instance)).To(Succeed())
+		for _, id := range []string{".", "..", "../data", ""} {
+			Ω(repository.Delete(id)).To(Equal(logstash.ErrInvalidId), id)
+			Ω(repository.Save(newTestInstance(config, id, 6000))).To(Equal(logstash.ErrInvalidId), id)
+		}
+		Ω(repository.FindById("instance-1")).ToNot(BeNil())
+		_, err := os.Stat(config.InstanceLogDirectory)
+		Ω(err).ToNot(HaveOccurred())
+	})
+
+	Context("when an instance is saved", func() {
+		BeforeEach(func() {
+			Ω(repository.Save(instance)).To(Succeed())
+		})
+
+		It("finds it again with its metadata", func() {
+			found, err := repository.FindById("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(found).To(Equal(instance))
+		})
+
+		It("renders the logstash config", func() {
+			config, err := ioutil.ReadFile(instance.ConfigPath())
+			Ω(err).ToNot(HaveOccurred())
+			Ω(string(config)).To(ContainSubstring(`port => "5000"`))
+		})
+
+		It("creates the log directory", func() {
+			_, err := os.Stat(instance.LogDir)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("re-renders a config that was lost", func() {
+			Ω(os.Remove(instance.ConfigPath())).To(Succeed())
+			Ω(logstash.RenderConfig(instance)).To(Succeed())
+			config, err := ioutil.ReadFile(instance.ConfigPath())
+			Ω(err).ToNot(HaveOccurred())
+			Ω(string(config)).To(ContainSubstring(`port => "5000"`))
+		})
+
+		It("counts it", func() {
+			Ω(repository.GetInstanceCount()).To(Equal(1))
+		})
+
+		It("lists it with the others, ordered by id", func() {
+			other := newTestInstance(config, "instance-0", 5001)
+			Ω(repository.Save(other)).To(Succeed())
+			Ω(repository.FindAll()).To(Equal([]*logstash.Instance{other, instance}))
+		})
+
+		It("deletes it with its directories", func() {
+			Ω(repository.Delete("instance-1")).To(Succeed())
+			_, err := repository.FindById("instance-1")
+			Ω(err).To(HaveOccurred())
+			Ω(repository.GetInstanceCount()).To(Equal(0))
+			_, err = os.Stat(instance.Basepath)
+			Ω(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Stat(instance.LogDir)
+			Ω(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("bindings", func() {
+		var binding *logstash.Binding
+
+		BeforeEach(func() {
+			Ω(repository.Save(instance)).To(Succeed())
+			binding = &logstash.Binding{
+				Id:         "binding-1",
+				InstanceId: "instance-1",
+				CreatedBy:  &api.OriginatingIdentity{Platform: "cloudfoundry", UserId: "user-2"},
+				CreatedAt:  time.Date(2014, 9, 2, 12, 0, 0, 0, time.UTC),
+			}
+			Ω(repository.SaveBinding(binding)).To(Succeed())
+		})
+
+		It("records who created them", func() {
+			found, err := repository.FindBindingById("instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(found).To(Equal(binding))
+		})
+
+		It("lists them per instance", func() {
+			bindings, err := repository.FindBindings("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(bindings).To(Equal([]*logstash.Binding{binding}))
+		})
+
+		It("has none for an instance that was never bound", func() {
+			Ω(repository.Save(newTestInstance(config, "instance-2", 5002))).To(Succeed())
+			Ω(repository.FindBindings("instance-2")).To(BeEmpty())
+		})
+
+		It("deletes them", func() {
+			Ω(repository.DeleteBinding("instance-1", "binding-1")).To(Succeed())
+			_, err := repository.FindBindingById("instance-1", "binding-1")
+			Ω(err).To(HaveOccurred())
+		})
+
+		It("cannot delete a binding that does not exist", func() {
+			Ω(repository.DeleteBinding("instance-1", "binding-2")).ToNot(Succeed())
+		})
+
+		It("cannot bind an instance that does not exist", func() {
+			err := repository.SaveBinding(&logstash.Binding{Id: "binding-2", InstanceId: "missing"})
+			Ω(err).To(HaveOccurred())
+		})
+
+		It("deletes them with their instance", func() {
+			Ω(repository.Delete("instance-1")).To(Succeed())
+			Ω(repository.Save(instance)).To(Succeed())
+			Ω(repository.FindBindings("instance-1")).To(BeEmpty())
+		})
+	})
+}
+
+// The repositories that refuse to save an instance on the port of another: Bolt through its ports bucket and the
+// cache through its index, while the filesystem leaves it to the cache
+func itRefusesPortsOfOtherInstances(newRepository func(config logstash.ServiceConfiguration) logstash.InstanceRepository) {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var repository logstash.InstanceRepository
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-repository")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			InstanceDatabase:      path.Join(tmpDir, "instances.db"),
+		}
+		Ω(os.MkdirAll(config.InstanceDataDirectory, 0755)).To(Succeed())
+		repository = newRepository(config)
+	})
+
+	AfterEach(func() {
+		if closer, ok := repository.(io.Closer); ok {
+			closer.Close()
+		}
+		os.RemoveAll(tmpDir)
+	})
+
+	It("refuses to give two instances the same port", func() {
+		Ω(repository.Save(newTestInstance(config, "instance-1", 5000))).To(Succeed())
+		err := repository.Save(newTestInstance(config, "instance-2", 5000))
+		Ω(err).To(Equal(&logstash.PortInUseError{Port: 5000, InstanceId: "instance-1"}))
+		Ω(repository.GetInstanceCount()).To(Equal(1))
+	})
+
+	It("counts the ports of TLS inputs", func() {
+		withTLS := newTestInstance(config, "instance-1", 5000)
+		withTLS.TLS = &logstash.InstanceTLS{Port: 5001, Certificate: "certificate", Key: "key"}
+		Ω(repository.Save(withTLS)).To(Succeed())
+
+		err := repository.Save(newTestInstance(config, "instance-2", 5001))
+		Ω(err).To(Equal(&logstash.PortInUseError{Port: 5001, InstanceId: "instance-1"}))
+		other := newTestInstance(config, "instance-2", 5002)
+		other.TLS = &logstash.InstanceTLS{Port: 5000, Certificate: "certificate", Key: "key"}
+		Ω(repository.Save(other)).To(Equal(&logstash.PortInUseError{Port: 5000, InstanceId: "instance-1"}))
+
+		Ω(repository.Delete("instance-1")).To(Succeed())
+		Ω(repository.Save(newTestInstance(config, "instance-2", 5001))).To(Succeed())
+	})
+
+	It("frees the port of a deleted instance", func() {
+		Ω(repository.Save(newTestInstance(config, "instance-1", 5000))).To(Succeed())
+		Ω(repository.Delete("instance-1")).To(Succeed())
+		Ω(repository.Save(newTestInstance(config, "instance-2", 5000))).To(Succeed())
+	})
+
+	It("frees the previous port of an instance saved again", func() {
+		Ω(repository.Save(newTestInstance(config, "instance-1", 5000))).To(Succeed())
+		Ω(repository.Save(newTestInstance(config, "instance-1", 5001))).To(Succeed())
+		Ω(repository.Save(newTestInstance(config, "instance-2", 5000))).To(Succeed())
+	})
+}
@@ -0,0 +1,169 @@
+package logstash_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/system"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Fails writes to files whose name ends with one of the suffixes, as a full or read-only disk would
+type FaultyFileWriter struct {
+	Suffixes []string
+	Err      error
+}
+
+func (writer *FaultyFileWriter) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	for _, suffix := range writer.Suffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return &os.PathError{Op: "write", Path: filename, Err: writer.Err}
+		}
+	}
+	return system.AtomicFileWriter{}.WriteFile(filename, data, perm)
+}
+
+var _ = Describe("FileSystemInstanceRepository", func() {
+	itBehavesLikeAnInstanceRepository(func(config logstash.ServiceConfiguration) logstash.InstanceRepository {
+		return &logstash.FileSystemInstanceRepository{LogstashConf: config}
+	})
+
+	Context("on disk", func() {
+		var tmpDir string
+		var config logstash.ServiceConfiguration
+		var repository *logstash.FileSystemInstanceRepository
+		var instance *logstash.Instance
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "logstash-repository")
+			Ω(err).ToNot(HaveOccurred())
+
+			config = logstash.ServiceConfiguration{
+				Host:                  "127.0.0.1",
+				DefaultConfigPath:     "assets",
+				InstanceDataDirectory: path.Join(tmpDir, "data"),
+				InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			}
+			repository = &logstash.FileSystemInstanceRepository{
+				LogstashConf: config,
+			}
+			instance = newTestInstance(config, "instance-1", 5000)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		Context("when the disk is full", func() {
+			var writer *FaultyFileWriter
+
+			BeforeEach(func() {
+				writer = &FaultyFileWriter{Err: syscall.ENOSPC}
+				repository.FileWriter = writer
+			})
+
+			It("fails to save an instance whose port cannot be written", func() {
+				writer.Suffixes = []string{"logstash.port"}
+				err := repository.Save(instance)
+				Ω(err).To(HaveOccurred())
+				Ω(err.(*os.PathError).Err).To(Equal(syscall.ENOSPC))
+			})
+
+			It("keeps the previous config when the new one cannot be written", func() {
+				Ω(repository.Save(instance)).To(Succeed())
+
+				writer.Suffixes = []string{"logstash.conf"}
+				instance.Port = 5001
+				Ω(repository.Save(instance)).ToNot(Succeed())
+
+				config, err := ioutil.ReadFile(instance.ConfigPath())
+				Ω(err).ToNot(HaveOccurred())
+				Ω(string(config)).To(ContainSubstring(`port => "5000"`))
+			})
+
+			It("fails to save a binding", func() {
+				Ω(repository.Save(instance)).To(Succeed())
+
+				writer.Suffixes = []string{"binding-1.json"}
+				Ω(repository.SaveBinding(&logstash.Binding{Id: "binding-1", InstanceId: "instance-1"})).ToNot(Succeed())
+				Ω(repository.FindBindings("instance-1")).To(BeEmpty())
+			})
+		})
+
+		Context("when permission is denied", func() {
+			It("fails to save an instance whose metadata cannot be written", func() {
+				repository.FileWriter = &FaultyFileWriter{Suffixes: []string{"instance.json"}, Err: syscall.EACCES}
+				err := repository.Save(instance)
+				Ω(err).To(HaveOccurred())
+				Ω(err.(*os.PathError).Err).To(Equal(syscall.EACCES))
+			})
+		})
+
+		Context("when the template is broken", func() {
+			writeTemplate := func(template string) {
+				templateDir := path.Join(tmpDir, "templates")
+				Ω(os.MkdirAll(templateDir, 0755)).To(Succeed())
+				Ω(ioutil.WriteFile(path.Join(templateDir, "logstash.conf.tmpl"), []byte(template), 0644)).To(Succeed())
+				instance.TemplatePath = templateDir
+			}
+
+			It("refuses to write an empty config", func() {
+				writeTemplate("  \n")
+				Ω(repository.Save(instance)).ToNot(Succeed())
+				_, err := os.Stat(instance.ConfigPath())
+				Ω(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("reports errors from rendering", func() {
+				writeTemplate(`port => "<%= undefinedValue %>"`)
+				err := repository.Save(instance)
+				Ω(err).To(HaveOccurred())
+				Ω(err.Error()).To(ContainSubstring("undefinedvalue is undefined"))
+			})
+
+			It("reports a missing template", func() {
+				instance.TemplatePath = path.Join(tmpDir, "missing")
+				Ω(repository.Save(instance)).ToNot(Succeed())
+			})
+		})
+
+		Context("when an instance only has a port file", func() {
+			BeforeEach(func() {
+				Ω(os.MkdirAll(instance.Basepath, 0755)).To(Succeed())
+				Ω(ioutil.WriteFile(path.Join(instance.Basepath, "logstash.port"), []byte("5000"), 0644)).To(Succeed())
+			})
+
+			It("is still found", func() {
+				found, err := repository.FindById("instance-1")
+				Ω(err).ToNot(HaveOccurred())
+				Ω(found.Port).To(Equal(5000))
+				Ω(found.CreatedBy).To(BeNil())
+			})
+		})
+
+		It("has no instances before the data directory is created", func() {
+			Ω(repository.FindAll()).To(BeEmpty())
+			Ω(repository.GetInstanceCount()).To(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("NewInstanceRepository", func() {
+	It("defaults to the filesystem", func() {
+		repository, err := logstash.NewInstanceRepository(logstash.ServiceConfiguration{})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(repository).To(BeAssignableToTypeOf(&logstash.FileSystemInstanceRepository{}))
+	})
+
+	It("rejects unknown backends", func() {
+		_, err := logstash.NewInstanceRepository(logstash.ServiceConfiguration{Repository: "mysql"})
+		Ω(err).To(HaveOccurred())
+	})
+})
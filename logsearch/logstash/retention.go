@@ -0,0 +1,116 @@
+package logstash
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/pivotal-golang/lager"
+)
+
+// ApplyRetention deletes the indices of every instance, of logstash or of the elasticsearch service, that are older than its
+// retention, recording in the audit log what was deleted. With dryRun nothing is deleted.
+func (broker *logstashServiceBroker) ApplyRetention(ctx context.Context, dryRun bool) ([]elasticsearch.RetentionResult, error) {
+	logger := LoggerFromContext(ctx, broker.Logger)
+	config := broker.ServiceConfiguration.Elasticsearch
+
+	targets, err := broker.retentionTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	retention := &elasticsearch.Retention{Client: elasticsearch.NewClient(config), Config: config.Retention}
+	started := time.Now()
+	results := retention.Run(targets, dryRun)
+
+	for _, result := range results {
+		if len(result.Deleted) == 0 && result.Err == nil {
+			continue
+		}
+
+		parameters := map[string]interface{}{
+			"index_prefix":   result.IndexPrefix,
+			"retention_days": result.Days,
+			"dry_run":        dryRun,
+		}
+		// a failed pass may have deleted none of the indices it found
+		if result.Err != nil {
+			logger.Error("applying-retention-failed", result.Err, lager.Data{"index-prefix": result.IndexPrefix, "dry-run": dryRun})
+		} else {
+			logger.Info("applied-retention", lager.Data{"index-prefix": result.IndexPrefix, "deleted": result.Deleted, "dry-run": dryRun})
+			parameters["deleted"] = result.Deleted
+			if !dryRun {
+				retentionDeletedIndices.Add(float64(len(result.Deleted)))
+			}
+		}
+
+		for _, instanceId := range result.InstanceIds {
+			RecordAudit(broker, ctx, logger, AuditEntry{
+				Operation:  "retention",
+				InstanceId: instanceId,
+				Parameters: parameters,
+			}, started, result.Err)
+		}
+	}
+	return results, nil
+}
+
+// Parses the retention_days parameter of an instance, which only instances shipping to Elasticsearch take
+func (broker *logstashServiceBroker) parseRetention(planId string, value string) (int, error) {
+	if !broker.ServiceConfiguration.Elasticsearch.Enabled() {
+		return 0, &InvalidParameterError{Name: elasticsearch.RetentionParameter, Reason: "instances only keep indices when the broker ships to elasticsearch"}
+	}
+	return broker.ServiceConfiguration.Elasticsearch.Retention.ParseOverride(planId, value)
+}
+
+// The logstash instances shipping to Elasticsearch and the instances of the RetentionSources keeping indices there
+func (broker *logstashServiceBroker) retentionTargets() ([]elasticsearch.RetentionTarget, error) {
+	targets := []elasticsearch.RetentionTarget{}
+
+	if broker.ServiceConfiguration.Elasticsearch.Enabled() {
+		instances, err := broker.InstanceRepository.FindAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			// the shipper of a stack shares the indices of its indexer, whose retention updates change
+			if instance.Stack != nil && instance.Stack.Role == stack.RoleShipper {
+				continue
+			}
+			targets = append(targets, elasticsearch.RetentionTarget{
+				InstanceId:  instance.Id,
+				PlanId:      instance.PlanId,
+				IndexPrefix: instance.indexPrefix(),
+				Days:        instance.RetentionDays,
+			})
+		}
+	}
+
+	for _, source := range broker.RetentionSources {
+		serviceTargets, err := source.RetentionTargets()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, serviceTargets...)
+	}
+	return targets, nil
+}
+
+// Runs ApplyRetention every day at the configured time, as a dry run when the config says so, until stop is closed
+func (broker *logstashServiceBroker) scheduleRetention(stop <-chan struct{}) error {
+	config := broker.ServiceConfiguration.Elasticsearch.Retention
+	if !config.Enabled {
+		return errors.New("elasticsearch retention is not enabled")
+	}
+
+	logger := broker.Logger.Session("retention")
+	return elasticsearch.ScheduleDaily(config.RunAt, stop, func() {
+		ctx := WithLogger(context.Background(), logger)
+		if _, err := broker.ApplyRetention(ctx, config.DryRun); err != nil {
+			logger.Error("applying-retention", err)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package logstash_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Lists and deletes the indices it holds, which is all a retention pass asks of the cluster
+type fakeIndices struct {
+	sync.Mutex
+	indices []string
+	// answers deletes with an error, keeping the indices
+	failDeletes bool
+}
+
+func (es *fakeIndices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.Lock()
+	defer es.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case "GET":
+		prefix := strings.TrimSuffix(strings.TrimPrefix(name, "_cat/indices/"), "*")
+		rows := []map[string]string{}
+		for _, index := range es.indices {
+			if strings.HasPrefix(index, prefix) {
+				rows = append(rows, map[string]string{"index": index})
+			}
+		}
+		json.NewEncoder(w).Encode(rows)
+	case "DELETE":
+		if es.failDeletes {
+			http.Error(w, `{"error":"cluster_block_exception"}`, http.StatusInternalServerError)
+			return
+		}
+		deleted := map[string]bool{}
+		for _, index := range strings.Split(name, ",") {
+			deleted[index] = true
+		}
+		kept := []string{}
+		for _, index := range es.indices {
+			if !deleted[index] {
+				kept = append(kept, index)
+			}
+		}
+		es.indices = kept
+		w.Write([]byte(`{"acknowledged":true}`))
+	}
+}
+
+// Stands in for the brokers of other services keeping indices on the cluster
+type fakeRetentionSource []elasticsearch.RetentionTarget
+
+func (source fakeRetentionSource) RetentionTargets() ([]elasticsearch.RetentionTarget, error) {
+	return source, nil
+}
+
+var _ = Describe("Retention", func() {
+	var (
+		tmpDir string
+		es     *fakeIndices
+		server *httptest.Server
+		config logstash.ServiceConfiguration
+		broker interface {
+			api.ServiceBroker
+			api.InstanceUpdater
+			api.Auditor
+			ApplyRetention(ctx context.Context, dryRun bool) ([]elasticsearch.RetentionResult, error)
+		}
+		starter *RecordingProcessStarter
+		sources []elasticsearch.RetentionSource
+		ctx     context.Context
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-retention")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+		sources = nil
+
+		es = &fakeIndices{indices: []string{
+			"logsearch-instance-1-2015.01.01",
+			"logsearch-instance-1-2099.01.01",
+			"logsearch-instance-2-2015.01.01",
+		}}
+		server = httptest.NewServer(es)
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+			Elasticsearch: elasticsearch.Configuration{
+				Hosts: []string{server.URL},
+				Retention: elasticsearch.RetentionConfiguration{
+					DefaultMaxDays: 30,
+					Plans:          map[string]elasticsearch.PlanRetention{"plan-1": {Days: 7, MaxDays: 30}},
+				},
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		logstashBroker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("retention"))
+		Ω(err).ToNot(HaveOccurred())
+		starter = &RecordingProcessStarter{Failing: map[string]bool{}}
+		logstashBroker.ProcessStarter = starter
+		logstashBroker.RetentionSources = sources
+		nextPort := 6000
+		logstashBroker.FindFreePort = func() (int, error) {
+			nextPort++
+			return nextPort, nil
+		}
+		broker = logstashBroker
+
+		_, err = broker.Provision(ctx, "instance-1", map[string]string{"plan_id": "plan-1"})
+		Ω(err).ToNot(HaveOccurred())
+		_, err = broker.Provision(ctx, "instance-2", map[string]string{"plan_id": "plan-2"})
+		Ω(err).ToNot(HaveOccurred())
+		starter.Started = nil
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("deletes the old indices of instances whose plan has a retention and audits them", func() {
+		results, err := broker.ApplyRetention(ctx, false)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(results).To(HaveLen(2))
+		Ω(results[0].Deleted).To(Equal([]string{"logsearch-instance-1-2015.01.01"}))
+		Ω(results[1].Days).To(Equal(0))
+		Ω(es.indices).To(Equal([]string{"logsearch-instance-1-2099.01.01", "logsearch-instance-2-2015.01.01"}))
+
+		entries, err := broker.AuditLog().Query(api.AuditQuery{InstanceId: "instance-1"})
+		Ω(err).ToNot(HaveOccurred())
+		entry := entries[len(entries)-1]
+		Ω(entry.Operation).To(Equal("retention"))
+		Ω(entry.Parameters["index_prefix"]).To(Equal("logsearch-instance-1"))
+		Ω(entry.Parameters["dry_run"]).To(Equal(false))
+		Ω(entry.Parameters["deleted"]).To(ConsistOf("logsearch-instance-1-2015.01.01"))
+	})
+
+	It("deletes nothing with a dry run", func() {
+		results, err := broker.ApplyRetention(ctx, true)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(results[0].Deleted).To(Equal([]string{"logsearch-instance-1-2015.01.01"}))
+		Ω(es.indices).To(HaveLen(3))
+	})
+
+	It("lets an update override the retention of the plan without restarting the agent", func() {
+		Ω(broker.Update(ctx, "instance-2", map[string]string{"retention_days": "10"})).To(Succeed())
+		Ω(starter.Started).To(BeEmpty())
+
+		results, err := broker.ApplyRetention(ctx, false)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(results[1].Days).To(Equal(10))
+		Ω(es.indices).To(Equal([]string{"logsearch-instance-1-2099.01.01"}))
+
+		Ω(broker.Update(ctx, "instance-2", map[string]string{"retention_days": "31"})).To(Equal(&api.InvalidParameterError{
+			Name:   "retention_days",
+			Reason: "may be at most 30 on this plan",
+		}))
+	})
+
+	It("neither counts nor audits as deleted the indices of a failed delete", func() {
+		es.failDeletes = true
+		deleted := metricValue("logsearch_retention_deleted_indices_total")
+
+		results, err := broker.ApplyRetention(ctx, false)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(results[0].Err).To(HaveOccurred())
+		Ω(es.indices).To(HaveLen(3))
+		Ω(metricValue("logsearch_retention_deleted_indices_total")).To(Equal(deleted))
+
+		entries, err := broker.AuditLog().Query(api.AuditQuery{InstanceId: "instance-1"})
+		Ω(err).ToNot(HaveOccurred())
+		entry := entries[len(entries)-1]
+		Ω(entry.Operation).To(Equal("retention"))
+		Ω(entry.Outcome).To(Equal("unknown-error"))
+		Ω(entry.Error).ToNot(BeEmpty())
+		Ω(entry.Parameters).ToNot(HaveKey("deleted"))
+	})
+
+	It("keeps the indices of a stack for the retention of its indexer", func() {
+		es.indices = append(es.indices, "logsearch-stack-1-2015.01.01")
+		component := stack.Component{StackId: "stack-1", Buffer: stack.Buffer{Host: "127.0.0.1", Port: 6380, Key: "logsearch"}}
+		component.Role = stack.RoleIndexer
+		_, err := broker.Provision(stack.WithComponent(ctx, component), "stack-1-indexer", map[string]string{"plan_id": "plan-2", "pipeline": "stack-indexer"})
+		Ω(err).ToNot(HaveOccurred())
+		component.Role = stack.RoleShipper
+		_, err = broker.Provision(stack.WithComponent(ctx, component), "stack-1-shipper", map[string]string{"plan_id": "plan-2", "pipeline": "stack-shipper"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(broker.Update(ctx, "stack-1-indexer", map[string]string{"retention_days": "10"})).To(Succeed())
+
+		results, err := broker.ApplyRetention(ctx, false)
+		Ω(err).ToNot(HaveOccurred())
+		instanceIds := []string{}
+		for _, result := range results {
+			instanceIds = append(instanceIds, result.InstanceIds...)
+		}
+		Ω(instanceIds).ToNot(ContainElement("stack-1-shipper"))
+		Ω(es.indices).ToNot(ContainElement("logsearch-stack-1-2015.01.01"))
+	})
+
+	Context("with the instances of other services keeping indices on the cluster", func() {
+		BeforeEach(func() {
+			es.indices = append(es.indices, "logsearch-es-1-2015.01.01")
+			sources = []elasticsearch.RetentionSource{fakeRetentionSource{
+				{InstanceId: "es-1", PlanId: "plan-1", IndexPrefix: "logsearch-es-1"},
+			}}
+		})
+
+		It("deletes their old indices too", func() {
+			_, err := broker.ApplyRetention(ctx, false)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(es.indices).ToNot(ContainElement("logsearch-es-1-2015.01.01"))
+		})
+	})
+
+	Context("when the broker does not ship to elasticsearch", func() {
+		BeforeEach(func() {
+			config.Elasticsearch = elasticsearch.Configuration{}
+		})
+
+		It("refuses retention_days", func() {
+			expected := &api.InvalidParameterError{
+				Name:   "retention_days",
+				Reason: "instances only keep indices when the broker ships to elasticsearch",
+			}
+			_, err := broker.Provision(ctx, "instance-3", map[string]string{"retention_days": "10"})
+			Ω(err).To(Equal(expected))
+			Ω(broker.Update(ctx, "instance-1", map[string]string{"retention_days": "10"})).To(Equal(expected))
+		})
+	})
+})
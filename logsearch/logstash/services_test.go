@@ -0,0 +1,130 @@
+package logstash_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/malston/cf-logsearch-service-broker/registry"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Services", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var logger *lagertest.TestLogger
+	var logstashBroker stack.LogstashBroker
+	var starter *RecordingProcessStarter
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-services")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+		}
+		logger = lagertest.NewTestLogger("services")
+	})
+
+	JustBeforeEach(func() {
+		broker, err := logstash.NewServiceBrokerFromConfig(config, logger)
+		Ω(err).ToNot(HaveOccurred())
+		starter = &RecordingProcessStarter{Failing: map[string]bool{}}
+		broker.ProcessStarter = starter
+		broker.FindFreePort = func() (int, error) { return 6001, nil }
+		logstashBroker = broker
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("offers logstash without a dashboard client", func() {
+		Ω(logstashBroker.GetCatalog()[0].Name).To(Equal("logsearch-service"))
+		Ω(logstashBroker.GetCatalog()[0].DashboardClient).To(BeNil())
+	})
+
+	It("needs elasticsearch hosts for the stack service", func() {
+		config.Elasticsearch = elasticsearch.Configuration{}
+		config.Elasticsearch.SetDefaults()
+		config.Stack = stack.Configuration{OfferService: true, DataDirectory: path.Join(tmpDir, "stacks")}
+		config.Stack.SetDefaults()
+		Ω(logstash.CheckConfig(config)).To(MatchError("stack offer_service needs elasticsearch hosts"))
+	})
+
+	Context("when every service is offered and served through a registry", func() {
+		var services *registry.Registry
+		var ctx context.Context
+
+		BeforeEach(func() {
+			config.Elasticsearch = elasticsearch.Configuration{
+				Hosts:         []string{"http://127.0.0.1:1"},
+				OfferService:  true,
+				DataDirectory: path.Join(tmpDir, "elasticsearch"),
+			}
+			config.Redis = redis.Configuration{
+				OfferService:  true,
+				Host:          "127.0.0.1",
+				DataDirectory: path.Join(tmpDir, "redis"),
+				LogDirectory:  path.Join(tmpDir, "redis-logs"),
+			}
+			config.Stack = stack.Configuration{OfferService: true, DataDirectory: path.Join(tmpDir, "stacks")}
+			Ω(logstash.CreateDirectories(config)).To(Succeed())
+			ctx = context.Background()
+		})
+
+		// as main.go builds them, logstash first
+		JustBeforeEach(func() {
+			redisBroker := redis.NewServiceBroker(config.Redis, logger)
+			brokers := []api.ServiceBroker{
+				logstashBroker,
+				elasticsearch.NewServiceBroker(config.Elasticsearch, logger),
+				redisBroker,
+				stack.NewServiceBroker(config.Stack, config.Elasticsearch, logstashBroker, redisBroker, logger),
+			}
+
+			var err error
+			services, err = registry.New(&registry.FileOwnership{Path: path.Join(tmpDir, "service-instances.json")}, logger, brokers...)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("checks the health of every broker", func() {
+			statuses := map[string]string{}
+			for _, check := range services.CheckHealth() {
+				statuses[check.Name] = check.Status
+			}
+			Ω(statuses).To(HaveLen(6))
+			Ω(statuses).To(HaveKeyWithValue("data-directory", api.HealthStatusOk))
+			Ω(statuses).To(HaveKeyWithValue("elasticsearch-data-directory", api.HealthStatusOk))
+			// nothing listens on its hosts
+			Ω(statuses).To(HaveKeyWithValue("elasticsearch-cluster", api.HealthStatusFailed))
+			Ω(statuses).To(HaveKeyWithValue("redis-data-directory", api.HealthStatusOk))
+			Ω(statuses).To(HaveKeyWithValue("stack-data-directory", api.HealthStatusOk))
+		})
+
+		It("keeps logstash instances to the logstash broker", func() {
+			_, err := services.Provision(ctx, "instance-1", map[string]string{"service_id": logstashBroker.GetCatalog()[0].Id})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(starter.Started).To(Equal([]string{"instance-1"}))
+
+			_, err = services.BindWithParameters(ctx, "instance-1", "binding-1", map[string]string{"access": "read-only"})
+			Ω(err).To(Equal(&api.InvalidParameterError{Name: "access", Reason: "cannot be given when binding"}))
+			Ω(services.Deprovision(ctx, "instance-1")).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,403 @@
+package logstash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karlseguin/gerb"
+	"github.com/karlseguin/gerb/core"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+)
+
+// gerb reports render errors to a global logger rather than returning them,
+// so renders are serialized while that logger is swapped for one that collects them.
+var renderMutex sync.Mutex
+
+// How long config_test_command may take; logstash needs a while to boot its JVM
+const configTestTimeout = 2 * time.Minute
+
+type renderErrors []string
+
+func (errors *renderErrors) Error(v ...interface{}) {
+	*errors = append(*errors, strings.TrimSpace(fmt.Sprintln(v...)))
+}
+
+// A problem with a template, at Line when it could be traced to one
+type TemplateError struct {
+	File string
+	Line int
+	Err  string
+}
+
+func (err *TemplateError) Error() string {
+	if err.Line == 0 {
+		return fmt.Sprintf("%s: %s", err.File, err.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Err)
+}
+
+// Renders a template into memory, failing if gerb reports any error or the result is blank
+func renderTemplate(templateFile string, data map[string]interface{}) ([]byte, error) {
+	source, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return nil, err
+	}
+	return renderTemplateSource(templateFile, source, data)
+}
+
+func renderTemplateSource(templateFile string, source []byte, data map[string]interface{}) (rendered []byte, err error) {
+	if offset := strayPercent(source); offset != -1 {
+		return nil, &TemplateError{File: templateFile, Line: lineOf(source, offset), Err: `a literal % must be written as <%= "%" %>`}
+	}
+
+	tc, err := gerb.Parse(true, source)
+	if err != nil {
+		return nil, &TemplateError{File: templateFile, Line: parseErrorLine(source, err.Error()), Err: err.Error()}
+	}
+
+	renderMutex.Lock()
+	defer renderMutex.Unlock()
+
+	collected := &renderErrors{}
+	previous := core.Log
+	core.Log = collected
+	defer func() {
+		core.Log = previous
+		if r := recover(); r != nil {
+			err = &TemplateError{File: templateFile, Err: fmt.Sprintf("rendering failed: %v", r)}
+		}
+	}()
+
+	var buffer bytes.Buffer
+	tc.Render(&buffer, data)
+
+	if len(*collected) > 0 {
+		first := (*collected)[0]
+		return nil, &TemplateError{File: templateFile, Line: renderErrorLine(source, first), Err: strings.Join(*collected, "; ")}
+	}
+	if len(bytes.TrimSpace(buffer.Bytes())) == 0 {
+		return nil, &TemplateError{File: templateFile, Err: "rendering produced an empty config"}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// CheckTemplates renders the template in conf_path and the template of every pipeline for a
+// sample instance, so that a broken template stops the broker from starting rather than failing
+// the first provision, and runs config_test_command, if set, on each result. The template in
+// conf_path may be left out once default_pipeline is set.
+func CheckTemplates(config ServiceConfiguration) error {
+	pipelines, err := LoadPipelines(config)
+	if err != nil {
+		return err
+	}
+
+	if config.DefaultPipeline != "" && pipelines[config.DefaultPipeline] == nil {
+		return fmt.Errorf("default_pipeline: unknown pipeline '%s'", config.DefaultPipeline)
+	}
+	plans := []string{}
+	for plan := range config.PlanPipelines {
+		plans = append(plans, plan)
+	}
+	sort.Strings(plans)
+	for _, plan := range plans {
+		if pipelines[config.PlanPipelines[plan]] == nil {
+			return fmt.Errorf("plan_pipelines: plan '%s' uses unknown pipeline '%s'", plan, config.PlanPipelines[plan])
+		}
+	}
+
+	_, err = os.Stat(path.Join(config.DefaultConfigPath, "logstash.conf.tmpl"))
+	if config.DefaultPipeline == "" || err == nil {
+		if err := checkTemplate(config, "", nil); err != nil {
+			return err
+		}
+	}
+	if config.Stack.OfferService {
+		for _, role := range []string{stack.RoleShipper, stack.RoleIndexer} {
+			name := config.Stack.Pipeline(role)
+			if pipelines[name] == nil || pipelines[name].Stack != role {
+				return fmt.Errorf("stack: '%s' is not a stack %s pipeline", name, role)
+			}
+		}
+	}
+
+	for _, name := range pipelineNames(pipelines) {
+		if err := checkTemplate(config, name, pipelines[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTemplate(config ServiceConfiguration, name string, pipeline *Pipeline) error {
+	sample := &Instance{
+		Id:            "config-test",
+		Host:          config.Host,
+		Port:          5000,
+		TemplatePath:  config.templatePath(name),
+		Pipeline:      name,
+		Elasticsearch: config.Elasticsearch,
+	}
+	if pipeline != nil && pipeline.TLS {
+		sample.TLS = &InstanceTLS{Port: 5001}
+	}
+	if pipeline != nil && pipeline.Stack != "" {
+		sample.Stack = &stack.Component{
+			StackId: "config-test",
+			Role:    pipeline.Stack,
+			Buffer:  stack.Buffer{Host: config.Host, Port: 6379, Password: "config-test", Key: "logsearch"},
+		}
+	}
+	templateFile := path.Join(sample.TempatePath(), "logstash.conf.tmpl")
+
+	source, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return err
+	}
+	rendered, err := renderTemplateSource(templateFile, source, configData(sample))
+	if err != nil {
+		return err
+	}
+
+	if len(config.ConfigTestCommand) == 0 {
+		return nil
+	}
+	return runConfigTest(config, templateFile, source, configData(sample), rendered)
+}
+
+// The data every template is rendered with
+func configData(instance *Instance) map[string]interface{} {
+	index := instance.indexPrefix() + "-" + instance.elasticsearchConfig().IndexPattern
+	output := outputConfig(instance.elasticsearchConfig(), index)
+	return map[string]interface{}{
+		"logstash": map[string]interface{}{"Host": instance.Host, "Port": instance.Port, "Filters": instance.Filters},
+		"elasticsearch": map[string]interface{}{
+			"Hosts":  logstashArray(instance.Elasticsearch.Hosts),
+			"Index":  index,
+			"Output": output,
+		},
+		"redis": bufferConfig(instance.Stack, output),
+		"tls":   tlsConfig(instance),
+	}
+}
+
+// The TLS input of an instance, which templates render only when it is Enabled
+func tlsConfig(instance *Instance) map[string]interface{} {
+	if instance.TLS == nil {
+		return map[string]interface{}{"Enabled": false, "Port": 0, "Options": ""}
+	}
+	return map[string]interface{}{"Enabled": true, "Port": instance.TLS.Port, "Options": tlsOptions(instance)}
+}
+
+// The buffer of a stack component: the indexer reads it as its input and the shipper writes it as its output.
+// Instances of their own have no input and their usual output.
+func bufferConfig(component *stack.Component, output string) map[string]interface{} {
+	if component == nil {
+		return map[string]interface{}{"Input": "", "Output": output}
+	}
+
+	plugin := strings.Join([]string{
+		"redis {",
+		"\t\thost => " + logstashString(component.Buffer.Host),
+		"\t\tport => " + strconv.Itoa(component.Buffer.Port),
+		"\t\tpassword => " + logstashString(component.Buffer.Password),
+		"\t\tdata_type => \"list\"",
+		"\t\tkey => " + logstashString(component.Buffer.Key),
+		"\t}",
+	}, "\n")
+	if component.Role == stack.RoleIndexer {
+		return map[string]interface{}{"Input": plugin, "Output": output}
+	}
+	return map[string]interface{}{"Input": "", "Output": plugin}
+}
+
+// The output section of an instance: its indices in Elasticsearch, or stdout, and so the agent log, without hosts
+func outputConfig(config elasticsearch.Configuration, index string) string {
+	if !config.Enabled() {
+		return "stdout {\n\t\tcodec => rubydebug\n\t}"
+	}
+
+	lines := []string{
+		"elasticsearch {",
+		"\t\thosts => " + logstashArray(config.Hosts),
+		"\t\tindex => " + logstashString(index),
+	}
+	if config.Username != "" {
+		lines = append(lines, "\t\tuser => "+logstashString(config.Username))
+	}
+	if config.Password != "" {
+		lines = append(lines, "\t\tpassword => "+logstashString(config.Password))
+	}
+	return strings.Join(append(lines, "\t}"), "\n")
+}
+
+// Quotes a value for a logstash config. In the grammar of logstash a backslash only escapes a quote and is kept as
+// it is otherwise, so paths and patterns are written unchanged; a value ending in a backslash would escape the
+// closing quote and cannot be quoted at all, which CheckConfig refuses for the credentials.
+func logstashString(value string) string {
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
+
+func logstashArray(values []string) string {
+	quoted := []string{}
+	for _, value := range values {
+		quoted = append(quoted, logstashString(value))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+var configTestLine = regexp.MustCompile(`(?i)\bline:? (\d+)`)
+
+// Runs config_test_command with the path of the rendered config appended, blaming the
+// template line behind the first line of the rendered config the command complains about
+func runConfigTest(config ServiceConfiguration, templateFile string, source []byte, data map[string]interface{}, rendered []byte) error {
+	file, err := ioutil.TempFile("", "logstash-config-test")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(rendered); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configTestTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, config.ConfigTestCommand[1:]...), file.Name())
+	output, err := exec.CommandContext(ctx, config.command(config.ConfigTestCommand[0]), args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	message := strings.TrimSpace(string(output))
+	if message == "" {
+		message = err.Error()
+	}
+	templateError := &TemplateError{
+		File: templateFile,
+		Err:  fmt.Sprintf("%s rejected the rendered config: %s", strings.Join(config.ConfigTestCommand, " "), message),
+	}
+	if match := configTestLine.FindStringSubmatch(message); match != nil {
+		renderedLine, _ := strconv.Atoi(match[1])
+		templateError.Line = templateLineOf(source, data, renderedLine)
+	}
+	return templateError
+}
+
+// Finds the line of the tag gerb quotes at the end of a parse error, e.g. "Invalid character: <%= 1 $ 2 %>"
+func parseErrorLine(source []byte, message string) int {
+	index := strings.Index(message, ": <%")
+	if index == -1 {
+		return 0
+	}
+	return lineOf(source, bytes.Index(source, []byte(message[index+2:])))
+}
+
+var undefinedName = regexp.MustCompile(`^([\w.]+) is undefined`)
+
+// Finds the first tag using the name an error such as "logstash.port is undefined" complains
+// about. gerb lowercases names, so tags are compared in lower case.
+func renderErrorLine(source []byte, message string) int {
+	match := undefinedName.FindStringSubmatch(message)
+	if match == nil {
+		return 0
+	}
+
+	lowered := bytes.ToLower(source)
+	for offset := 0; ; {
+		start := bytes.Index(lowered[offset:], []byte("<%"))
+		if start == -1 {
+			return 0
+		}
+		start += offset
+		end := bytes.Index(lowered[start:], []byte("%>"))
+		if end == -1 {
+			return 0
+		}
+		end += start
+		if bytes.Contains(lowered[start:end], []byte(match[1])) {
+			return lineOf(source, start)
+		}
+		offset = end
+	}
+}
+
+// Maps a line of the rendered config back to the template line that ended it, by rendering
+// the template again with a marker before every newline that is not inside a tag.
+func templateLineOf(source []byte, data map[string]interface{}, renderedLine int) int {
+	var marked bytes.Buffer
+	line := 1
+	inTag := false
+	for i := 0; i < len(source); i++ {
+		switch {
+		case !inTag && bytes.HasPrefix(source[i:], []byte("<%")):
+			inTag = true
+		case inTag && bytes.HasPrefix(source[i:], []byte("%>")):
+			inTag = false
+		case source[i] == '\n':
+			if !inTag {
+				fmt.Fprintf(&marked, "\x00%d\x00", line)
+			}
+			line++
+		}
+		marked.WriteByte(source[i])
+	}
+	fmt.Fprintf(&marked, "\x00%d\x00", line)
+
+	rendered, err := renderTemplateSource("", marked.Bytes(), data)
+	if err != nil {
+		return 0
+	}
+	lines := strings.Split(string(rendered), "\n")
+	if renderedLine < 1 || renderedLine > len(lines) {
+		return 0
+	}
+	markers := strings.Split(lines[renderedLine-1], "\x00")
+	if len(markers) < 3 {
+		return 0
+	}
+	templateLine, _ := strconv.Atoi(markers[len(markers)-2])
+	return templateLine
+}
+
+// Finds a % outside of tags, which gerb never gets past when parsing, e.g. the %{SYSLOGLINE} of a grok pattern
+func strayPercent(source []byte) int {
+	inTag := false
+	for i := 0; i < len(source); i++ {
+		switch {
+		case !inTag && bytes.HasPrefix(source[i:], []byte("<%")):
+			inTag = true
+			i++
+		case inTag && bytes.HasPrefix(source[i:], []byte("%>")):
+			inTag = false
+			i++
+		case !inTag && source[i] == '%':
+			return i
+		}
+	}
+	return -1
+}
+
+func lineOf(source []byte, offset int) int {
+	if offset < 0 {
+		return 0
+	}
+	return bytes.Count(source[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,114 @@
+package logstash_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CheckTemplates", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var templateFile string
+
+	writeTemplate := func(template string) {
+		Ω(ioutil.WriteFile(templateFile, []byte(template), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-template")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = logstash.ServiceConfiguration{
+			Host:              "127.0.0.1",
+			DefaultConfigPath: tmpDir,
+		}
+		templateFile = path.Join(tmpDir, "logstash.conf.tmpl")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("accepts the bundled template", func() {
+		config.DefaultConfigPath = "assets"
+		Ω(logstash.CheckTemplates(config)).To(Succeed())
+	})
+
+	It("reports a missing template", func() {
+		Ω(logstash.CheckTemplates(config)).ToNot(Succeed())
+	})
+
+	It("points at the tag that does not parse", func() {
+		writeTemplate("input {\n  tcp { port => <%= 1 $ 2 %> }\n}\n")
+		Ω(logstash.CheckTemplates(config)).To(Equal(&logstash.TemplateError{
+			File: templateFile,
+			Line: 2,
+			Err:  "Expected closing tag: <%= 1 $ 2 %>",
+		}))
+	})
+
+	It("points at the tag using an undefined value", func() {
+		writeTemplate("input {\n  tcp {\n    port => <%= logstash.Prot %>\n  }\n}\n")
+		err := logstash.CheckTemplates(config)
+		Ω(err).To(BeAssignableToTypeOf(&logstash.TemplateError{}))
+		Ω(err.(*logstash.TemplateError).Line).To(Equal(3))
+		Ω(err.Error()).To(HavePrefix(templateFile + ":3: logstash.prot is undefined"))
+	})
+
+	Context("with a config test command", func() {
+		BeforeEach(func() {
+			writeTemplate("input {\n<% for i := 0; i < 3; i++ { %>\n  tcp { port => <%= logstash[\"Port\"] %> }\n<% } %>\n}\nfilter { bad }\n")
+		})
+
+		It("runs it on the rendered config, looked up in the command mapping", func() {
+			config.ConfigTestCommand = []string{"logstash", "agent", "--configtest", "-f"}
+			config.CommandMapping = map[string]string{"logstash": "true"}
+			Ω(logstash.CheckTemplates(config)).To(Succeed())
+		})
+
+		It("passes it the rendered config", func() {
+			config.ConfigTestCommand = []string{"grep", "-q", "port => 5000"}
+			Ω(logstash.CheckTemplates(config)).To(Succeed())
+		})
+
+		It("blames the template line behind the rendered line it rejects", func() {
+			// the loop renders the filter on line 10
+			config.ConfigTestCommand = []string{"sh", "-c", "echo 'Error: Expected one of #, => at line 10, column 10' >&2; exit 1"}
+			Ω(logstash.CheckTemplates(config)).To(Equal(&logstash.TemplateError{
+				File: templateFile,
+				Line: 6,
+				Err:  "sh -c echo 'Error: Expected one of #, => at line 10, column 10' >&2; exit 1 rejected the rendered config: Error: Expected one of #, => at line 10, column 10",
+			}))
+		})
+
+		It("reports failures it cannot trace to a line", func() {
+			config.ConfigTestCommand = []string{"false"}
+			err := logstash.CheckTemplates(config)
+			Ω(err).To(Equal(&logstash.TemplateError{
+				File: templateFile,
+				Err:  "false rejected the rendered config: exit status 1",
+			}))
+		})
+	})
+
+	It("is read from the broker config", func() {
+		configPath := path.Join(tmpDir, "config.yml")
+		Ω(ioutil.WriteFile(configPath, []byte(`---
+logstash:
+  data_directory: "tmp/logstash-data"
+  config_test_command: [logstash, agent, --configtest, -f]
+`), 0644)).To(Succeed())
+
+		parsed, err := logstash.ParseConfig(configPath)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(parsed.ServiceConfiguration.ConfigTestCommand).To(Equal([]string{"logstash", "agent", "--configtest", "-f"}))
+		Ω(parsed.ServiceConfiguration.ProbeTimeoutMilliseconds).To(Equal(500))
+	})
+})
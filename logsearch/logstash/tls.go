@@ -0,0 +1,131 @@
+package logstash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	. "github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/pki"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// Syslog over TLS (RFC 5425) on a second port of instances whose pipeline takes it
+type TLSConfiguration struct {
+	Enabled bool `yaml:"enabled"`
+	// Holds ca.crt and ca.key of the authority issuing the certificates of instances; a new one is created when empty
+	CADirectory string `yaml:"ca_directory"`
+	// How long the certificate of an instance is valid
+	CertificateDays int `yaml:"certificate_days"`
+}
+
+// The update parameter replacing the certificate of an instance, given as "true"
+const RotateCertificateParameter = "rotate_certificate"
+
+// The server certificate of an instance, PEM encoded, and the port it listens on with it. The key is only kept in
+// the owner-only tls/server.key of the instance; it is set while a new one waits to be written there.
+type InstanceTLS struct {
+	Port        int       `json:"port"`
+	Certificate string    `json:"certificate"`
+	Key         string    `json:"-"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+func (config TLSConfiguration) certificateValidity() time.Duration {
+	return time.Duration(config.CertificateDays) * 24 * time.Hour
+}
+
+// Loads the authority of the broker, creating it on first use. When TLS is not enabled an existing authority is
+// still loaded, as instances issued certificates before keep listening for TLS; nil when there is none.
+func loadAuthority(config TLSConfiguration) (*pki.Authority, error) {
+	if !config.Enabled {
+		if _, err := os.Stat(path.Join(config.CADirectory, "ca.crt")); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	return pki.LoadOrCreate(config.CADirectory, "Logsearch Service Broker CA", system.AtomicFileWriter{})
+}
+
+// Issues the instance a certificate for its host, on a port of its own unless it has one already
+func (broker *logstashServiceBroker) issueCertificate(instance *Instance) error {
+	port := 0
+	if instance.TLS != nil {
+		port = instance.TLS.Port
+	} else {
+		var err error
+		if port, err = broker.findFreePort(instance.Port); err != nil {
+			return err
+		}
+	}
+
+	issued, err := broker.Authority.Issue(instance.Id, []string{instance.Host}, broker.ServiceConfiguration.TLS.certificateValidity())
+	if err != nil {
+		return err
+	}
+	instance.TLS = &InstanceTLS{
+		Port:        port,
+		Certificate: issued.Certificate,
+		Key:         issued.Key,
+		NotAfter:    issued.NotAfter,
+	}
+	return nil
+}
+
+// Checks the value of the rotate_certificate update parameter against the instance
+func (broker *logstashServiceBroker) checkRotation(instance *Instance, value string) error {
+	if value != "true" {
+		return &InvalidParameterError{Name: RotateCertificateParameter, Reason: "must be true"}
+	}
+	if instance.TLS == nil {
+		return &InvalidParameterError{Name: RotateCertificateParameter, Reason: "the instance does not listen for TLS"}
+	}
+	if broker.Authority == nil {
+		return &InvalidParameterError{Name: RotateCertificateParameter, Reason: "the broker has no authority to issue certificates"}
+	}
+	return nil
+}
+
+// Reads the key of the certificate of an instance from its tls directory
+func readTLSKey(instance *Instance) (string, error) {
+	key, err := ioutil.ReadFile(instance.TLSKeyPath())
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// The options of the TLS input of an instance, which the pipeline places in a tcp input on TLSPort
+func tlsOptions(instance *Instance) string {
+	return strings.Join([]string{
+		"ssl_enable => true",
+		"\t\tssl_cert => " + logstashString(instance.TLSCertificatePath()),
+		"\t\tssl_key => " + logstashString(instance.TLSKeyPath()),
+		"\t\tssl_verify => false",
+	}, "\n")
+}
+
+// Writes the certificate of the instance next to its config, where its TLS input reads it, and its key when it
+// has a new one
+func writeTLSFiles(writer system.FileWriter, instance *Instance) error {
+	if instance.TLS == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(instance.TLSKeyPath()), 0700); err != nil {
+		return err
+	}
+	if instance.TLS.Key != "" {
+		if err := writer.WriteFile(instance.TLSKeyPath(), []byte(instance.TLS.Key), 0600); err != nil {
+			return err
+		}
+	}
+	return writer.WriteFile(instance.TLSCertificatePath(), []byte(instance.TLS.Certificate), 0644)
+}
+
+// The drain url of the TLS input of an instance
+func (instance Instance) syslogTLSDrainUrl() string {
+	return fmt.Sprintf("syslog-tls://%s:%d", instance.Host, instance.TLS.Port)
+}
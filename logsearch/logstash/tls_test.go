@@ -0,0 +1,271 @@
+package logstash_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS", func() {
+	var tmpDir string
+	var config logstash.ServiceConfiguration
+	var broker api.ServiceBroker
+	var starter *RecordingProcessStarter
+	var ctx context.Context
+
+	renderedConfig := func(instanceId string) string {
+		data, err := ioutil.ReadFile(path.Join(config.InstanceDataDirectory, instanceId, "logstash.conf"))
+		Ω(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	findInstance := func(instanceId string) *logstash.Instance {
+		repository := &logstash.FileSystemInstanceRepository{LogstashConf: config}
+		instance, err := repository.FindById(instanceId)
+		Ω(err).ToNot(HaveOccurred())
+		return instance
+	}
+
+	readKey := func(instance *logstash.Instance) string {
+		key, err := ioutil.ReadFile(instance.TLSKeyPath())
+		Ω(err).ToNot(HaveOccurred())
+		return string(key)
+	}
+
+	// Verifies a PEM encoded server certificate for host against the PEM encoded authority
+	verify := func(certificatePEM string, authorityPEM string, host string) error {
+		roots := x509.NewCertPool()
+		Ω(roots.AppendCertsFromPEM([]byte(authorityPEM))).To(BeTrue())
+		block, _ := pem.Decode([]byte(certificatePEM))
+		Ω(block).ToNot(BeNil())
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		Ω(err).ToNot(HaveOccurred())
+		_, err = certificate.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		return err
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "logstash-tls")
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+
+		config = logstash.ServiceConfiguration{
+			Host:                  "127.0.0.1",
+			DefaultConfigPath:     "assets",
+			InstanceDataDirectory: path.Join(tmpDir, "data"),
+			InstanceLogDirectory:  path.Join(tmpDir, "logs"),
+			AuditDirectory:        path.Join(tmpDir, "audit"),
+			ServiceInstanceLimit:  10,
+			DefaultPipeline:       "syslog-5424",
+			TLS: logstash.TLSConfiguration{
+				Enabled:         true,
+				CADirectory:     path.Join(tmpDir, "ca"),
+				CertificateDays: 30,
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		logstashBroker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("tls"))
+		Ω(err).ToNot(HaveOccurred())
+		starter = &RecordingProcessStarter{Failing: map[string]bool{}}
+		logstashBroker.ProcessStarter = starter
+		port := 6000
+		logstashBroker.FindFreePort = func() (int, error) {
+			port++
+			return port, nil
+		}
+		broker = logstashBroker
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("creates the authority of the broker on first use and keeps it", func() {
+		_, err := os.Stat(path.Join(tmpDir, "ca", "ca.crt"))
+		Ω(err).ToNot(HaveOccurred())
+		info, err := os.Stat(path.Join(tmpDir, "ca", "ca.key"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		before, err := ioutil.ReadFile(path.Join(tmpDir, "ca", "ca.crt"))
+		Ω(err).ToNot(HaveOccurred())
+		_, err = logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("tls"))
+		Ω(err).ToNot(HaveOccurred())
+		after, err := ioutil.ReadFile(path.Join(tmpDir, "ca", "ca.crt"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(after).To(Equal(before))
+	})
+
+	It("issues instances of TLS pipelines a certificate and listens for TLS on a second port", func() {
+		_, err := broker.Provision(ctx, "instance-1", map[string]string{})
+		Ω(err).ToNot(HaveOccurred())
+
+		instance := findInstance("instance-1")
+		Ω(instance.Port).To(Equal(6001))
+		Ω(instance.TLS).ToNot(BeNil())
+		Ω(instance.TLS.Port).To(Equal(6002))
+
+		key, err := os.Stat(instance.TLSKeyPath())
+		Ω(err).ToNot(HaveOccurred())
+		Ω(key.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		metadata, err := ioutil.ReadFile(instance.MetadataPath())
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(metadata)).ToNot(ContainSubstring("PRIVATE KEY"))
+		certificate, err := ioutil.ReadFile(instance.TLSCertificatePath())
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(certificate)).To(Equal(instance.TLS.Certificate))
+
+		conf := renderedConfig("instance-1")
+		Ω(conf).To(ContainSubstring(`port => "6002"`))
+		Ω(conf).To(ContainSubstring("ssl_enable => true"))
+		Ω(conf).To(ContainSubstring(`ssl_cert => "` + instance.TLSCertificatePath() + `"`))
+		Ω(conf).To(ContainSubstring(`ssl_key => "` + instance.TLSKeyPath() + `"`))
+	})
+
+	It("gives bindings a syslog-tls drain url and the certificate of the authority", func() {
+		_, err := broker.Provision(ctx, "instance-1", map[string]string{})
+		Ω(err).ToNot(HaveOccurred())
+
+		credentials, err := broker.Bind(ctx, "instance-1", "binding-1")
+		Ω(err).ToNot(HaveOccurred())
+		tls := credentials.(logstash.Credentials)
+		Ω(tls.Host).To(Equal("127.0.0.1"))
+		Ω(tls.Port).To(Equal(6001))
+		Ω(tls.SyslogDrainUrl).To(Equal("syslog-tls://127.0.0.1:6002"))
+		Ω(verify(findInstance("instance-1").TLS.Certificate, tls.CACertificate, "127.0.0.1")).To(Succeed())
+	})
+
+	It("leaves instances of other pipelines without TLS", func() {
+		_, err := broker.Provision(ctx, "instance-1", map[string]string{"pipeline": "json-lines"})
+		Ω(err).ToNot(HaveOccurred())
+
+		Ω(findInstance("instance-1").TLS).To(BeNil())
+		Ω(renderedConfig("instance-1")).ToNot(ContainSubstring("ssl_enable"))
+
+		credentials, err := broker.Bind(ctx, "instance-1", "binding-1")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(credentials).To(Equal(logstash.Credentials{Host: "127.0.0.1", Port: 6001}))
+	})
+
+	Context("when tls is not enabled", func() {
+		BeforeEach(func() {
+			config.TLS.Enabled = false
+		})
+
+		It("issues no certificates and creates no authority", func() {
+			_, err := broker.Provision(ctx, "instance-1", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(findInstance("instance-1").TLS).To(BeNil())
+			Ω(renderedConfig("instance-1")).ToNot(ContainSubstring("ssl_enable"))
+			_, err = os.Stat(path.Join(tmpDir, "ca"))
+			Ω(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("when tls is no longer enabled", func() {
+		JustBeforeEach(func() {
+			_, err := broker.Provision(ctx, "instance-1", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+
+			config.TLS.Enabled = false
+			logstashBroker, err := logstash.NewServiceBrokerFromConfig(config, lagertest.NewTestLogger("tls"))
+			Ω(err).ToNot(HaveOccurred())
+			logstashBroker.ProcessStarter = starter
+			broker = logstashBroker
+		})
+
+		It("still gives bindings of instances listening for TLS their drain url and the certificate of the authority", func() {
+			credentials, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+			tls := credentials.(logstash.Credentials)
+			Ω(tls.SyslogDrainUrl).To(Equal("syslog-tls://127.0.0.1:6002"))
+			Ω(verify(findInstance("instance-1").TLS.Certificate, tls.CACertificate, "127.0.0.1")).To(Succeed())
+		})
+
+		It("still rotates their certificates", func() {
+			before := findInstance("instance-1")
+			Ω(broker.(api.InstanceUpdater).Update(ctx, "instance-1", map[string]string{logstash.RotateCertificateParameter: "true"})).To(Succeed())
+			Ω(findInstance("instance-1").TLS.Certificate).ToNot(Equal(before.TLS.Certificate))
+		})
+
+		It("issues no certificates to new instances", func() {
+			_, err := broker.Provision(ctx, "instance-2", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(findInstance("instance-2").TLS).To(BeNil())
+		})
+	})
+
+	Describe("rotating certificates", func() {
+		var updater api.InstanceUpdater
+
+		JustBeforeEach(func() {
+			updater = broker.(api.InstanceUpdater)
+			_, err := broker.Provision(ctx, "instance-1", map[string]string{})
+			Ω(err).ToNot(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-2", map[string]string{"pipeline": "json-lines"})
+			Ω(err).ToNot(HaveOccurred())
+			starter.Started = nil
+		})
+
+		It("issues a new certificate on the same port and restarts the agent", func() {
+			before := findInstance("instance-1")
+			keyBefore := readKey(before)
+
+			Ω(updater.Update(ctx, "instance-1", map[string]string{logstash.RotateCertificateParameter: "true"})).To(Succeed())
+
+			after := findInstance("instance-1")
+			Ω(after.TLS.Port).To(Equal(before.TLS.Port))
+			Ω(after.TLS.Certificate).ToNot(Equal(before.TLS.Certificate))
+			Ω(readKey(after)).ToNot(Equal(keyBefore))
+			certificate, err := ioutil.ReadFile(after.TLSCertificatePath())
+			Ω(err).ToNot(HaveOccurred())
+			Ω(string(certificate)).To(Equal(after.TLS.Certificate))
+			Ω(starter.Started).To(Equal([]string{"instance-1"}))
+		})
+
+		It("goes back to the certificate and key it had when the agent does not come back", func() {
+			before := findInstance("instance-1")
+			keyBefore := readKey(before)
+			starter.Failing["instance-1"] = true
+
+			Ω(updater.Update(ctx, "instance-1", map[string]string{logstash.RotateCertificateParameter: "true"})).ToNot(Succeed())
+
+			after := findInstance("instance-1")
+			Ω(after.TLS.Certificate).To(Equal(before.TLS.Certificate))
+			certificate, err := ioutil.ReadFile(after.TLSCertificatePath())
+			Ω(err).ToNot(HaveOccurred())
+			Ω(string(certificate)).To(Equal(before.TLS.Certificate))
+			Ω(readKey(after)).To(Equal(keyBefore))
+		})
+
+		It("refuses values other than true", func() {
+			Ω(updater.Update(ctx, "instance-1", map[string]string{logstash.RotateCertificateParameter: "yes"})).To(Equal(&api.InvalidParameterError{
+				Name:   logstash.RotateCertificateParameter,
+				Reason: "must be true",
+			}))
+			Ω(starter.Started).To(BeEmpty())
+		})
+
+		It("refuses instances without a TLS input", func() {
+			Ω(updater.Update(ctx, "instance-2", map[string]string{logstash.RotateCertificateParameter: "true"})).To(Equal(&api.InvalidParameterError{
+				Name:   logstash.RotateCertificateParameter,
+				Reason: "the instance does not listen for TLS",
+			}))
+			Ω(starter.Started).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The plan of the built-in catalog, used when the config names no plans
+const PlanId = "d9f636a6-5df0-4e2f-a848-39d9f827177e"
+
+// The redis section of the broker config
+type Configuration struct {
+	// Offers a redis-server per instance as a service of its own
+	OfferService bool `yaml:"offer_service"`
+	// The address instances listen on and bindings are given; the logstash host by default
+	Host string `yaml:"host"`
+	// The redis-server executable
+	Command string `yaml:"command"`
+	// Holds a directory per instance with its metadata, redis.conf and persistence
+	DataDirectory string `yaml:"data_directory"`
+	LogDirectory  string `yaml:"log_directory"`
+	// The plans in the catalog; a single 64mb plan when empty
+	Plans []PlanConfiguration `yaml:"plans"`
+}
+
+type PlanConfiguration struct {
+	Id          string `yaml:"id"`
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// The maxmemory of the redis-server of each instance, e.g. 64mb
+	MaxMemory string `yaml:"maxmemory"`
+}
+
+var maxMemoryPattern = regexp.MustCompile(`^(?i)[1-9][0-9]*(b|k|kb|m|mb|g|gb)?$`)
+
+func (config *Configuration) SetDefaults() {
+	if config.Command == "" {
+		config.Command = "redis-server"
+	}
+	if len(config.Plans) == 0 {
+		config.Plans = []PlanConfiguration{{
+			Id:          PlanId,
+			Name:        "buffer-64mb",
+			Description: "A dedicated redis-server with 64mb of memory",
+			MaxMemory:   "64mb",
+		}}
+	}
+}
+
+func (config Configuration) Check() error {
+	seen := map[string]bool{}
+	for _, plan := range config.Plans {
+		if plan.Id == "" || plan.Name == "" {
+			return fmt.Errorf("redis plans need an id and a name")
+		}
+		if seen[plan.Id] {
+			return fmt.Errorf("redis plan id '%s' is used twice", plan.Id)
+		}
+		seen[plan.Id] = true
+		if !maxMemoryPattern.MatchString(plan.MaxMemory) {
+			return fmt.Errorf("redis plan '%s' has maxmemory '%s', expected a size such as 64mb", plan.Name, plan.MaxMemory)
+		}
+	}
+	if config.OfferService && config.Host == "" {
+		return fmt.Errorf("redis offer_service needs a host")
+	}
+	return nil
+}
+
+// The plan with planId; the first plan when planId is empty
+func (config Configuration) plan(planId string) (PlanConfiguration, bool) {
+	if planId == "" && len(config.Plans) > 0 {
+		return config.Plans[0], true
+	}
+	for _, plan := range config.Plans {
+		if plan.Id == planId {
+			return plan, true
+		}
+	}
+	return PlanConfiguration{}, false
+}
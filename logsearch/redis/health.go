@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"net"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// How long a server has to accept a connection before it counts as failed
+const probeTimeout = time.Second
+
+// CheckHealth checks the directory the instances are kept in
+func (broker *ServiceBroker) CheckHealth() []api.HealthCheck {
+	return []api.HealthCheck{
+		healthCheck("redis-data-directory", system.CheckDirectoryWritable(broker.Config.DataDirectory)),
+	}
+}
+
+// CheckInstancesHealth connects to the server of every instance, timing how long it takes
+func (broker *ServiceBroker) CheckInstancesHealth() ([]api.InstanceHealth, error) {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+
+	health := []api.InstanceHealth{}
+	for _, instance := range instances {
+		port := probe(instance.Address())
+		health = append(health, api.InstanceHealth{
+			InstanceId: instance.Id,
+			Address:    instance.Address(),
+			Status:     port.Status,
+			Ports:      []api.PortHealth{port},
+		})
+	}
+	return health, nil
+}
+
+func probe(address string) api.PortHealth {
+	started := time.Now()
+	conn, err := net.DialTimeout("tcp", address, probeTimeout)
+	port := api.PortHealth{
+		Protocol:      "tcp",
+		Status:        api.HealthStatusOk,
+		LatencyMillis: float64(time.Since(started)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		port.Status = api.HealthStatusFailed
+		return port
+	}
+	conn.Close()
+	return port
+}
+
+func healthCheck(name string, err error) api.HealthCheck {
+	if err != nil {
+		return api.HealthCheck{Name: name, Status: api.HealthStatusFailed, Error: err.Error()}
+	}
+	return api.HealthCheck{Name: name, Status: api.HealthStatusOk}
+}
@@ -0,0 +1,208 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// An instance of the redis service: a redis-server of its own
+type Instance struct {
+	Id       string `json:"id"`
+	Basepath string `json:"-"`
+	LogDir   string `json:"-"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	// The requirepass of the server, shared by every binding
+	Password         string                   `json:"password"`
+	MaxMemory        string                   `json:"maxmemory"`
+	ServiceId        string                   `json:"service_id"`
+	PlanId           string                   `json:"plan_id"`
+	OrganizationGuid string                   `json:"organization_guid"`
+	SpaceGuid        string                   `json:"space_guid"`
+	CreatedBy        *api.OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt        time.Time                `json:"created_at"`
+	Bindings         []*Binding               `json:"bindings"`
+}
+
+type Binding struct {
+	Id        string                   `json:"id"`
+	CreatedBy *api.OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt time.Time                `json:"created_at"`
+}
+
+func (instance Instance) Address() string {
+	return fmt.Sprintf("%s:%d", instance.Host, instance.Port)
+}
+
+func (instance Instance) ConfigPath() string {
+	return path.Join(instance.Basepath, "redis.conf")
+}
+
+func (instance Instance) PidFilePath() string {
+	return path.Join(instance.Basepath, "redis.pid")
+}
+
+func (instance Instance) MetadataPath() string {
+	return path.Join(instance.Basepath, "instance.json")
+}
+
+// Where the server keeps its append-only file and snapshots
+func (instance Instance) PersistenceDir() string {
+	return path.Join(instance.Basepath, "data")
+}
+
+func (instance Instance) LogFilePath() string {
+	return path.Join(instance.LogDir, "redis.log")
+}
+
+// The redis.conf of the instance. Writes are refused rather than keys evicted when maxmemory is reached,
+// so a full buffer pushes back on shippers instead of losing events.
+func (instance Instance) Config() string {
+	return strings.Join([]string{
+		"daemonize no",
+		fmt.Sprintf("bind %s", instance.Host),
+		fmt.Sprintf("port %d", instance.Port),
+		fmt.Sprintf("requirepass %s", instance.Password),
+		fmt.Sprintf("maxmemory %s", instance.MaxMemory),
+		"maxmemory-policy noeviction",
+		fmt.Sprintf("dir %s", instance.PersistenceDir()),
+		"appendonly yes",
+		"appendfsync everysec",
+		fmt.Sprintf("logfile %s", instance.LogFilePath()),
+		"",
+	}, "\n")
+}
+
+func (instance Instance) binding(bindingId string) *Binding {
+	for _, binding := range instance.Bindings {
+		if binding.Id == bindingId {
+			return binding
+		}
+	}
+	return nil
+}
+
+func (instance *Instance) removeBinding(bindingId string) {
+	bindings := []*Binding{}
+	for _, binding := range instance.Bindings {
+		if binding.Id != bindingId {
+			bindings = append(bindings, binding)
+		}
+	}
+	instance.Bindings = bindings
+}
+
+type InstanceRepository interface {
+	Save(instance *Instance) error
+	FindById(instanceId string) (*Instance, error)
+	FindAll() ([]*Instance, error)
+	// Removes everything kept for the instance, its persistence and logs included
+	Delete(instanceId string) error
+}
+
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// Keeps each instance in a directory of its own holding instance.json, redis.conf and the persistence dir,
+// with its log in a directory of the same name under LogDirectory
+type FileSystemInstanceRepository struct {
+	DataDirectory string
+	LogDirectory  string
+
+	// Used for every file the repository writes; an AtomicFileWriter when nil
+	FileWriter system.FileWriter
+}
+
+// Save writes the metadata and redis.conf of the instance, creating its directories. Both hold the password,
+// so only the broker may read them.
+func (repository *FileSystemInstanceRepository) Save(instance *Instance) error {
+	repository.locate(instance)
+	for _, dir := range []string{instance.PersistenceDir(), instance.LogDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	if err := repository.fileWriter().WriteFile(instance.MetadataPath(), data, 0600); err != nil {
+		return err
+	}
+	return repository.fileWriter().WriteFile(instance.ConfigPath(), []byte(instance.Config()), 0600)
+}
+
+func (repository *FileSystemInstanceRepository) FindById(instanceId string) (*Instance, error) {
+	instance := &Instance{Id: instanceId}
+	repository.locate(instance)
+
+	data, err := ioutil.ReadFile(instance.MetadataPath())
+	if os.IsNotExist(err) {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (repository *FileSystemInstanceRepository) FindAll() ([]*Instance, error) {
+	instances := []*Instance{}
+
+	dirs, err := ioutil.ReadDir(repository.DataDirectory)
+	if os.IsNotExist(err) {
+		return instances, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		instance, err := repository.FindById(dir.Name())
+		if err == ErrInstanceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (repository *FileSystemInstanceRepository) Delete(instanceId string) error {
+	instance := &Instance{Id: instanceId}
+	repository.locate(instance)
+
+	if err := os.RemoveAll(instance.Basepath); err != nil {
+		return err
+	}
+	return os.RemoveAll(instance.LogDir)
+}
+
+func (repository *FileSystemInstanceRepository) locate(instance *Instance) {
+	instance.Basepath = path.Join(repository.DataDirectory, instance.Id)
+	instance.LogDir = path.Join(repository.LogDirectory, instance.Id)
+}
+
+func (repository *FileSystemInstanceRepository) fileWriter() system.FileWriter {
+	if repository.FileWriter == nil {
+		return system.AtomicFileWriter{}
+	}
+	return repository.FileWriter
+}
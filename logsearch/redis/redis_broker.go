@@ -1,9 +1,261 @@
 package redis
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
 	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
+)
+
+const ServiceId = "ad65b09f-f974-4525-9896-0e9421ce029b"
+
+const (
+	serverStartTimeout = 30 * time.Second
+	serverStopTimeout  = 10 * time.Second
 )
 
+// ServiceBroker buffers logs in a redis-server per instance, listening on a port of its own with a
+// generated password and the maxmemory of its plan.
 type ServiceBroker struct {
-	api.ServiceBroker
+	Config             Configuration
+	ProcessStarter     ProcessStarter
+	InstanceRepository InstanceRepository
+	FindFreePort       func() (int, error)
+	Logger             lager.Logger
+}
+
+func NewServiceBroker(config Configuration, logger lager.Logger) *ServiceBroker {
+	config.SetDefaults()
+	return &ServiceBroker{
+		Config:         config,
+		ProcessStarter: NewProcessStarter(system.OSCommandRunner{}, config.Command),
+		InstanceRepository: &FileSystemInstanceRepository{
+			DataDirectory: config.DataDirectory,
+			LogDirectory:  config.LogDirectory,
+		},
+		FindFreePort: system.FindFreePort,
+		Logger:       logger,
+	}
+}
+
+// The credentials of a binding
+type Credentials struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"password"`
+	// redis://:<password>@<host>:<port>
+	Uri string `json:"uri"`
+}
+
+func (broker *ServiceBroker) GetCatalog() []api.Service {
+	plans := []api.Plan{}
+	for _, plan := range broker.Config.Plans {
+		description := plan.Description
+		if description == "" {
+			description = fmt.Sprintf("A dedicated redis-server with %s of memory", plan.MaxMemory)
+		}
+		plans = append(plans, api.Plan{
+			Id:          plan.Id,
+			Name:        plan.Name,
+			Description: description,
+			Metadata: api.PlanMetadata{
+				Bullets:     []string{fmt.Sprintf("maxmemory %s", plan.MaxMemory)},
+				DisplayName: plan.Name,
+			},
+		})
+	}
+
+	return []api.Service{
+		api.Service{
+			Id:          ServiceId,
+			Name:        "logsearch-redis",
+			Description: "A redis-server buffering logs on their way to Logsearch",
+			Bindable:    true,
+			Plans:       plans,
+			Metadata: api.ServiceMetadata{
+				DisplayName:      "Logsearch Redis",
+				LongDescription:  "A dedicated redis-server to queue log events between shippers and indexers",
+				DocumentationUrl: "http://documentation.com",
+				SupportUrl:       "http://support.com",
+				Listing: api.ServiceMetadataListing{
+					Blurb:    "Logsearch Redis ...",
+					ImageUrl: "http://image.com/image.png",
+				},
+				Provider: api.ServiceMetadataProvider{
+					Name: "Logsearch.io",
+				},
+			},
+			Tags: []string{
+				"redis",
+				"logsearch",
+			},
+		},
+	}
+}
+
+// Whether the broker offers serviceId
+func (broker *ServiceBroker) Offers(serviceId string) bool {
+	return serviceId == ServiceId
+}
+
+// Whether the broker provisioned instanceId
+func (broker *ServiceBroker) Owns(instanceId string) bool {
+	_, err := broker.InstanceRepository.FindById(instanceId)
+	return err == nil
+}
+
+// Provision writes the redis.conf of the instance and starts its server. An instance whose server does not
+// come up is removed again.
+func (broker *ServiceBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("creating-redis-instance")
+
+	if _, err := broker.InstanceRepository.FindById(instanceId); err == nil {
+		return "", api.ServiceInstanceAlreadyExistsError
+	}
+
+	plan, ok := broker.Config.plan(params["plan_id"])
+	if !ok {
+		return "", &api.InvalidParameterError{Name: "plan_id", Reason: "is not a plan of this service"}
+	}
+
+	port, err := broker.FindFreePort()
+	if err != nil {
+		return "", err
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+
+	instance := &Instance{
+		Id:               instanceId,
+		Host:             broker.Config.Host,
+		Port:             port,
+		Password:         password,
+		MaxMemory:        plan.MaxMemory,
+		ServiceId:        params["service_id"],
+		PlanId:           plan.Id,
+		OrganizationGuid: params["organization_guid"],
+		SpaceGuid:        params["space_guid"],
+		CreatedBy:        api.OriginatingIdentityFromContext(ctx),
+		CreatedAt:        time.Now().UTC(),
+		Bindings:         []*Binding{},
+	}
+	if err := broker.InstanceRepository.Save(instance); err != nil {
+		broker.remove(logger, instance)
+		return "", err
+	}
+
+	if err := broker.ProcessStarter.Start(logger, instance, serverStartTimeout); err != nil {
+		broker.remove(logger, instance)
+		return "", err
+	}
+	logger.Info("created-redis-instance", lager.Data{"address": instance.Address(), "maxmemory": instance.MaxMemory})
+
+	return "", nil
+}
+
+func (broker *ServiceBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("binding-redis-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return nil, api.ServiceInstanceDoesNotExistsError
+	}
+	if instance.binding(bindingId) != nil {
+		return nil, api.ServiceInstanceBindingAlreadyExistsError
+	}
+
+	instance.Bindings = append(instance.Bindings, &Binding{
+		Id:        bindingId,
+		CreatedBy: api.OriginatingIdentityFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err := broker.InstanceRepository.Save(instance); err != nil {
+		return nil, err
+	}
+
+	return Credentials{
+		Host:     instance.Host,
+		Port:     instance.Port,
+		Password: instance.Password,
+		Uri:      fmt.Sprintf("redis://:%s@%s", instance.Password, instance.Address()),
+	}, nil
+}
+
+func (broker *ServiceBroker) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("unbinding-redis-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+	if instance.binding(bindingId) == nil {
+		return api.ServiceInstanceBindingDoesNotExistsError
+	}
+
+	instance.removeBinding(bindingId)
+	return broker.InstanceRepository.Save(instance)
+}
+
+// Deprovision stops the server and removes the instance with everything it persisted
+func (broker *ServiceBroker) Deprovision(ctx context.Context, instanceId string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("deprovisioning-redis-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+
+	if err := broker.ProcessStarter.Stop(logger, instance, serverStopTimeout); err != nil {
+		return err
+	}
+	return broker.InstanceRepository.Delete(instanceId)
+}
+
+// StartStoppedInstances starts the server of every instance that is not running, as after the host restarted.
+// An instance whose server does not come up is logged and left for the next start of the broker.
+func (broker *ServiceBroker) StartStoppedInstances(logger lager.Logger) error {
+	instances, err := broker.InstanceRepository.FindAll()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if broker.ProcessStarter.Status(instance).State == api.ProcessRunning {
+			continue
+		}
+		logger.Info("starting-stopped-redis-server", lager.Data{"instance-id": instance.Id})
+		if err := broker.ProcessStarter.Start(logger, instance, serverStartTimeout); err != nil {
+			logger.Error("starting-stopped-redis-server-failed", err, lager.Data{"instance-id": instance.Id})
+		}
+	}
+	return nil
+}
+
+// Stops the server of a half provisioned instance and deletes what was written for it
+func (broker *ServiceBroker) remove(logger lager.Logger, instance *Instance) {
+	if err := broker.ProcessStarter.Stop(logger, instance, serverStopTimeout); err != nil {
+		logger.Error("stopping-redis-server", err)
+	}
+	if err := broker.InstanceRepository.Delete(instance.Id); err != nil {
+		logger.Error("removing-redis-instance", err)
+	}
+}
+
+func generatePassword() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
 }
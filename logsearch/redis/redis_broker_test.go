@@ -0,0 +1,304 @@
+package redis_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Pretends to run servers, remembering which are running
+type fakeProcessStarter struct {
+	Running map[string]bool
+	Failing bool
+}
+
+func (starter *fakeProcessStarter) Start(logger lager.Logger, instance *redis.Instance, timeout time.Duration) error {
+	if starter.Failing {
+		return os.ErrPermission
+	}
+	starter.Running[instance.Id] = true
+	return nil
+}
+
+func (starter *fakeProcessStarter) Stop(logger lager.Logger, instance *redis.Instance, timeout time.Duration) error {
+	delete(starter.Running, instance.Id)
+	return nil
+}
+
+func (starter *fakeProcessStarter) Status(instance *redis.Instance) api.ProcessDetails {
+	if starter.Running[instance.Id] {
+		return api.ProcessDetails{State: api.ProcessRunning}
+	}
+	return api.ProcessDetails{State: api.ProcessStopped}
+}
+
+var _ = Describe("ServiceBroker", func() {
+	var (
+		tmpDir  string
+		config  redis.Configuration
+		broker  *redis.ServiceBroker
+		starter *fakeProcessStarter
+		ctx     context.Context
+		params  map[string]string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "redis-broker")
+		Ω(err).ToNot(HaveOccurred())
+
+		config = redis.Configuration{
+			OfferService:  true,
+			Host:          "127.0.0.1",
+			DataDirectory: path.Join(tmpDir, "data"),
+			LogDirectory:  path.Join(tmpDir, "logs"),
+			Plans: []redis.PlanConfiguration{
+				{Id: "plan-small", Name: "small", MaxMemory: "32mb"},
+				{Id: "plan-large", Name: "large", MaxMemory: "1gb"},
+			},
+		}
+		ctx = context.Background()
+		params = map[string]string{"service_id": redis.ServiceId, "plan_id": "plan-large"}
+	})
+
+	JustBeforeEach(func() {
+		broker = redis.NewServiceBroker(config, lagertest.NewTestLogger("redis-broker"))
+		starter = &fakeProcessStarter{Running: map[string]bool{}}
+		broker.ProcessStarter = starter
+		broker.FindFreePort = func() (int, error) { return 6380, nil }
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("offers a plan per configured maxmemory", func() {
+		catalog := broker.GetCatalog()
+		Ω(catalog).To(HaveLen(1))
+		Ω(catalog[0].Id).To(Equal(redis.ServiceId))
+		Ω(catalog[0].Plans).To(HaveLen(2))
+		Ω(catalog[0].Plans[1].Id).To(Equal("plan-large"))
+		Ω(catalog[0].Plans[1].Description).To(Equal("A dedicated redis-server with 1gb of memory"))
+		Ω(broker.Offers(redis.ServiceId)).To(BeTrue())
+		Ω(broker.Offers("logstash-service-id")).To(BeFalse())
+		Ω(catalog[0].DashboardClient).To(BeNil())
+	})
+
+	Describe("provisioning", func() {
+		It("starts a server with a password, the maxmemory of the plan and persistence in the instance dir", func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(starter.Running).To(HaveKey("instance-1"))
+			Ω(broker.Owns("instance-1")).To(BeTrue())
+
+			instance, err := broker.InstanceRepository.FindById("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(instance.Password).To(HaveLen(48))
+			Ω(instance.MaxMemory).To(Equal("1gb"))
+
+			conf, err := ioutil.ReadFile(path.Join(tmpDir, "data", "instance-1", "redis.conf"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(string(conf)).To(ContainSubstring("bind 127.0.0.1\nport 6380\nrequirepass " + instance.Password + "\nmaxmemory 1gb\nmaxmemory-policy noeviction\n"))
+			Ω(string(conf)).To(ContainSubstring("dir " + path.Join(tmpDir, "data", "instance-1", "data") + "\nappendonly yes\n"))
+			Ω(string(conf)).To(ContainSubstring("logfile " + path.Join(tmpDir, "logs", "instance-1", "redis.log")))
+
+			info, err := os.Stat(path.Join(tmpDir, "data", "instance-1", "redis.conf"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			info, err = os.Stat(path.Join(tmpDir, "data", "instance-1", "data"))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(info.IsDir()).To(BeTrue())
+		})
+
+		It("generates a different password for every instance", func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-2", params)
+			Ω(err).ToNot(HaveOccurred())
+
+			first, err := broker.InstanceRepository.FindById("instance-1")
+			Ω(err).ToNot(HaveOccurred())
+			second, err := broker.InstanceRepository.FindById("instance-2")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(first.Password).ToNot(Equal(second.Password))
+		})
+
+		It("refuses an instance that already exists and plans it does not offer", func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-1", params)
+			Ω(err).To(Equal(api.ServiceInstanceAlreadyExistsError))
+
+			params["plan_id"] = "plan-huge"
+			_, err = broker.Provision(ctx, "instance-2", params)
+			Ω(err).To(Equal(&api.InvalidParameterError{Name: "plan_id", Reason: "is not a plan of this service"}))
+		})
+
+		It("removes the instance again when its server does not start", func() {
+			starter.Failing = true
+
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).To(Equal(os.ErrPermission))
+			Ω(broker.Owns("instance-1")).To(BeFalse())
+			_, err = os.Stat(path.Join(tmpDir, "data", "instance-1"))
+			Ω(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("binding", func() {
+		JustBeforeEach(func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the host, port and password of the server", func() {
+			credentials, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+			password := credentials.(redis.Credentials).Password
+			Ω(password).To(HaveLen(48))
+			Ω(credentials).To(Equal(redis.Credentials{
+				Host:     "127.0.0.1",
+				Port:     6380,
+				Password: password,
+				Uri:      "redis://:" + password + "@127.0.0.1:6380",
+			}))
+
+			_, err = broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).To(Equal(api.ServiceInstanceBindingAlreadyExistsError))
+		})
+
+		It("forgets the binding when unbinding", func() {
+			_, err := broker.Bind(ctx, "instance-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(broker.Unbind(ctx, "instance-1", "binding-1")).To(Succeed())
+			Ω(broker.Unbind(ctx, "instance-1", "binding-1")).To(Equal(api.ServiceInstanceBindingDoesNotExistsError))
+		})
+
+		It("does not bind instances that do not exist", func() {
+			_, err := broker.Bind(ctx, "instance-2", "binding-1")
+			Ω(err).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+
+	Describe("deprovisioning", func() {
+		JustBeforeEach(func() {
+			_, err := broker.Provision(ctx, "instance-1", params)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("stops the server and removes its data and logs", func() {
+			Ω(broker.Deprovision(ctx, "instance-1")).To(Succeed())
+
+			Ω(starter.Running).To(BeEmpty())
+			Ω(broker.Owns("instance-1")).To(BeFalse())
+			for _, dir := range []string{path.Join(tmpDir, "data", "instance-1"), path.Join(tmpDir, "logs", "instance-1")} {
+				_, err := os.Stat(dir)
+				Ω(os.IsNotExist(err)).To(BeTrue())
+			}
+		})
+
+		It("does not deprovision instances that do not exist", func() {
+			Ω(broker.Deprovision(ctx, "instance-2")).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+
+	Describe("starting stopped instances", func() {
+		JustBeforeEach(func() {
+			for _, instanceId := range []string{"instance-1", "instance-2"} {
+				_, err := broker.Provision(ctx, instanceId, params)
+				Ω(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("starts the servers that are not running", func() {
+			delete(starter.Running, "instance-2")
+
+			Ω(broker.StartStoppedInstances(lagertest.NewTestLogger("redis-broker"))).To(Succeed())
+			Ω(starter.Running).To(Equal(map[string]bool{"instance-1": true, "instance-2": true}))
+		})
+
+		It("goes on with the other instances when a server does not start", func() {
+			starter.Running = map[string]bool{}
+			starter.Failing = true
+
+			Ω(broker.StartStoppedInstances(lagertest.NewTestLogger("redis-broker"))).To(Succeed())
+			Ω(broker.Owns("instance-1")).To(BeTrue())
+			Ω(broker.Owns("instance-2")).To(BeTrue())
+		})
+	})
+
+	Describe("health", func() {
+		It("checks the data directory", func() {
+			Ω(broker.CheckHealth()).To(HaveLen(1))
+			Ω(broker.CheckHealth()[0].Status).To(Equal(api.HealthStatusFailed))
+
+			Ω(os.MkdirAll(config.DataDirectory, 0755)).To(Succeed())
+			Ω(broker.CheckHealth()).To(Equal([]api.HealthCheck{{Name: "redis-data-directory", Status: api.HealthStatusOk}}))
+		})
+
+		It("probes the port of every server", func() {
+			server, err := net.Listen("tcp", "127.0.0.1:0")
+			Ω(err).ToNot(HaveOccurred())
+			defer server.Close()
+			stopped, err := net.Listen("tcp", "127.0.0.1:0")
+			Ω(err).ToNot(HaveOccurred())
+			stopped.Close()
+
+			for instanceId, listener := range map[string]net.Listener{"instance-1": server, "instance-2": stopped} {
+				port := listener.Addr().(*net.TCPAddr).Port
+				broker.FindFreePort = func() (int, error) { return port, nil }
+				_, err := broker.Provision(ctx, instanceId, params)
+				Ω(err).ToNot(HaveOccurred())
+			}
+
+			health, err := broker.CheckInstancesHealth()
+			Ω(err).ToNot(HaveOccurred())
+			statuses := map[string]string{}
+			for _, instance := range health {
+				Ω(instance.Ports).To(HaveLen(1))
+				Ω(instance.Ports[0].Status).To(Equal(instance.Status))
+				statuses[instance.InstanceId] = instance.Status
+			}
+			Ω(statuses).To(Equal(map[string]string{"instance-1": api.HealthStatusOk, "instance-2": api.HealthStatusFailed}))
+		})
+	})
+
+	Describe("the configuration", func() {
+		It("offers a single 64mb plan by default", func() {
+			config := redis.Configuration{}
+			config.SetDefaults()
+			Ω(config.Command).To(Equal("redis-server"))
+			Ω(config.Plans).To(Equal([]redis.PlanConfiguration{{
+				Id:          redis.PlanId,
+				Name:        "buffer-64mb",
+				Description: "A dedicated redis-server with 64mb of memory",
+				MaxMemory:   "64mb",
+			}}))
+			Ω(config.Check()).To(Succeed())
+		})
+
+		It("checks the plans", func() {
+			config.Plans = append(config.Plans, redis.PlanConfiguration{Id: "plan-small", Name: "tiny", MaxMemory: "1mb"})
+			Ω(config.Check()).To(MatchError("redis plan id 'plan-small' is used twice"))
+
+			config.Plans = []redis.PlanConfiguration{{Id: "plan-1", Name: "small", MaxMemory: "lots"}}
+			Ω(config.Check()).To(MatchError("redis plan 'small' has maxmemory 'lots', expected a size such as 64mb"))
+
+			config.Plans = []redis.PlanConfiguration{{Id: "plan-1", Name: "small", MaxMemory: "64MB"}}
+			config.Host = ""
+			Ω(config.Check()).To(MatchError("redis offer_service needs a host"))
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
+)
+
+type ProcessStarter interface {
+	Start(logger lager.Logger, instance *Instance, timeout time.Duration) error
+	Stop(logger lager.Logger, instance *Instance, timeout time.Duration) error
+	Status(instance *Instance) api.ProcessDetails
+}
+
+// RedisServerStarter runs the redis-server of an instance with its redis.conf, keeping its pid next to it
+type RedisServerStarter struct {
+	CommandRunner    system.CommandRunner
+	Command          string
+	IsReady          func(address *net.TCPAddr) bool
+	IsProcessRunning func(pid int) bool
+	StopProcess      func(pid int, timeout time.Duration) error
+}
+
+func NewProcessStarter(commandRunner system.CommandRunner, command string) *RedisServerStarter {
+	return &RedisServerStarter{
+		CommandRunner:    commandRunner,
+		Command:          command,
+		IsReady:          isListening,
+		IsProcessRunning: system.IsProcessRunning,
+		StopProcess:      system.StopProcess,
+	}
+}
+
+// Start runs the server and waits until it accepts connections
+func (starter *RedisServerStarter) Start(logger lager.Logger, instance *Instance, timeout time.Duration) error {
+	pid, err := starter.CommandRunner.Run(logger, starter.Command, instance.ConfigPath())
+	if err != nil {
+		return fmt.Errorf("redis-server failed to start: %s", err)
+	}
+	if err := system.WritePidFile(instance.PidFilePath(), pid); err != nil {
+		return err
+	}
+
+	address, err := net.ResolveTCPAddr("tcp", instance.Address())
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for !starter.IsReady(address) {
+		if time.Now().After(deadline) {
+			return errors.New("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Stop terminates the server of an instance, if it is running, and removes its pid file. A process that took over
+// the pid of a server that exited is left alone.
+func (starter *RedisServerStarter) Stop(logger lager.Logger, instance *Instance, timeout time.Duration) error {
+	pid, err := system.ReadPidFile(instance.PidFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == system.ErrPidReused {
+		logger.Info("removing-stale-pid-file", lager.Data{"pid": pid})
+		return os.Remove(instance.PidFilePath())
+	}
+	if err != nil {
+		return err
+	}
+
+	if starter.IsProcessRunning(pid) {
+		logger.Info("stopping-redis-server", lager.Data{"pid": pid})
+		if err := starter.StopProcess(pid, timeout); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(instance.PidFilePath())
+}
+
+// Status reports whether the server recorded in the instance's pid file is still running.
+func (starter *RedisServerStarter) Status(instance *Instance) api.ProcessDetails {
+	pid, err := system.ReadPidFile(instance.PidFilePath())
+	if err == system.ErrPidReused {
+		return api.ProcessDetails{State: api.ProcessStopped, Pid: pid}
+	}
+	if err != nil {
+		return api.ProcessDetails{State: api.ProcessStopped}
+	}
+
+	if !starter.IsProcessRunning(pid) {
+		return api.ProcessDetails{State: api.ProcessStopped, Pid: pid}
+	}
+	return api.ProcessDetails{State: api.ProcessRunning, Pid: pid}
+}
+
+func isListening(address *net.TCPAddr) bool {
+	conn, err := net.DialTCP("tcp", nil, address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,108 @@
+package redis_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeCommandRunner struct {
+	Commands []string
+}
+
+func (runner *fakeCommandRunner) Run(_ lager.Logger, name string, args ...string) (int, error) {
+	runner.Commands = append(runner.Commands, name+" "+strings.Join(args, " "))
+	return 4242, nil
+}
+
+var _ = Describe("RedisServerStarter", func() {
+	var (
+		tmpDir      string
+		logger      *lagertest.TestLogger
+		runner      *fakeCommandRunner
+		ready       bool
+		runningPids map[int]bool
+		stoppedPids []int
+		instance    *redis.Instance
+		starter     *redis.RedisServerStarter
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "redis-starter")
+		Ω(err).ToNot(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("redis-starter")
+		runner = &fakeCommandRunner{}
+		ready = true
+		runningPids = map[int]bool{}
+		stoppedPids = []int{}
+		instance = &redis.Instance{Id: "instance-1", Host: "127.0.0.1", Port: 6380, Basepath: tmpDir}
+
+		starter = &redis.RedisServerStarter{
+			CommandRunner:    runner,
+			Command:          "/opt/redis/bin/redis-server",
+			IsReady:          func(*net.TCPAddr) bool { return ready },
+			IsProcessRunning: func(pid int) bool { return runningPids[pid] },
+			StopProcess: func(pid int, timeout time.Duration) error {
+				stoppedPids = append(stoppedPids, pid)
+				delete(runningPids, pid)
+				return nil
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("runs the command with the config of the instance and records its pid", func() {
+		Ω(starter.Start(logger, instance, time.Second)).To(Succeed())
+		Ω(runner.Commands).To(Equal([]string{"/opt/redis/bin/redis-server " + path.Join(tmpDir, "redis.conf")}))
+		Ω(system.ReadPidFile(path.Join(tmpDir, "redis.pid"))).To(Equal(4242))
+	})
+
+	It("times out when the server never listens", func() {
+		ready = false
+		Ω(starter.Start(logger, instance, 50*time.Millisecond)).To(MatchError("timeout"))
+	})
+
+	It("stops the recorded server and removes its pid file", func() {
+		Ω(starter.Start(logger, instance, time.Second)).To(Succeed())
+		runningPids[4242] = true
+		Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessRunning, Pid: 4242}))
+
+		Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+		Ω(stoppedPids).To(Equal([]int{4242}))
+		Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessStopped}))
+		Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+	})
+
+	It("leaves alone a process that took over the pid of the server", func() {
+		// the test process stands in for the process that got the pid of the exited server
+		pid := os.Getpid()
+		started, err := system.ProcessStartTime(pid)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ioutil.WriteFile(instance.PidFilePath(), []byte(fmt.Sprintf("%d %d", pid, started-1)), 0644)).To(Succeed())
+		runningPids[pid] = true
+
+		Ω(starter.Status(instance)).To(Equal(api.ProcessDetails{State: api.ProcessStopped, Pid: pid}))
+		Ω(starter.Stop(logger, instance, time.Second)).To(Succeed())
+		Ω(stoppedPids).To(BeEmpty())
+		_, err = os.Stat(instance.PidFilePath())
+		Ω(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,46 @@
+package stack
+
+import (
+	"context"
+)
+
+// Roles of the logstash instances of a stack
+const (
+	// Listens for events and pushes them onto the buffer
+	RoleShipper = "shipper"
+	// Pops events off the buffer, filters them and writes them to Elasticsearch
+	RoleIndexer = "indexer"
+)
+
+// How a logstash instance provisioned as part of a stack is wired to the rest of it
+type Component struct {
+	// The instance id of the stack, which names the indices of its components
+	StackId string `json:"stack_id"`
+	Role    string `json:"role"`
+	Buffer  Buffer `json:"buffer"`
+}
+
+// The redis list between the shipper and the indexer of a stack
+type Buffer struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"password"`
+	Key      string `json:"key"`
+}
+
+type contextKey int
+
+const componentKey contextKey = iota
+
+// Returns a copy of the context telling the logstash broker that the instance it provisions is a component
+func WithComponent(ctx context.Context, component Component) context.Context {
+	return context.WithValue(ctx, componentKey, component)
+}
+
+// Returns the component carried by the context, or nil when the instance is provisioned on its own
+func ComponentFromContext(ctx context.Context) *Component {
+	if component, ok := ctx.Value(componentKey).(Component); ok {
+		return &component
+	}
+	return nil
+}
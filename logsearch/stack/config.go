@@ -0,0 +1,42 @@
+package stack
+
+import (
+	"fmt"
+)
+
+// The stack section of the broker config
+type Configuration struct {
+	// Offers a shipper, a redis buffer and an indexer per instance as a service of its own
+	OfferService bool `yaml:"offer_service"`
+	// Where the service keeps its instances
+	DataDirectory string `yaml:"data_directory"`
+	// The pipelines the shipper and the indexer are rendered from
+	ShipperPipeline string `yaml:"shipper_pipeline"`
+	IndexerPipeline string `yaml:"indexer_pipeline"`
+	// The redis plan of the buffer; the first redis plan when empty
+	BufferPlanId string `yaml:"buffer_plan_id"`
+}
+
+func (config *Configuration) SetDefaults() {
+	if config.ShipperPipeline == "" {
+		config.ShipperPipeline = "stack-shipper"
+	}
+	if config.IndexerPipeline == "" {
+		config.IndexerPipeline = "stack-indexer"
+	}
+}
+
+func (config Configuration) Check() error {
+	if config.OfferService && config.ShipperPipeline == config.IndexerPipeline {
+		return fmt.Errorf("stack shipper_pipeline and indexer_pipeline must differ")
+	}
+	return nil
+}
+
+// The pipeline of the component with role
+func (config Configuration) Pipeline(role string) string {
+	if role == RoleShipper {
+		return config.ShipperPipeline
+	}
+	return config.IndexerPipeline
+}
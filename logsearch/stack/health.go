@@ -0,0 +1,22 @@
+package stack
+
+import (
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// CheckHealth checks the directory the stacks are kept in
+func (broker *ServiceBroker) CheckHealth() []api.HealthCheck {
+	check := api.HealthCheck{Name: "stack-data-directory", Status: api.HealthStatusOk}
+	if err := system.CheckDirectoryWritable(broker.Config.DataDirectory); err != nil {
+		check.Status = api.HealthStatusFailed
+		check.Error = err.Error()
+	}
+	return []api.HealthCheck{check}
+}
+
+// CheckInstancesHealth reports no instances: the shipper, indexer and buffer of a stack are instances of the
+// logstash and redis brokers, which probe them
+func (broker *ServiceBroker) CheckInstancesHealth() ([]api.InstanceHealth, error) {
+	return []api.InstanceHealth{}, nil
+}
@@ -0,0 +1,117 @@
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+// An instance of the stack service, made of a redis buffer and a shipper and an indexer logstash instance
+type Instance struct {
+	Id string `json:"id"`
+	// The instance ids of the components
+	BufferId         string                   `json:"buffer_id"`
+	ShipperId        string                   `json:"shipper_id"`
+	IndexerId        string                   `json:"indexer_id"`
+	IndexPrefix      string                   `json:"index_prefix"`
+	ServiceId        string                   `json:"service_id"`
+	PlanId           string                   `json:"plan_id"`
+	OrganizationGuid string                   `json:"organization_guid"`
+	SpaceGuid        string                   `json:"space_guid"`
+	CreatedBy        *api.OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt        time.Time                `json:"created_at"`
+	Bindings         []*Binding               `json:"bindings"`
+}
+
+type Binding struct {
+	Id        string                   `json:"id"`
+	CreatedBy *api.OriginatingIdentity `json:"created_by,omitempty"`
+	CreatedAt time.Time                `json:"created_at"`
+}
+
+func (instance Instance) binding(bindingId string) *Binding {
+	for _, binding := range instance.Bindings {
+		if binding.Id == bindingId {
+			return binding
+		}
+	}
+	return nil
+}
+
+func (instance *Instance) removeBinding(bindingId string) {
+	bindings := []*Binding{}
+	for _, binding := range instance.Bindings {
+		if binding.Id != bindingId {
+			bindings = append(bindings, binding)
+		}
+	}
+	instance.Bindings = bindings
+}
+
+type InstanceRepository interface {
+	Save(instance *Instance) error
+	FindById(instanceId string) (*Instance, error)
+	Delete(instanceId string) error
+}
+
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// Keeps each instance, with its bindings, in <id>.json in a directory
+type FileSystemInstanceRepository struct {
+	Directory string
+
+	// Used for every file the repository writes; an AtomicFileWriter when nil
+	FileWriter system.FileWriter
+}
+
+func (repository *FileSystemInstanceRepository) Save(instance *Instance) error {
+	if err := os.MkdirAll(repository.Directory, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	return repository.fileWriter().WriteFile(repository.instancePath(instance.Id), data, 0644)
+}
+
+func (repository *FileSystemInstanceRepository) FindById(instanceId string) (*Instance, error) {
+	data, err := ioutil.ReadFile(repository.instancePath(instanceId))
+	if os.IsNotExist(err) {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &Instance{}
+	if err := json.Unmarshal(data, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (repository *FileSystemInstanceRepository) Delete(instanceId string) error {
+	err := os.Remove(repository.instancePath(instanceId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (repository *FileSystemInstanceRepository) instancePath(instanceId string) string {
+	return path.Join(repository.Directory, instanceId+".json")
+}
+
+func (repository *FileSystemInstanceRepository) fileWriter() system.FileWriter {
+	if repository.FileWriter == nil {
+		return system.AtomicFileWriter{}
+	}
+	return repository.FileWriter
+}
@@ -0,0 +1,370 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	ServiceId = "3f6b8f2e-2a4c-4f0e-9d0b-6c1e7a9b5d42"
+	PlanId    = "8a1d4c7e-5b3f-4e2a-a6c9-0f7d2e8b1c35"
+)
+
+// The redis list shippers push events onto and indexers pop them off
+const bufferKey = "logsearch"
+
+// Provisions the shipper and the indexer of a stack, and tells where the shipper listens
+type LogstashBroker interface {
+	api.ServiceBroker
+	GetInstance(instanceId string) (api.InstanceDetails, error)
+}
+
+// ServiceBroker provisions a logging pipeline per instance out of the other services: a shipper logstash
+// instance pushing the events it receives onto a redis list, and an indexer logstash instance popping them
+// off, filtering them and writing them to Elasticsearch.
+type ServiceBroker struct {
+	Config             Configuration
+	Elasticsearch      elasticsearch.Configuration
+	Logstash           LogstashBroker
+	Redis              api.ServiceBroker
+	InstanceRepository InstanceRepository
+	Logger             lager.Logger
+}
+
+func NewServiceBroker(config Configuration, elasticsearchConfig elasticsearch.Configuration, logstash LogstashBroker, redis api.ServiceBroker, logger lager.Logger) *ServiceBroker {
+	config.SetDefaults()
+	elasticsearchConfig.SetDefaults()
+	return &ServiceBroker{
+		Config:             config,
+		Elasticsearch:      elasticsearchConfig,
+		Logstash:           logstash,
+		Redis:              redis,
+		InstanceRepository: &FileSystemInstanceRepository{Directory: config.DataDirectory},
+		Logger:             logger,
+	}
+}
+
+// The credentials of a binding
+type Credentials struct {
+	// Where the shipper takes syslog over tcp and udp
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	SyslogDrainUrl string `json:"syslog_drain_url"`
+	Search         Search `json:"search"`
+}
+
+// Where the events of the stack can be searched
+type Search struct {
+	Uri string `json:"uri"`
+	// Matches every index the indexer writes to
+	IndexPattern string `json:"index_pattern"`
+}
+
+func (broker *ServiceBroker) GetCatalog() []api.Service {
+	return []api.Service{
+		api.Service{
+			Id:          ServiceId,
+			Name:        "logsearch-stack",
+			Description: "A shipper, a redis buffer and an indexer of your own in front of Logsearch",
+			Bindable:    true,
+			Plans: []api.Plan{
+				api.Plan{
+					Id:          PlanId,
+					Name:        "dedicated",
+					Description: "Dedicated logstash and redis processes feeding the shared cluster",
+					Metadata: api.PlanMetadata{
+						Bullets:     []string{},
+						DisplayName: "Dedicated",
+					},
+				},
+			},
+			Metadata: api.ServiceMetadata{
+				DisplayName:      "Logsearch Stack",
+				LongDescription:  "A complete logging pipeline: syslog in, buffered in redis, indexed into Elasticsearch",
+				DocumentationUrl: "http://documentation.com",
+				SupportUrl:       "http://support.com",
+				Listing: api.ServiceMetadataListing{
+					Blurb:    "Logsearch Stack ...",
+					ImageUrl: "http://image.com/image.png",
+				},
+				Provider: api.ServiceMetadataProvider{
+					Name: "Logsearch.io",
+				},
+			},
+			Tags: []string{
+				"logging",
+				"logsearch",
+			},
+		},
+	}
+}
+
+// Whether the broker offers serviceId
+func (broker *ServiceBroker) Offers(serviceId string) bool {
+	return serviceId == ServiceId
+}
+
+// Whether the broker provisioned instanceId
+func (broker *ServiceBroker) Owns(instanceId string) bool {
+	_, err := broker.InstanceRepository.FindById(instanceId)
+	return err == nil
+}
+
+// Provision creates the buffer, then the indexer reading it and last the shipper writing to it. When a step
+// fails the components already created are removed again, newest first.
+func (broker *ServiceBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("creating-stack-instance")
+
+	if _, err := broker.InstanceRepository.FindById(instanceId); err == nil {
+		return "", api.ServiceInstanceAlreadyExistsError
+	}
+
+	instance := &Instance{
+		Id:        instanceId,
+		BufferId:  instanceId + "-buffer",
+		ShipperId: instanceId + "-shipper",
+		IndexerId: instanceId + "-indexer",
+		IndexPrefix: broker.Elasticsearch.InstanceIndexPrefix(
+			instanceId,
+			params["organization_name"], params["organization_guid"],
+			params["space_name"], params["space_guid"],
+		),
+		ServiceId:        params["service_id"],
+		PlanId:           params["plan_id"],
+		OrganizationGuid: params["organization_guid"],
+		SpaceGuid:        params["space_guid"],
+		CreatedBy:        api.OriginatingIdentityFromContext(ctx),
+		CreatedAt:        time.Now().UTC(),
+		Bindings:         []*Binding{},
+	}
+
+	var undo []func() error
+	rollback := func(err error) (string, error) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil && undoErr != api.ServiceInstanceDoesNotExistsError {
+				logger.Error("rolling-back-stack", undoErr)
+			}
+		}
+		return "", err
+	}
+
+	bufferParams := componentParams(params)
+	bufferParams["service_id"] = redis.ServiceId
+	bufferParams["plan_id"] = broker.Config.BufferPlanId
+	if _, err := broker.Redis.Provision(ctx, instance.BufferId, bufferParams); err != nil {
+		return rollback(err)
+	}
+	undo = append(undo, func() error { return broker.Redis.Deprovision(ctx, instance.BufferId) })
+
+	credentials, err := broker.Redis.Bind(ctx, instance.BufferId, broker.bufferBindingId(instance))
+	if err != nil {
+		return rollback(err)
+	}
+	undo = append(undo, func() error { return broker.Redis.Unbind(ctx, instance.BufferId, broker.bufferBindingId(instance)) })
+	bufferCredentials, ok := credentials.(redis.Credentials)
+	if !ok {
+		return rollback(fmt.Errorf("unexpected credentials of the buffer: %T", credentials))
+	}
+	buffer := Buffer{Host: bufferCredentials.Host, Port: bufferCredentials.Port, Password: bufferCredentials.Password, Key: bufferKey}
+
+	indexerParams := componentParams(params)
+	for _, name := range []string{"filters", elasticsearch.RetentionParameter} {
+		if value, ok := params[name]; ok {
+			indexerParams[name] = value
+		}
+	}
+	// a component whose agent does not start is kept by the logstash broker, so it is undone as well
+	undo = append(undo, func() error { return broker.Logstash.Deprovision(ctx, instance.IndexerId) })
+	if err := broker.provisionComponent(ctx, instance, RoleIndexer, buffer, indexerParams); err != nil {
+		return rollback(err)
+	}
+
+	undo = append(undo, func() error { return broker.Logstash.Deprovision(ctx, instance.ShipperId) })
+	if err := broker.provisionComponent(ctx, instance, RoleShipper, buffer, componentParams(params)); err != nil {
+		return rollback(err)
+	}
+
+	if err := broker.InstanceRepository.Save(instance); err != nil {
+		return rollback(err)
+	}
+	logger.Info("created-stack-instance", lager.Data{"shipper": instance.ShipperId, "indexer": instance.IndexerId, "buffer": instance.BufferId})
+
+	return "", nil
+}
+
+func (broker *ServiceBroker) provisionComponent(ctx context.Context, instance *Instance, role string, buffer Buffer, params map[string]string) error {
+	params["pipeline"] = broker.Config.Pipeline(role)
+	componentCtx := WithComponent(ctx, Component{StackId: instance.Id, Role: role, Buffer: buffer})
+
+	componentId := instance.ShipperId
+	if role == RoleIndexer {
+		componentId = instance.IndexerId
+	}
+	_, err := broker.Logstash.Provision(componentCtx, componentId, params)
+	return err
+}
+
+// The org and space of a stack, which its components share
+func componentParams(params map[string]string) map[string]string {
+	shared := map[string]string{}
+	for _, name := range []string{"organization_guid", "organization_name", "space_guid", "space_name"} {
+		if value, ok := params[name]; ok {
+			shared[name] = value
+		}
+	}
+	return shared
+}
+
+// The binding through which the stack holds the password of its buffer
+func (broker *ServiceBroker) bufferBindingId(instance *Instance) string {
+	return instance.Id + "-stack"
+}
+
+// Update passes new filters and retention_days on to the indexer; nothing else about a stack can be changed.
+func (broker *ServiceBroker) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("updating-stack-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	indexerParams := map[string]string{}
+	for _, name := range names {
+		switch name {
+		case "service_id":
+		case "plan_id":
+			if params[name] != instance.PlanId {
+				return &api.InvalidParameterError{Name: name, Reason: "the plan of an instance cannot be changed"}
+			}
+		case "filters", elasticsearch.RetentionParameter:
+			indexerParams[name] = params[name]
+		default:
+			return &api.InvalidParameterError{Name: name, Reason: "cannot be updated"}
+		}
+	}
+	if len(indexerParams) == 0 {
+		return nil
+	}
+
+	updater, ok := broker.Logstash.(api.InstanceUpdater)
+	if !ok {
+		return &api.InvalidParameterError{Name: names[0], Reason: "cannot be updated"}
+	}
+	return updater.Update(ctx, instance.IndexerId, indexerParams)
+}
+
+// Bind records the binding with the shipper and returns where it listens and where its events can be searched
+func (broker *ServiceBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("binding-stack-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return nil, api.ServiceInstanceDoesNotExistsError
+	}
+	if instance.binding(bindingId) != nil {
+		return nil, api.ServiceInstanceBindingAlreadyExistsError
+	}
+
+	shipper, err := broker.Logstash.GetInstance(instance.ShipperId)
+	if err != nil {
+		return nil, err
+	}
+	host, portText, err := net.SplitHostPort(shipper.Address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := broker.Logstash.Bind(ctx, instance.ShipperId, bindingId); err != nil {
+		return nil, err
+	}
+	instance.Bindings = append(instance.Bindings, &Binding{
+		Id:        bindingId,
+		CreatedBy: api.OriginatingIdentityFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err := broker.InstanceRepository.Save(instance); err != nil {
+		if unbindErr := broker.Logstash.Unbind(ctx, instance.ShipperId, bindingId); unbindErr != nil {
+			logger.Error("unbinding-shipper", unbindErr)
+		}
+		return nil, err
+	}
+
+	return Credentials{
+		Host:           host,
+		Port:           port,
+		SyslogDrainUrl: fmt.Sprintf("syslog://%s", shipper.Address),
+		Search: Search{
+			Uri:          broker.Elasticsearch.ApplicationUrl(),
+			IndexPattern: instance.IndexPrefix + "-*",
+		},
+	}, nil
+}
+
+func (broker *ServiceBroker) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("unbinding-stack-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+	if instance.binding(bindingId) == nil {
+		return api.ServiceInstanceBindingDoesNotExistsError
+	}
+
+	err = broker.Logstash.Unbind(ctx, instance.ShipperId, bindingId)
+	if err != nil && err != api.ServiceInstanceBindingDoesNotExistsError && err != api.ServiceInstanceDoesNotExistsError {
+		return err
+	}
+	instance.removeBinding(bindingId)
+	return broker.InstanceRepository.Save(instance)
+}
+
+// Deprovision removes the shipper, the indexer and the buffer, in that order, so nothing is left writing to a
+// removed component. Components already gone are skipped, so a failed deprovision can be retried.
+func (broker *ServiceBroker) Deprovision(ctx context.Context, instanceId string) error {
+	logger := api.LoggerFromContext(ctx, broker.Logger)
+	logger.Info("deprovisioning-stack-instance")
+
+	instance, err := broker.InstanceRepository.FindById(instanceId)
+	if err != nil {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+
+	steps := []func() error{
+		func() error { return broker.Logstash.Deprovision(ctx, instance.ShipperId) },
+		func() error { return broker.Logstash.Deprovision(ctx, instance.IndexerId) },
+		func() error { return broker.Redis.Unbind(ctx, instance.BufferId, broker.bufferBindingId(instance)) },
+		func() error { return broker.Redis.Deprovision(ctx, instance.BufferId) },
+	}
+	for _, step := range steps {
+		err := step()
+		if err != nil && err != api.ServiceInstanceDoesNotExistsError && err != api.ServiceInstanceBindingDoesNotExistsError {
+			return err
+		}
+	}
+
+	return broker.InstanceRepository.Delete(instanceId)
+}
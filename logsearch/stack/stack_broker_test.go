@@ -0,0 +1,275 @@
+package stack_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var errFailing = errors.New("failing")
+
+// Remembers the instances and bindings of a broker, failing to provision the ids in Failing
+type fakeBroker struct {
+	Instances map[string]map[string]string
+	Contexts  map[string]context.Context
+	Bindings  map[string]bool
+	Failing   map[string]bool
+	Updates   map[string]map[string]string
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		Instances: map[string]map[string]string{},
+		Contexts:  map[string]context.Context{},
+		Bindings:  map[string]bool{},
+		Failing:   map[string]bool{},
+		Updates:   map[string]map[string]string{},
+	}
+}
+
+func (broker *fakeBroker) GetCatalog() []api.Service { return []api.Service{} }
+
+func (broker *fakeBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	if broker.Failing[instanceId] {
+		return "", errFailing
+	}
+	broker.Instances[instanceId] = params
+	broker.Contexts[instanceId] = ctx
+	return "", nil
+}
+
+func (broker *fakeBroker) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	broker.Updates[instanceId] = params
+	return nil
+}
+
+func (broker *fakeBroker) Deprovision(ctx context.Context, instanceId string) error {
+	if _, ok := broker.Instances[instanceId]; !ok {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+	delete(broker.Instances, instanceId)
+	return nil
+}
+
+func (broker *fakeBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	if _, ok := broker.Instances[instanceId]; !ok {
+		return nil, api.ServiceInstanceDoesNotExistsError
+	}
+	broker.Bindings[instanceId+"/"+bindingId] = true
+	return redis.Credentials{Host: "10.0.0.2", Port: 6380, Password: "secret"}, nil
+}
+
+func (broker *fakeBroker) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	if !broker.Bindings[instanceId+"/"+bindingId] {
+		return api.ServiceInstanceBindingDoesNotExistsError
+	}
+	delete(broker.Bindings, instanceId+"/"+bindingId)
+	return nil
+}
+
+// Places every instance at 10.0.0.1:5001
+type fakeLogstashBroker struct {
+	*fakeBroker
+}
+
+func (broker fakeLogstashBroker) GetInstance(instanceId string) (api.InstanceDetails, error) {
+	if _, ok := broker.Instances[instanceId]; !ok {
+		return api.InstanceDetails{}, api.ServiceInstanceDoesNotExistsError
+	}
+	return api.InstanceDetails{Id: instanceId, Address: "10.0.0.1:5001"}, nil
+}
+
+var _ = Describe("ServiceBroker", func() {
+	var (
+		tmpDir   string
+		broker   *stack.ServiceBroker
+		logstash fakeLogstashBroker
+		buffers  *fakeBroker
+		ctx      context.Context
+		params   map[string]string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "stack-broker")
+		Ω(err).ToNot(HaveOccurred())
+
+		logstash = fakeLogstashBroker{newFakeBroker()}
+		buffers = newFakeBroker()
+		broker = stack.NewServiceBroker(
+			stack.Configuration{OfferService: true, DataDirectory: path.Join(tmpDir, "stacks"), BufferPlanId: "plan-buffer"},
+			elasticsearch.Configuration{Hosts: []string{"http://10.0.0.9:9200"}},
+			logstash,
+			buffers,
+			lagertest.NewTestLogger("stack-broker"),
+		)
+		ctx = context.Background()
+		params = map[string]string{
+			"service_id":        stack.ServiceId,
+			"plan_id":           stack.PlanId,
+			"organization_guid": "org-guid",
+			"space_guid":        "space-guid",
+			"filters":           `mutate { add_tag => ["stack"] }`,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("offers the stack service", func() {
+		catalog := broker.GetCatalog()
+		Ω(catalog).To(HaveLen(1))
+		Ω(catalog[0].Name).To(Equal("logsearch-stack"))
+		Ω(catalog[0].DashboardClient).To(BeNil())
+		Ω(broker.Offers(stack.ServiceId)).To(BeTrue())
+		Ω(broker.Offers(redis.ServiceId)).To(BeFalse())
+	})
+
+	It("checks the directory of the stacks", func() {
+		Ω(broker.CheckHealth()[0].Status).To(Equal(api.HealthStatusFailed))
+
+		Ω(os.MkdirAll(path.Join(tmpDir, "stacks"), 0755)).To(Succeed())
+		Ω(broker.CheckHealth()).To(Equal([]api.HealthCheck{{Name: "stack-data-directory", Status: api.HealthStatusOk}}))
+		Ω(broker.CheckInstancesHealth()).To(BeEmpty())
+	})
+
+	Describe("provisioning", func() {
+		It("provisions a buffer, an indexer reading it and a shipper writing it", func() {
+			_, err := broker.Provision(ctx, "stack-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(broker.Owns("stack-1")).To(BeTrue())
+			Ω(broker.Owns("stack-1-shipper")).To(BeFalse())
+
+			Ω(buffers.Instances["stack-1-buffer"]).To(Equal(map[string]string{
+				"service_id":        redis.ServiceId,
+				"plan_id":           "plan-buffer",
+				"organization_guid": "org-guid",
+				"space_guid":        "space-guid",
+			}))
+			Ω(buffers.Bindings).To(HaveKey("stack-1-buffer/stack-1-stack"))
+
+			Ω(logstash.Instances["stack-1-indexer"]).To(Equal(map[string]string{
+				"pipeline":          "stack-indexer",
+				"organization_guid": "org-guid",
+				"space_guid":        "space-guid",
+				"filters":           `mutate { add_tag => ["stack"] }`,
+			}))
+			Ω(logstash.Instances["stack-1-shipper"]).To(Equal(map[string]string{
+				"pipeline":          "stack-shipper",
+				"organization_guid": "org-guid",
+				"space_guid":        "space-guid",
+			}))
+
+			buffer := stack.Buffer{Host: "10.0.0.2", Port: 6380, Password: "secret", Key: "logsearch"}
+			Ω(stack.ComponentFromContext(logstash.Contexts["stack-1-indexer"])).To(Equal(&stack.Component{StackId: "stack-1", Role: stack.RoleIndexer, Buffer: buffer}))
+			Ω(stack.ComponentFromContext(logstash.Contexts["stack-1-shipper"])).To(Equal(&stack.Component{StackId: "stack-1", Role: stack.RoleShipper, Buffer: buffer}))
+		})
+
+		It("refuses a stack that already exists", func() {
+			_, err := broker.Provision(ctx, "stack-1", params)
+			Ω(err).ToNot(HaveOccurred())
+			_, err = broker.Provision(ctx, "stack-1", params)
+			Ω(err).To(Equal(api.ServiceInstanceAlreadyExistsError))
+		})
+
+		It("removes the components already provisioned when a step fails", func() {
+			for _, failing := range []string{"stack-1-indexer", "stack-1-shipper"} {
+				logstash.Failing = map[string]bool{failing: true}
+
+				_, err := broker.Provision(ctx, "stack-1", params)
+				Ω(err).To(Equal(errFailing))
+				Ω(logstash.Instances).To(BeEmpty())
+				Ω(buffers.Instances).To(BeEmpty())
+				Ω(buffers.Bindings).To(BeEmpty())
+				Ω(broker.Owns("stack-1")).To(BeFalse())
+			}
+
+			logstash.Failing = map[string]bool{}
+			buffers.Failing = map[string]bool{"stack-1-buffer": true}
+			_, err := broker.Provision(ctx, "stack-1", params)
+			Ω(err).To(Equal(errFailing))
+			Ω(logstash.Instances).To(BeEmpty())
+		})
+	})
+
+	Describe("binding", func() {
+		BeforeEach(func() {
+			_, err := broker.Provision(ctx, "stack-1", params)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the endpoints of the shipper and where to search", func() {
+			credentials, err := broker.Bind(ctx, "stack-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+			Ω(credentials).To(Equal(stack.Credentials{
+				Host:           "10.0.0.1",
+				Port:           5001,
+				SyslogDrainUrl: "syslog://10.0.0.1:5001",
+				Search: stack.Search{
+					Uri:          "http://10.0.0.9:9200",
+					IndexPattern: "logsearch-stack-1-*",
+				},
+			}))
+			Ω(logstash.Bindings).To(HaveKey("stack-1-shipper/binding-1"))
+
+			_, err = broker.Bind(ctx, "stack-1", "binding-1")
+			Ω(err).To(Equal(api.ServiceInstanceBindingAlreadyExistsError))
+		})
+
+		It("unbinds from the shipper", func() {
+			_, err := broker.Bind(ctx, "stack-1", "binding-1")
+			Ω(err).ToNot(HaveOccurred())
+
+			Ω(broker.Unbind(ctx, "stack-1", "binding-1")).To(Succeed())
+			Ω(logstash.Bindings).To(BeEmpty())
+			Ω(broker.Unbind(ctx, "stack-1", "binding-1")).To(Equal(api.ServiceInstanceBindingDoesNotExistsError))
+		})
+	})
+
+	Describe("updating", func() {
+		BeforeEach(func() {
+			_, err := broker.Provision(ctx, "stack-1", params)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("passes filters and retention on to the indexer", func() {
+			Ω(broker.Update(ctx, "stack-1", map[string]string{"service_id": stack.ServiceId, "filters": "", "retention_days": "7"})).To(Succeed())
+			Ω(logstash.Updates).To(Equal(map[string]map[string]string{
+				"stack-1-indexer": {"filters": "", "retention_days": "7"},
+			}))
+
+			err := broker.Update(ctx, "stack-1", map[string]string{"pipeline": "json-lines"})
+			Ω(err).To(Equal(&api.InvalidParameterError{Name: "pipeline", Reason: "cannot be updated"}))
+		})
+	})
+
+	Describe("deprovisioning", func() {
+		BeforeEach(func() {
+			_, err := broker.Provision(ctx, "stack-1", params)
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("removes every component, skipping those already gone", func() {
+			delete(logstash.Instances, "stack-1-shipper")
+
+			Ω(broker.Deprovision(ctx, "stack-1")).To(Succeed())
+			Ω(logstash.Instances).To(BeEmpty())
+			Ω(buffers.Instances).To(BeEmpty())
+			Ω(buffers.Bindings).To(BeEmpty())
+			Ω(broker.Owns("stack-1")).To(BeFalse())
+			Ω(broker.Deprovision(ctx, "stack-1")).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		})
+	})
+})
@@ -1,15 +1,114 @@
 package main
 
 import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/cloudfoundry-incubator/cf-lager"
+	"github.com/pivotal-golang/lager"
 
 	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/elasticsearch"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/ingress"
 	"github.com/malston/cf-logsearch-service-broker/logsearch/logstash"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/redis"
+	"github.com/malston/cf-logsearch-service-broker/logsearch/stack"
+	"github.com/malston/cf-logsearch-service-broker/registry"
 )
 
 func main() {
 	logger := cf_lager.New("logsearch-broker")
+	config := logstash.LoadConfig(logger).ServiceConfiguration
+
+	// the redis broker runs the buffers of the stack service too
+	var redisBroker *redis.ServiceBroker
+	if config.Redis.OfferService || config.Stack.OfferService {
+		redisBroker = redis.NewServiceBroker(config.Redis, logger)
+		// redis-servers, unlike logstash agents, do not come back by themselves after the host restarted
+		if err := redisBroker.StartStoppedInstances(logger.Session("redis")); err != nil {
+			logger.Error("starting-stopped-redis-instances", err)
+		}
+	}
+
+	var elasticsearchBroker *elasticsearch.ServiceBroker
+	if config.Elasticsearch.OfferService {
+		elasticsearchBroker = elasticsearch.NewServiceBroker(config.Elasticsearch, logger)
+	}
+
+	broker, err := logstash.NewServiceBrokerFromConfig(config, logger)
+	if err != nil {
+		logger.Fatal("Creating service broker", err)
+	}
+	if elasticsearchBroker != nil {
+		broker.RetentionSources = []elasticsearch.RetentionSource{elasticsearchBroker}
+	}
+	broker.ScheduleRetention()
+
+	// logstash first, so the admin API reaches it, then every other service the config offers
+	brokers := []api.ServiceBroker{broker}
+	if elasticsearchBroker != nil {
+		brokers = append(brokers, elasticsearchBroker)
+	}
+	if config.Redis.OfferService {
+		brokers = append(brokers, redisBroker)
+	}
+	// the stack service provisions its shippers and indexers through the logstash broker
+	if config.Stack.OfferService {
+		brokers = append(brokers, stack.NewServiceBroker(config.Stack, config.Elasticsearch, broker, redisBroker, logger))
+	}
+
+	services, err := registry.New(
+		&registry.FileOwnership{Path: config.ServiceInstancesFile},
+		logger,
+		brokers...,
+	)
+	if err != nil {
+		logger.Fatal("Creating service registry", err)
+	}
 
-	logstashBroker := api.New(logstash.NewServiceBroker(logger), logger)
+	var ingressServer *ingress.Server
+	if config.Ingress.Enabled {
+		ingressServer, err = startIngress(config.Ingress, broker, logger.Session("ingress"))
+		if err != nil {
+			logger.Fatal("Starting ingress", err)
+		}
+	}
+
+	// stops the ingress, the retention schedule and releases the repository; the instances keep running
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if ingressServer != nil {
+			if err := ingressServer.Close(); err != nil {
+				logger.Error("closing-ingress", err)
+			}
+		}
+		if err := broker.Close(); err != nil {
+			logger.Error("closing-broker", err)
+		}
+		os.Exit(0)
+	}()
+
+	logstashBroker := api.New(services, logger)
 	logstashBroker.Run()
 }
+
+// Listens on the ingress port and serves it in the background, routing by the bindings of the logstash broker
+func startIngress(config ingress.Configuration, router ingress.Router, logger lager.Logger) (*ingress.Server, error) {
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := ingress.NewServer(config, router, logger)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("serving", err)
+		}
+	}()
+	logger.Info("listening", lager.Data{"address": listener.Addr().String()})
+	return server, nil
+}
@@ -0,0 +1,317 @@
+// Package metrics implements counters, gauges and histograms that are exposed
+// in the Prometheus text format (version 0.0.4).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4"
+
+// Default latency buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type Metric interface {
+	Name() string
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mutex   sync.RWMutex
+	metrics map[string]Metric
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: map[string]Metric{},
+	}
+}
+
+// MustRegister adds metrics to the registry, panicking if a metric with the same name was already registered.
+func (registry *Registry) MustRegister(metrics ...Metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for _, metric := range metrics {
+		if _, exists := registry.metrics[metric.Name()]; exists {
+			panic(fmt.Sprintf("metric %s is already registered", metric.Name()))
+		}
+		registry.metrics[metric.Name()] = metric
+	}
+}
+
+// Write writes every registered metric, sorted by name, in the Prometheus text format.
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mutex.RLock()
+	names := []string{}
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := []Metric{}
+	for _, name := range names {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.mutex.RUnlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		metric.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+func MustRegister(metrics ...Metric) {
+	DefaultRegistry.MustRegister(metrics...)
+}
+
+// A set of series sharing a name, keyed by their label values
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+func newFamily(name, help, kind string, labelNames []string) *family {
+	return &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     map[string]*series{},
+	}
+}
+
+func (f *family) Name() string {
+	return f.name
+}
+
+// Must be called with the mutex held
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Must be called with the mutex held. Unlike get it does not create missing series.
+func (f *family) lookup(labelValues []string) *series {
+	s, ok := f.series[strings.Join(labelValues, "\xff")]
+	if !ok {
+		return &series{}
+	}
+	return s
+}
+
+// Must be called with the mutex held
+func (f *family) sorted() []*series {
+	keys := []string{}
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := []*series{}
+	for _, key := range keys {
+		sorted = append(sorted, f.series[key])
+	}
+	return sorted
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+func (f *family) writeSample(w *bufio.Writer, name string, labelValues []string, extraName, extraValue string, value float64) {
+	pairs := []string{}
+	for i, labelName := range f.labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, escapeLabelValue(labelValues[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	w.WriteString(name)
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+type Counter struct {
+	*family
+}
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{newFamily(name, help, "counter", labelNames)}
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", counter.name))
+	}
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.get(labelValues).value += delta
+}
+
+func (counter *Counter) Value(labelValues ...string) float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.lookup(labelValues).value
+}
+
+func (counter *Counter) write(w *bufio.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.writeHeader(w)
+	for _, s := range counter.sorted() {
+		counter.writeSample(w, counter.name, s.labelValues, "", "", s.value)
+	}
+}
+
+type Gauge struct {
+	*family
+}
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{newFamily(name, help, "gauge", labelNames)}
+}
+
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.get(labelValues).value = value
+}
+
+func (gauge *Gauge) Add(delta float64, labelValues ...string) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.get(labelValues).value += delta
+}
+
+func (gauge *Gauge) Value(labelValues ...string) float64 {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	return gauge.lookup(labelValues).value
+}
+
+func (gauge *Gauge) write(w *bufio.Writer) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+
+	gauge.writeHeader(w)
+	for _, s := range gauge.sorted() {
+		gauge.writeSample(w, gauge.name, s.labelValues, "", "", s.value)
+	}
+}
+
+type Histogram struct {
+	*family
+	upperBounds []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	upperBounds := append([]float64{}, buckets...)
+	sort.Float64s(upperBounds)
+	return &Histogram{
+		family:      newFamily(name, help, "histogram", labelNames),
+		upperBounds: upperBounds,
+	}
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	s := histogram.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(histogram.upperBounds))
+	}
+	for i, upperBound := range histogram.upperBounds {
+		if value <= upperBound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	return histogram.lookup(labelValues).count
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	histogram.writeHeader(w)
+	for _, s := range histogram.sorted() {
+		for i, upperBound := range histogram.upperBounds {
+			var count uint64
+			if s.buckets != nil {
+				count = s.buckets[i]
+			}
+			histogram.writeSample(w, histogram.name+"_bucket", s.labelValues, "le", formatFloat(upperBound), float64(count))
+		}
+		histogram.writeSample(w, histogram.name+"_bucket", s.labelValues, "le", "+Inf", float64(s.count))
+		histogram.writeSample(w, histogram.name+"_sum", s.labelValues, "", "", s.value)
+		histogram.writeSample(w, histogram.name+"_count", s.labelValues, "", "", float64(s.count))
+	}
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
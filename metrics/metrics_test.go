@@ -0,0 +1,86 @@
+package metrics_test
+
+import (
+	"bytes"
+
+	"github.com/malston/cf-logsearch-service-broker/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var registry *metrics.Registry
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+	})
+
+	exposition := func() string {
+		buffer := &bytes.Buffer{}
+		err := registry.Write(buffer)
+		Ω(err).ToNot(HaveOccurred())
+		return buffer.String()
+	}
+
+	Context("a counter with labels", func() {
+		It("writes one series per label value, sorted", func() {
+			counter := metrics.NewCounter("requests_total", "Requests served", "route")
+			registry.MustRegister(counter)
+			counter.Inc("/v2/catalog")
+			counter.Add(2, "/healthz")
+
+			Ω(exposition()).To(Equal(`# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{route="/healthz"} 2
+requests_total{route="/v2/catalog"} 1
+`))
+		})
+
+		It("escapes label values", func() {
+			counter := metrics.NewCounter("errors_total", "Errors", "error")
+			registry.MustRegister(counter)
+			counter.Inc(`a "quoted" \ value`)
+
+			Ω(exposition()).To(ContainSubstring(`errors_total{error="a \"quoted\" \\ value"} 1`))
+		})
+	})
+
+	Context("a gauge without labels", func() {
+		It("writes its current value", func() {
+			gauge := metrics.NewGauge("instances", "Provisioned instances")
+			registry.MustRegister(gauge)
+			gauge.Set(5)
+			gauge.Add(-1)
+
+			Ω(gauge.Value()).To(Equal(4.0))
+			Ω(exposition()).To(ContainSubstring("\ninstances 4\n"))
+		})
+	})
+
+	Context("a histogram", func() {
+		It("writes cumulative buckets, sum and count", func() {
+			histogram := metrics.NewHistogram("duration_seconds", "Durations", []float64{1, 0.5})
+			registry.MustRegister(histogram)
+			histogram.Observe(0.25)
+			histogram.Observe(0.75)
+			histogram.Observe(2)
+
+			Ω(exposition()).To(Equal(`# HELP duration_seconds Durations
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.5"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 3
+duration_seconds_count 3
+`))
+		})
+	})
+
+	It("refuses to register two metrics with the same name", func() {
+		registry.MustRegister(metrics.NewCounter("duplicate", "first"))
+		Ω(func() {
+			registry.MustRegister(metrics.NewGauge("duplicate", "second"))
+		}).To(Panic())
+	})
+})
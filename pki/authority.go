@@ -0,0 +1,185 @@
+// Package pki is the certificate authority of the broker, which issues the server certificates of instances.
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+const (
+	certificateFile = "ca.crt"
+	keyFile         = "ca.key"
+
+	authorityValidity = 10 * 365 * 24 * time.Hour
+	// logstash reads PKCS#1 RSA keys only
+	keyBits = 2048
+)
+
+// A certificate authority whose key never leaves the broker
+type Authority struct {
+	Certificate *x509.Certificate
+
+	certificatePEM []byte
+	key            *rsa.PrivateKey
+}
+
+// A certificate issued by an Authority, PEM encoded
+type Certificate struct {
+	Certificate string
+	Key         string
+	NotAfter    time.Time
+}
+
+// LoadOrCreate reads ca.crt and ca.key from directory, creating a new authority named commonName there when
+// neither exists yet.
+func LoadOrCreate(directory string, commonName string, writer system.FileWriter) (*Authority, error) {
+	certificatePEM, certErr := ioutil.ReadFile(path.Join(directory, certificateFile))
+	keyPEM, keyErr := ioutil.ReadFile(path.Join(directory, keyFile))
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return create(directory, commonName, writer)
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	return Parse(certificatePEM, keyPEM)
+}
+
+// Parse reads an authority from its PEM encoded certificate and PKCS#1 key
+func Parse(certificatePEM []byte, keyPEM []byte) (*Authority, error) {
+	certificateBlock, _ := pem.Decode(certificatePEM)
+	if certificateBlock == nil || certificateBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("ca certificate: no PEM encoded certificate")
+	}
+	certificate, err := x509.ParseCertificate(certificateBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ca certificate: %s", err)
+	}
+	if !certificate.IsCA {
+		return nil, errors.New("ca certificate: not a certificate authority")
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil || keyBlock.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("ca key: no PEM encoded RSA private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ca key: %s", err)
+	}
+	if key.PublicKey.N.Cmp(certificate.PublicKey.(*rsa.PublicKey).N) != 0 {
+		return nil, errors.New("ca key: does not match the certificate")
+	}
+
+	return &Authority{Certificate: certificate, certificatePEM: certificatePEM, key: key}, nil
+}
+
+func create(directory string, commonName string, writer system.FileWriter) (*Authority, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(authorityValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	// the key first, so a certificate on disk always has its key next to it
+	if err := writer.WriteFile(path.Join(directory, keyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := writer.WriteFile(path.Join(directory, certificateFile), certificatePEM, 0644); err != nil {
+		return nil, err
+	}
+
+	return Parse(certificatePEM, keyPEM)
+}
+
+// The PEM encoded certificate of the authority, which clients trust to verify the certificates it issues
+func (authority *Authority) CertificatePEM() string {
+	return string(authority.certificatePEM)
+}
+
+// Issue creates a key and a server certificate for commonName, valid for the hosts, which may be IP addresses
+func (authority *Authority) Issue(commonName string, hosts []string, validity time.Duration) (Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return Certificate{}, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	// a certificate outliving the authority would fail to verify before it expires
+	if template.NotAfter.After(authority.Certificate.NotAfter) {
+		template.NotAfter = authority.Certificate.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.Certificate, &key.PublicKey, authority.key)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	return Certificate{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:         string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		NotAfter:    template.NotAfter,
+	}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
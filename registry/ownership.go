@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/malston/cf-logsearch-service-broker/system"
+)
+
+var ErrNotRecorded = errors.New("instance not recorded")
+
+// Remembers the service each instance was provisioned for
+type Ownership interface {
+	// The service id of an instance, ErrNotRecorded when it has none
+	Find(instanceId string) (string, error)
+	Save(instanceId string, serviceId string) error
+	Delete(instanceId string) error
+}
+
+// FileOwnership implements the Ownership interface.
+//
+// Every instance is kept in a single JSON object of instance ids to service ids, rewritten whole on each change.
+type FileOwnership struct {
+	Path string
+
+	// Used to write the file; an AtomicFileWriter when nil
+	FileWriter system.FileWriter
+
+	mutex sync.Mutex
+}
+
+func (ownership *FileOwnership) Find(instanceId string) (string, error) {
+	ownership.mutex.Lock()
+	defer ownership.mutex.Unlock()
+
+	owners, err := ownership.read()
+	if err != nil {
+		return "", err
+	}
+	serviceId, ok := owners[instanceId]
+	if !ok {
+		return "", ErrNotRecorded
+	}
+	return serviceId, nil
+}
+
+func (ownership *FileOwnership) Save(instanceId string, serviceId string) error {
+	ownership.mutex.Lock()
+	defer ownership.mutex.Unlock()
+
+	owners, err := ownership.read()
+	if err != nil {
+		return err
+	}
+	owners[instanceId] = serviceId
+	return ownership.write(owners)
+}
+
+func (ownership *FileOwnership) Delete(instanceId string) error {
+	ownership.mutex.Lock()
+	defer ownership.mutex.Unlock()
+
+	owners, err := ownership.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := owners[instanceId]; !ok {
+		return nil
+	}
+	delete(owners, instanceId)
+	return ownership.write(owners)
+}
+
+func (ownership *FileOwnership) read() (map[string]string, error) {
+	owners := map[string]string{}
+	data, err := ioutil.ReadFile(ownership.Path)
+	if os.IsNotExist(err) {
+		return owners, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &owners); err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+func (ownership *FileOwnership) write(owners map[string]string) error {
+	data, err := json.Marshal(owners)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(ownership.Path), 0755); err != nil {
+		return err
+	}
+
+	writer := ownership.FileWriter
+	if writer == nil {
+		writer = system.AtomicFileWriter{}
+	}
+	return writer.WriteFile(ownership.Path, data, 0644)
+}
@@ -0,0 +1,339 @@
+// Package registry serves the services of several brokers from one broker API.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/pivotal-golang/lager"
+)
+
+// Implemented by brokers that can tell their instances apart from those of other brokers
+type InstanceOwner interface {
+	Owns(instanceId string) bool
+}
+
+// Returned by the operator features of the registry when its primary broker does not have them
+var ErrNotSupported = errors.New("not supported by the primary broker")
+
+// Registry implements the api.ServiceBroker interface for the services of several brokers.
+//
+// The catalog lists the services of every broker in order. Provisioning goes to the broker offering the
+// service_id of the request and the registry records that service as the owner of the instance, so updates,
+// bindings and deprovisioning go to the same broker. Instances provisioned before they were recorded go to the
+// first broker claiming them through InstanceOwner, else to the primary broker, the first one.
+//
+// Operators reach the primary broker: instance administration, backups, quotas, pipelines and the audit log
+// are its own. Health checks cover every broker.
+type Registry struct {
+	Brokers   []api.ServiceBroker
+	Ownership Ownership
+	Logger    lager.Logger
+
+	// brokers by the ids of the services they offer
+	services map[string]api.ServiceBroker
+
+	// Instance ids between being looked up and their owner being saved, so that each is provisioned once while
+	// the brokers provision other ids
+	provisioning      map[string]bool
+	provisioningMutex sync.Mutex
+}
+
+func New(ownership Ownership, logger lager.Logger, brokers ...api.ServiceBroker) (*Registry, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("a registry needs at least one broker")
+	}
+
+	services := map[string]api.ServiceBroker{}
+	for _, broker := range brokers {
+		for _, service := range broker.GetCatalog() {
+			if _, ok := services[service.Id]; ok {
+				return nil, fmt.Errorf("service id '%s' is offered by more than one broker", service.Id)
+			}
+			services[service.Id] = broker
+		}
+	}
+
+	return &Registry{
+		Brokers:      brokers,
+		Ownership:    ownership,
+		Logger:       logger,
+		services:     services,
+		provisioning: map[string]bool{},
+	}, nil
+}
+
+func (registry *Registry) primary() api.ServiceBroker {
+	return registry.Brokers[0]
+}
+
+func (registry *Registry) GetCatalog() []api.Service {
+	catalog := []api.Service{}
+	for _, broker := range registry.Brokers {
+		catalog = append(catalog, broker.GetCatalog()...)
+	}
+	return catalog
+}
+
+// The broker of the instance: the one offering its recorded service, else the first claiming it, else the primary
+func (registry *Registry) brokerForInstance(instanceId string) (api.ServiceBroker, error) {
+	serviceId, err := registry.Ownership.Find(instanceId)
+	if err == nil {
+		broker, ok := registry.services[serviceId]
+		if !ok {
+			return nil, fmt.Errorf("instance '%s' belongs to service '%s', which no broker offers", instanceId, serviceId)
+		}
+		return broker, nil
+	}
+	if err != ErrNotRecorded {
+		return nil, err
+	}
+
+	for _, broker := range registry.Brokers {
+		if owner, ok := broker.(InstanceOwner); ok && owner.Owns(instanceId) {
+			return broker, nil
+		}
+	}
+	return registry.primary(), nil
+}
+
+// Provision records the owner of the instance once its broker provisioned it. An instance whose owner cannot be
+// recorded is deprovisioned again, as later requests could not find their way to it.
+func (registry *Registry) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	serviceId := params["service_id"]
+	broker, ok := registry.services[serviceId]
+	if !ok {
+		return "", &api.InvalidParameterError{Name: "service_id", Reason: "is not offered by this broker"}
+	}
+
+	if err := registry.startProvisioning(instanceId); err != nil {
+		return "", err
+	}
+	defer registry.finishProvisioning(instanceId)
+
+	url, err := broker.Provision(ctx, instanceId, params)
+	if err != nil {
+		return "", err
+	}
+
+	if err := registry.Ownership.Save(instanceId, serviceId); err != nil {
+		logger := api.LoggerFromContext(ctx, registry.Logger)
+		logger.Error("recording-owner", err, lager.Data{"service-id": serviceId})
+		if deprovisionErr := broker.Deprovision(ctx, instanceId); deprovisionErr != nil {
+			logger.Error("deprovisioning-unrecorded-instance", deprovisionErr)
+		}
+		return "", err
+	}
+	return url, nil
+}
+
+// Claims an instance id that is neither recorded nor being provisioned
+func (registry *Registry) startProvisioning(instanceId string) error {
+	registry.provisioningMutex.Lock()
+	defer registry.provisioningMutex.Unlock()
+
+	if registry.provisioning[instanceId] {
+		return api.ServiceInstanceAlreadyExistsError
+	}
+	_, err := registry.Ownership.Find(instanceId)
+	if err == nil {
+		return api.ServiceInstanceAlreadyExistsError
+	}
+	if err != ErrNotRecorded {
+		return err
+	}
+
+	registry.provisioning[instanceId] = true
+	return nil
+}
+
+func (registry *Registry) finishProvisioning(instanceId string) {
+	registry.provisioningMutex.Lock()
+	delete(registry.provisioning, instanceId)
+	registry.provisioningMutex.Unlock()
+}
+
+// Update hands the parameters to the broker of the instance, which may not support updates
+func (registry *Registry) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	broker, err := registry.brokerForInstance(instanceId)
+	if err != nil {
+		return err
+	}
+
+	updater, ok := broker.(api.InstanceUpdater)
+	if !ok {
+		return &api.InvalidParameterError{Name: "service_id", Reason: "instances of this service cannot be updated"}
+	}
+	return updater.Update(ctx, instanceId, params)
+}
+
+func (registry *Registry) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	broker, err := registry.brokerForInstance(instanceId)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Bind(ctx, instanceId, bindingId)
+}
+
+// BindWithParameters passes the parameters on when the broker of the instance takes them
+func (registry *Registry) BindWithParameters(ctx context.Context, instanceId string, bindingId string, params map[string]string) (interface{}, error) {
+	broker, err := registry.brokerForInstance(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	if binder, ok := broker.(api.ParameterizedBinder); ok {
+		return binder.BindWithParameters(ctx, instanceId, bindingId, params)
+	}
+	return broker.Bind(ctx, instanceId, bindingId)
+}
+
+func (registry *Registry) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	broker, err := registry.brokerForInstance(instanceId)
+	if err != nil {
+		return err
+	}
+	return broker.Unbind(ctx, instanceId, bindingId)
+}
+
+// Deprovision forgets the owner of the instance once its broker no longer has it
+func (registry *Registry) Deprovision(ctx context.Context, instanceId string) error {
+	broker, err := registry.brokerForInstance(instanceId)
+	if err != nil {
+		return err
+	}
+
+	err = broker.Deprovision(ctx, instanceId)
+	if err != nil && err != api.ServiceInstanceDoesNotExistsError {
+		return err
+	}
+	if deleteErr := registry.Ownership.Delete(instanceId); deleteErr != nil {
+		return deleteErr
+	}
+	return err
+}
+
+// CheckHealth reports the checks of every broker
+func (registry *Registry) CheckHealth() []api.HealthCheck {
+	checks := []api.HealthCheck{}
+	for _, broker := range registry.Brokers {
+		if checker, ok := broker.(api.HealthChecker); ok {
+			checks = append(checks, checker.CheckHealth()...)
+		}
+	}
+	return checks
+}
+
+// CheckInstancesHealth probes the instances of every broker
+func (registry *Registry) CheckInstancesHealth() ([]api.InstanceHealth, error) {
+	instances := []api.InstanceHealth{}
+	for _, broker := range registry.Brokers {
+		checker, ok := broker.(api.HealthChecker)
+		if !ok {
+			continue
+		}
+		health, err := checker.CheckInstancesHealth()
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, health...)
+	}
+	return instances, nil
+}
+
+func (registry *Registry) administrator() (api.InstanceAdministrator, error) {
+	administrator, ok := registry.primary().(api.InstanceAdministrator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return administrator, nil
+}
+
+func (registry *Registry) ListInstances(filter api.InstanceFilter) ([]api.InstanceDetails, error) {
+	administrator, err := registry.administrator()
+	if err != nil {
+		return nil, err
+	}
+	return administrator.ListInstances(filter)
+}
+
+func (registry *Registry) GetInstance(instanceId string) (api.InstanceDetails, error) {
+	administrator, err := registry.administrator()
+	if err != nil {
+		return api.InstanceDetails{}, err
+	}
+	return administrator.GetInstance(instanceId)
+}
+
+func (registry *Registry) RestartInstance(ctx context.Context, instanceId string) error {
+	administrator, err := registry.administrator()
+	if err != nil {
+		return err
+	}
+	return administrator.RestartInstance(ctx, instanceId)
+}
+
+// ForceDeleteInstance also forgets the owner of the instance
+func (registry *Registry) ForceDeleteInstance(ctx context.Context, instanceId string) error {
+	administrator, err := registry.administrator()
+	if err != nil {
+		return err
+	}
+	if err := administrator.ForceDeleteInstance(ctx, instanceId); err != nil {
+		return err
+	}
+	return registry.Ownership.Delete(instanceId)
+}
+
+func (registry *Registry) Backup(w io.Writer) error {
+	archiver, ok := registry.primary().(api.StateArchiver)
+	if !ok {
+		return ErrNotSupported
+	}
+	return archiver.Backup(w)
+}
+
+func (registry *Registry) Restore(ctx context.Context, r io.Reader) (api.RestoreReport, error) {
+	archiver, ok := registry.primary().(api.StateArchiver)
+	if !ok {
+		return api.RestoreReport{}, ErrNotSupported
+	}
+	return archiver.Restore(ctx, r)
+}
+
+func (registry *Registry) QuotaUsage() ([]api.QuotaUsage, error) {
+	reporter, ok := registry.primary().(api.QuotaReporter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return reporter.QuotaUsage()
+}
+
+func (registry *Registry) ListPipelines() ([]api.PipelineDetails, error) {
+	lister, ok := registry.primary().(api.PipelineLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.ListPipelines()
+}
+
+// AuditLog is the log of the primary broker, which discards entries when it keeps none
+func (registry *Registry) AuditLog() api.AuditLog {
+	auditor, ok := registry.primary().(api.Auditor)
+	if !ok {
+		return discardLog{}
+	}
+	return auditor.AuditLog()
+}
+
+type discardLog struct{}
+
+func (discardLog) Record(entry api.AuditEntry) error { return nil }
+
+func (discardLog) Query(query api.AuditQuery) ([]api.AuditEntry, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,292 @@
+package registry_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/api"
+	"github.com/malston/cf-logsearch-service-broker/registry"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Offers one service and records what it is asked to do
+type fakeBroker struct {
+	ServiceId string
+	Instances map[string]bool
+	Calls     []string
+}
+
+func newFakeBroker(serviceId string) *fakeBroker {
+	return &fakeBroker{ServiceId: serviceId, Instances: map[string]bool{}}
+}
+
+func (broker *fakeBroker) GetCatalog() []api.Service {
+	return []api.Service{{Id: broker.ServiceId, Name: broker.ServiceId}}
+}
+
+func (broker *fakeBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	broker.Calls = append(broker.Calls, "provision "+instanceId)
+	broker.Instances[instanceId] = true
+	return "", nil
+}
+
+func (broker *fakeBroker) Bind(ctx context.Context, instanceId string, bindingId string) (interface{}, error) {
+	broker.Calls = append(broker.Calls, "bind "+instanceId)
+	return broker.ServiceId, nil
+}
+
+func (broker *fakeBroker) Unbind(ctx context.Context, instanceId string, bindingId string) error {
+	broker.Calls = append(broker.Calls, "unbind "+instanceId)
+	return nil
+}
+
+func (broker *fakeBroker) Deprovision(ctx context.Context, instanceId string) error {
+	broker.Calls = append(broker.Calls, "deprovision "+instanceId)
+	if !broker.Instances[instanceId] {
+		return api.ServiceInstanceDoesNotExistsError
+	}
+	delete(broker.Instances, instanceId)
+	return nil
+}
+
+// A broker that takes binding parameters, updates instances, checks its health and knows its instances
+type fakeOwningBroker struct {
+	*fakeBroker
+	BindParams   map[string]string
+	UpdateParams map[string]string
+}
+
+func (broker *fakeOwningBroker) Owns(instanceId string) bool {
+	return broker.Instances[instanceId]
+}
+
+func (broker *fakeOwningBroker) BindWithParameters(ctx context.Context, instanceId string, bindingId string, params map[string]string) (interface{}, error) {
+	broker.BindParams = params
+	return broker.Bind(ctx, instanceId, bindingId)
+}
+
+func (broker *fakeOwningBroker) Update(ctx context.Context, instanceId string, params map[string]string) error {
+	broker.UpdateParams = params
+	return nil
+}
+
+func (broker *fakeOwningBroker) CheckHealth() []api.HealthCheck {
+	return []api.HealthCheck{{Name: broker.ServiceId, Status: api.HealthStatusOk}}
+}
+
+func (broker *fakeOwningBroker) CheckInstancesHealth() ([]api.InstanceHealth, error) {
+	return []api.InstanceHealth{{InstanceId: broker.ServiceId + "-instance", Status: api.HealthStatusOk}}, nil
+}
+
+// Fails to save owners, finding none
+type failingOwnership struct{}
+
+func (failingOwnership) Find(instanceId string) (string, error) { return "", registry.ErrNotRecorded }
+
+func (failingOwnership) Save(instanceId string, serviceId string) error { return os.ErrPermission }
+
+func (failingOwnership) Delete(instanceId string) error { return nil }
+
+// Takes its time saving, so that concurrent provisions overlap
+type slowOwnership struct {
+	registry.Ownership
+}
+
+func (ownership slowOwnership) Save(instanceId string, serviceId string) error {
+	time.Sleep(10 * time.Millisecond)
+	return ownership.Ownership.Save(instanceId, serviceId)
+}
+
+// Provisions once released, as a broker waiting for its agent to start does
+type blockingBroker struct {
+	*fakeBroker
+	started chan struct{}
+	release chan struct{}
+}
+
+func (broker *blockingBroker) Provision(ctx context.Context, instanceId string, params map[string]string) (string, error) {
+	close(broker.started)
+	<-broker.release
+	return broker.fakeBroker.Provision(ctx, instanceId, params)
+}
+
+var _ = Describe("Registry", func() {
+	var (
+		tmpDir    string
+		ownership *registry.FileOwnership
+		primary   *fakeBroker
+		other     *fakeOwningBroker
+		services  *registry.Registry
+		ctx       context.Context
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "registry")
+		Ω(err).ToNot(HaveOccurred())
+
+		ownership = &registry.FileOwnership{Path: path.Join(tmpDir, "state", "service-instances.json")}
+		primary = newFakeBroker("service-1")
+		other = &fakeOwningBroker{fakeBroker: newFakeBroker("service-2")}
+		services, err = registry.New(ownership, lagertest.NewTestLogger("registry"), primary, other)
+		Ω(err).ToNot(HaveOccurred())
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("lists the services of every broker in order", func() {
+		catalog := services.GetCatalog()
+		Ω(catalog).To(HaveLen(2))
+		Ω(catalog[0].Id).To(Equal("service-1"))
+		Ω(catalog[1].Id).To(Equal("service-2"))
+	})
+
+	It("refuses brokers offering the same service", func() {
+		_, err := registry.New(ownership, lagertest.NewTestLogger("registry"), primary, newFakeBroker("service-1"))
+		Ω(err).To(MatchError("service id 'service-1' is offered by more than one broker"))
+	})
+
+	It("provisions with the broker offering the service and sends the instance back to it", func() {
+		_, err := services.Provision(ctx, "instance-1", map[string]string{"service_id": "service-2"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ownership.Find("instance-1")).To(Equal("service-2"))
+
+		credentials, err := services.BindWithParameters(ctx, "instance-1", "binding-1", map[string]string{"access": "read-only"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(credentials).To(Equal("service-2"))
+		Ω(other.BindParams).To(Equal(map[string]string{"access": "read-only"}))
+		Ω(services.Update(ctx, "instance-1", map[string]string{"filters": ""})).To(Succeed())
+		Ω(other.UpdateParams).To(Equal(map[string]string{"filters": ""}))
+		Ω(services.Unbind(ctx, "instance-1", "binding-1")).To(Succeed())
+		Ω(services.Deprovision(ctx, "instance-1")).To(Succeed())
+
+		Ω(other.Calls).To(Equal([]string{"provision instance-1", "bind instance-1", "unbind instance-1", "deprovision instance-1"}))
+		Ω(primary.Calls).To(BeEmpty())
+		_, err = ownership.Find("instance-1")
+		Ω(err).To(Equal(registry.ErrNotRecorded))
+	})
+
+	It("remembers the owners across restarts", func() {
+		_, err := services.Provision(ctx, "instance-1", map[string]string{"service_id": "service-2"})
+		Ω(err).ToNot(HaveOccurred())
+		delete(other.Instances, "instance-1")
+
+		restarted, err := registry.New(&registry.FileOwnership{Path: ownership.Path}, lagertest.NewTestLogger("registry"), primary, other)
+		Ω(err).ToNot(HaveOccurred())
+		_, err = restarted.Bind(ctx, "instance-1", "binding-1")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(other.Calls).To(Equal([]string{"provision instance-1", "bind instance-1"}))
+	})
+
+	It("deprovisions an instance again when its owner cannot be recorded", func() {
+		failing, err := registry.New(failingOwnership{}, lagertest.NewTestLogger("registry"), primary, other)
+		Ω(err).ToNot(HaveOccurred())
+
+		_, err = failing.Provision(ctx, "instance-1", map[string]string{"service_id": "service-2"})
+		Ω(err).To(Equal(os.ErrPermission))
+		Ω(other.Calls).To(Equal([]string{"provision instance-1", "deprovision instance-1"}))
+		Ω(other.Instances).To(BeEmpty())
+	})
+
+	It("provisions an instance id once when asked for it concurrently", func() {
+		slow, err := registry.New(slowOwnership{ownership}, lagertest.NewTestLogger("registry"), primary, other)
+		Ω(err).ToNot(HaveOccurred())
+
+		results := make(chan error, 2)
+		for _, serviceId := range []string{"service-1", "service-2"} {
+			go func(serviceId string) {
+				_, err := slow.Provision(ctx, "instance-1", map[string]string{"service_id": serviceId})
+				results <- err
+			}(serviceId)
+		}
+
+		errs := []error{<-results, <-results}
+		Ω(errs).To(ConsistOf(BeNil(), Equal(api.ServiceInstanceAlreadyExistsError)))
+		Ω(len(primary.Calls) + len(other.Calls)).To(Equal(1))
+	})
+
+	It("provisions other instances while a broker takes its time", func() {
+		blocking := &blockingBroker{fakeBroker: primary, started: make(chan struct{}), release: make(chan struct{})}
+		waiting, err := registry.New(ownership, lagertest.NewTestLogger("registry"), blocking, other)
+		Ω(err).ToNot(HaveOccurred())
+
+		results := make(chan error, 1)
+		go func() {
+			_, err := waiting.Provision(ctx, "instance-1", map[string]string{"service_id": "service-1"})
+			results <- err
+		}()
+		Eventually(blocking.started).Should(BeClosed())
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := waiting.Provision(ctx, "instance-2", map[string]string{"service_id": "service-2"})
+			done <- err
+		}()
+		Eventually(done).Should(Receive(BeNil()))
+
+		close(blocking.release)
+		Eventually(results).Should(Receive(BeNil()))
+		Ω(ownership.Find("instance-1")).To(Equal("service-1"))
+	})
+
+	It("refuses services no broker offers and instances it already has", func() {
+		_, err := services.Provision(ctx, "instance-1", map[string]string{"service_id": "service-3"})
+		Ω(err).To(Equal(&api.InvalidParameterError{Name: "service_id", Reason: "is not offered by this broker"}))
+
+		_, err = services.Provision(ctx, "instance-1", map[string]string{"service_id": "service-1"})
+		Ω(err).ToNot(HaveOccurred())
+		_, err = services.Provision(ctx, "instance-1", map[string]string{"service_id": "service-2"})
+		Ω(err).To(Equal(api.ServiceInstanceAlreadyExistsError))
+		Ω(other.Calls).To(BeEmpty())
+	})
+
+	It("finds unrecorded instances by asking the brokers, else with the primary", func() {
+		other.Instances["instance-1"] = true
+
+		_, err := services.Bind(ctx, "instance-1", "binding-1")
+		Ω(err).ToNot(HaveOccurred())
+		_, err = services.Bind(ctx, "instance-2", "binding-1")
+		Ω(err).ToNot(HaveOccurred())
+
+		Ω(other.Calls).To(Equal([]string{"bind instance-1"}))
+		Ω(primary.Calls).To(Equal([]string{"bind instance-2"}))
+	})
+
+	It("does not update instances of brokers that cannot", func() {
+		_, err := services.Provision(ctx, "instance-1", map[string]string{"service_id": "service-1"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(services.Update(ctx, "instance-1", map[string]string{})).To(Equal(&api.InvalidParameterError{
+			Name:   "service_id",
+			Reason: "instances of this service cannot be updated",
+		}))
+	})
+
+	It("forgets instances their broker no longer has", func() {
+		Ω(ownership.Save("instance-1", "service-1")).To(Succeed())
+		Ω(services.Deprovision(ctx, "instance-1")).To(Equal(api.ServiceInstanceDoesNotExistsError))
+		_, err := ownership.Find("instance-1")
+		Ω(err).To(Equal(registry.ErrNotRecorded))
+	})
+
+	It("checks the health of every broker", func() {
+		Ω(services.CheckHealth()).To(Equal([]api.HealthCheck{{Name: "service-2", Status: api.HealthStatusOk}}))
+		Ω(services.CheckInstancesHealth()).To(Equal([]api.InstanceHealth{{InstanceId: "service-2-instance", Status: api.HealthStatusOk}}))
+	})
+
+	It("leaves the operator features to the primary broker", func() {
+		_, err := services.ListPipelines()
+		Ω(err).To(Equal(registry.ErrNotSupported))
+		_, err = services.GetInstance("instance-1")
+		Ω(err).To(Equal(registry.ErrNotSupported))
+		Ω(services.AuditLog().Record(api.AuditEntry{Operation: "provision"})).To(Succeed())
+	})
+})
@@ -8,20 +8,24 @@ import (
 	"github.com/pivotal-golang/lager"
 )
 
+// Starts a command in the background, returning its pid
 type CommandRunner interface {
-	Run(name string, args ...string) error
+	Run(logger lager.Logger, name string, args ...string) (int, error)
 }
 
-type OSCommandRunner struct {
-	Logger lager.Logger
-}
+type OSCommandRunner struct{}
 
-func (runner OSCommandRunner) Run(name string, args ...string) error {
+func (runner OSCommandRunner) Run(logger lager.Logger, name string, args ...string) (int, error) {
 	cmd := exec.Command(name, args...)
-	runner.Logger.Info(fmt.Sprint(name, " ", strings.Join(args, " ")))
+	logger.Info(fmt.Sprint(name, " ", strings.Join(args, " ")))
 	err := cmd.Start()
 	if err != nil {
-		runner.Logger.Info(fmt.Sprintf("command failed: %s", err))
+		logger.Info(fmt.Sprintf("command failed: %s", err))
+		return 0, err
 	}
-	return err
+
+	// reap the process when it exits so that it does not linger as a zombie
+	go cmd.Wait()
+
+	return cmd.Process.Pid, nil
 }
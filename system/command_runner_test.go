@@ -11,19 +11,16 @@ import (
 var _ = Describe("A command runner", func() {
 	Context("is called with a valid command", func() {
 		It("should run successfully", func() {
-			commandRunner := &system.OSCommandRunner{
-				Logger: lagertest.NewTestLogger("command-runner-test"),
-			}
-			err := commandRunner.Run("echo", "Hi", "there!")
+			commandRunner := &system.OSCommandRunner{}
+			pid, err := commandRunner.Run(lagertest.NewTestLogger("command-runner-test"), "echo", "Hi", "there!")
 			Ω(err).ToNot(HaveOccurred())
+			Ω(pid).To(BeNumerically(">", 0))
 		})
 	})
 	Context("is called with an invalid command", func() {
 		It("should fail with an error", func() {
-			commandRunner := &system.OSCommandRunner{
-				Logger: lagertest.NewTestLogger("command-runner-test"),
-			}
-			err := commandRunner.Run("bad", "command")
+			commandRunner := &system.OSCommandRunner{}
+			_, err := commandRunner.Run(lagertest.NewTestLogger("command-runner-test"), "bad", "command")
 			Ω(err).To(HaveOccurred())
 		})
 	})
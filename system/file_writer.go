@@ -0,0 +1,64 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Writes whole files
+type FileWriter interface {
+	WriteFile(filename string, data []byte, perm os.FileMode) error
+}
+
+// AtomicFileWriter writes to a temporary file in the same directory, syncs it
+// and renames it over the target, so that a crash or a full disk leaves either
+// the old or the new content behind but never a truncated file.
+type AtomicFileWriter struct{}
+
+func (writer AtomicFileWriter) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	dir, base := path.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	err = writeAndSync(f, data, perm)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func writeAndSync(f *os.File, data []byte, perm os.FileMode) error {
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Makes the rename itself durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
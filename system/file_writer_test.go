@@ -0,0 +1,73 @@
+package system_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/malston/cf-logsearch-service-broker/system"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AtomicFileWriter", func() {
+	var tmpDir string
+	var writer system.AtomicFileWriter
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "atomic-file-writer")
+		Ω(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	entries := func() []string {
+		infos, err := ioutil.ReadDir(tmpDir)
+		Ω(err).ToNot(HaveOccurred())
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	It("writes the file with the given permissions", func() {
+		filename := path.Join(tmpDir, "logstash.port")
+		Ω(writer.WriteFile(filename, []byte("5000"), 0640)).To(Succeed())
+
+		Ω(ioutil.ReadFile(filename)).To(Equal([]byte("5000")))
+		info, err := os.Stat(filename)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+	})
+
+	It("replaces an existing file without leaving temporary files behind", func() {
+		filename := path.Join(tmpDir, "logstash.port")
+		Ω(ioutil.WriteFile(filename, []byte("5000"), 0644)).To(Succeed())
+
+		Ω(writer.WriteFile(filename, []byte("5001"), 0644)).To(Succeed())
+
+		Ω(ioutil.ReadFile(filename)).To(Equal([]byte("5001")))
+		Ω(entries()).To(Equal([]string{"logstash.port"}))
+	})
+
+	It("fails when the directory does not exist", func() {
+		Ω(writer.WriteFile(path.Join(tmpDir, "missing", "logstash.port"), []byte("5000"), 0644)).ToNot(Succeed())
+	})
+
+	It("cleans up and leaves the target alone when it cannot be replaced", func() {
+		target := path.Join(tmpDir, "logstash.conf")
+		Ω(os.MkdirAll(path.Join(target, "child"), 0755)).To(Succeed())
+
+		Ω(writer.WriteFile(target, []byte("input {}"), 0644)).ToNot(Succeed())
+
+		Ω(entries()).To(Equal([]string{"logstash.conf"}))
+		info, err := os.Stat(path.Join(target, "child"))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(info.IsDir()).To(BeTrue())
+	})
+})
@@ -3,20 +3,24 @@ package system
 import (
 	"fmt"
 	"net"
-	"os"
-	"strconv"
 )
 
 func FindFreePort() (int, error) {
-	ln, _ := net.Listen("tcp", ":0")
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return -1, err
+	}
 	defer ln.Close()
 
-	fmt.Fprintf(os.Stdout, "Found free port on %q", ln.Addr().String())
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
 
-	port, err := strconv.ParseInt(ln.Addr().String()[5:], 10, 32)
+// IsPortFree reports whether a tcp port can be listened on
+func IsPortFree(port int) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		return -1, err
+		return false
 	}
-
-	return int(port), nil
+	ln.Close()
+	return true
 }
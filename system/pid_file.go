@@ -0,0 +1,73 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Returned with the pid of a pid file whose process has exited and whose pid the kernel has since given to another
+// process, which must not be signalled in its place.
+var ErrPidReused = errors.New("the pid belongs to another process")
+
+// Records pid in a pid file along with when its process started, so that ReadPidFile can tell it from a later
+// process with the same pid.
+func WritePidFile(filename string, pid int) error {
+	content := strconv.Itoa(pid)
+	if started, err := ProcessStartTime(pid); err == nil {
+		content += " " + strconv.FormatUint(started, 10)
+	}
+	return ioutil.WriteFile(filename, []byte(content), 0644)
+}
+
+// Reads the pid of a pid file, returning it with ErrPidReused when the process running under it started at another
+// time than the one recorded. Pid files without a start time, and processes whose start time cannot be read, are
+// taken at their word.
+func ReadPidFile(filename string) (int, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, fmt.Errorf("malformed pid file %s", filename)
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) == 1 {
+		return pid, nil
+	}
+
+	recorded, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if started, err := ProcessStartTime(pid); err == nil && started != recorded {
+		return pid, ErrPidReused
+	}
+	return pid, nil
+}
+
+// When a process started, in clock ticks since boot, from /proc/<pid>/stat
+func ProcessStartTime(pid int) (uint64, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name in parentheses may hold spaces, the fields after it do not
+	end := strings.LastIndex(string(stat), ")")
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	// starttime is the 22nd field, the state after the name the 3rd
+	const startTimeField = 22 - 3
+	if len(fields) <= startTimeField {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	return strconv.ParseUint(fields[startTimeField], 10, 64)
+}
@@ -0,0 +1,52 @@
+package system
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Reports whether a process with the given pid exists and can be signalled.
+func IsProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// Asks a process to terminate, killing it if it is still running after the timeout.
+func StopProcess(pid int, timeout time.Duration) error {
+	if !IsProcessRunning(pid) {
+		return nil
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !IsProcessRunning(pid) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := process.Kill(); err != nil {
+		return err
+	}
+	time.Sleep(50 * time.Millisecond)
+	if IsProcessRunning(pid) {
+		return errors.New("process did not exit after being killed")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package system_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/malston/cf-logsearch-service-broker/system"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Processes", func() {
+	var pid int
+
+	BeforeEach(func() {
+		var err error
+		pid, err = system.OSCommandRunner{}.Run(lagertest.NewTestLogger("process-test"), "sleep", "30")
+		Ω(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		system.StopProcess(pid, time.Second)
+	})
+
+	It("reports a started process as running", func() {
+		Ω(system.IsProcessRunning(pid)).To(BeTrue())
+	})
+
+	It("stops a running process", func() {
+		Ω(system.StopProcess(pid, 5*time.Second)).To(Succeed())
+		Eventually(func() bool { return system.IsProcessRunning(pid) }).Should(BeFalse())
+	})
+
+	It("does not report an invalid pid as running", func() {
+		Ω(system.IsProcessRunning(0)).To(BeFalse())
+	})
+	Describe("pid files", func() {
+		var pidFile string
+
+		BeforeEach(func() {
+			tmpDir, err := ioutil.TempDir("", "pid-file")
+			Ω(err).ToNot(HaveOccurred())
+			pidFile = path.Join(tmpDir, "process.pid")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(path.Dir(pidFile))
+		})
+
+		It("reads back the pid of a running process", func() {
+			Ω(system.WritePidFile(pidFile, pid)).To(Succeed())
+			Ω(system.ReadPidFile(pidFile)).To(Equal(pid))
+		})
+
+		It("refuses the pid of a process that started after the pid file was written", func() {
+			started, err := system.ProcessStartTime(pid)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(pid)+" "+strconv.FormatUint(started-1, 10)), 0644)).To(Succeed())
+
+			read, err := system.ReadPidFile(pidFile)
+			Ω(err).To(Equal(system.ErrPidReused))
+			Ω(read).To(Equal(pid))
+		})
+
+		It("takes pid files without a start time at their word", func() {
+			Ω(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644)).To(Succeed())
+			Ω(system.ReadPidFile(pidFile)).To(Equal(pid))
+		})
+	})
+})